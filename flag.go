@@ -1,49 +1,315 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"github.com/pete911/vault-auth-kubernetes/pkg/auth"
+	"github.com/pete911/vault-auth-kubernetes/pkg/backup"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
 	"gopkg.in/validator.v2"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	commandRun     = "run"
+	commandPlan    = "plan"
+	commandExport  = "export"
+	commandBackup  = "backup"
+	commandRestore = "restore"
+	commandStatus  = "status"
+	commandAudit   = "audit-verify"
+
+	// audit-log value for stdout
+	auditStdout = "-"
 )
 
 type Flags struct {
+	// run (default), plan, export, backup or restore, plan prints effective roles from role files without connecting to
+	// vault or kubernetes, export prints vault roles as config map or roles file without connecting to kubernetes,
+	// backup saves snapshot of vault auth mount and restore re-applies saved snapshot, status prints status of running
+	// instance (status endpoint) and audit-verify verifies hash chain of audit records
+	Command       string
 	Kubeconfig    string
 	VaultHost     string `validate:"nonzero"`
 	VaultMount    string `validate:"nonzero"`
 	VaultKubeHost string
 	VaultRoleId   string `validate:"nonzero"`
 	VaultSecretId string `validate:"nonzero"`
+	// tenant roles
+	TenantAllowedPolicies []string
+	// guardrails
+	GuardrailsFile string
+	// acl policies defined by roles
+	ACLPolicies bool
+	PoliciesDir string
+	// identity entities and groups of managed service accounts
+	Identity           bool
+	IdentityGroupLabel string
+	// kv version 2 path bootstrap of namespaces
+	KVBootstrapFile string
+	// kubernetes secrets engine for the same cluster
+	SecretsEngine            bool
+	SecretsEngineClusterRole string
+	// auth method type (kubernetes or jwt) and jwt auth issuer, signing keys and default audience
+	AuthType    string
+	JWTIssuer   string
+	JWTKeysFile string
+	JWTAudience string
+	// auth kubernetes config service account signing public keys (pem_keys), issuer and validation options
+	PEMKeys              bool
+	PEMKeysFile          string
+	Issuer               string
+	DisableISSValidation bool
+	DisableLocalCAJWT    bool
+	// login with bound service account token after vault role is written
+	LoginVerification bool
+	// vault auth mount description and tune
+	MountSpecFile string
+	// roles from files
+	RolesFile string
+	RolesDir  string
+	// health and metrics server
+	ListenAddr string
+	// status server
+	StatusAddr    string
+	StatusHistory int
+	// concurrency and rate limits
+	Workers    int
+	KubeQPS    float64
+	KubeBurst  int
+	VaultQPS   float64
+	VaultBurst int
+	// vault role cache
+	RoleVerifyInterval time.Duration
+	// export command
+	ExportFormat      string
+	ExportMountConfig bool
+	// snapshots of vault auth mount, taken by backup command and before roles are deleted
+	BackupStore    string
+	BackupDir      string
+	BackupKeep     int
+	BackupSnapshot string
+	// status command
+	StatusURL    string
+	StatusFormat string
+	// audit log of vault and kubernetes mutations, verified by audit-verify command
+	AuditLog     string
+	AuditStore   string
+	AuditKeep    int
+	AuditKeyFile string
 }
 
 func ParseFlags() (Flags, error) {
 
 	f := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	kubeconfig := f.String("kubeconfig", getStringEnv("KUBECONFIG", ""), "path to kubeconfig file, or empty for in-cluster kubeconfig")
-	vaultHost := f.String("vault-host", getStringEnv("VAK_VAULT_HOST", ""), "vault host")
+	vaultHost := f.String("vault-host", getStringEnv("VAK_VAULT_HOST", ""), "vault host, or comma separated hosts of HA vault cluster nodes")
 	vaultMount := f.String("vault-mount", getStringEnv("VAK_VAULT_MOUNT", ""), "vault kubernetes mount e.g cluster-name, or environment/cluster-name")
 	vaultKubeHost := f.String("vault-kube-host", getStringEnv("VAK_VAULT_KUBE_HOST", ""), "kubernetes API that can be reached from vault, defaults to host from kubeconfig")
 	vaultRoleId := f.String("vault-role-id", getStringEnv("VAK_VAULT_ROLE_ID", ""), "vault role id")
 	vaultSecretId := f.String("vault-secret-id", getStringEnv("VAK_VAULT_SECRET_ID", ""), "vault secret id")
-	f.Parse(os.Args[1:])
+	tenantAllowedPolicies := f.String("tenant-allowed-policies", getStringEnv("VAK_TENANT_ALLOWED_POLICIES", ""), "comma separated policies (glob patterns) allowed in tenant roles, tenant roles are disabled if empty")
+	guardrailsFile := f.String("guardrails-file", getStringEnv("VAK_GUARDRAILS_FILE", ""), "path to json file with guardrail rules for vault roles, guardrails are disabled if empty")
+	aclPolicies := f.Bool("acl-policies", getBoolEnv("VAK_ACL_POLICIES", false), "write acl policies defined by roles (acl_policies) to vault and report roles with token policies that do not exist in vault")
+	policiesDir := f.String("policies-dir", getStringEnv("VAK_POLICIES_DIR", ""), "path to directory with acl policy files (<policy-name>.hcl), requires acl-policies flag")
+	identity := f.Bool("identity", getBoolEnv("VAK_IDENTITY", false), "write vault identity entities and entity aliases for managed service accounts and identity groups for namespaces")
+	identityGroupLabel := f.String("identity-group-label", getStringEnv("VAK_IDENTITY_GROUP_LABEL", ""), "namespace label (e.g. team) used to group entities instead of namespace, requires identity flag")
+	kvBootstrapFile := f.String("kv-bootstrap-file", getStringEnv("VAK_KV_BOOTSTRAP_FILE", ""), "path to json file with kv version 2 mount and base path written for every namespace with vault role, kv bootstrap is disabled if empty")
+	secretsEngine := f.Bool("secrets-engine", getBoolEnv("VAK_SECRETS_ENGINE", false), "mount and configure vault kubernetes secrets engine and write secrets engine roles defined by roles (secrets_engine_role)")
+	secretsEngineClusterRole := f.String("secrets-engine-cluster-role", getStringEnv("VAK_SECRETS_ENGINE_CLUSTER_ROLE", "vault-secrets-engine"), "cluster role bound to secrets engine service account (vault-auth/secrets-engine), used only if secrets-engine flag is set")
+	authType := f.String("auth-type", getStringEnv("VAK_AUTH_TYPE", vault.AuthTypeKubernetes), "vault auth method type mounted at kubernetes/<vault-mount>, kubernetes (token review) or jwt (service account tokens validated with cluster signing keys)")
+	jwtIssuer := f.String("jwt-issuer", getStringEnv("VAK_JWT_ISSUER", ""), "service account token issuer, discovered from API server if empty, used only if auth-type is jwt")
+	jwtKeysFile := f.String("jwt-keys-file", getStringEnv("VAK_JWT_KEYS_FILE", ""), "path to file with PEM encoded service account signing public keys, keys are discovered from API server (jwks) if empty, used only if auth-type is jwt")
+	jwtAudience := f.String("jwt-audience", getStringEnv("VAK_JWT_AUDIENCE", "vault"), "audience bound to jwt roles that do not set audience, used only if auth-type is jwt")
+	pemKeys := f.Bool("pem-keys", getBoolEnv("VAK_PEM_KEYS", false), "write service account signing public keys (pem_keys) to vault auth kubernetes config, keys are refreshed on every reload")
+	pemKeysFile := f.String("pem-keys-file", getStringEnv("VAK_PEM_KEYS_FILE", ""), "path to file with PEM encoded service account signing public keys, keys are discovered from API server (jwks) if empty, used only if pem-keys flag is set")
+	issuer := f.String("issuer", getStringEnv("VAK_ISSUER", ""), "service account token issuer written to vault auth kubernetes config (issuer)")
+	disableISSValidation := f.Bool("disable-iss-validation", getBoolEnv("VAK_DISABLE_ISS_VALIDATION", true), "disable service account token issuer validation in vault auth kubernetes config (disable_iss_validation)")
+	disableLocalCAJWT := f.Bool("disable-local-ca-jwt", getBoolEnv("VAK_DISABLE_LOCAL_CA_JWT", false), "disable defaulting to local CA and service account JWT of vault pod in vault auth kubernetes config (disable_local_ca_jwt)")
+	loginVerification := f.Bool("login-verification", getBoolEnv("VAK_LOGIN_VERIFICATION", false), "verify every written vault role by login with short-lived token of bound service account, result is set on roles config map annotation")
+	mountSpecFile := f.String("mount-spec-file", getStringEnv("VAK_MOUNT_SPEC_FILE", ""), "path to json file with vault auth mount description and tune, auth is mounted with defaults and not tuned if empty")
+	rolesFile := f.String("roles-file", getStringEnv("VAK_ROLES_FILE", ""), "path to yaml or json file with vault roles, roles are added to roles from config map")
+	rolesDir := f.String("roles-dir", getStringEnv("VAK_ROLES_DIR", ""), "path to directory with yaml or json files with vault roles, roles are added to roles from config map")
+	workers := f.Int("workers", getIntEnv("VAK_WORKERS", 10), "number of concurrent namespace and role operations during reload")
+	kubeQPS := f.Float64("kube-qps", getFloatEnv("VAK_KUBE_QPS", 20), "kubernetes API requests per second")
+	kubeBurst := f.Int("kube-burst", getIntEnv("VAK_KUBE_BURST", 40), "kubernetes API requests burst")
+	vaultQPS := f.Float64("vault-qps", getFloatEnv("VAK_VAULT_QPS", 50), "vault requests per second, vault requests are not rate limited if 0")
+	vaultBurst := f.Int("vault-burst", getIntEnv("VAK_VAULT_BURST", 100), "vault requests burst")
+	roleVerifyInterval := f.Duration("role-verify-interval", getDurationEnv("VAK_ROLE_VERIFY_INTERVAL", 10*time.Minute), "interval of vault roles verification (drift detection), roles are verified on every reload if 0")
+	exportFormat := f.String("export-format", getStringEnv("VAK_EXPORT_FORMAT", "configmap"), "export command output format, configmap or file (roles file)")
+	exportMountConfig := f.Bool("export-mount-config", getBoolEnv("VAK_EXPORT_MOUNT_CONFIG", false), "include vault auth mount spec and auth config (kubernetes or jwt) in export command output")
+	backupStore := f.String("backup-store", getStringEnv("VAK_BACKUP_STORE", ""), "where are vault auth snapshots stored, file (backup-dir) or secret (vault-auth namespace), snapshots are disabled if empty")
+	backupDir := f.String("backup-dir", getStringEnv("VAK_BACKUP_DIR", ""), "directory of vault auth snapshots when backup-store is file")
+	backupKeep := f.Int("backup-keep", getIntEnv("VAK_BACKUP_KEEP", 10), "number of kept vault auth snapshots, the oldest snapshots are deleted, all snapshots are kept if 0")
+	backupSnapshot := f.String("backup-snapshot", getStringEnv("VAK_BACKUP_SNAPSHOT", ""), "name of snapshot re-applied by restore command, the latest snapshot is restored if empty")
+	listenAddr := f.String("listen-addr", getStringEnv("VAK_LISTEN_ADDR", ":8080"), "address of health (/health) and metrics (/metrics) server, server is disabled if empty")
+	statusAddr := f.String("status-addr", getStringEnv("VAK_STATUS_ADDR", ""), "address (e.g. localhost:8081) of status (/status) server, server is not authenticated and it is disabled if empty")
+	statusHistory := f.Int("status-history", getIntEnv("VAK_STATUS_HISTORY", 10), "number of the last reload results returned by status endpoint")
+	statusURL := f.String("status-url", getStringEnv("VAK_STATUS_URL", "http://localhost:8081/status"), "status endpoint of running vault-auth-kubernetes read by status command")
+	statusFormat := f.String("status-format", getStringEnv("VAK_STATUS_FORMAT", auth.StatusFormatTable), "status command output format, table, json or yaml")
+	auditLog := f.String("audit-log", getStringEnv("VAK_AUDIT_LOG", ""), "path of audit log file (json lines) with every vault and kubernetes mutation, - for stdout, audit log is disabled if empty")
+	auditStore := f.String("audit-store", getStringEnv("VAK_AUDIT_STORE", ""), "kubernetes store of audit records, secret (vault-auth namespace), records are stored only in audit-log if empty")
+	auditKeep := f.Int("audit-keep", getIntEnv("VAK_AUDIT_KEEP", 1000), "number of kept audit records in audit-store, the oldest records are deleted, all records are kept if 0")
+	auditKeyFile := f.String("audit-key-file", getStringEnv("VAK_AUDIT_KEY_FILE", ""), "path of file with hmac key of audit records, records are chained by sha256 (detects only accidental corruption) if empty")
+
+	command, args := commandRun, os.Args[1:]
+	if len(args) != 0 {
+		switch args[0] {
+		case commandPlan, commandExport, commandBackup, commandRestore, commandStatus, commandAudit:
+			command, args = args[0], args[1:]
+		}
+	}
+	f.Parse(args)
 
 	vakFlags := Flags{
+		Command:       command,
 		Kubeconfig:    stringValue(kubeconfig),
 		VaultHost:     stringValue(vaultHost),
 		VaultMount:    stringValue(vaultMount),
 		VaultKubeHost: stringValue(vaultKubeHost),
 		VaultRoleId:   stringValue(vaultRoleId),
 		VaultSecretId: stringValue(vaultSecretId),
+
+		TenantAllowedPolicies: stringSliceValue(tenantAllowedPolicies),
+		GuardrailsFile:        stringValue(guardrailsFile),
+		MountSpecFile:         stringValue(mountSpecFile),
+		ACLPolicies:           boolValue(aclPolicies),
+		PoliciesDir:           stringValue(policiesDir),
+		Identity:              boolValue(identity),
+		IdentityGroupLabel:    stringValue(identityGroupLabel),
+		KVBootstrapFile:       stringValue(kvBootstrapFile),
+		RolesFile:             stringValue(rolesFile),
+		RolesDir:              stringValue(rolesDir),
+		ListenAddr:            stringValue(listenAddr),
+		StatusAddr:            stringValue(statusAddr),
+		Workers:               intValue(workers),
+		KubeQPS:               floatValue(kubeQPS),
+		KubeBurst:             intValue(kubeBurst),
+		VaultQPS:              floatValue(vaultQPS),
+		VaultBurst:            intValue(vaultBurst),
+		RoleVerifyInterval:    durationValue(roleVerifyInterval),
+		ExportFormat:          stringValue(exportFormat),
+		ExportMountConfig:     boolValue(exportMountConfig),
+		BackupStore:           stringValue(backupStore),
+		BackupDir:             stringValue(backupDir),
+		BackupKeep:            intValue(backupKeep),
+		BackupSnapshot:        stringValue(backupSnapshot),
+
+		SecretsEngine:            boolValue(secretsEngine),
+		SecretsEngineClusterRole: stringValue(secretsEngineClusterRole),
+
+		AuthType:    stringValue(authType),
+		JWTIssuer:   stringValue(jwtIssuer),
+		JWTKeysFile: stringValue(jwtKeysFile),
+		JWTAudience: stringValue(jwtAudience),
+
+		PEMKeys:              boolValue(pemKeys),
+		PEMKeysFile:          stringValue(pemKeysFile),
+		Issuer:               stringValue(issuer),
+		DisableISSValidation: boolValue(disableISSValidation),
+		DisableLocalCAJWT:    boolValue(disableLocalCAJWT),
+
+		LoginVerification: boolValue(loginVerification),
+
+		StatusHistory: intValue(statusHistory),
+		StatusURL:     stringValue(statusURL),
+		StatusFormat:  stringValue(statusFormat),
+
+		AuditLog:     stringValue(auditLog),
+		AuditStore:   stringValue(auditStore),
+		AuditKeep:    intValue(auditKeep),
+		AuditKeyFile: stringValue(auditKeyFile),
 	}
 
+	if vakFlags.AuditStore != "" && vakFlags.AuditStore != audit.StoreSecret {
+		return vakFlags, fmt.Errorf("audit-store %q is not %s", vakFlags.AuditStore, audit.StoreSecret)
+	}
+	if command == commandAudit {
+		if (vakFlags.AuditLog == "" || vakFlags.AuditLog == auditStdout) && vakFlags.AuditStore == "" {
+			return vakFlags, errors.New("audit-verify requires audit-log file or audit-store flag")
+		}
+		return vakFlags, nil
+	}
+
+	if command == commandStatus {
+		switch vakFlags.StatusFormat {
+		case auth.StatusFormatTable, auth.StatusFormatJSON, auth.StatusFormatYAML:
+		default:
+			return vakFlags, fmt.Errorf("status-format %q is not one of %s, %s or %s", vakFlags.StatusFormat, auth.StatusFormatTable, auth.StatusFormatJSON, auth.StatusFormatYAML)
+		}
+		if vakFlags.StatusURL == "" {
+			return vakFlags, errors.New("status requires status-url flag")
+		}
+		return vakFlags, nil
+	}
+
+	if command == commandPlan {
+		if vakFlags.RolesFile == "" && vakFlags.RolesDir == "" {
+			return vakFlags, errors.New("plan requires roles-file or roles-dir flag")
+		}
+		return vakFlags, nil
+	}
+	if err := validateBackupFlags(vakFlags); err != nil {
+		return vakFlags, err
+	}
+	if vakFlags.PoliciesDir != "" && !vakFlags.ACLPolicies {
+		return vakFlags, errors.New("policies-dir requires acl-policies flag")
+	}
+	if vakFlags.IdentityGroupLabel != "" && !vakFlags.Identity {
+		return vakFlags, errors.New("identity-group-label requires identity flag")
+	}
+	if vakFlags.AuthType != vault.AuthTypeKubernetes && vakFlags.AuthType != vault.AuthTypeJWT {
+		return vakFlags, fmt.Errorf("auth-type %q is not one of %s or %s", vakFlags.AuthType, vault.AuthTypeKubernetes, vault.AuthTypeJWT)
+	}
+	if vakFlags.AuthType == vault.AuthTypeJWT && vakFlags.JWTAudience == "" {
+		return vakFlags, errors.New("jwt auth-type requires jwt-audience flag")
+	}
+	if vakFlags.PEMKeysFile != "" && !vakFlags.PEMKeys {
+		return vakFlags, errors.New("pem-keys-file requires pem-keys flag")
+	}
+	if vakFlags.StatusHistory < 1 {
+		return vakFlags, errors.New("status-history has to be at least 1")
+	}
+	if vakFlags.SecretsEngine && vakFlags.SecretsEngineClusterRole == "" {
+		return vakFlags, errors.New("secrets-engine requires secrets-engine-cluster-role flag")
+	}
 	err := validator.Validate(vakFlags)
 	return vakFlags, err
 }
 
+func validateBackupFlags(flags Flags) error {
+
+	switch flags.BackupStore {
+	case "":
+		if flags.Command == commandBackup || flags.Command == commandRestore {
+			return fmt.Errorf("%s requires backup-store flag", flags.Command)
+		}
+	case backup.StoreFile:
+		if flags.BackupDir == "" {
+			return errors.New("file backup-store requires backup-dir flag")
+		}
+	case backup.StoreSecret:
+	default:
+		return fmt.Errorf("backup-store %q is not one of %s or %s", flags.BackupStore, backup.StoreFile, backup.StoreSecret)
+	}
+	return nil
+}
+
 func (f Flags) String() string {
 
-	return fmt.Sprintf("kubeconfig: %q vault-host %q vault-mount: %q vault-kube-host: %q vault-role-id ****** vault-secret-id ******",
-		f.Kubeconfig, f.VaultHost, f.VaultMount, f.VaultKubeHost)
+	return fmt.Sprintf("command: %q kubeconfig: %q vault-host %q vault-mount: %q vault-kube-host: %q vault-role-id ****** vault-secret-id ****** tenant-allowed-policies: %q guardrails-file: %q acl-policies: %t policies-dir: %q identity: %t identity-group-label: %q kv-bootstrap-file: %q secrets-engine: %t secrets-engine-cluster-role: %q auth-type: %q jwt-issuer: %q jwt-keys-file: %q jwt-audience: %q pem-keys: %t pem-keys-file: %q issuer: %q disable-iss-validation: %t disable-local-ca-jwt: %t login-verification: %t mount-spec-file: %q roles-file: %q roles-dir: %q listen-addr: %q status-addr: %q status-history: %d workers: %d kube-qps: %g kube-burst: %d vault-qps: %g vault-burst: %d role-verify-interval: %s backup-store: %q backup-dir: %q backup-keep: %d status-url: %q status-format: %q audit-log: %q audit-store: %q audit-keep: %d audit-key-file: %q",
+		f.Command, f.Kubeconfig, f.VaultHost, f.VaultMount, f.VaultKubeHost, f.TenantAllowedPolicies, f.GuardrailsFile, f.ACLPolicies, f.PoliciesDir, f.Identity, f.IdentityGroupLabel, f.KVBootstrapFile, f.SecretsEngine, f.SecretsEngineClusterRole, f.AuthType, f.JWTIssuer, f.JWTKeysFile, f.JWTAudience, f.PEMKeys, f.PEMKeysFile, f.Issuer, f.DisableISSValidation, f.DisableLocalCAJWT, f.LoginVerification, f.MountSpecFile, f.RolesFile, f.RolesDir, f.ListenAddr, f.StatusAddr, f.StatusHistory,
+		f.Workers, f.KubeQPS, f.KubeBurst, f.VaultQPS, f.VaultBurst, f.RoleVerifyInterval, f.BackupStore, f.BackupDir, f.BackupKeep, f.StatusURL, f.StatusFormat, f.AuditLog, f.AuditStore, f.AuditKeep, f.AuditKeyFile)
+}
+
+// vault-host flag value as list of hosts
+func vaultHosts(flags Flags) []string {
+	return stringSliceValue(&flags.VaultHost)
 }
 
 func getStringEnv(envName string, defaultValue string) string {
@@ -55,6 +321,94 @@ func getStringEnv(envName string, defaultValue string) string {
 	return env
 }
 
+// int env. variable, default value is returned if the variable is not set or it is not a number
+func getIntEnv(envName string, defaultValue int) int {
+
+	env, ok := os.LookupEnv(envName)
+	if !ok {
+		return defaultValue
+	}
+	v, err := strconv.Atoi(env)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+// float env. variable, default value is returned if the variable is not set or it is not a number
+func getFloatEnv(envName string, defaultValue float64) float64 {
+
+	env, ok := os.LookupEnv(envName)
+	if !ok {
+		return defaultValue
+	}
+	v, err := strconv.ParseFloat(env, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+// bool env. variable, default value is returned if the variable is not set or it is not a bool
+func getBoolEnv(envName string, defaultValue bool) bool {
+
+	env, ok := os.LookupEnv(envName)
+	if !ok {
+		return defaultValue
+	}
+	v, err := strconv.ParseBool(env)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+// duration env. variable, default value is returned if the variable is not set or it is not a duration
+func getDurationEnv(envName string, defaultValue time.Duration) time.Duration {
+
+	env, ok := os.LookupEnv(envName)
+	if !ok {
+		return defaultValue
+	}
+	v, err := time.ParseDuration(env)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+func intValue(v *int) int {
+
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func floatValue(v *float64) float64 {
+
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+func boolValue(v *bool) bool {
+
+	if v == nil {
+		return false
+	}
+	return *v
+}
+
+func durationValue(v *time.Duration) time.Duration {
+
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
 func stringValue(v *string) string {
 
 	if v == nil {
@@ -62,3 +416,15 @@ func stringValue(v *string) string {
 	}
 	return *v
 }
+
+// comma separated values to slice, empty values are removed
+func stringSliceValue(v *string) []string {
+
+	var out []string
+	for _, s := range strings.Split(stringValue(v), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
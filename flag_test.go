@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDefaultFlagsFailValidation(t *testing.T) {
@@ -31,12 +32,31 @@ func TestFlags(t *testing.T) {
 	require.NoError(t, err)
 
 	expected := Flags{
+		Command:       commandRun,
 		Kubeconfig:    args[2],
 		VaultMount:    env["VAK_VAULT_MOUNT"],
 		VaultHost:     args[4],
 		VaultKubeHost: args[6],
 		VaultRoleId:   args[8],
 		VaultSecretId: args[10],
+		ListenAddr:    ":8080",
+		Workers:       10,
+		KubeQPS:       20,
+		KubeBurst:     40,
+		VaultQPS:      50,
+		VaultBurst:    100,
+
+		RoleVerifyInterval:       10 * time.Minute,
+		ExportFormat:             "configmap",
+		BackupKeep:               10,
+		SecretsEngineClusterRole: "vault-secrets-engine",
+		AuthType:                 "kubernetes",
+		JWTAudience:              "vault",
+		DisableISSValidation:     true,
+		StatusHistory:            10,
+		StatusURL:                "http://localhost:8081/status",
+		StatusFormat:             "table",
+		AuditKeep:                1000,
 	}
 	assert.Equal(t, expected, flags)
 }
@@ -60,16 +80,378 @@ func TestFlagsOverride(t *testing.T) {
 	require.NoError(t, err)
 
 	expected := Flags{
+		Command:       commandRun,
 		Kubeconfig:    args[2],
 		VaultMount:    args[4],
 		VaultHost:     args[6],
 		VaultKubeHost: args[8],
 		VaultRoleId:   args[10],
 		VaultSecretId: args[12],
+		ListenAddr:    ":8080",
+		Workers:       10,
+		KubeQPS:       20,
+		KubeBurst:     40,
+		VaultQPS:      50,
+		VaultBurst:    100,
+
+		RoleVerifyInterval:       10 * time.Minute,
+		ExportFormat:             "configmap",
+		BackupKeep:               10,
+		SecretsEngineClusterRole: "vault-secrets-engine",
+		AuthType:                 "kubernetes",
+		JWTAudience:              "vault",
+		DisableISSValidation:     true,
+		StatusHistory:            10,
+		StatusURL:                "http://localhost:8081/status",
+		StatusFormat:             "table",
+		AuditKeep:                1000,
 	}
 	assert.Equal(t, expected, flags)
 }
 
+func TestFlagsTenantAllowedPolicies(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--tenant-allowed-policies", "tenant-*, default,",
+	}
+	rollback := setInput(args, nil)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tenant-*", "default"}, flags.TenantAllowedPolicies)
+}
+
+func TestFlagsGuardrailsFile(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+	env := map[string]string{"VAK_GUARDRAILS_FILE": "/etc/vak/guardrails.json"}
+	rollback := setInput(args, env)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, env["VAK_GUARDRAILS_FILE"], flags.GuardrailsFile)
+}
+
+func TestFlagsMountSpecFile(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--mount-spec-file", "/etc/vak/mount-spec.json",
+	}
+	rollback := setInput(args, nil)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/vak/mount-spec.json", flags.MountSpecFile)
+}
+
+func TestFlagsACLPolicies(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+	rollback := setInput(args, map[string]string{"VAK_ACL_POLICIES": "true"})
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.True(t, flags.ACLPolicies)
+}
+
+func TestFlagsPoliciesDir(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--policies-dir", "/etc/vak-policies",
+	}
+
+	t.Run("when policies dir is set without acl policies then error is returned", func(t *testing.T) {
+
+		rollback := setInput(args, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+
+	t.Run("when policies dir is set with acl policies then it is parsed", func(t *testing.T) {
+
+		rollback := setInput(args, map[string]string{"VAK_ACL_POLICIES": "true"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, "/etc/vak-policies", flags.PoliciesDir)
+	})
+}
+
+func TestFlagsIdentity(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--identity-group-label", "team",
+	}
+
+	t.Run("when identity group label is set without identity then error is returned", func(t *testing.T) {
+
+		rollback := setInput(args, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+
+	t.Run("when identity group label is set with identity then it is parsed", func(t *testing.T) {
+
+		rollback := setInput(args, map[string]string{"VAK_IDENTITY": "true"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.True(t, flags.Identity)
+		assert.Equal(t, "team", flags.IdentityGroupLabel)
+	})
+}
+
+func TestFlagsRolesFiles(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--roles-file", "roles.yaml",
+	}
+	env := map[string]string{"VAK_ROLES_DIR": "/etc/vak/roles"}
+	rollback := setInput(args, env)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, "roles.yaml", flags.RolesFile)
+	assert.Equal(t, env["VAK_ROLES_DIR"], flags.RolesDir)
+}
+
+func TestFlagsListenAddr(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "https://vault-0:8200,https://vault-1:8200",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+	env := map[string]string{"VAK_LISTEN_ADDR": ":9090"}
+	rollback := setInput(args, env)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, ":9090", flags.ListenAddr)
+	assert.Equal(t, []string{"https://vault-0:8200", "https://vault-1:8200"}, vaultHosts(flags))
+}
+
+func TestFlagsStatusAddr(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "https://vault-0:8200",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--status-addr", "localhost:8081",
+	}
+	rollback := setInput(args, nil)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", flags.ListenAddr)
+	assert.Equal(t, "localhost:8081", flags.StatusAddr)
+}
+
+func TestFlagsConcurrency(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--workers", "25",
+		"--vault-qps", "0",
+	}
+	env := map[string]string{"VAK_KUBE_QPS": "100.5", "VAK_KUBE_BURST": "200", "VAK_VAULT_BURST": "not a number"}
+	rollback := setInput(args, env)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, 25, flags.Workers)
+	assert.Equal(t, 100.5, flags.KubeQPS)
+	assert.Equal(t, 200, flags.KubeBurst)
+	assert.Equal(t, float64(0), flags.VaultQPS)
+	assert.Equal(t, 100, flags.VaultBurst)
+}
+
+func TestFlagsRoleVerifyInterval(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+
+	t.Run("when role verify interval env. variable is set then it is used", func(t *testing.T) {
+
+		rollback := setInput(args, map[string]string{"VAK_ROLE_VERIFY_INTERVAL": "0"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), flags.RoleVerifyInterval)
+	})
+
+	t.Run("when role verify interval flag is set then it is used", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--role-verify-interval", "1h"), map[string]string{"VAK_ROLE_VERIFY_INTERVAL": "5m"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, time.Hour, flags.RoleVerifyInterval)
+	})
+}
+
+func TestFlagsExport(t *testing.T) {
+
+	t.Run("when export command has vault flags then export flags are parsed", func(t *testing.T) {
+
+		args := []string{"vault-auth-kubernetes", "export",
+			"--vault-mount", "test/backend",
+			"--vault-host", "localhost:8443",
+			"--vault-role-id", "abc",
+			"--vault-secret-id", "def",
+			"--export-format", "file",
+		}
+		rollback := setInput(args, map[string]string{"VAK_EXPORT_MOUNT_CONFIG": "true"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, commandExport, flags.Command)
+		assert.Equal(t, "file", flags.ExportFormat)
+		assert.True(t, flags.ExportMountConfig)
+	})
+
+	t.Run("when export command does not have vault flags then error is returned", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "export"}, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		require.Error(t, err)
+	})
+}
+
+func TestFlagsBackup(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+
+	t.Run("when restore command has backup flags then backup flags are parsed", func(t *testing.T) {
+
+		restoreArgs := append([]string{args[0], "restore"}, args[1:]...)
+		rollback := setInput(append(restoreArgs, "--backup-store", "file", "--backup-snapshot", "20261018-120000.000"),
+			map[string]string{"VAK_BACKUP_DIR": "/var/backup", "VAK_BACKUP_KEEP": "3"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, commandRestore, flags.Command)
+		assert.Equal(t, "file", flags.BackupStore)
+		assert.Equal(t, "/var/backup", flags.BackupDir)
+		assert.Equal(t, 3, flags.BackupKeep)
+		assert.Equal(t, "20261018-120000.000", flags.BackupSnapshot)
+	})
+
+	t.Run("when backup command does not have backup store then error is returned", func(t *testing.T) {
+
+		rollback := setInput(append([]string{args[0], "backup"}, args[1:]...), nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		require.Error(t, err)
+	})
+
+	t.Run("when file backup store does not have backup dir then error is returned", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--backup-store", "file"), nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		require.Error(t, err)
+	})
+
+	t.Run("when backup store is unknown then error is returned", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--backup-store", "s3"), nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		require.Error(t, err)
+	})
+}
+
+func TestFlagsPlan(t *testing.T) {
+
+	t.Run("when plan command has roles file then vault flags are not required", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "plan", "--roles-file", "roles.yaml"}, nil)
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, commandPlan, flags.Command)
+		assert.Equal(t, "roles.yaml", flags.RolesFile)
+	})
+
+	t.Run("when plan command does not have roles file nor roles dir then error is returned", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "plan"}, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		require.Error(t, err)
+	})
+}
+
 func TestFlagsValidateMissingVaultFlags(t *testing.T) {
 
 	args := []string{"vault-auth-kubernetes",
@@ -100,3 +482,258 @@ func setInput(args []string, env map[string]string) (rollback func()) {
 	}
 	return rollback
 }
+
+func TestFlagsKVBootstrapFile(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+	env := map[string]string{"VAK_KV_BOOTSTRAP_FILE": "/etc/vak/kv-bootstrap.json"}
+	rollback := setInput(args, env)
+	defer func() { rollback() }()
+
+	flags, err := ParseFlags()
+	require.NoError(t, err)
+	assert.Equal(t, env["VAK_KV_BOOTSTRAP_FILE"], flags.KVBootstrapFile)
+}
+
+func TestFlagsSecretsEngine(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+		"--secrets-engine",
+	}
+
+	t.Run("when secrets engine is set then default cluster role is used", func(t *testing.T) {
+
+		rollback := setInput(args, nil)
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.True(t, flags.SecretsEngine)
+		assert.Equal(t, "vault-secrets-engine", flags.SecretsEngineClusterRole)
+	})
+
+	t.Run("when secrets engine cluster role is set then it is parsed", func(t *testing.T) {
+
+		rollback := setInput(args, map[string]string{"VAK_SECRETS_ENGINE_CLUSTER_ROLE": "secrets-engine"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, "secrets-engine", flags.SecretsEngineClusterRole)
+	})
+
+	t.Run("when secrets engine cluster role is empty then error is returned", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--secrets-engine-cluster-role", ""), nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+}
+
+func TestFlagsAuthType(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+
+	t.Run("when auth type is jwt then jwt flags are parsed", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--auth-type", "jwt", "--jwt-issuer", "https://kubernetes.default.svc"),
+			map[string]string{"VAK_JWT_KEYS_FILE": "/etc/vak/sa.pub", "VAK_JWT_AUDIENCE": "vault-prod"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, "jwt", flags.AuthType)
+		assert.Equal(t, "https://kubernetes.default.svc", flags.JWTIssuer)
+		assert.Equal(t, "/etc/vak/sa.pub", flags.JWTKeysFile)
+		assert.Equal(t, "vault-prod", flags.JWTAudience)
+	})
+
+	t.Run("when auth type is not kubernetes or jwt then error is returned", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--auth-type", "oidc"), nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+
+	t.Run("when auth type is jwt and audience is empty then error is returned", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--auth-type", "jwt", "--jwt-audience", ""), nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+}
+
+func TestFlagsPEMKeys(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+
+	t.Run("when pem keys flags are set then they are parsed", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--pem-keys", "--pem-keys-file", "/etc/vak/sa.pub", "--issuer", "https://kubernetes.default.svc"),
+			map[string]string{"VAK_DISABLE_ISS_VALIDATION": "false", "VAK_DISABLE_LOCAL_CA_JWT": "true"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.True(t, flags.PEMKeys)
+		assert.Equal(t, "/etc/vak/sa.pub", flags.PEMKeysFile)
+		assert.Equal(t, "https://kubernetes.default.svc", flags.Issuer)
+		assert.False(t, flags.DisableISSValidation)
+		assert.True(t, flags.DisableLocalCAJWT)
+	})
+
+	t.Run("when pem keys file is set without pem keys then error is returned", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--pem-keys-file", "/etc/vak/sa.pub"), nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+}
+
+func TestFlagsLoginVerification(t *testing.T) {
+
+	args := []string{"vault-auth-kubernetes",
+		"--vault-mount", "test/backend",
+		"--vault-host", "localhost:8443",
+		"--vault-role-id", "abc",
+		"--vault-secret-id", "def",
+	}
+
+	t.Run("when login verification flag is set then it is parsed", func(t *testing.T) {
+
+		rollback := setInput(append(args, "--login-verification"), nil)
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.True(t, flags.LoginVerification)
+	})
+
+	t.Run("when login verification env var is set then it is parsed", func(t *testing.T) {
+
+		rollback := setInput(args, map[string]string{"VAK_LOGIN_VERIFICATION": "true"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.True(t, flags.LoginVerification)
+	})
+}
+
+func TestFlagsStatus(t *testing.T) {
+
+	t.Run("when status command is set then vault flags are not required", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "status", "--status-url", "http://vak:8081/status", "--status-format", "yaml"}, nil)
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, commandStatus, flags.Command)
+		assert.Equal(t, "http://vak:8081/status", flags.StatusURL)
+		assert.Equal(t, "yaml", flags.StatusFormat)
+	})
+
+	t.Run("when status format is not valid then error is returned", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "status", "--status-format", "xml"}, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+
+	t.Run("when status history is less than 1 then error is returned", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes",
+			"--vault-mount", "test/backend",
+			"--vault-host", "localhost:8443",
+			"--vault-role-id", "abc",
+			"--vault-secret-id", "def",
+			"--status-history", "0",
+		}, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+}
+
+func TestFlagsAudit(t *testing.T) {
+
+	t.Run("when audit log and store are set then they are parsed", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes",
+			"--vault-mount", "test/backend",
+			"--vault-host", "localhost:8443",
+			"--vault-role-id", "abc",
+			"--vault-secret-id", "def",
+			"--audit-log", "-",
+			"--audit-keep", "50",
+			"--audit-key-file", "/etc/vak-audit/key",
+		}, map[string]string{"VAK_AUDIT_STORE": "secret"})
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, "-", flags.AuditLog)
+		assert.Equal(t, "secret", flags.AuditStore)
+		assert.Equal(t, 50, flags.AuditKeep)
+		assert.Equal(t, "/etc/vak-audit/key", flags.AuditKeyFile)
+	})
+
+	t.Run("when audit store is not valid then error is returned", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "audit-verify", "--audit-store", "configmap"}, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+
+	t.Run("when audit-verify command is set then vault flags are not required", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "audit-verify", "--audit-log", "/var/log/vak/audit.log"}, nil)
+		defer func() { rollback() }()
+
+		flags, err := ParseFlags()
+		require.NoError(t, err)
+		assert.Equal(t, commandAudit, flags.Command)
+	})
+
+	t.Run("when audit-verify command has audit log on stdout then error is returned", func(t *testing.T) {
+
+		rollback := setInput([]string{"vault-auth-kubernetes", "audit-verify", "--audit-log", "-"}, nil)
+		defer func() { rollback() }()
+
+		_, err := ParseFlags()
+		assert.Error(t, err)
+	})
+}
@@ -13,7 +13,7 @@ var kubeconfigPath = getStringEnv("KUBECONFIG", "")
 
 func TestK8s(t *testing.T) {
 
-	kubeconfig, err := k8s.LoadKubeconfig(kubeconfigPath)
+	kubeconfig, err := k8s.LoadKubeconfig(kubeconfigPath, 0, 0)
 	require.NoError(t, err)
 	c := k8s.NewClient(kubeconfig.Clientset)
 
@@ -38,7 +38,7 @@ func TestVault(t *testing.T) {
 	t.Run("when auth kubernetes role is created then it can be listed", func(t *testing.T) {
 
 		defer c.DeleteAuthKubernetes()
-		err = c.InitAuthKubernetes("localhost", []byte("--- some ca ---"), []byte(testJWT))
+		_, err = c.InitAuthKubernetes("localhost", []byte("--- some ca ---"), []byte(testJWT), vault.AuthKubernetesOptions{})
 		require.NoError(t, err)
 
 		createRole(t, c, "test-role")
@@ -49,7 +49,7 @@ func TestVault(t *testing.T) {
 	t.Run("when auth kubernetes role is deleted then it is not in the list", func(t *testing.T) {
 
 		defer c.DeleteAuthKubernetes()
-		err = c.InitAuthKubernetes("localhost", []byte("--- some ca ---"), []byte(testJWT))
+		_, err = c.InitAuthKubernetes("localhost", []byte("--- some ca ---"), []byte(testJWT), vault.AuthKubernetesOptions{})
 		require.NoError(t, err)
 
 		createRole(t, c, "test-role-1")
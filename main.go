@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
 	"github.com/pete911/vault-auth-kubernetes/pkg/auth"
+	"github.com/pete911/vault-auth-kubernetes/pkg/backup"
 	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
 	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
 	"net/http"
@@ -12,7 +16,13 @@ import (
 	"time"
 )
 
-const httpClientTimeoutSeconds = 10
+const (
+	httpClientTimeoutSeconds = 10
+	// namespace of snapshot secrets when backup-store is secret
+	backupNamespace = "vault-auth"
+	// namespace of audit record secrets when audit-store is secret
+	auditNamespace = "vault-auth"
+)
 
 func main() {
 
@@ -22,41 +32,366 @@ func main() {
 		os.Exit(1)
 	}
 
+	if flags.Command == commandPlan {
+		os.Exit(plan(flags))
+	}
+	if flags.Command == commandExport {
+		os.Exit(export(flags))
+	}
+	if flags.Command == commandBackup || flags.Command == commandRestore {
+		os.Exit(backupRestore(flags))
+	}
+	if flags.Command == commandStatus {
+		os.Exit(status(flags))
+	}
+	if flags.Command == commandAudit {
+		os.Exit(auditVerify(flags))
+	}
+
+	if flags.AuditLog == auditStdout {
+		// stdout is audit log
+		logger.StdOutLogger.SetOutput(os.Stderr)
+	}
 	logger.Logf("starting vault-auth-kubernetes with flags: %s", flags)
 	httpClient := newHttpClient(true)
 
-	vaultClient := newVaultClient(flags, httpClient)
-
-	kubeconfig, err := k8s.LoadKubeconfig(flags.Kubeconfig)
+	kubeconfig, err := k8s.LoadKubeconfig(flags.Kubeconfig, float32(flags.KubeQPS), flags.KubeBurst)
 	if err != nil {
 		logger.Errorf("get kubeconfig: %v", err)
 		os.Exit(1)
 	}
 	k8sClient := k8s.NewClient(kubeconfig.Clientset)
+	auditLog := newAuditLog(flags, k8sClient)
+	var vaultAudit vault.AuditFunc
+	if auditLog != nil {
+		vaultAudit = auditLog.Recorder(audit.SystemVault)
+		k8sClient = k8sClient.WithAudit(auditLog.Recorder(audit.SystemKubernetes))
+	}
+
+	vaultClient := newVaultClient(flags, httpClient, vaultAudit)
 	if flags.VaultKubeHost == "" {
 		flags.VaultKubeHost = kubeconfig.Host
 		logger.Logf("vault-kube-host not set, setting host to %s (from kubeconfig)", flags.VaultKubeHost)
 	}
 
 	authConfig := auth.Config{
-		VaultMount: flags.VaultMount,
-		K8sHost:    flags.VaultKubeHost,
-		K8sCA:      kubeconfig.CA,
+		VaultMount:            flags.VaultMount,
+		K8sHost:               flags.VaultKubeHost,
+		K8sCA:                 kubeconfig.CA,
+		K8sCAFile:             kubeconfig.CAFile,
+		TenantAllowedPolicies: flags.TenantAllowedPolicies,
+		RolesFile:             flags.RolesFile,
+		RolesDir:              flags.RolesDir,
+		Workers:               flags.Workers,
+		RoleVerifyInterval:    flags.RoleVerifyInterval,
+		ACLPolicies:           flags.ACLPolicies,
+		PoliciesDir:           flags.PoliciesDir,
+		Identity:              flags.Identity,
+		IdentityGroupLabel:    flags.IdentityGroupLabel,
+
+		SecretsEngine:            flags.SecretsEngine,
+		SecretsEngineClusterRole: flags.SecretsEngineClusterRole,
+
+		AuthType:    flags.AuthType,
+		JWTIssuer:   flags.JWTIssuer,
+		JWTKeysFile: flags.JWTKeysFile,
+
+		PEMKeys:              flags.PEMKeys,
+		PEMKeysFile:          flags.PEMKeysFile,
+		Issuer:               flags.Issuer,
+		DisableISSValidation: flags.DisableISSValidation,
+		DisableLocalCAJWT:    flags.DisableLocalCAJWT,
+
+		LoginVerification: flags.LoginVerification,
+		StatusHistory:     flags.StatusHistory,
+	}
+	if flags.BackupStore != "" {
+		authConfig.Backup = newBackup(flags, vaultClient, k8sClient)
+	}
+	if auditLog != nil {
+		authConfig.Audit = auditLog
+	}
+	if authConfig.Guardrails = loadGuardrails(flags); len(authConfig.Guardrails.Rules) != 0 {
+		logger.Logf("loaded %d guardrail rules from %s", len(authConfig.Guardrails.Rules), flags.GuardrailsFile)
+	}
+	if flags.KVBootstrapFile != "" {
+		kvBootstrap, err := auth.LoadKVBootstrap(flags.KVBootstrapFile)
+		if err != nil {
+			logger.Errorf("load kv bootstrap: %v", err)
+			os.Exit(1)
+		}
+		authConfig.KVBootstrap = &kvBootstrap
 	}
 
-	if err := auth.NewAuth(authConfig, vaultClient, k8sClient).Run(); err != nil {
+	a := auth.NewAuth(authConfig, vaultClient, k8sClient)
+	if flags.ListenAddr != "" {
+		go serve(flags.ListenAddr, vaultClient)
+	}
+	if flags.StatusAddr != "" {
+		go serveStatus(flags.StatusAddr, a.Status)
+	}
+	if err := a.Run(); err != nil {
 		logger.Errorf("auth run: %v", err)
 		os.Exit(1)
 	}
 }
 
-func newVaultClient(flags Flags, httpClient *http.Client) *vault.Client {
+// print effective roles from role files, returns exit code
+func plan(flags Flags) int {
+
+	config := auth.Config{
+		RolesFile:  flags.RolesFile,
+		RolesDir:   flags.RolesDir,
+		Guardrails: loadGuardrails(flags),
+	}
+	p, err := auth.NewPlan(config)
+	if err != nil {
+		logger.Errorf("plan: %v", err)
+		return 1
+	}
+
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		logger.Errorf("plan: marshal: %v", err)
+		return 1
+	}
+	fmt.Println(string(b))
+	if p.HasViolations() {
+		return 1
+	}
+	return 0
+}
+
+// print vault roles in roles config map or roles file format, returns exit code
+func export(flags Flags) int {
+
+	// stdout is export output
+	logger.StdOutLogger.SetOutput(os.Stderr)
+	vaultClient := newVaultClient(flags, newHttpClient(true), nil)
+	e, err := auth.NewExport(vaultClient, fmt.Sprintf("kubernetes/%s", flags.VaultMount), flags.AuthType, flags.ExportMountConfig)
+	if err != nil {
+		logger.Errorf("export: %v", err)
+		return 1
+	}
+	b, err := e.Format(flags.ExportFormat)
+	if err != nil {
+		logger.Errorf("export: %v", err)
+		return 1
+	}
+	for _, warning := range e.Warnings() {
+		logger.Errorf("export: %s", warning)
+	}
+	fmt.Print(string(b))
+	return 0
+}
+
+// print status of running vault-auth-kubernetes read from its status endpoint, returns exit code
+func status(flags Flags) int {
+
+	response, err := newHttpClient(false).Get(flags.StatusURL)
+	if err != nil {
+		logger.Errorf("status: %v", err)
+		return 1
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		logger.Errorf("status: %s returned %s", flags.StatusURL, response.Status)
+		return 1
+	}
+
+	var s auth.Status
+	if err := json.NewDecoder(response.Body).Decode(&s); err != nil {
+		logger.Errorf("status: decode response: %v", err)
+		return 1
+	}
+	b, err := s.Format(flags.StatusFormat)
+	if err != nil {
+		logger.Errorf("status: %v", err)
+		return 1
+	}
+	fmt.Print(string(b))
+	return 0
+}
+
+// save snapshot of vault auth mount (backup command) or re-apply saved snapshot (restore command), prints snapshot name,
+// returns exit code
+func backupRestore(flags Flags) int {
+
+	// stdout is snapshot name
+	logger.StdOutLogger.SetOutput(os.Stderr)
+
+	// restore of auth kubernetes config needs token reviewer jwt, it is not in snapshot
+	restoreTokenReviewer := flags.Command == commandRestore && flags.AuthType == vault.AuthTypeKubernetes
+	var k8sClient k8s.Client
+	if flags.BackupStore == backup.StoreSecret || flags.AuditStore == audit.StoreSecret || restoreTokenReviewer {
+		kubeconfig, err := k8s.LoadKubeconfig(flags.Kubeconfig, float32(flags.KubeQPS), flags.KubeBurst)
+		if err != nil {
+			logger.Errorf("get kubeconfig: %v", err)
+			return 1
+		}
+		k8sClient = k8s.NewClient(kubeconfig.Clientset)
+	}
+	// restored roles are audited the same way as roles written by run
+	var vaultAudit vault.AuditFunc
+	if auditLog := newAuditLog(flags, k8sClient); auditLog != nil {
+		vaultAudit = auditLog.Recorder(audit.SystemVault)
+		k8sClient = k8sClient.WithAudit(auditLog.Recorder(audit.SystemKubernetes))
+	}
+	vaultClient := newVaultClient(flags, newHttpClient(true), vaultAudit)
+	b := newBackup(flags, vaultClient, k8sClient)
+
+	var snapshot backup.Snapshot
+	var err error
+	if flags.Command == commandRestore {
+		var tokenReviewerJWT []byte
+		if restoreTokenReviewer {
+			if tokenReviewerJWT, err = auth.TokenReviewerJWT(k8sClient); err != nil {
+				logger.Errorf("%s: get token reviewer jwt: %v", flags.Command, err)
+				return 1
+			}
+		}
+		snapshot, err = b.Restore(flags.BackupSnapshot, tokenReviewerJWT)
+	} else {
+		snapshot, err = b.Snapshot("backup command")
+	}
+	if err != nil {
+		logger.Errorf("%s: %v", flags.Command, err)
+		return 1
+	}
+	fmt.Println(snapshot.Name)
+	return 0
+}
+
+// backup of vault auth mount to file or secret store, k8s client is used only by secret store
+func newBackup(flags Flags, vaultClient *vault.Client, k8sClient k8s.Client) backup.Backup {
+
+	var store backup.Store = backup.NewFileStore(flags.BackupDir)
+	if flags.BackupStore == backup.StoreSecret {
+		store = backup.NewSecretStore(k8sClient, backupNamespace)
+	}
+	return backup.NewBackup(vaultClient, store, fmt.Sprintf("kubernetes/%s", flags.VaultMount), flags.BackupKeep)
+}
+
+// audit log of mutations written to audit-log file (or stdout) and secret store, nil if audit is disabled, k8s client is
+// used only by secret store and it must not be audited (audit records are not audited)
+func newAuditLog(flags Flags, k8sClient k8s.Client) *audit.Log {
+
+	var stores []audit.Store
+	switch flags.AuditLog {
+	case "":
+	case auditStdout:
+		stores = append(stores, audit.NewWriterStore(os.Stdout))
+	default:
+		stores = append(stores, audit.NewFileStore(flags.AuditLog))
+	}
+	if flags.AuditStore == audit.StoreSecret {
+		stores = append(stores, audit.NewSecretStore(k8sClient, auditNamespace, flags.AuditKeep))
+	}
+	if len(stores) == 0 {
+		return nil
+	}
+
+	key, err := loadAuditKey(flags)
+	if err != nil {
+		logger.Errorf("load audit key: %v", err)
+		os.Exit(1)
+	}
+	auditLog, err := audit.NewLog(key, stores...)
+	if err != nil {
+		logger.Errorf("new audit log: %v", err)
+		os.Exit(1)
+	}
+	return auditLog
+}
+
+// verify hash chain of records in audit-log file, or in secret store if audit-log is not file, returns exit code
+func auditVerify(flags Flags) int {
+
+	var records []audit.Record
+	var err error
+	if flags.AuditLog != "" && flags.AuditLog != auditStdout {
+		records, err = audit.NewFileStore(flags.AuditLog).Records()
+	} else {
+		kubeconfig, kubeconfigErr := k8s.LoadKubeconfig(flags.Kubeconfig, float32(flags.KubeQPS), flags.KubeBurst)
+		if kubeconfigErr != nil {
+			logger.Errorf("get kubeconfig: %v", kubeconfigErr)
+			return 1
+		}
+		records, err = audit.NewSecretStore(k8s.NewClient(kubeconfig.Clientset), auditNamespace, flags.AuditKeep).Records()
+	}
+	if err != nil {
+		logger.Errorf("audit-verify: read records: %v", err)
+		return 1
+	}
+	key, err := loadAuditKey(flags)
+	if err != nil {
+		logger.Errorf("audit-verify: load audit key: %v", err)
+		return 1
+	}
+	first, err := audit.Verify(records, key)
+	if err != nil {
+		logger.Errorf("audit-verify: %v", err)
+		return 1
+	}
+	if first > 1 {
+		logger.Logf("audit-verify: records before sequence %d were deleted (audit-keep or rotated audit log)", first)
+	}
+	fmt.Printf("%d audit records verified\n", len(records))
+	return 0
+}
+
+// hmac key of audit records from audit-key-file, trailing new line is not part of the key, nil if file is not set
+func loadAuditKey(flags Flags) ([]byte, error) {
+
+	if flags.AuditKeyFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(flags.AuditKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimRight(b, "\r\n")
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", flags.AuditKeyFile)
+	}
+	return key, nil
+}
+
+func loadGuardrails(flags Flags) auth.Guardrails {
+
+	if flags.GuardrailsFile == "" {
+		return auth.Guardrails{}
+	}
+	guardrails, err := auth.LoadGuardrails(flags.GuardrailsFile)
+	if err != nil {
+		logger.Errorf("load guardrails: %v", err)
+		os.Exit(1)
+	}
+	return guardrails
+}
+
+// vault client, vault mutations are not audited if audit is nil
+func newVaultClient(flags Flags, httpClient *http.Client, auditFunc vault.AuditFunc) *vault.Client {
 
 	vaultConfig := vault.Config{
 		HttpClient: httpClient,
-		Host:       flags.VaultHost,
+		Hosts:      vaultHosts(flags),
+		QPS:        flags.VaultQPS,
+		Burst:      flags.VaultBurst,
 		RoleId:     flags.VaultRoleId,
 		SecretId:   flags.VaultSecretId,
+
+		AuthType:    flags.AuthType,
+		JWTAudience: flags.JWTAudience,
+		Audit:       auditFunc,
+	}
+	if flags.MountSpecFile != "" {
+		mountSpec, err := vault.LoadMountSpec(flags.MountSpecFile)
+		if err != nil {
+			logger.Errorf("load mount spec: %v", err)
+			os.Exit(1)
+		}
+		vaultConfig.MountSpec = &mountSpec
 	}
 	vaultClient, err := vault.NewClient(vaultConfig, fmt.Sprintf("kubernetes/%s", flags.VaultMount))
 	if err != nil {
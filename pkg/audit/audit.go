@@ -0,0 +1,246 @@
+// Package audit is append-only log of vault and kubernetes mutations, records are numbered and hash chained, so
+// removed, reordered or changed records are detected by Verify, records are chained by hmac when log has key, without
+// key only accidental corruption is detected (anyone who can change records can compute sha256 of changed records)
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	SystemVault      = "vault"
+	SystemKubernetes = "kubernetes"
+
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	// write to vault path that cannot be read, it is not known if it was create or update
+	ActionWrite = "write"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+
+	digestPrefix = "sha256:"
+)
+
+// object that is not known, e.g. vault path that was neither read nor written since start, record has empty digest and
+// unknown flag
+var Unknown = unknownObject{}
+
+type unknownObject struct{}
+
+// digest of object that is not kept (e.g. vault request with tokens), it is recorded as it is
+type Digested string
+
+var recordsMetric = metrics.NewCounter("vak_audit_records_total", "Number of audit records by result (stored or failed).", "result")
+
+// object that triggered mutation, e.g. roles config map, manager is field manager of the latest managed fields entry,
+// it identifies client that changed the object (e.g. kubectl-edit or argocd-controller), not user
+type Source struct {
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resource_version,omitempty"`
+	Manager         string `json:"manager,omitempty"`
+}
+
+// one mutation, before and after are digests of the object (empty if object did not exist), before unknown is set when
+// object before mutation is not known (before is empty), hash is hmac-sha256 (or sha256 if log has no key) of the record
+// (with empty hash), previous is hash of the previous record and sequence is number of the record in chain, the first
+// record has sequence 1 and empty previous hash
+type Record struct {
+	Sequence      int64     `json:"sequence"`
+	Time          time.Time `json:"time"`
+	System        string    `json:"system"`
+	Target        string    `json:"target"`
+	Action        string    `json:"action"`
+	Before        string    `json:"before,omitempty"`
+	BeforeUnknown bool      `json:"before_unknown,omitempty"`
+	After         string    `json:"after,omitempty"`
+	Source        *Source   `json:"source,omitempty"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+	Previous      string    `json:"previous,omitempty"`
+	Hash          string    `json:"hash"`
+}
+
+// hmac-sha256 of the record with key, sha256 if key is nil
+func (r Record) hash(key []byte) (string, error) {
+
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// records are appended to every store, stores are append only
+type Store interface {
+	Append(record Record) error
+	// the last record, nil if store is empty or cannot be read (e.g. stdout)
+	Last() (*Record, error)
+}
+
+type Log struct {
+	mu     sync.Mutex
+	stores []Store
+	// key of records hmac, records are chained by sha256 if nil
+	key []byte
+	// hash and sequence of the last record
+	last     string
+	sequence int64
+	// resolves source of mutation, source is not set if nil
+	sources func(system, target string) *Source
+	now     func() time.Time
+}
+
+// new log, chain continues from the last record of the first store that has records, records are chained by hmac with
+// key (only writer and verifier should have it), or by sha256 if key is nil
+func NewLog(key []byte, stores ...Store) (*Log, error) {
+
+	l := &Log{stores: stores, key: key, now: time.Now}
+	for _, store := range stores {
+		last, err := store.Last()
+		if err != nil {
+			return nil, fmt.Errorf("read last audit record: %w", err)
+		}
+		if last != nil {
+			l.last, l.sequence = last.Hash, last.Sequence
+			break
+		}
+	}
+	return l, nil
+}
+
+// set source resolver, source is resolved for every record by system and target
+func (l *Log) SetSources(sources func(system, target string) *Source) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sources = sources
+}
+
+// recorder of mutations in system, before and after are objects (nil if object did not exist), Digested or Unknown, err
+// is error of the mutation
+func (l *Log) Recorder(system string) func(target, action string, before, after interface{}, err error) {
+
+	return func(target, action string, before, after interface{}, err error) {
+		record := Record{
+			System:  system,
+			Target:  target,
+			Action:  action,
+			Outcome: OutcomeSuccess,
+		}
+		record.Before, record.BeforeUnknown = objectDigest(before)
+		record.After, _ = objectDigest(after)
+		if err != nil {
+			record.Outcome, record.Error = OutcomeFailure, err.Error()
+		}
+		l.Record(record)
+	}
+}
+
+// set sequence, time, source, previous and hash of record and append it to stores, store errors are logged, so audit
+// log does not stop reconciliation
+func (l *Log) Record(record Record) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record.Time = l.now().UTC()
+	if record.Source == nil && l.sources != nil {
+		record.Source = l.sources(record.System, record.Target)
+	}
+	record.Sequence, record.Previous = l.sequence+1, l.last
+	hash, err := record.hash(l.key)
+	if err != nil {
+		logger.Errorf("audit %s %s %s: %v", record.System, record.Action, record.Target, err)
+		recordsMetric.Inc("failed")
+		return
+	}
+	record.Hash, l.last, l.sequence = hash, hash, record.Sequence
+
+	for _, store := range l.stores {
+		if err := store.Append(record); err != nil {
+			logger.Errorf("audit %s %s %s: append: %v", record.System, record.Action, record.Target, err)
+			recordsMetric.Inc("failed")
+			continue
+		}
+		recordsMetric.Inc("stored")
+	}
+}
+
+// sha256 digest of object json, empty if object is nil
+func Digest(v interface{}) string {
+
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return digestPrefix + hex.EncodeToString(sum[:])
+}
+
+// digest of object, Digested is returned as it is, unknown is true if object is Unknown
+func objectDigest(v interface{}) (digest string, unknown bool) {
+
+	switch v := v.(type) {
+	case Digested:
+		return string(v), false
+	case unknownObject:
+		return "", true
+	}
+	return Digest(v), false
+}
+
+// verify hash (with the key records were written with) of every record and that records are chained without gaps in
+// sequence, returns sequence of the first record, records before it were deleted (e.g. by retention or file rotation),
+// record with sequence 1 is the start of chain and it cannot have previous hash
+func Verify(records []Record, key []byte) (int64, error) {
+
+	if len(records) == 0 {
+		return 0, nil
+	}
+	if records[0].Sequence < 1 {
+		return 0, fmt.Errorf("record 1: sequence %d is not valid", records[0].Sequence)
+	}
+	if records[0].Sequence == 1 && records[0].Previous != "" {
+		return 0, fmt.Errorf("record 1: the first record has previous hash %s", records[0].Previous)
+	}
+	for i, record := range records {
+		hash, err := record.hash(key)
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		if hash != record.Hash {
+			return 0, fmt.Errorf("record %d: hash %s does not match record content", i+1, record.Hash)
+		}
+		if i == 0 {
+			continue
+		}
+		if record.Previous != records[i-1].Hash {
+			return 0, fmt.Errorf("record %d: previous hash %s does not match hash of record %d", i+1, record.Previous, i)
+		}
+		if record.Sequence != records[i-1].Sequence+1 {
+			return 0, fmt.Errorf("record %d: sequence %d does not follow sequence %d", i+1, record.Sequence, records[i-1].Sequence)
+		}
+	}
+	return records[0].Sequence, nil
+}
@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// store that keeps records in memory
+type memoryStore struct {
+	records []Record
+	last    *Record
+	err     error
+}
+
+func (m *memoryStore) Append(record Record) error {
+
+	if m.err != nil {
+		return m.err
+	}
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *memoryStore) Last() (*Record, error) {
+	return m.last, nil
+}
+
+func newTestLog(t *testing.T, stores ...Store) *Log {
+	return newTestKeyLog(t, nil, stores...)
+}
+
+func newTestKeyLog(t *testing.T, key []byte, stores ...Store) *Log {
+
+	l, err := NewLog(key, stores...)
+	require.NoError(t, err)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	return l
+}
+
+func TestLog(t *testing.T) {
+
+	t.Run("when mutations are recorded then records are chained by hash", func(t *testing.T) {
+
+		store := &memoryStore{}
+		l := newTestLog(t, store)
+		record := l.Recorder(SystemVault)
+		record("auth/kubernetes/test/role/app", ActionCreate, nil, map[string]interface{}{"token_policies": []string{"app"}}, nil)
+		record("auth/kubernetes/test/role/app", ActionDelete, map[string]interface{}{"token_policies": []string{"app"}}, nil, errors.New("permission denied"))
+
+		require.Len(t, store.records, 2)
+		assert.Equal(t, int64(1), store.records[0].Sequence)
+		assert.Empty(t, store.records[0].Previous)
+		assert.Empty(t, store.records[0].Before)
+		assert.Equal(t, OutcomeSuccess, store.records[0].Outcome)
+		assert.Equal(t, store.records[0].Hash, store.records[1].Previous)
+		assert.Equal(t, store.records[0].After, store.records[1].Before)
+		assert.Equal(t, OutcomeFailure, store.records[1].Outcome)
+		assert.Equal(t, "permission denied", store.records[1].Error)
+		first, err := Verify(store.records, nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), first)
+	})
+
+	t.Run("when before is digested or unknown then it is recorded as it is", func(t *testing.T) {
+
+		store := &memoryStore{}
+		l := newTestLog(t, store)
+		record := l.Recorder(SystemVault)
+		after := map[string]interface{}{"token_policies": []string{"app"}}
+		record("auth/kubernetes/test/role/app", ActionWrite, Unknown, after, nil)
+		record("auth/kubernetes/test/role/app", ActionUpdate, Digested(Digest(after)), after, nil)
+
+		require.Len(t, store.records, 2)
+		assert.Empty(t, store.records[0].Before)
+		assert.True(t, store.records[0].BeforeUnknown)
+		assert.Equal(t, store.records[0].After, store.records[1].Before)
+		assert.False(t, store.records[1].BeforeUnknown)
+		_, err := Verify(store.records, nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("when store has records then chain continues from the last record", func(t *testing.T) {
+
+		l := newTestLog(t, &memoryStore{}, &memoryStore{last: &Record{Sequence: 7, Hash: "abc"}})
+		store := &memoryStore{}
+		l.stores = append(l.stores, store)
+		l.Record(Record{System: SystemKubernetes, Target: "serviceaccounts/payments/app", Action: ActionCreate, Outcome: OutcomeSuccess})
+
+		require.Len(t, store.records, 1)
+		assert.Equal(t, "abc", store.records[0].Previous)
+		assert.Equal(t, int64(8), store.records[0].Sequence)
+	})
+
+	t.Run("when source resolver is set then records have source", func(t *testing.T) {
+
+		store := &memoryStore{}
+		l := newTestLog(t, store)
+		l.SetSources(func(system, target string) *Source {
+			if target == "serviceaccounts/payments/app" {
+				return &Source{Kind: "ConfigMap", Namespace: "vault-auth", Name: "vault-auth-roles", ResourceVersion: "7", Manager: "kubectl-edit"}
+			}
+			return nil
+		})
+		l.Record(Record{System: SystemKubernetes, Target: "serviceaccounts/payments/app", Action: ActionCreate})
+		l.Record(Record{System: SystemVault, Target: "auth/kubernetes/test/config", Action: ActionUpdate})
+
+		require.Len(t, store.records, 2)
+		require.NotNil(t, store.records[0].Source)
+		assert.Equal(t, "kubectl-edit", store.records[0].Source.Manager)
+		assert.Nil(t, store.records[1].Source)
+	})
+
+	t.Run("when store fails then other stores have the record", func(t *testing.T) {
+
+		store := &memoryStore{}
+		l := newTestLog(t, &memoryStore{err: errors.New("disk full")}, store)
+		l.Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionUpdate})
+		assert.Len(t, store.records, 1)
+	})
+}
+
+func TestVerify(t *testing.T) {
+
+	key := []byte("audit-key")
+	store := &memoryStore{}
+	l := newTestKeyLog(t, key, store)
+	for _, target := range []string{"sys/policies/acl/app", "auth/kubernetes/test/role/app", "serviceaccounts/payments/app"} {
+		l.Record(Record{System: SystemVault, Target: target, Action: ActionCreate, Outcome: OutcomeSuccess})
+	}
+	records := func() []Record {
+		return append([]Record(nil), store.records...)
+	}
+
+	t.Run("when records are verified with the key then the first sequence is returned", func(t *testing.T) {
+
+		first, err := Verify(records(), key)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), first)
+	})
+
+	t.Run("when records are verified without the key or with other key then verify fails", func(t *testing.T) {
+
+		_, err := Verify(records(), nil)
+		assert.ErrorContains(t, err, "record 1: hash")
+		_, err = Verify(records(), []byte("other-key"))
+		assert.ErrorContains(t, err, "record 1: hash")
+	})
+
+	t.Run("when the first records are removed (rotated) then sequence of the first kept record is returned", func(t *testing.T) {
+
+		first, err := Verify(records()[1:], key)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), first)
+	})
+
+	t.Run("when record is changed then verify fails", func(t *testing.T) {
+
+		changed := records()
+		changed[1].Action = ActionDelete
+		_, err := Verify(changed, key)
+		assert.ErrorContains(t, err, "record 2: hash")
+	})
+
+	t.Run("when record is removed then verify fails", func(t *testing.T) {
+
+		removed := records()
+		removed = append(removed[:1], removed[2:]...)
+		_, err := Verify(removed, key)
+		assert.ErrorContains(t, err, "record 2: previous hash")
+	})
+
+	t.Run("when the first record of chain has previous hash then verify fails", func(t *testing.T) {
+
+		first := records()[:1]
+		first[0].Previous = "abc"
+		_, err := Verify(first, nil)
+		assert.ErrorContains(t, err, "record 1: the first record has previous hash")
+	})
+}
+
+func TestDigest(t *testing.T) {
+
+	assert.Empty(t, Digest(nil))
+	var role map[string]interface{}
+	assert.Empty(t, Digest(role))
+	// map keys are sorted, so digest does not depend on key order
+	assert.Equal(t, Digest(map[string]int{"a": 1, "b": 2}), Digest(map[string]int{"b": 2, "a": 1}))
+	assert.Regexp(t, `^sha256:[0-9a-f]{64}$`, Digest("app"))
+}
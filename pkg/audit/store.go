@@ -0,0 +1,227 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	StoreSecret = "secret"
+
+	secretNamePrefix = "vak-audit-"
+	secretLabel      = "vak-audit"
+	secretDataKey    = "record.json"
+)
+
+// records as json lines written to writer (e.g. stdout), writer cannot be read, so chain starts with the first record
+// on every start, unless other store has records
+type WriterStore struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterStore(w io.Writer) *WriterStore {
+	return &WriterStore{w: w}
+}
+
+func (s *WriterStore) Append(record Record) error {
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *WriterStore) Last() (*Record, error) {
+	return nil, nil
+}
+
+// records as json lines appended to file, file is opened on every append, so it can be rotated (rotated file is the
+// start of new chain)
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) FileStore {
+	return FileStore{path: path}
+}
+
+func (f FileStore) Append(record Record) error {
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f FileStore) Last() (*Record, error) {
+
+	records, err := f.Records()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[len(records)-1], nil
+}
+
+// records in the order they were appended, file that does not exist has no records
+func (f FileStore) Records() ([]Record, error) {
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", f.path, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+type SecretsClient interface {
+	CreateSecret(secret k8s.Secret) error
+	GetSecrets(namespace, labelSelector string) ([]k8s.Secret, error)
+	DeleteSecret(namespace, name string) error
+}
+
+// records as kubernetes secrets (labelled 'vak-audit=true') named 'vak-audit-<unix nano time>-<hash prefix>', one
+// secret per record, so records are never updated, only the latest keep records are kept (all if keep is 0), secrets
+// are listed only once, names of appended secrets are kept in memory
+type SecretStore struct {
+	client    SecretsClient
+	namespace string
+	keep      int
+
+	mu sync.Mutex
+	// sorted names of record secrets, nil until secrets are listed
+	names []string
+}
+
+func NewSecretStore(client SecretsClient, namespace string, keep int) *SecretStore {
+	return &SecretStore{client: client, namespace: namespace, keep: keep}
+}
+
+func (s *SecretStore) Append(record Record) error {
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s%019d-%.8s", secretNamePrefix, record.Time.UnixNano(), record.Hash)
+	if err := s.client.CreateSecret(k8s.Secret{
+		Namespace: s.namespace,
+		Name:      name,
+		Labels:    map[string]string{secretLabel: "true"},
+		Data:      map[string][]byte{secretDataKey: b},
+	}); err != nil {
+		return err
+	}
+	if err := s.prune(name); err != nil {
+		logger.Errorf("delete old audit records: %v", err)
+	}
+	return nil
+}
+
+// delete the oldest record secrets over retention, name is the appended secret
+func (s *SecretStore) prune(name string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.names == nil {
+		secrets, err := s.secrets()
+		if err != nil {
+			return err
+		}
+		s.names = []string{}
+		for _, secret := range secrets {
+			s.names = append(s.names, secret.Name)
+		}
+	} else {
+		s.names = append(s.names, name)
+	}
+
+	for s.keep > 0 && len(s.names) > s.keep {
+		if err := s.client.DeleteSecret(s.namespace, s.names[0]); err != nil {
+			return err
+		}
+		s.names = s.names[1:]
+	}
+	return nil
+}
+
+func (s *SecretStore) Last() (*Record, error) {
+
+	records, err := s.Records()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[len(records)-1], nil
+}
+
+// records sorted by secret name (record time)
+func (s *SecretStore) Records() ([]Record, error) {
+
+	secrets, err := s.secrets()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, secret := range secrets {
+		b, ok := secret.Data[secretDataKey]
+		if !ok {
+			return nil, fmt.Errorf("secret %s does not have %s key", secret.Name, secretDataKey)
+		}
+		var record Record
+		if err := json.Unmarshal(b, &record); err != nil {
+			return nil, fmt.Errorf("unmarshal secret %s: %w", secret.Name, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// record secrets sorted by name
+func (s *SecretStore) secrets() ([]k8s.Secret, error) {
+
+	secrets, err := s.client.GetSecrets(s.namespace, secretLabel+"=true")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets, nil
+}
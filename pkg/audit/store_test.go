@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"bytes"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+
+	t.Run("when file does not exist then there are no records and append creates it", func(t *testing.T) {
+
+		store := NewFileStore(filepath.Join(t.TempDir(), "audit.log"))
+		last, err := store.Last()
+		require.NoError(t, err)
+		assert.Nil(t, last)
+
+		newTestLog(t, store).Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionCreate})
+		records, err := store.Records()
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "sys/policies/acl/app", records[0].Target)
+
+		info, err := os.Stat(store.path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("when log is created again then chain continues in the file", func(t *testing.T) {
+
+		store := NewFileStore(filepath.Join(t.TempDir(), "audit.log"))
+		newTestLog(t, store).Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionCreate})
+		newTestLog(t, store).Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionDelete})
+
+		records, err := store.Records()
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		_, err = Verify(records, nil)
+		assert.NoError(t, err)
+	})
+
+	t.Run("when file has invalid line then line is returned in error", func(t *testing.T) {
+
+		path := filepath.Join(t.TempDir(), "audit.log")
+		require.NoError(t, os.WriteFile(path, []byte("{}\n\nnot json\n"), 0600))
+		_, err := NewFileStore(path).Records()
+		assert.ErrorContains(t, err, "line 3")
+	})
+}
+
+func TestWriterStore(t *testing.T) {
+
+	var b bytes.Buffer
+	store := NewWriterStore(&b)
+	l := newTestLog(t, store)
+	l.Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionCreate})
+	l.Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionDelete})
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"action":"delete"`)
+	last, err := store.Last()
+	require.NoError(t, err)
+	assert.Nil(t, last)
+}
+
+func TestSecretStore(t *testing.T) {
+
+	t.Run("when records are appended then every record is in labelled secret", func(t *testing.T) {
+
+		store := NewSecretStore(k8s.NewClient(fake.NewSimpleClientset()), "vault-auth", 0)
+		l := newTestLog(t, store)
+		l.Record(Record{System: SystemKubernetes, Target: "serviceaccounts/payments/app", Action: ActionCreate})
+		l.Record(Record{System: SystemKubernetes, Target: "serviceaccounts/payments/app", Action: ActionDelete})
+
+		records, err := store.Records()
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		assert.Equal(t, ActionCreate, records[0].Action)
+		_, err = Verify(records, nil)
+		assert.NoError(t, err)
+
+		last, err := store.Last()
+		require.NoError(t, err)
+		assert.Equal(t, &records[1], last)
+	})
+
+	t.Run("when there are more records than keep then the oldest secrets are deleted", func(t *testing.T) {
+
+		client := k8s.NewClient(fake.NewSimpleClientset())
+		// records stored before restart
+		l := newTestLog(t, NewSecretStore(client, "vault-auth", 0))
+		for i := 0; i < 3; i++ {
+			l.Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionUpdate})
+		}
+
+		store := NewSecretStore(client, "vault-auth", 2)
+		now := l.now
+		l = newTestLog(t, store)
+		l.now = now
+		l.Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionDelete})
+		l.Record(Record{System: SystemVault, Target: "sys/policies/acl/app", Action: ActionCreate})
+
+		secrets, err := client.GetSecrets("vault-auth", secretLabel+"=true")
+		require.NoError(t, err)
+		assert.Len(t, secrets, 2)
+		records, err := store.Records()
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		assert.Equal(t, ActionDelete, records[0].Action)
+		assert.Equal(t, ActionCreate, records[1].Action)
+		_, err = Verify(records, nil)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"sort"
+	"strings"
+)
+
+// source of role that caused mutation of target, roles are desired roles of the last reload, target that is not defined
+// by desired role (e.g. deleted vault role) is attributed to the source role was removed from, source is nil if target
+// is not defined by role (e.g. auth config, identity or kv metadata) or role was removed before start
+func (a Auth) auditSource(system, target string) *audit.Source {
+
+	a.status.mu.Lock()
+	desired, removed := a.status.roles, a.status.removed
+	a.status.mu.Unlock()
+
+	mount := fmt.Sprintf("kubernetes/%s", a.config.VaultMount)
+	for _, roles := range []vaultRoles{desired, removed} {
+		var names []string
+		switch system {
+		case audit.SystemVault:
+			names = roles.vaultTargetRoles(mount, target)
+		case audit.SystemKubernetes:
+			names = roles.kubernetesTargetRoles(target)
+		}
+		if len(names) != 0 {
+			return roles[names[0]].source.auditSource()
+		}
+	}
+	return nil
+}
+
+// sorted names of roles that define vault auth role, secrets engine role or acl policy at path
+func (v vaultRoles) vaultTargetRoles(mount, path string) []string {
+
+	for _, prefix := range []string{fmt.Sprintf("auth/%s/role/", mount), fmt.Sprintf("%s/roles/", mount)} {
+		if name, ok := strings.CutPrefix(path, prefix); ok {
+			if _, ok := v[name]; ok {
+				return []string{name}
+			}
+			return nil
+		}
+	}
+
+	policy, ok := strings.CutPrefix(path, "sys/policies/acl/")
+	if !ok {
+		return nil
+	}
+	var names []string
+	for name, role := range v {
+		if _, ok := role.aclPolicies[policy]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sorted names of roles that bind service account or are defined in config map, target is
+// '<resource>/<namespace>/<name>'
+func (v vaultRoles) kubernetesTargetRoles(target string) []string {
+
+	parts := strings.Split(target, "/")
+	if len(parts) != 3 {
+		return nil
+	}
+	resource, namespace, name := parts[0], parts[1], parts[2]
+	switch resource {
+	case "serviceaccounts":
+		return v.boundRoles(namespace, name)
+	case "configmaps":
+		var names []string
+		for roleName, role := range v {
+			if role.source.kind == configMapSourceKind && role.source.namespace == namespace && role.source.name == name {
+				names = append(names, roleName)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	return nil
+}
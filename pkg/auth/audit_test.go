@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAuth_auditSource(t *testing.T) {
+
+	payments := roleSource{kind: configMapSourceKind, namespace: "payments", name: "vault-roles", resourceVersion: "12", manager: "argocd-controller"}
+	platform := roleSource{kind: configMapSourceKind, namespace: "vault-auth", name: "vault-auth-roles", resourceVersion: "7", manager: "kubectl-edit"}
+	a := NewAuth(Config{VaultMount: "test-account/test-cluster"}, nil, nil)
+	a.status.setDesired(vaultRoles{
+		"app": {
+			Role:        vault.Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"payments"}},
+			source:      payments,
+			aclPolicies: map[string]string{"shared": `path "secret/*" { capabilities = ["read"] }`},
+		},
+		"worker": {
+			Role:        vault.Role{BoundServiceAccountNames: []string{"*"}, BoundServiceAccountNamespaces: []string{"pay*"}},
+			source:      platform,
+			aclPolicies: map[string]string{"shared": `path "secret/*" { capabilities = ["read"] }`},
+		},
+	}, nil)
+
+	t.Run("when vault target is role then source is source of the role", func(t *testing.T) {
+
+		assert.Equal(t, payments.auditSource(), a.auditSource(audit.SystemVault, "auth/kubernetes/test-account/test-cluster/role/app"))
+		assert.Equal(t, platform.auditSource(), a.auditSource(audit.SystemVault, "kubernetes/test-account/test-cluster/roles/worker"))
+		assert.Nil(t, a.auditSource(audit.SystemVault, "auth/kubernetes/test-account/test-cluster/role/legacy"))
+		assert.Nil(t, a.auditSource(audit.SystemVault, "auth/kubernetes/other-account/test-cluster/role/app"))
+	})
+
+	t.Run("when acl policy is defined by more roles then source is source of the first role", func(t *testing.T) {
+		assert.Equal(t, payments.auditSource(), a.auditSource(audit.SystemVault, "sys/policies/acl/shared"))
+	})
+
+	t.Run("when kubernetes target is service account then source is source of the first bound role", func(t *testing.T) {
+
+		assert.Equal(t, payments.auditSource(), a.auditSource(audit.SystemKubernetes, "serviceaccounts/payments/app"))
+		assert.Equal(t, platform.auditSource(), a.auditSource(audit.SystemKubernetes, "serviceaccounts/payroll/batch"))
+		assert.Nil(t, a.auditSource(audit.SystemKubernetes, "serviceaccounts/default/app"))
+	})
+
+	t.Run("when role is removed from source then its targets are attributed to the source", func(t *testing.T) {
+
+		roles := a.status.roles
+		defer a.status.setDesired(roles, nil)
+		a.status.setDesired(vaultRoles{"app": roles["app"]}, nil)
+
+		assert.Equal(t, platform.auditSource(), a.auditSource(audit.SystemVault, "auth/kubernetes/test-account/test-cluster/role/worker"))
+		assert.Equal(t, platform.auditSource(), a.auditSource(audit.SystemKubernetes, "serviceaccounts/payroll/batch"))
+		assert.Equal(t, payments.auditSource(), a.auditSource(audit.SystemVault, "sys/policies/acl/shared"))
+	})
+
+	t.Run("when kubernetes target is config map then source is the config map", func(t *testing.T) {
+
+		assert.Equal(t, platform.auditSource(), a.auditSource(audit.SystemKubernetes, "configmaps/vault-auth/vault-auth-roles"))
+		assert.Nil(t, a.auditSource(audit.SystemKubernetes, "clusterrolebindings/vault-auth-token-reviewer"))
+	})
+}
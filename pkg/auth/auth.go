@@ -1,9 +1,19 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"github.com/pete911/vault-auth-kubernetes/pkg/backup"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
 	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,79 +29,352 @@ const (
 	vaultAuthConfigMap           = "vault-auth-roles"
 )
 
+const (
+	// key of last logged vault state in reported map
+	vaultHealthKey = "vault/health"
+
+	reconcileCompleted = "completed"
+	reconcileSkipped   = "skipped"
+)
+
 var (
 	serviceAccountAnnotations = map[string]string{"vak-managed": "true"}
+
+	reconcileMetric = metrics.NewCounter("vak_reconcile_total", "Number of reloads by result (completed or skipped).", "result")
 )
 
 type VaultClient interface {
-	InitAuthKubernetes(k8sHost string, k8sCA []byte, tokenReviewerJWT []byte) error
+	CheckHealth() (vault.Health, error)
+	InitAuthKubernetes(k8sHost string, k8sCA []byte, tokenReviewerJWT []byte, options vault.AuthKubernetesOptions) (bool, error)
+	InitAuthJWT(issuer string, validationPubkeys []string) (bool, error)
 	ListRoles() ([]string, error)
+	ReadRole(name string) (*vault.Role, error)
 	DeleteRole(role string) error
 	CreateRole(namespace string, role vault.Role) error
+	AuthMount() string
+	AuthAccessor() string
+	ReadAuthType() (string, error)
+	ListPolicies() ([]string, error)
+	ReadPolicy(name string) (*vault.Policy, error)
+	WritePolicy(name, policy string) error
+	DeletePolicy(name string) error
+	AuthAliasNameSource() string
+	ListEntities() ([]string, error)
+	ReadEntity(name string) (*vault.Entity, error)
+	WriteEntity(name string, metadata map[string]string) error
+	DeleteEntity(name string) error
+	LookupEntityByAlias(aliasName, mountAccessor string) (*vault.Entity, error)
+	WriteEntityAlias(alias vault.EntityAlias) error
+	DeleteEntityAlias(id string) error
+	ListGroups() ([]string, error)
+	ReadGroup(name string) (*vault.Group, error)
+	WriteGroup(name string, metadata map[string]string, memberEntityIDs []string) error
+	DeleteGroup(name string) error
+	EnsureKVMount(path string) (bool, error)
+	ListKVMetadata(mount, path string) ([]string, error)
+	ReadKVMetadata(mount, path string) (*vault.KVMetadata, error)
+	WriteKVMetadata(mount, path string, metadata vault.KVMetadata) error
+	InitSecretsKubernetes(kubernetesHost string, kubernetesCACert, serviceAccountJWT []byte) (bool, error)
+	ListSecretsRoles() ([]string, error)
+	ReadSecretsRole(name string) (map[string]interface{}, error)
+	WriteSecretsRole(name string, role map[string]interface{}) error
+	DeleteSecretsRole(name string) error
+	ReadAuthKubernetesConfig() (*vault.AuthKubernetesConfig, error)
+	ReadAuthJWTConfig() (*vault.AuthJWTConfig, error)
+	Login(role string, serviceAccountJWT []byte) (vault.LoginResult, error)
+	RevokeToken(token string) error
+	LoginAudience(role vault.Role) string
 }
 
 type K8sClient interface {
 	GetNamespaces() ([]string, error)
-	GetConfigMapData(namespace, name string) (map[string]string, error)
+	GetNamespacesMeta() ([]k8s.Namespace, error)
+	GetConfigMap(namespace, name string) (k8s.ConfigMap, error)
+	GetConfigMaps(labelSelector string) ([]k8s.ConfigMap, error)
+	UpdateConfigMapData(namespace, name, key, value string) error
+	UpdateConfigMapAnnotation(namespace, name, key, value string) error
+	CreateEvent(event k8s.Event) error
 	GetServiceAccounts(namespace string, annotations map[string]string) ([]string, error)
+	GetServiceAccountUIDs(namespace string, annotations map[string]string) (map[string]string, error)
 	DeleteServiceAccount(namespace, serviceAccount string) error
 	CreateServiceAccount(namespace, serviceAccount string, annotations map[string]string) error
 	GetServiceAccountToken(namespace, serviceAccount string) ([]byte, error)
+	CreateServiceAccountToken(namespace, serviceAccount string, audiences []string, expirationSeconds int64) ([]byte, error)
 	CreateAuthDelegatorClusterRoleBinding(bindingName, namespace, serviceAccount string) error
+	CreateClusterRoleBinding(bindingName, clusterRole, namespace, serviceAccount string) error
+	GetServiceAccountIssuer() (k8s.ServiceAccountIssuer, error)
+}
+
+// snapshot of vault auth mount, taken before vault roles are deleted
+type Backup interface {
+	Snapshot(reason string) (backup.Snapshot, error)
+}
+
+// audit log of vault and kubernetes mutations, auth resolves role source that caused mutation
+type Audit interface {
+	SetSources(sources func(system, target string) *audit.Source)
 }
 
 type Config struct {
 	VaultMount string
 	K8sHost    string
 	K8sCA      []byte
+	// CA is re-read from the file on every reload when set, so rotated cluster CA is pushed to vault
+	K8sCAFile string
+	// tenant roles from labelled config maps are enabled when at least one allowed policy (glob pattern) is set
+	TenantAllowedPolicies []string
+	// role file and directory, roles from files are added to roles from config map
+	RolesFile string
+	RolesDir  string
+	// rules evaluated before roles are created, roles that violate any rule are skipped
+	Guardrails Guardrails
+	// number of concurrent namespace and role operations, operations are sequential if not set
+	Workers int
+	// how often are vault roles listed and read to detect drift, roles are verified on every reload if not set
+	RoleVerifyInterval time.Duration
+	// snapshot is taken before roles are deleted, roles are not deleted if snapshot fails, snapshots are disabled if nil
+	Backup Backup
+	// acl policies defined by roles are written to vault and deleted when no role defines them, roles with token
+	// policies that do not exist in vault are reported
+	ACLPolicies bool
+	// directory with acl policy (.hcl) files written with acl policies of roles, used only if ACLPolicies is set
+	PoliciesDir string
+	// identity entities (with entity aliases) are written for managed service accounts and identity groups for
+	// namespaces, or for values of namespace label if IdentityGroupLabel is set
+	Identity           bool
+	IdentityGroupLabel string
+	// kv version 2 base path with metadata is written for every namespace with vault role, paths of namespaces without
+	// roles are marked as orphaned, kv bootstrap is disabled if nil
+	KVBootstrap *KVBootstrap
+	// kubernetes secrets engine is mounted at the same path as auth mount and configured with service account bound to
+	// SecretsEngineClusterRole, secrets engine roles are written for vault roles with secrets_engine_role
+	SecretsEngine            bool
+	SecretsEngineClusterRole string
+	// auth method type (kubernetes or jwt), jwt auth validates service account tokens with cluster signing keys, there
+	// is no token reviewer, issuer and keys are discovered from API server if JWTIssuer and JWTKeysFile are not set
+	AuthType    string
+	JWTIssuer   string
+	JWTKeysFile string
+	// service account signing public keys are written to auth kubernetes config (pem_keys) when PEMKeys is set, keys are
+	// read from PEMKeysFile or API server jwks on every reload, so rotated keys are pushed to vault
+	PEMKeys              bool
+	PEMKeysFile          string
+	Issuer               string
+	DisableISSValidation bool
+	DisableLocalCAJWT    bool
+	// every written vault role is verified by login with short-lived token of bound service account, result is set on
+	// config map annotation, failed logins are reported as events and verified again on every role verification
+	LoginVerification bool
+	// number of the last reload results kept for status, 10 if not set
+	StatusHistory int
+	// audit log of mutations made by clients, records are not attributed to role sources if nil
+	Audit Audit
 }
 
 type Auth struct {
 	config      Config
 	vaultClient VaultClient
 	k8sClient   K8sClient
+	// last reported event message by source and reason
+	reported *reportedMessages
+	// last known vault roles
+	cache *roleCache
+	// last applied vault roles, to tell vault role changes made outside of this application
+	drift *roleDrift
+	// acl policies written by this application
+	policies *policyState
+	// identity entities and groups written by this application
+	identity *identityState
+	// kv base paths written by this application
+	kv *kvState
+	// kubernetes secrets engine roles written by this application
+	secretsEngine *secretsEngineState
+	// vault roles to verify by login
+	login *loginState
+	// desired state, errors and results of the last reloads
+	status *statusState
 }
 
 func NewAuth(config Config, vaultClient VaultClient, k8sClient K8sClient) Auth {
 
-	return Auth{
-		config:      config,
-		vaultClient: vaultClient,
-		k8sClient:   k8sClient,
+	a := Auth{
+		config:        config,
+		vaultClient:   vaultClient,
+		k8sClient:     k8sClient,
+		reported:      newReportedMessages(),
+		cache:         newRoleCache(config.RoleVerifyInterval),
+		drift:         newRoleDrift(),
+		policies:      newPolicyState(),
+		identity:      newIdentityState(),
+		kv:            newKVState(),
+		secretsEngine: newSecretsEngineState(),
+		login:         newLoginState(),
+		status:        newStatusState(config.StatusHistory),
 	}
+	if config.Audit != nil {
+		config.Audit.SetSources(a.auditSource)
+	}
+	return a
 }
 
 func (a Auth) Run() error {
 
-	if err := a.initTokenReviewer(); err != nil {
+	var token []byte
+	if a.config.AuthType != vault.AuthTypeJWT {
+		var err error
+		if token, err = a.initTokenReviewer(); err != nil {
+			return err
+		}
+	}
+	if err := a.initAuth(token); err != nil {
 		return err
 	}
 
 	for {
-		a.initServiceAccounts()
+		a.reconcile(token)
 		<-time.After(time.Duration(vaultAuthConfigReloadSeconds) * time.Second)
 	}
 }
 
+// one reload, skipped when vault is sealed or not reachable (e.g. during failover)
+func (a Auth) reconcile(tokenReviewerJWT []byte) {
+
+	start := time.Now()
+	if tokenReviewerJWT != nil {
+		a.status.setReviewerToken(tokenReviewerJWT)
+	}
+	if !a.vaultReady() {
+		reconcileMetric.Inc(reconcileSkipped)
+		a.status.finishReload(start, reconcileSkipped, a.reported.get(vaultHealthKey))
+		return
+	}
+	// vault auth can be lost (e.g. vault restored from old snapshot), kubernetes CA or signing keys rotated
+	if err := a.initAuth(tokenReviewerJWT); err != nil {
+		logger.Errorf("init vault auth %s: %v", a.authType(), err)
+		a.status.reloadError("init vault auth %s: %v", a.authType(), err)
+	}
+	if err := a.initSecretsEngine(); err != nil {
+		logger.Errorf("init vault kubernetes secrets engine: %v", err)
+		a.status.reloadError("init vault kubernetes secrets engine: %v", err)
+	}
+	a.initServiceAccounts()
+	reconcileMetric.Inc(reconcileCompleted)
+	a.status.finishReload(start, reconcileCompleted)
+}
+
+// vault is ready when unsealed active or standby node is reachable, vault state is logged only when it changes
+func (a Auth) vaultReady() bool {
+
+	health, err := a.vaultClient.CheckHealth()
+	var state string
+	switch {
+	case err != nil:
+		state = fmt.Sprintf("vault is not reachable, skipping reload: %v", err)
+	case health.Sealed:
+		state = fmt.Sprintf("vault %s is sealed, skipping reload", health.Host)
+	case health.Standby:
+		state = fmt.Sprintf("no active vault node found, using standby %s", health.Host)
+	default:
+		state = fmt.Sprintf("vault %s is active", health.Host)
+	}
+
+	if a.reported.set(vaultHealthKey, state) {
+		if err != nil || health.Sealed {
+			logger.Error(state)
+		} else {
+			logger.Log(state)
+		}
+	}
+	return err == nil && !health.Sealed
+}
+
 func (a Auth) initServiceAccounts() {
 
-	data, err := a.k8sClient.GetConfigMapData(vaultAuthConfigNamespace, vaultAuthConfigMap)
+	configMap, err := a.k8sClient.GetConfigMap(vaultAuthConfigNamespace, vaultAuthConfigMap)
 	if err != nil {
 		logger.Errorf("get vault auth kubernetes roles from config map %s in %s namespace: %v",
 			vaultAuthConfigMap, vaultAuthConfigNamespace, err)
 		return
 	}
 
-	vaultRoles := newVaultRoles(data)
+	definitions, violations := configMapRoleDefinitions(configMap)
+	vaultRoles, templates := a.newRoles(newConfigMapSource(configMap), definitions, violations)
+
+	fileRoles, fileTemplates, err := a.getFileRoles()
+	if err != nil {
+		// stop here, otherwise roles from files would be deleted
+		logger.Errorf("get roles from files: %v", err)
+		return
+	}
+	vaultRoles.merge(fileRoles)
+	templates = append(templates, fileTemplates...)
+
+	var namespaces []k8s.Namespace
+	if len(templates) != 0 || a.config.Guardrails.hasNamespaceLabels() {
+		namespaces, err = a.k8sClient.GetNamespacesMeta()
+		if err != nil {
+			// stop here, otherwise roles rendered from templates would be deleted
+			logger.Errorf("get namespaces: %v", err)
+			return
+		}
+	}
+	vaultRoles.merge(templates.expand(namespaces))
+
+	if len(a.config.TenantAllowedPolicies) != 0 {
+		tenantRoles, err := a.getTenantRoles(vaultRoles)
+		if err != nil {
+			// stop here, otherwise tenant roles would be deleted
+			logger.Errorf("get tenant roles: %v", err)
+			return
+		}
+		vaultRoles.merge(tenantRoles)
+	}
 	serviceAccountsSetByNamespace := vaultRoles.getServiceAccountsSetByNamespace()
+	a.status.setDesired(vaultRoles, serviceAccountsSetByNamespace)
+	allowedRoles := a.applyGuardrails(vaultRoles, namespaces)
+	allowedServiceAccountsSetByNamespace := allowedRoles.getServiceAccountsSetByNamespace()
 
-	// delete service accounts and roles that are not in vault role config map
+	// each step fans out to workers, but steps run in order: deletes before creates and service accounts before roles,
+	// delete service accounts and roles that are not in vault role config map, denied roles are left as they are
+	verify := a.cache.start(time.Now())
 	a.deleteServiceAccounts(serviceAccountsSetByNamespace, serviceAccountAnnotations)
-	a.deleteVaultRoles(vaultRoles)
+	a.deleteVaultRoles(vaultRoles, verify)
+
+	// create service accounts, identity entities, acl policies and roles of allowed roles
+	a.createServiceAccounts(allowedServiceAccountsSetByNamespace)
+	a.reconcileIdentity(allowedServiceAccountsSetByNamespace, serviceAccountsSetByNamespace, namespaces, verify)
+	a.reconcilePolicies(vaultRoles, allowedRoles, verify)
+	a.createVaultRoles(allowedRoles)
+	a.verifyLogins(allowedRoles, verify)
+	a.reconcileSecretsEngine(allowedRoles, verify)
+	a.bootstrapKV(allowedRoles, namespaces, verify)
+	a.cache.finish()
+}
 
-	// create service accounts and roles that are in vault role config map
-	a.createServiceAccounts(serviceAccountsSetByNamespace)
-	a.createVaultRoles(vaultRoles)
+// roles and role templates from definitions, invalid definitions are reported on the source
+func (a Auth) newRoles(source roleSource, definitions []roleDefinition, violations []string) (vaultRoles, roleTemplates) {
+
+	roles, invalidRoles := newVaultRoles(source, definitions)
+	templates, invalidTemplates := newRoleTemplates(source, definitions)
+	a.report(source, eventReasonInvalidRole, append(append(violations, invalidRoles...), invalidTemplates...))
+	return roles, templates
+}
+
+func (a Auth) getFileRoles() (vaultRoles, roleTemplates, error) {
+
+	files, err := readRoleFiles(a.config.RolesFile, a.config.RolesDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roles := make(vaultRoles)
+	var templates roleTemplates
+	for _, file := range files {
+		fileRoles, fileTemplates := a.newRoles(file.source, file.definitions, file.violations)
+		roles.merge(fileRoles)
+		templates = append(templates, fileTemplates...)
+	}
+	return roles, templates, nil
 }
 
 func (a Auth) deleteServiceAccounts(serviceAccountsSetByNamespace map[string]map[string]struct{}, serviceAccountAnnotations map[string]string) {
@@ -102,11 +385,11 @@ func (a Auth) deleteServiceAccounts(serviceAccountsSetByNamespace map[string]map
 		return
 	}
 
-	for _, k8sNamespace := range k8sNamespaces {
+	util.ForEach(a.config.Workers, k8sNamespaces, func(k8sNamespace string) {
 		k8sServiceAccounts, err := a.k8sClient.GetServiceAccounts(k8sNamespace, serviceAccountAnnotations)
 		if err != nil {
 			logger.Errorf("get service accounts: %v", err)
-			continue
+			return
 		}
 		for _, k8sServiceAccount := range k8sServiceAccounts {
 			serviceAccountsSet, ok := serviceAccountsSetByNamespace[k8sNamespace]
@@ -114,7 +397,7 @@ func (a Auth) deleteServiceAccounts(serviceAccountsSetByNamespace map[string]map
 			if !ok {
 				if err := a.k8sClient.DeleteServiceAccount(k8sNamespace, k8sServiceAccount); err != nil {
 					logger.Errorf("service account %s in %s namespace is not in config: delete service account: %v",
-						k8sServiceAccount, k8sNamespaces, err)
+						k8sServiceAccount, k8sNamespace, err)
 				}
 				continue
 			}
@@ -125,24 +408,47 @@ func (a Auth) deleteServiceAccounts(serviceAccountsSetByNamespace map[string]map
 				}
 			}
 		}
-	}
+	})
 }
 
-func (a Auth) deleteVaultRoles(vaultRolesInConfig vaultRoles) {
+// delete roles that are not in config, roles are listed from vault only when verify is true, otherwise roles from
+// cache are used
+func (a Auth) deleteVaultRoles(vaultRolesInConfig vaultRoles, verify bool) {
 
-	vaultRolesInVault, err := a.vaultClient.ListRoles()
-	if err != nil {
-		logger.Errorf("delete vault roles: list roles: %v", err)
-		return
+	vaultRolesInVault := a.cache.names()
+	if verify {
+		var err error
+		if vaultRolesInVault, err = a.vaultClient.ListRoles(); err != nil {
+			logger.Errorf("delete vault roles: list roles: %v", err)
+			return
+		}
 	}
 
+	var deleted []string
 	for _, vaultRoleInVault := range vaultRolesInVault {
 		if _, ok := vaultRolesInConfig[vaultRoleInVault]; !ok {
-			if err := a.vaultClient.DeleteRole(vaultRoleInVault); err != nil {
-				logger.Errorf("delete vault role: %v", err)
-			}
+			deleted = append(deleted, vaultRoleInVault)
+		}
+	}
+	if len(deleted) != 0 && a.config.Backup != nil {
+		_, err := a.config.Backup.Snapshot(fmt.Sprintf("delete roles %s", strings.Join(deleted, ", ")))
+		switch {
+		case errors.Is(err, backup.ErrNotMounted):
+			// roles in cache are gone with the mount, there is nothing to back up
+			logger.Logf("delete vault roles: snapshot is not taken: %v", err)
+		case err != nil:
+			logger.Errorf("delete vault roles: snapshot failed, roles %v are not deleted: %v", deleted, err)
+			return
 		}
 	}
+	util.ForEach(a.config.Workers, deleted, func(role string) {
+		if err := a.vaultClient.DeleteRole(role); err != nil {
+			logger.Errorf("delete vault role: %v", err)
+			return
+		}
+		a.cache.remove(role)
+		a.drift.remove(role)
+	})
 }
 
 func (a Auth) createServiceAccounts(serviceAccountsSetByNamespace map[string]map[string]struct{}) {
@@ -152,37 +458,238 @@ func (a Auth) createServiceAccounts(serviceAccountsSetByNamespace map[string]map
 		logger.Errorf("create service accounts: get namespaces: %v", err)
 	}
 
-	for _, k8sNamespace := range k8sNamespaces {
+	util.ForEach(a.config.Workers, k8sNamespaces, func(k8sNamespace string) {
 		for serviceAccount := range serviceAccountsSetByNamespace[k8sNamespace] {
 			if err := a.k8sClient.CreateServiceAccount(k8sNamespace, serviceAccount, serviceAccountAnnotations); err != nil {
 				logger.Errorf("create service account: %v", err)
 			}
 		}
-	}
+	})
 }
 
+// create roles that are not in vault or differ from vault role, roles changed in vault outside of this application are
+// handled by drift policy of the role and reported on the role source
 func (a Auth) createVaultRoles(vaultRolesInConfig vaultRoles) {
 
-	for roleName, role := range vaultRolesInConfig {
-		if err := a.vaultClient.CreateRole(roleName, role); err != nil {
-			logger.Errorf("create vault role: %v", err)
+	var roleNames []string
+	for roleName := range vaultRolesInConfig {
+		roleNames = append(roleNames, roleName)
+	}
+	sort.Strings(roleNames)
+
+	var mu sync.Mutex
+	drifts := make(map[roleSource][]string)
+	util.ForEach(a.config.Workers, roleNames, func(roleName string) {
+		if message := a.createVaultRole(roleName, vaultRolesInConfig[roleName]); message != "" {
+			mu.Lock()
+			defer mu.Unlock()
+			source := vaultRolesInConfig[roleName].source
+			drifts[source] = append(drifts[source], message)
+		}
+	})
+
+	// files are not kubernetes objects, drift is only logged
+	for _, role := range vaultRolesInConfig {
+		if role.source.kind != fileSourceKind {
+			a.report(role.source, eventReasonRoleDrift, drifts[role.source])
+		}
+	}
+}
+
+// create vault role, returns drift message if vault role was changed outside of this application
+func (a Auth) createVaultRole(roleName string, role vaultRole) string {
+
+	hash := role.Hash()
+	if a.cache.hit(roleName, hash) {
+		return ""
+	}
+
+	vaultValue, err := a.vaultClient.ReadRole(roleName)
+	if err != nil {
+		logger.Errorf("read vault role: %v", err)
+		a.status.roleFailed(roleName, fmt.Errorf("read vault role: %w", err))
+		return ""
+	}
+	if vaultValue != nil {
+		diff := role.Diff(*vaultValue)
+		if len(diff) == 0 {
+			a.drift.setApplied(roleName, hash)
+			a.cache.set(roleName, hash)
+			a.status.roleApplied(roleName)
+			return ""
+		}
+		if a.drift.drifted(roleName, *vaultValue) {
+			return a.handleDrift(roleName, role, *vaultValue, diff)
+		}
+		if !a.drift.known(roleName) && role.driftPolicy != driftPolicyEnforce {
+			return a.handleUnknownDrift(roleName, role, diff)
 		}
 	}
+
+	if err := a.vaultClient.CreateRole(roleName, role.Role); err != nil {
+		logger.Errorf("create vault role: %v", err)
+		a.status.roleFailed(roleName, fmt.Errorf("create vault role: %w", err))
+		return ""
+	}
+	a.drift.setApplied(roleName, hash)
+	a.cache.set(roleName, hash)
+	a.status.roleApplied(roleName)
+	a.roleWritten(roleName)
+	return ""
 }
 
-func (a Auth) initTokenReviewer() error {
+// token of token reviewer service account, it is not stored in snapshots, restore re-supplies it to auth config
+func TokenReviewerJWT(k8sClient K8sClient) ([]byte, error) {
+	return k8sClient.GetServiceAccountToken(tokenReviewerNamespace, tokenReviewerServiceAccount)
+}
+
+// token reviewer service account with auth delegator role, returns service account token
+func (a Auth) initTokenReviewer() ([]byte, error) {
 
 	if err := a.k8sClient.CreateServiceAccount(tokenReviewerNamespace, tokenReviewerServiceAccount, nil); err != nil {
-		return fmt.Errorf("create service account: %w", err)
+		return nil, fmt.Errorf("create service account: %w", err)
 	}
 
 	token, err := a.k8sClient.GetServiceAccountToken(tokenReviewerNamespace, tokenReviewerServiceAccount)
 	if err != nil {
-		return fmt.Errorf("get service account token: %w", err)
+		return nil, fmt.Errorf("get service account token: %w", err)
 	}
 
 	if err := a.k8sClient.CreateAuthDelegatorClusterRoleBinding(tokenReviewerClusterRoleBinding, tokenReviewerNamespace, tokenReviewerServiceAccount); err != nil {
-		return fmt.Errorf("create auth delegator cluster role binding: %w", err)
+		return nil, fmt.Errorf("create auth delegator cluster role binding: %w", err)
+	}
+	return token, nil
+}
+
+// mount and configure vault auth of configured auth type
+func (a Auth) initAuth(tokenReviewerJWT []byte) error {
+
+	if a.config.AuthType == vault.AuthTypeJWT {
+		return a.initAuthJWT()
+	}
+	return a.initAuthKubernetes(tokenReviewerJWT)
+}
+
+// mount and configure vault auth kubernetes, vault is updated only if kubernetes host, CA or options have changed
+func (a Auth) initAuthKubernetes(tokenReviewerJWT []byte) error {
+
+	ca, err := a.k8sCA()
+	if err != nil {
+		return err
+	}
+	options, err := a.authKubernetesOptions()
+	if err != nil {
+		return err
+	}
+	mounted, err := a.vaultClient.InitAuthKubernetes(a.config.K8sHost, ca, tokenReviewerJWT, options)
+	if mounted {
+		// auth was mounted again, roles in vault are gone
+		a.cache.clear()
+	}
+	return err
+}
+
+// CA is re-read from the file on every call when K8sCAFile is set
+func (a Auth) k8sCA() ([]byte, error) {
+
+	if a.config.K8sCAFile == "" {
+		return a.config.K8sCA, nil
+	}
+	ca, err := os.ReadFile(a.config.K8sCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read kubernetes CA: %w", err)
+	}
+	return ca, nil
+}
+
+// mount and configure vault jwt auth, vault is updated only if issuer or signing keys have changed
+func (a Auth) initAuthJWT() error {
+
+	issuer, keys, err := a.serviceAccountIssuer()
+	if err != nil {
+		return err
+	}
+	mounted, err := a.vaultClient.InitAuthJWT(issuer, keys)
+	if mounted {
+		// auth was mounted again, roles in vault are gone
+		a.cache.clear()
+	}
+	return err
+}
+
+// auth kubernetes options from config, pem keys are read only if PEMKeys is set
+func (a Auth) authKubernetesOptions() (vault.AuthKubernetesOptions, error) {
+
+	options := vault.AuthKubernetesOptions{
+		Issuer:               a.config.Issuer,
+		DisableISSValidation: a.config.DisableISSValidation,
+		DisableLocalCAJWT:    a.config.DisableLocalCAJWT,
+	}
+	if !a.config.PEMKeys {
+		return options, nil
+	}
+	keys, err := a.keysFile(a.config.PEMKeysFile)
+	if err != nil {
+		return options, err
+	}
+	if len(keys) == 0 {
+		discovered, err := a.k8sClient.GetServiceAccountIssuer()
+		if err != nil {
+			return options, fmt.Errorf("get service account issuer: %w", err)
+		}
+		keys = discovered.Keys
+	}
+	options.PEMKeys = keys
+	return options, nil
+}
+
+// issuer and keys from config (keys are re-read from the file on every call), API server discovery is used only for
+// values that are not configured
+func (a Auth) serviceAccountIssuer() (string, []string, error) {
+
+	issuer := a.config.JWTIssuer
+	keys, err := a.keysFile(a.config.JWTKeysFile)
+	if err != nil {
+		return "", nil, err
+	}
+	if issuer != "" && len(keys) != 0 {
+		return issuer, keys, nil
+	}
+
+	discovered, err := a.k8sClient.GetServiceAccountIssuer()
+	if err != nil {
+		return "", nil, fmt.Errorf("get service account issuer: %w", err)
+	}
+	if issuer == "" {
+		issuer = discovered.Issuer
+	}
+	if len(keys) == 0 {
+		keys = discovered.Keys
+	}
+	return issuer, keys, nil
+}
+
+// PEM encoded public keys from the file, no keys if file is not set
+func (a Auth) keysFile(file string) ([]string, error) {
+
+	if file == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read keys: %w", err)
+	}
+	keys, err := k8s.ParsePEMKeys(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return keys, nil
+}
+
+func (a Auth) authType() string {
+
+	if a.config.AuthType == "" {
+		return vault.AuthTypeKubernetes
 	}
-	return a.vaultClient.InitAuthKubernetes(a.config.K8sHost, a.config.K8sCA, token)
+	return a.config.AuthType
 }
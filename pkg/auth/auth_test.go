@@ -2,9 +2,13 @@ package auth
 
 import (
 	"errors"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
 	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,24 +18,35 @@ var testConfig = Config{
 	K8sCA:      []byte("--- CA ---"),
 }
 
+const testPublicKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEecMQHYgBM7n0J8zXYxAwYG9FtSkK
+nXQLRX8bZcZYHgDALSq/9KQvrYu8r/IPv0QioGO/eQ/1vnh4MCkX/4Aa+Q==
+-----END PUBLIC KEY-----
+`
+
+// service account signing key added during key rotation
+const testRotatedPublicKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAErfniHqQx/Gvibd6gw3kU+AYFez6c
+MqzUddlsfTphbOJWEOPZbbAb906UnzoSKW4xCFgczcHNuu76r3ZtKpNM+Q==
+-----END PUBLIC KEY-----
+`
+
 func TestAuth_initTokenReviewer(t *testing.T) {
 
 	token := []byte("test token")
 	var emptyAnnotations map[string]string
 
-	t.Run("when kube service account and vault auth requests are successful then no error is return", func(t *testing.T) {
+	t.Run("when kube service account requests are successful then token is returned", func(t *testing.T) {
 
-		vaultClient := new(VaultClientMock)
-		vaultClient.On("InitAuthKubernetes", testConfig.K8sHost, testConfig.K8sCA, token).Return(nil)
 		k8sClient := new(K8sClientMock)
 		k8sClient.On("CreateServiceAccount", tokenReviewerNamespace, tokenReviewerServiceAccount, emptyAnnotations).Return(nil)
 		k8sClient.On("GetServiceAccountToken", tokenReviewerNamespace, tokenReviewerServiceAccount).Return(token, nil)
 		k8sClient.On("CreateAuthDelegatorClusterRoleBinding", tokenReviewerClusterRoleBinding, tokenReviewerNamespace, tokenReviewerServiceAccount).Return(nil)
 
-		a := NewAuth(testConfig, vaultClient, k8sClient)
-		err := a.initTokenReviewer()
+		a := NewAuth(testConfig, nil, k8sClient)
+		reviewerToken, err := a.initTokenReviewer()
 		require.NoError(t, err)
-		vaultClient.AssertExpectations(t)
+		assert.Equal(t, token, reviewerToken)
 		k8sClient.AssertExpectations(t)
 	})
 
@@ -41,7 +56,7 @@ func TestAuth_initTokenReviewer(t *testing.T) {
 		k8sClient.On("CreateServiceAccount", tokenReviewerNamespace, tokenReviewerServiceAccount, emptyAnnotations).Return(errors.New("cannot create service account"))
 
 		a := NewAuth(testConfig, nil, k8sClient)
-		err := a.initTokenReviewer()
+		_, err := a.initTokenReviewer()
 		require.Error(t, err)
 		k8sClient.AssertExpectations(t)
 	})
@@ -53,7 +68,7 @@ func TestAuth_initTokenReviewer(t *testing.T) {
 		k8sClient.On("GetServiceAccountToken", tokenReviewerNamespace, tokenReviewerServiceAccount).Return(nil, errors.New("cannot retrieve kube token"))
 
 		a := NewAuth(testConfig, nil, k8sClient)
-		err := a.initTokenReviewer()
+		_, err := a.initTokenReviewer()
 		require.Error(t, err)
 		k8sClient.AssertExpectations(t)
 	})
@@ -66,12 +81,200 @@ func TestAuth_initTokenReviewer(t *testing.T) {
 		k8sClient.On("CreateAuthDelegatorClusterRoleBinding", tokenReviewerClusterRoleBinding, tokenReviewerNamespace, tokenReviewerServiceAccount).Return(errors.New("cannot create binding"))
 
 		a := NewAuth(testConfig, nil, k8sClient)
-		err := a.initTokenReviewer()
+		_, err := a.initTokenReviewer()
 		require.Error(t, err)
 		k8sClient.AssertExpectations(t)
 	})
 }
 
+func TestAuth_initAuthKubernetes(t *testing.T) {
+
+	token := []byte("test token")
+
+	t.Run("when kubernetes CA file is not set then CA from config is used", func(t *testing.T) {
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("InitAuthKubernetes", testConfig.K8sHost, testConfig.K8sCA, token, vault.AuthKubernetesOptions{}).Return(false, nil)
+
+		a := NewAuth(testConfig, vaultClient, nil)
+		require.NoError(t, a.initAuthKubernetes(token))
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when kubernetes CA file is set then CA is read from the file", func(t *testing.T) {
+
+		caFile := filepath.Join(t.TempDir(), "ca.crt")
+		require.NoError(t, os.WriteFile(caFile, []byte("--- rotated CA ---"), 0600))
+		config := testConfig
+		config.K8sCAFile = caFile
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("InitAuthKubernetes", testConfig.K8sHost, []byte("--- rotated CA ---"), token, vault.AuthKubernetesOptions{}).Return(false, nil)
+
+		a := NewAuth(config, vaultClient, nil)
+		require.NoError(t, a.initAuthKubernetes(token))
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when kubernetes CA file cannot be read then error is returned", func(t *testing.T) {
+
+		config := testConfig
+		config.K8sCAFile = filepath.Join(t.TempDir(), "missing.crt")
+
+		a := NewAuth(config, new(VaultClientMock), nil)
+		require.Error(t, a.initAuthKubernetes(token))
+	})
+
+	t.Run("when pem keys are set without keys file then keys are discovered from API server", func(t *testing.T) {
+
+		config := testConfig
+		config.PEMKeys, config.Issuer, config.DisableLocalCAJWT = true, "https://kubernetes.default.svc", true
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetServiceAccountIssuer").Return(k8s.ServiceAccountIssuer{Issuer: "https://kubernetes.default.svc", Keys: []string{"key-1", "key-2"}}, nil)
+		expectedOptions := vault.AuthKubernetesOptions{PEMKeys: []string{"key-1", "key-2"}, Issuer: "https://kubernetes.default.svc", DisableLocalCAJWT: true}
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("InitAuthKubernetes", testConfig.K8sHost, testConfig.K8sCA, token, expectedOptions).Return(false, nil)
+
+		a := NewAuth(config, vaultClient, k8sClient)
+		require.NoError(t, a.initAuthKubernetes(token))
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when pem keys file is set then keys are read from the file", func(t *testing.T) {
+
+		keysFile := filepath.Join(t.TempDir(), "sa.pub")
+		require.NoError(t, os.WriteFile(keysFile, []byte(testPublicKey), 0600))
+		config := testConfig
+		config.PEMKeys, config.PEMKeysFile, config.DisableISSValidation = true, keysFile, true
+		vaultClient := new(VaultClientMock)
+		expectedOptions := vault.AuthKubernetesOptions{PEMKeys: []string{testPublicKey}, DisableISSValidation: true}
+		vaultClient.On("InitAuthKubernetes", testConfig.K8sHost, testConfig.K8sCA, token, expectedOptions).Return(false, nil)
+
+		a := NewAuth(config, vaultClient, new(K8sClientMock))
+		require.NoError(t, a.initAuthKubernetes(token))
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when pem keys cannot be discovered then error is returned and auth is not configured", func(t *testing.T) {
+
+		config := testConfig
+		config.PEMKeys = true
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetServiceAccountIssuer").Return(k8s.ServiceAccountIssuer{}, errors.New("forbidden"))
+		vaultClient := new(VaultClientMock)
+
+		a := NewAuth(config, vaultClient, k8sClient)
+		require.Error(t, a.initAuthKubernetes(token))
+		vaultClient.AssertNotCalled(t, "InitAuthKubernetes", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestAuth_initAuthJWT(t *testing.T) {
+
+	discovered := k8s.ServiceAccountIssuer{Issuer: "https://kubernetes.default.svc", Keys: []string{"discovered key"}}
+
+	t.Run("when issuer and keys file are not set then they are discovered from API server", func(t *testing.T) {
+
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetServiceAccountIssuer").Return(discovered, nil)
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("InitAuthJWT", discovered.Issuer, discovered.Keys).Return(false, nil)
+
+		config := testConfig
+		config.AuthType = vault.AuthTypeJWT
+		a := NewAuth(config, vaultClient, k8sClient)
+		require.NoError(t, a.initAuth(nil))
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when issuer and keys file are set then API server is not called", func(t *testing.T) {
+
+		keysFile := filepath.Join(t.TempDir(), "sa.pub")
+		require.NoError(t, os.WriteFile(keysFile, []byte(testPublicKey), 0600))
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("InitAuthJWT", "https://issuer", []string{testPublicKey}).Return(false, nil)
+
+		config := testConfig
+		config.AuthType = vault.AuthTypeJWT
+		config.JWTIssuer = "https://issuer"
+		config.JWTKeysFile = keysFile
+		a := NewAuth(config, vaultClient, new(K8sClientMock))
+		require.NoError(t, a.initAuth(nil))
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when only issuer is set then keys are discovered from API server", func(t *testing.T) {
+
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetServiceAccountIssuer").Return(discovered, nil)
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("InitAuthJWT", "https://issuer", discovered.Keys).Return(false, nil)
+
+		config := testConfig
+		config.AuthType = vault.AuthTypeJWT
+		config.JWTIssuer = "https://issuer"
+		a := NewAuth(config, vaultClient, k8sClient)
+		require.NoError(t, a.initAuth(nil))
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when keys file does not have public keys then error is returned", func(t *testing.T) {
+
+		keysFile := filepath.Join(t.TempDir(), "sa.pub")
+		require.NoError(t, os.WriteFile(keysFile, []byte("not a key"), 0600))
+
+		config := testConfig
+		config.AuthType = vault.AuthTypeJWT
+		config.JWTIssuer = "https://issuer"
+		config.JWTKeysFile = keysFile
+		a := NewAuth(config, new(VaultClientMock), new(K8sClientMock))
+		require.Error(t, a.initAuth(nil))
+	})
+}
+
+func TestAuth_reconcile(t *testing.T) {
+
+	t.Run("when vault is sealed then reload is skipped", func(t *testing.T) {
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("CheckHealth").Return(vault.Health{Host: "https://vault", Initialized: true, Sealed: true}, nil)
+		k8sClient := new(K8sClientMock)
+
+		a := NewAuth(testConfig, vaultClient, k8sClient)
+		a.reconcile([]byte("test token"))
+		vaultClient.AssertExpectations(t)
+		k8sClient.AssertExpectations(t)
+		assert.Equal(t, "vault https://vault is sealed, skipping reload", a.reported.get(vaultHealthKey))
+	})
+
+	t.Run("when vault is not reachable then reload is skipped", func(t *testing.T) {
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("CheckHealth").Return(vault.Health{}, errors.New("no vault host is reachable"))
+		k8sClient := new(K8sClientMock)
+
+		a := NewAuth(testConfig, vaultClient, k8sClient)
+		a.reconcile([]byte("test token"))
+		vaultClient.AssertExpectations(t)
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when vault is active then vault auth is initialised and roles are reloaded", func(t *testing.T) {
+
+		token := []byte("test token")
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("CheckHealth").Return(vault.Health{Host: "https://vault", Initialized: true}, nil)
+		vaultClient.On("InitAuthKubernetes", testConfig.K8sHost, testConfig.K8sCA, token, vault.AuthKubernetesOptions{}).Return(false, nil).Once()
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{}, errors.New("config map not found")).Once()
+
+		a := NewAuth(testConfig, vaultClient, k8sClient)
+		a.reconcile(token)
+		vaultClient.AssertExpectations(t)
+		k8sClient.AssertExpectations(t)
+	})
+}
+
 func TestAuth_initServiceAccounts(t *testing.T) {
 
 	t.Run("when vault auth kubernetes config map contains namespaces with vault-policies then vault roles and kube service accounts are updated", func(t *testing.T) {
@@ -84,10 +287,11 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return([]string{"role1", "role3"}, nil)
 		vaultClient.On("DeleteRole", "role3").Return(nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
 		vaultClient.On("CreateRole", "role1", mock.Anything).Return(nil)
 		vaultClient.On("CreateRole", "role2", mock.Anything).Return(nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{"kube-system", "test", "default"}, nil)
 		k8sClient.On("GetServiceAccounts", "test", serviceAccountAnnotations).Return([]string{"vault-agent-injector", "default"}, nil)
 		k8sClient.On("GetServiceAccounts", "kube-system", serviceAccountAnnotations).Return([]string{"vault-agent-injector"}, nil)
@@ -104,11 +308,193 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		k8sClient.AssertExpectations(t)
 	})
 
+	t.Run("when config map contains role template then roles are created for matching namespaces and roles of deleted namespaces are removed", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"namespaces": `{"template": {"role_name": "ns-{{.Namespace}}"}, "bound_service_account_names": ["vault-agent-injector"], "token_policies": ["{{.Namespace}}"]}`,
+		}
+		expectedRole := vault.Role{
+			BoundServiceAccountNames:      []string{"vault-agent-injector"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"payments"},
+		}
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ListRoles").Return([]string{"ns-payments", "ns-deleted"}, nil)
+		vaultClient.On("DeleteRole", "ns-deleted").Return(nil).Once()
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
+		vaultClient.On("CreateRole", "ns-payments", expectedRole).Return(nil).Once()
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
+		k8sClient.On("GetNamespacesMeta").Return([]k8s.Namespace{{Name: "payments"}}, nil)
+		k8sClient.On("GetNamespaces").Return([]string{"payments"}, nil)
+		k8sClient.On("GetServiceAccounts", "payments", serviceAccountAnnotations).Return(nil, nil)
+		k8sClient.On("CreateServiceAccount", "payments", "vault-agent-injector", serviceAccountAnnotations).Return(nil).Once()
+
+		a := NewAuth(testConfig, vaultClient, k8sClient)
+		a.initServiceAccounts()
+		vaultClient.AssertExpectations(t)
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when config map contains role template and get namespaces fails then kube and vault are not updated", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"namespaces": `{"template": {"role_name": "ns-{{.Namespace}}"}, "bound_service_account_names": ["vault-agent-injector"], "token_policies": ["{{.Namespace}}"]}`,
+		}
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
+		k8sClient.On("GetNamespacesMeta").Return(nil, errors.New("test failure"))
+
+		a := NewAuth(testConfig, nil, k8sClient)
+		a.initServiceAccounts()
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when tenant roles are enabled then roles from tenant config maps are created", func(t *testing.T) {
+
+		config := testConfig
+		config.TenantAllowedPolicies = []string{"tenant-*"}
+		tenantConfigMaps := []k8s.ConfigMap{
+			{Namespace: "payments", Name: "vault-roles", Data: map[string]string{
+				"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["kube-system"], "token_policies": ["tenant-payments"]}`,
+			}},
+		}
+		expectedRole := vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"tenant-payments"},
+		}
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ListRoles").Return(nil, nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
+		vaultClient.On("CreateRole", "payments.app", expectedRole).Return(nil).Once()
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{}, nil)
+		k8sClient.On("GetConfigMaps", tenantRolesLabelSelector).Return(tenantConfigMaps, nil)
+		k8sClient.On("GetNamespaces").Return([]string{"payments"}, nil)
+		k8sClient.On("GetServiceAccounts", "payments", serviceAccountAnnotations).Return(nil, nil)
+		k8sClient.On("CreateServiceAccount", "payments", "app", serviceAccountAnnotations).Return(nil).Once()
+
+		a := NewAuth(config, vaultClient, k8sClient)
+		a.initServiceAccounts()
+		vaultClient.AssertExpectations(t)
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when tenant roles are enabled and get tenant config maps fails then kube and vault are not updated", func(t *testing.T) {
+
+		config := testConfig
+		config.TenantAllowedPolicies = []string{"tenant-*"}
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{}, nil)
+		k8sClient.On("GetConfigMaps", tenantRolesLabelSelector).Return(nil, errors.New("test failure"))
+
+		a := NewAuth(config, nil, k8sClient)
+		a.initServiceAccounts()
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when role is denied by guardrails then it is not created nor deleted", func(t *testing.T) {
+
+		config := testConfig
+		config.Guardrails = Guardrails{Rules: []GuardrailRule{{NamespaceLabels: map[string]string{"team": "payments"}, AllowedPolicies: []string{"payments-*"}}}}
+		configMapData := map[string]string{
+			"payments": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["payments-read"]}`,
+			"admin":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["admin"]}`,
+		}
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ListRoles").Return([]string{"admin"}, nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
+		vaultClient.On("CreateRole", "payments", mock.Anything).Return(nil).Once()
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
+		k8sClient.On("GetNamespacesMeta").Return([]k8s.Namespace{{Name: "payments", Labels: map[string]string{"team": "payments"}}}, nil)
+		k8sClient.On("CreateEvent", mock.MatchedBy(func(e k8s.Event) bool { return e.Reason == eventReasonDeniedRole })).Return(nil).Once()
+		k8sClient.On("GetNamespaces").Return([]string{"payments"}, nil)
+		k8sClient.On("GetServiceAccounts", "payments", serviceAccountAnnotations).Return([]string{"app"}, nil)
+		k8sClient.On("CreateServiceAccount", "payments", "app", serviceAccountAnnotations).Return(nil)
+
+		a := NewAuth(config, vaultClient, k8sClient)
+		a.initServiceAccounts()
+		vaultClient.AssertExpectations(t)
+		vaultClient.AssertNotCalled(t, "DeleteRole", "admin")
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when role is denied by guardrails then its service accounts are not created nor deleted", func(t *testing.T) {
+
+		config := testConfig
+		config.Guardrails = Guardrails{Rules: []GuardrailRule{{AllowedPolicies: []string{"payments-*"}}}}
+		configMapData := map[string]string{
+			"payments": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["payments-read"]}`,
+			"admin":    `{"bound_service_account_names": ["admin", "deploy"], "bound_service_account_namespaces": ["payments"], "token_policies": ["admin"]}`,
+		}
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ListRoles").Return([]string{"payments", "admin"}, nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
+		vaultClient.On("CreateRole", "payments", mock.Anything).Return(nil).Once()
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
+		k8sClient.On("CreateEvent", mock.MatchedBy(func(e k8s.Event) bool { return e.Reason == eventReasonDeniedRole })).Return(nil).Once()
+		k8sClient.On("GetNamespaces").Return([]string{"payments"}, nil)
+		k8sClient.On("GetServiceAccounts", "payments", serviceAccountAnnotations).Return([]string{"app", "admin"}, nil)
+		k8sClient.On("CreateServiceAccount", "payments", "app", serviceAccountAnnotations).Return(nil)
+
+		a := NewAuth(config, vaultClient, k8sClient)
+		a.initServiceAccounts()
+		vaultClient.AssertExpectations(t)
+		k8sClient.AssertExpectations(t)
+		k8sClient.AssertNotCalled(t, "CreateServiceAccount", "payments", "deploy", serviceAccountAnnotations)
+		k8sClient.AssertNotCalled(t, "CreateServiceAccount", "payments", "admin", serviceAccountAnnotations)
+		k8sClient.AssertNotCalled(t, "DeleteServiceAccount", "payments", "admin")
+	})
+
+	t.Run("when roles file is set then roles from the file are created", func(t *testing.T) {
+
+		rolesFile := filepath.Join(t.TempDir(), "roles.yaml")
+		content := "app:\n  bound_service_account_names: [app]\n  bound_service_account_namespaces: [payments]\n  token_policies: [app]\n"
+		require.NoError(t, os.WriteFile(rolesFile, []byte(content), 0600))
+
+		config := testConfig
+		config.RolesFile = rolesFile
+		expectedRole := vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"app"},
+		}
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ListRoles").Return(nil, nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
+		vaultClient.On("CreateRole", "app", expectedRole).Return(nil).Once()
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{}, nil)
+		k8sClient.On("GetNamespaces").Return([]string{"payments"}, nil)
+		k8sClient.On("GetServiceAccounts", "payments", serviceAccountAnnotations).Return(nil, nil)
+		k8sClient.On("CreateServiceAccount", "payments", "app", serviceAccountAnnotations).Return(nil).Once()
+
+		a := NewAuth(config, vaultClient, k8sClient)
+		a.initServiceAccounts()
+		vaultClient.AssertExpectations(t)
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when roles file cannot be read then kube and vault are not updated", func(t *testing.T) {
+
+		config := testConfig
+		config.RolesFile = filepath.Join(t.TempDir(), "missing.yaml")
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{}, nil)
+
+		a := NewAuth(config, nil, k8sClient)
+		a.initServiceAccounts()
+		k8sClient.AssertExpectations(t)
+	})
+
 	t.Run("when vault auth kubernetes config fails then kube and vault are not updated", func(t *testing.T) {
 
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).
-			Return(nil, errors.New("get vault auth kubernetes config map request failed"))
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).
+			Return(k8s.ConfigMap{}, errors.New("get vault auth kubernetes config map request failed"))
 
 		a := NewAuth(testConfig, nil, k8sClient)
 		a.initServiceAccounts()
@@ -121,7 +507,7 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		vaultClient.On("ListRoles").Return([]string{"role1"}, nil)
 		vaultClient.On("DeleteRole", "role1").Return(nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{"kube-system", "default"}, nil)
 		k8sClient.On("GetServiceAccounts", "kube-system", serviceAccountAnnotations).Return([]string{"vault-agent-injector"}, nil)
 		k8sClient.On("GetServiceAccounts", "default", serviceAccountAnnotations).Return(nil, nil)
@@ -138,7 +524,7 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return([]string{}, nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{"kube-system", "default", "test"}, nil)
 		k8sClient.On("GetServiceAccounts", "kube-system", serviceAccountAnnotations).Return([]string{"vault-agent-injector"}, nil)
 		k8sClient.On("GetServiceAccounts", "default", serviceAccountAnnotations).Return([]string{"vault-agent-injector"}, nil)
@@ -158,7 +544,7 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return([]string{}, nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{"kube-system", "default", "test"}, nil)
 		k8sClient.On("GetServiceAccounts", "kube-system", serviceAccountAnnotations).Return([]string{}, errors.New("test failure"))
 		k8sClient.On("GetServiceAccounts", "default", serviceAccountAnnotations).Return([]string{"vault-agent-injector"}, nil)
@@ -178,9 +564,10 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		}
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return([]string{}, nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
 		vaultClient.On("CreateRole", "role", mock.Anything).Return(nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{"kube-system"}, nil)
 		k8sClient.On("GetServiceAccounts", "kube-system", serviceAccountAnnotations).Return([]string{"default", "vault-agent-injector", "test"}, nil)
 		k8sClient.On("CreateServiceAccount", "kube-system", "default", serviceAccountAnnotations).Return(nil).Once()
@@ -198,7 +585,7 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return([]string{}, nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return(nil, errors.New("failed to get namespaces"))
 
 		a := NewAuth(testConfig, vaultClient, k8sClient)
@@ -214,10 +601,11 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		}
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return(nil, nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
 		vaultClient.On("CreateRole", "role1", mock.Anything).Return(nil)
 		vaultClient.On("CreateRole", "role2", mock.Anything).Return(nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{"kube-system", "default"}, nil)
 		k8sClient.On("GetServiceAccounts", "kube-system", serviceAccountAnnotations).Return([]string{}, nil)
 		k8sClient.On("GetServiceAccounts", "default", serviceAccountAnnotations).Return([]string{}, nil)
@@ -235,7 +623,7 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return(nil, errors.New("failed to list roles"))
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return(nil, nil)
 
 		a := NewAuth(testConfig, vaultClient, k8sClient)
@@ -252,7 +640,7 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		vaultClient.On("DeleteRole", "role2", mock.Anything).Return(nil).Once()
 		vaultClient.On("DeleteRole", "role3", mock.Anything).Return(nil).Once()
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{}, nil)
 
 		a := NewAuth(testConfig, vaultClient, k8sClient)
@@ -268,10 +656,11 @@ func TestAuth_initServiceAccounts(t *testing.T) {
 		}
 		vaultClient := new(VaultClientMock)
 		vaultClient.On("ListRoles").Return([]string{}, nil)
+		vaultClient.On("ReadRole", mock.Anything).Return(nil, nil)
 		vaultClient.On("CreateRole", "role1", mock.Anything).Return(errors.New("test failure"))
 		vaultClient.On("CreateRole", "role2", mock.Anything).Return(nil)
 		k8sClient := new(K8sClientMock)
-		k8sClient.On("GetConfigMapData", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(configMapData, nil)
+		k8sClient.On("GetConfigMap", vaultAuthConfigNamespace, vaultAuthConfigMap).Return(k8s.ConfigMap{Data: configMapData}, nil)
 		k8sClient.On("GetNamespaces").Return([]string{}, nil)
 
 		a := NewAuth(testConfig, vaultClient, k8sClient)
@@ -286,8 +675,22 @@ type VaultClientMock struct {
 	mock.Mock
 }
 
-func (m *VaultClientMock) InitAuthKubernetes(k8sHost string, k8sCA []byte, tokenReviewerJWT []byte) error {
-	return m.Called(k8sHost, k8sCA, tokenReviewerJWT).Error(0)
+func (m *VaultClientMock) CheckHealth() (vault.Health, error) {
+
+	args := m.Called()
+	return args.Get(0).(vault.Health), args.Error(1)
+}
+
+func (m *VaultClientMock) InitAuthKubernetes(k8sHost string, k8sCA []byte, tokenReviewerJWT []byte, options vault.AuthKubernetesOptions) (bool, error) {
+
+	args := m.Called(k8sHost, k8sCA, tokenReviewerJWT, options)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *VaultClientMock) InitAuthJWT(issuer string, validationPubkeys []string) (bool, error) {
+
+	args := m.Called(issuer, validationPubkeys)
+	return args.Bool(0), args.Error(1)
 }
 
 func (m *VaultClientMock) ListRoles() ([]string, error) {
@@ -299,6 +702,15 @@ func (m *VaultClientMock) ListRoles() ([]string, error) {
 	return args.Get(0).([]string), args.Error(1)
 }
 
+func (m *VaultClientMock) ReadRole(name string) (*vault.Role, error) {
+
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.Role), args.Error(1)
+}
+
 func (m *VaultClientMock) DeleteRole(role string) error {
 	return m.Called(role).Error(0)
 }
@@ -307,6 +719,211 @@ func (m *VaultClientMock) CreateRole(namespace string, role vault.Role) error {
 	return m.Called(namespace, role).Error(0)
 }
 
+func (m *VaultClientMock) AuthAccessor() string {
+	return m.Called().String(0)
+}
+
+func (m *VaultClientMock) AuthMount() string {
+	return m.Called().String(0)
+}
+
+func (m *VaultClientMock) ReadAuthType() (string, error) {
+
+	args := m.Called()
+	return args.String(0), args.Error(1)
+}
+
+func (m *VaultClientMock) ListPolicies() ([]string, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadPolicy(name string) (*vault.Policy, error) {
+
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.Policy), args.Error(1)
+}
+
+func (m *VaultClientMock) WritePolicy(name, policy string) error {
+	return m.Called(name, policy).Error(0)
+}
+
+func (m *VaultClientMock) DeletePolicy(name string) error {
+	return m.Called(name).Error(0)
+}
+
+func (m *VaultClientMock) AuthAliasNameSource() string {
+	return m.Called().String(0)
+}
+
+func (m *VaultClientMock) ListEntities() ([]string, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadEntity(name string) (*vault.Entity, error) {
+
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.Entity), args.Error(1)
+}
+
+func (m *VaultClientMock) WriteEntity(name string, metadata map[string]string) error {
+	return m.Called(name, metadata).Error(0)
+}
+
+func (m *VaultClientMock) DeleteEntity(name string) error {
+	return m.Called(name).Error(0)
+}
+
+func (m *VaultClientMock) LookupEntityByAlias(aliasName, mountAccessor string) (*vault.Entity, error) {
+
+	args := m.Called(aliasName, mountAccessor)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.Entity), args.Error(1)
+}
+
+func (m *VaultClientMock) WriteEntityAlias(alias vault.EntityAlias) error {
+	return m.Called(alias).Error(0)
+}
+
+func (m *VaultClientMock) DeleteEntityAlias(id string) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *VaultClientMock) ListGroups() ([]string, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadGroup(name string) (*vault.Group, error) {
+
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.Group), args.Error(1)
+}
+
+func (m *VaultClientMock) WriteGroup(name string, metadata map[string]string, memberEntityIDs []string) error {
+	return m.Called(name, metadata, memberEntityIDs).Error(0)
+}
+
+func (m *VaultClientMock) DeleteGroup(name string) error {
+	return m.Called(name).Error(0)
+}
+
+func (m *VaultClientMock) EnsureKVMount(path string) (bool, error) {
+
+	args := m.Called(path)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *VaultClientMock) ListKVMetadata(mount, path string) ([]string, error) {
+
+	args := m.Called(mount, path)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadKVMetadata(mount, path string) (*vault.KVMetadata, error) {
+
+	args := m.Called(mount, path)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.KVMetadata), args.Error(1)
+}
+
+func (m *VaultClientMock) WriteKVMetadata(mount, path string, metadata vault.KVMetadata) error {
+	return m.Called(mount, path, metadata).Error(0)
+}
+
+func (m *VaultClientMock) InitSecretsKubernetes(kubernetesHost string, kubernetesCACert, serviceAccountJWT []byte) (bool, error) {
+
+	args := m.Called(kubernetesHost, kubernetesCACert, serviceAccountJWT)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *VaultClientMock) ListSecretsRoles() ([]string, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadSecretsRole(name string) (map[string]interface{}, error) {
+
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]interface{}), args.Error(1)
+}
+
+func (m *VaultClientMock) WriteSecretsRole(name string, role map[string]interface{}) error {
+	return m.Called(name, role).Error(0)
+}
+
+func (m *VaultClientMock) DeleteSecretsRole(name string) error {
+	return m.Called(name).Error(0)
+}
+
+func (m *VaultClientMock) ReadAuthKubernetesConfig() (*vault.AuthKubernetesConfig, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.AuthKubernetesConfig), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadAuthJWTConfig() (*vault.AuthJWTConfig, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*vault.AuthJWTConfig), args.Error(1)
+}
+
+func (m *VaultClientMock) Login(role string, serviceAccountJWT []byte) (vault.LoginResult, error) {
+
+	args := m.Called(role, serviceAccountJWT)
+	return args.Get(0).(vault.LoginResult), args.Error(1)
+}
+
+func (m *VaultClientMock) RevokeToken(token string) error {
+	return m.Called(token).Error(0)
+}
+
+func (m *VaultClientMock) LoginAudience(role vault.Role) string {
+	return m.Called(role).String(0)
+}
+
 // --- ---
 
 type K8sClientMock struct {
@@ -322,13 +939,40 @@ func (m *K8sClientMock) GetNamespaces() ([]string, error) {
 	return args.Get(0).([]string), args.Error(1)
 }
 
-func (m *K8sClientMock) GetConfigMapData(namespace, name string) (map[string]string, error) {
+func (m *K8sClientMock) GetNamespacesMeta() ([]k8s.Namespace, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]k8s.Namespace), args.Error(1)
+}
+
+func (m *K8sClientMock) GetConfigMap(namespace, name string) (k8s.ConfigMap, error) {
 
 	args := m.Called(namespace, name)
+	return args.Get(0).(k8s.ConfigMap), args.Error(1)
+}
+
+func (m *K8sClientMock) GetConfigMaps(labelSelector string) ([]k8s.ConfigMap, error) {
+
+	args := m.Called(labelSelector)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
-	return args.Get(0).(map[string]string), args.Error(1)
+	return args.Get(0).([]k8s.ConfigMap), args.Error(1)
+}
+
+func (m *K8sClientMock) UpdateConfigMapData(namespace, name, key, value string) error {
+	return m.Called(namespace, name, key, value).Error(0)
+}
+
+func (m *K8sClientMock) UpdateConfigMapAnnotation(namespace, name, key, value string) error {
+	return m.Called(namespace, name, key, value).Error(0)
+}
+
+func (m *K8sClientMock) CreateEvent(event k8s.Event) error {
+	return m.Called(event).Error(0)
 }
 
 func (m *K8sClientMock) GetServiceAccounts(namespace string, annotations map[string]string) ([]string, error) {
@@ -340,6 +984,15 @@ func (m *K8sClientMock) GetServiceAccounts(namespace string, annotations map[str
 	return args.Get(0).([]string), args.Error(1)
 }
 
+func (m *K8sClientMock) GetServiceAccountUIDs(namespace string, annotations map[string]string) (map[string]string, error) {
+
+	args := m.Called(namespace, annotations)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]string), args.Error(1)
+}
+
 func (m *K8sClientMock) CreateServiceAccount(namespace, serviceAccount string, annotations map[string]string) error {
 	return m.Called(namespace, serviceAccount, annotations).Error(0)
 }
@@ -348,6 +1001,15 @@ func (m *K8sClientMock) DeleteServiceAccount(namespace, serviceAccount string) e
 	return m.Called(namespace, serviceAccount).Error(0)
 }
 
+func (m *K8sClientMock) CreateServiceAccountToken(namespace, serviceAccount string, audiences []string, expirationSeconds int64) ([]byte, error) {
+
+	args := m.Called(namespace, serviceAccount, audiences, expirationSeconds)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
+
 func (m *K8sClientMock) GetServiceAccountToken(namespace, serviceAccount string) ([]byte, error) {
 
 	args := m.Called(namespace, serviceAccount)
@@ -360,3 +1022,13 @@ func (m *K8sClientMock) GetServiceAccountToken(namespace, serviceAccount string)
 func (m *K8sClientMock) CreateAuthDelegatorClusterRoleBinding(bindingName, namespace, serviceAccount string) error {
 	return m.Called(bindingName, namespace, serviceAccount).Error(0)
 }
+
+func (m *K8sClientMock) CreateClusterRoleBinding(bindingName, clusterRole, namespace, serviceAccount string) error {
+	return m.Called(bindingName, clusterRole, namespace, serviceAccount).Error(0)
+}
+
+func (m *K8sClientMock) GetServiceAccountIssuer() (k8s.ServiceAccountIssuer, error) {
+
+	args := m.Called()
+	return args.Get(0).(k8s.ServiceAccountIssuer), args.Error(1)
+}
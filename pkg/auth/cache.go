@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+)
+
+var (
+	roleCacheMetric         = metrics.NewCounter("vak_role_cache_requests_total", "Number of role cache lookups by result (hit or miss).", "result")
+	roleCacheHitRatioMetric = metrics.NewGauge("vak_role_cache_hit_ratio", "Role cache hit ratio of the last reload.")
+)
+
+// last known vault role state, hash of the role by role name, roles are written to vault only when the hash of desired
+// role changes, cache is cleared (and vault roles are listed and read) every verify interval to detect drift
+type roleCache struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	verifiedAt time.Time
+	hashes     map[string]string
+	hits       int
+	misses     int
+}
+
+func newRoleCache(interval time.Duration) *roleCache {
+	return &roleCache{interval: interval, hashes: make(map[string]string)}
+}
+
+// start of reload, returns true if cache was cleared and vault state has to be verified (first reload, verify interval
+// elapsed or cache is disabled by zero interval)
+func (c *roleCache) start(now time.Time) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hits, c.misses = 0, 0
+	if c.interval > 0 && !c.verifiedAt.IsZero() && now.Sub(c.verifiedAt) < c.interval {
+		return false
+	}
+	c.hashes = make(map[string]string)
+	c.verifiedAt = now
+	return true
+}
+
+// end of reload, hit ratio of the reload is set in metrics
+func (c *roleCache) finish() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if total := c.hits + c.misses; total != 0 {
+		roleCacheHitRatioMetric.Set(float64(c.hits) / float64(total))
+	}
+}
+
+// clear cache, next reload verifies vault state (e.g. auth was mounted again and vault roles are gone)
+func (c *roleCache) clear() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hashes = make(map[string]string)
+	c.verifiedAt = time.Time{}
+}
+
+// true if role with the same hash is in vault
+func (c *roleCache) hit(name, hash string) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.hashes[name]; ok && h == hash {
+		c.hits++
+		roleCacheMetric.Inc(cacheHit)
+		return true
+	}
+	c.misses++
+	roleCacheMetric.Inc(cacheMiss)
+	return false
+}
+
+func (c *roleCache) set(name, hash string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hashes[name] = hash
+}
+
+func (c *roleCache) remove(name string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.hashes, name)
+}
+
+// names of roles known to be in vault, sorted
+func (c *roleCache) names() []string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for name := range c.hashes {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRoleCache(t *testing.T) {
+
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("when verify interval has not elapsed then cached roles are kept", func(t *testing.T) {
+
+		c := newRoleCache(10 * time.Minute)
+		assert.True(t, c.start(now))
+		assert.False(t, c.hit("app", "hash-1"))
+		c.set("app", "hash-1")
+
+		assert.False(t, c.start(now.Add(5*time.Minute)))
+		assert.True(t, c.hit("app", "hash-1"))
+		assert.False(t, c.hit("app", "hash-2"))
+		assert.Equal(t, []string{"app"}, c.names())
+	})
+
+	t.Run("when verify interval has elapsed then cache is cleared", func(t *testing.T) {
+
+		c := newRoleCache(10 * time.Minute)
+		c.start(now)
+		c.set("app", "hash-1")
+
+		assert.True(t, c.start(now.Add(10*time.Minute)))
+		assert.False(t, c.hit("app", "hash-1"))
+		assert.Empty(t, c.names())
+	})
+
+	t.Run("when verify interval is not set then every reload verifies vault", func(t *testing.T) {
+
+		c := newRoleCache(0)
+		assert.True(t, c.start(now))
+		c.set("app", "hash-1")
+		assert.True(t, c.start(now))
+		assert.False(t, c.hit("app", "hash-1"))
+	})
+
+	t.Run("when cache is cleared then next reload verifies vault", func(t *testing.T) {
+
+		c := newRoleCache(10 * time.Minute)
+		c.start(now)
+		c.set("app", "hash-1")
+		c.set("worker", "hash-2")
+		c.remove("worker")
+		assert.Equal(t, []string{"app"}, c.names())
+
+		c.clear()
+		assert.True(t, c.start(now.Add(time.Minute)))
+	})
+
+	t.Run("when reload finishes then hit ratio is set", func(t *testing.T) {
+
+		c := newRoleCache(10 * time.Minute)
+		c.start(now)
+		c.set("app", "hash-1")
+		c.hit("app", "hash-1")
+		c.hit("app", "hash-1")
+		c.hit("app", "hash-1")
+		c.hit("worker", "hash-2")
+		c.finish()
+		assert.Equal(t, 0.75, metricsValue("vak_role_cache_hit_ratio"))
+	})
+}
@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// role definition parsed from yaml or json, raw is json representation of the role (or role template)
+type roleDefinition struct {
+	name   string
+	raw    []byte
+	line   int
+	column int
+	// line offset of config map value in file, positions are relative to the value
+	offset int
+	// role fields by name, used to report position of the field that failed to unmarshal
+	fields map[string]*yaml.Node
+	// role is the only value of config map key (named by the key), role can be written back to the key
+	standalone bool
+}
+
+func (d roleDefinition) newRole() (vault.Role, error) {
+
+	role, err := vault.NewRole(d.raw)
+	if err != nil {
+		return vault.Role{}, d.errorf(err)
+	}
+	return role, nil
+}
+
+func (d roleDefinition) driftPolicy() (string, error) {
+
+	policy, err := newDriftPolicy(d.raw)
+	if err != nil {
+		return "", d.errorf(err)
+	}
+	return policy, nil
+}
+
+func (d roleDefinition) aclPolicies() (map[string]string, error) {
+
+	policies, err := newACLPolicies(d.raw)
+	if err != nil {
+		return nil, d.errorf(err)
+	}
+	return policies, nil
+}
+
+func (d roleDefinition) secretsEngineRole() (map[string]interface{}, error) {
+
+	secretsEngineRole, err := newSecretsEngineRole(d.raw)
+	if err != nil {
+		return nil, d.errorf(err)
+	}
+	return secretsEngineRole, nil
+}
+
+// prefix error with position of the role, or position of the field if the error is json type error
+func (d roleDefinition) errorf(err error) error {
+
+	line, column := d.line, d.column
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if field, ok := d.fields[typeErr.Field]; ok {
+			line, column = field.Line, field.Column
+		}
+	}
+	if line == 0 {
+		return err
+	}
+	return fmt.Errorf("line %d column %d: %w", line+d.offset, column, err)
+}
+
+// config map entries to role definitions with defaults and profiles applied, entries that cannot be parsed are returned
+// as violations
+func configMapRoleDefinitions(configMap k8s.ConfigMap) ([]roleDefinition, []string) {
+
+	var definitions []roleDefinition
+	var violations []string
+	for _, key := range sortedKeys(configMap.Data) {
+		d, err := parseRoleDefinitions(key, []byte(configMap.Data[key]))
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		definitions = append(definitions, d...)
+	}
+	definitions, inheritViolations := inherit(definitions)
+	return definitions, append(violations, inheritViolations...)
+}
+
+// value is yaml or json role, list of roles or multiple yaml documents, every role in the list (or document) has to have
+// 'name' field, single role is named by the key
+func parseRoleDefinitions(key string, value []byte) ([]roleDefinition, error) {
+
+	documents, err := decodeDocuments(value)
+	if err != nil {
+		return nil, err
+	}
+	return newRoleDefinitions(key, documents)
+}
+
+// json is parsed by json decoder to report line and column of syntax error, yaml decoder does not report column
+func decodeDocuments(value []byte) ([]*yaml.Node, error) {
+
+	trimmed := bytes.TrimSpace(value)
+	if bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")) {
+		var v interface{}
+		if err := json.Unmarshal(value, &v); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				line, column := position(value, syntaxErr.Offset)
+				return nil, fmt.Errorf("line %d column %d: %w", line, column, err)
+			}
+			return nil, err
+		}
+		var node yaml.Node
+		if err := node.Encode(v); err != nil {
+			return nil, err
+		}
+		return []*yaml.Node{&node}, nil
+	}
+
+	var documents []*yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(value))
+	for {
+		var document yaml.Node
+		if err := decoder.Decode(&document); err != nil {
+			if errors.Is(err, io.EOF) {
+				return documents, nil
+			}
+			return nil, err
+		}
+		if len(document.Content) != 0 {
+			documents = append(documents, document.Content[0])
+		}
+	}
+}
+
+func newRoleDefinitions(key string, documents []*yaml.Node) ([]roleDefinition, error) {
+
+	if len(documents) == 1 && documents[0].Kind == yaml.MappingNode {
+		d := newRoleDefinition(key, documents[0])
+		d.standalone = true
+		return []roleDefinition{d}, nil
+	}
+
+	var definitions []roleDefinition
+	for _, document := range documents {
+		items := []*yaml.Node{document}
+		if document.Kind == yaml.SequenceNode {
+			items = document.Content
+		}
+		for _, item := range items {
+			if item.Kind != yaml.MappingNode {
+				return nil, nodeErrorf(item, "role has to be an object")
+			}
+			name := mappingValue(item, "name")
+			if name == nil || name.Kind != yaml.ScalarNode || name.Value == "" {
+				return nil, nodeErrorf(item, "role in list is missing name")
+			}
+			definitions = append(definitions, newRoleDefinition(name.Value, item))
+		}
+	}
+	return definitions, nil
+}
+
+func newRoleDefinition(name string, node *yaml.Node) roleDefinition {
+
+	d := roleDefinition{
+		name:   name,
+		line:   node.Line,
+		column: node.Column,
+		fields: make(map[string]*yaml.Node),
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		d.fields[node.Content[i].Value] = node.Content[i+1]
+	}
+
+	var v map[string]interface{}
+	if err := node.Decode(&v); err != nil {
+		// mapping node always decodes to map, keep empty role that fails validation
+		v = map[string]interface{}{}
+	}
+	delete(v, "name")
+	d.raw, _ = json.Marshal(v)
+	return d
+}
+
+// role definitions (with defaults and profiles applied) from one file
+type roleFile struct {
+	source      roleSource
+	definitions []roleDefinition
+	violations  []string
+}
+
+// read role files from file and directory paths, empty paths are skipped
+func readRoleFiles(paths ...string) ([]roleFile, error) {
+
+	var out []roleFile
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		files, err := roleFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			definitions, err := readRoleFile(file)
+			if err != nil {
+				return nil, err
+			}
+			definitions, violations := inherit(definitions)
+			out = append(out, roleFile{source: newFileSource(file), definitions: definitions, violations: violations})
+		}
+	}
+	return out, nil
+}
+
+// role file or all .yaml, .yml and .json files in directory
+func roleFiles(path string) ([]string, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// file document is either config map manifest or mapping of role names to roles (or lists of roles)
+func readRoleFile(file string) ([]roleDefinition, error) {
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := decodeDocuments(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	var definitions []roleDefinition
+	for _, document := range documents {
+		d, err := documentRoleDefinitions(document)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		definitions = append(definitions, d...)
+	}
+	return definitions, nil
+}
+
+func documentRoleDefinitions(document *yaml.Node) ([]roleDefinition, error) {
+
+	if document.Kind != yaml.MappingNode {
+		return nil, nodeErrorf(document, "document has to be config map or mapping of role names to roles")
+	}
+
+	entries := document
+	if kind := mappingValue(document, "kind"); kind != nil && kind.Value == "ConfigMap" {
+		// mount spec and auth config exported with roles
+		if metadata := mappingValue(document, "metadata"); metadata != nil {
+			if name := mappingValue(metadata, "name"); name != nil && name.Value == exportMountConfigMap {
+				return nil, nil
+			}
+		}
+		if entries = mappingValue(document, "data"); entries == nil {
+			return nil, nil
+		}
+	}
+
+	var definitions []roleDefinition
+	for i := 0; i+1 < len(entries.Content); i += 2 {
+		key, value := entries.Content[i].Value, entries.Content[i+1]
+		if value.Kind != yaml.ScalarNode {
+			d, err := newRoleDefinitions(key, []*yaml.Node{value})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			definitions = append(definitions, d...)
+			continue
+		}
+
+		// config map data value, positions are relative to the value, shift them for block scalars (|, >)
+		d, err := parseRoleDefinitions(key, []byte(value.Value))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		if value.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+			for j := range d {
+				d[j].offset = value.Line
+			}
+		}
+		definitions = append(definitions, d...)
+	}
+	return definitions, nil
+}
+
+// error prefixed with node position, nodes encoded from json do not have position
+func nodeErrorf(node *yaml.Node, format string, a ...interface{}) error {
+
+	err := fmt.Errorf(format, a...)
+	if node.Line == 0 {
+		return err
+	}
+	return fmt.Errorf("line %d column %d: %w", node.Line, node.Column, err)
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// line and column (both starting at 1) of the offset
+func position(b []byte, offset int64) (int, int) {
+
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	before := b[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - (bytes.LastIndexByte(before, '\n') + 1)
+	return line, column
+}
+
+func sortedKeys(m map[string]string) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRoleDefinitions(t *testing.T) {
+
+	t.Run("when value is yaml role then role is named by the key", func(t *testing.T) {
+
+		value := `
+# comments are allowed in yaml
+bound_service_account_names: [vault-agent-injector]
+bound_service_account_namespaces:
+  - kube-system
+token_policies: [test]
+token_ttl: 3600
+`
+		definitions, err := parseRoleDefinitions("test", []byte(value))
+		require.NoError(t, err)
+		require.Equal(t, 1, len(definitions))
+		assert.Equal(t, "test", definitions[0].name)
+
+		role, err := definitions[0].newRole()
+		require.NoError(t, err)
+		assert.Equal(t, vault.Role{
+			BoundServiceAccountNames:      []string{"vault-agent-injector"},
+			BoundServiceAccountNamespaces: []string{"kube-system"},
+			TokenPolicies:                 []string{"test"},
+			TokenTTL:                      3600,
+		}, role)
+	})
+
+	t.Run("when value is list of roles then roles are named by name field", func(t *testing.T) {
+
+		value := `
+- name: app
+  bound_service_account_names: [app]
+  token_policies: [app]
+- name: worker
+  bound_service_account_names: [worker]
+  token_policies: [worker]
+`
+		definitions, err := parseRoleDefinitions("team", []byte(value))
+		require.NoError(t, err)
+		require.Equal(t, 2, len(definitions))
+		assert.Equal(t, "app", definitions[0].name)
+		assert.Equal(t, "worker", definitions[1].name)
+		assert.NotContains(t, string(definitions[0].raw), "name\":\"app")
+	})
+
+	t.Run("when value is json list of roles then roles are named by name field", func(t *testing.T) {
+
+		value := `[{"name": "app", "token_policies": ["app"]}, {"name": "worker", "token_policies": ["worker"]}]`
+		definitions, err := parseRoleDefinitions("team", []byte(value))
+		require.NoError(t, err)
+		require.Equal(t, 2, len(definitions))
+		assert.Equal(t, "worker", definitions[1].name)
+	})
+
+	t.Run("when value has multiple yaml documents then every document is a role", func(t *testing.T) {
+
+		value := "name: app\ntoken_policies: [app]\n---\nname: worker\ntoken_policies: [worker]\n"
+		definitions, err := parseRoleDefinitions("team", []byte(value))
+		require.NoError(t, err)
+		require.Equal(t, 2, len(definitions))
+		assert.Equal(t, "app", definitions[0].name)
+		assert.Equal(t, "worker", definitions[1].name)
+	})
+
+	t.Run("when role in list is missing name then error with position is returned", func(t *testing.T) {
+
+		value := "- name: app\n  token_policies: [app]\n- token_policies: [worker]\n"
+		_, err := parseRoleDefinitions("team", []byte(value))
+		require.EqualError(t, err, "line 3 column 3: role in list is missing name")
+	})
+
+	t.Run("when json is invalid then error with line and column is returned", func(t *testing.T) {
+
+		value := "{\n  \"token_policies\": [\"test\"]\n  \"token_ttl\": 10\n}"
+		_, err := parseRoleDefinitions("test", []byte(value))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line 3 column 3:")
+	})
+
+	t.Run("when yaml is invalid then error with line is returned", func(t *testing.T) {
+
+		_, err := parseRoleDefinitions("test", []byte("token_policies: [test]\ntoken_ttl: a: 10\n"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line 2")
+	})
+
+	t.Run("when role field has invalid type then error with field position is returned", func(t *testing.T) {
+
+		definitions, err := parseRoleDefinitions("test", []byte("token_policies: [test]\ntoken_ttl: one hour\n"))
+		require.NoError(t, err)
+
+		_, err = definitions[0].newRole()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line 2 column 12:")
+	})
+}
+
+func TestConfigMapRoleDefinitions(t *testing.T) {
+
+	t.Run("when config map has invalid entry then valid entries are returned and invalid entry is violation", func(t *testing.T) {
+
+		configMap := k8s.ConfigMap{Data: map[string]string{
+			"app":     "token_policies: [app]",
+			"invalid": "[{\"token_policies\": [\"app\"]}]",
+		}}
+		definitions, violations := configMapRoleDefinitions(configMap)
+		require.Equal(t, 1, len(definitions))
+		assert.Equal(t, "app", definitions[0].name)
+		assert.Equal(t, []string{"invalid: role in list is missing name"}, violations)
+	})
+}
+
+func TestReadRoleFile(t *testing.T) {
+
+	t.Run("when file contains config map manifest and role mapping then roles from both documents are returned", func(t *testing.T) {
+
+		content := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: vault-auth-roles
+  namespace: vault-auth
+data:
+  default: |-
+    {"bound_service_account_names": ["default"], "token_policies": ["test"]}
+---
+app:
+  bound_service_account_names: [app]
+  token_policies: [app]
+team:
+  - name: worker
+    bound_service_account_names: [worker]
+    token_policies: [worker]
+`
+		file := filepath.Join(t.TempDir(), "roles.yaml")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+
+		definitions, err := readRoleFile(file)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(definitions))
+		assert.Equal(t, "default", definitions[0].name)
+		assert.Equal(t, "app", definitions[1].name)
+		assert.Equal(t, "worker", definitions[2].name)
+	})
+
+	t.Run("when config map value in file has invalid field then error position is relative to the file", func(t *testing.T) {
+
+		content := "kind: ConfigMap\ndata:\n  app: |-\n    token_policies: [app]\n    token_ttl: one hour\n"
+		file := filepath.Join(t.TempDir(), "roles.yaml")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+
+		definitions, err := readRoleFile(file)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(definitions))
+
+		_, err = definitions[0].newRole()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line 5 column 12:")
+	})
+
+	t.Run("when file is invalid then error with file name is returned", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "roles.yaml")
+		require.NoError(t, os.WriteFile(file, []byte("- app"), 0600))
+
+		_, err := readRoleFile(file)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), file)
+	})
+}
+
+func TestRoleFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{"b.yaml", "a.json", "c.yml", "README.md"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested.yaml"), 0700))
+
+	files, err := roleFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "a.json"), filepath.Join(dir, "b.yaml"), filepath.Join(dir, "c.yml")}, files)
+}
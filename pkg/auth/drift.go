@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"gopkg.in/yaml.v3"
+	"sync"
+)
+
+// what happens when vault role was changed outside of this application, set per role by 'drift_policy' field
+const (
+	// overwrite vault role with desired role (default)
+	driftPolicyEnforce = "enforce"
+	// report drift only, vault role is left as it is
+	driftPolicyWarn = "warn"
+	// write vault role back to the config map entry the role is defined in
+	driftPolicyAdopt = "adopt"
+)
+
+const eventReasonRoleDrift = "VaultRoleDrift"
+
+var roleDriftMetric = metrics.NewCounter("vak_role_drift_total", "Number of detected vault role drifts by drift policy.", "policy")
+
+type driftPolicySpec struct {
+	DriftPolicy string `json:"drift_policy"`
+}
+
+// drift policy of raw role, enforce if not set
+func newDriftPolicy(rawRole []byte) (string, error) {
+
+	var spec driftPolicySpec
+	if err := json.Unmarshal(rawRole, &spec); err != nil {
+		return "", fmt.Errorf("unmarshal drift policy: %w", err)
+	}
+	switch spec.DriftPolicy {
+	case "":
+		return driftPolicyEnforce, nil
+	case driftPolicyEnforce, driftPolicyWarn, driftPolicyAdopt:
+		return spec.DriftPolicy, nil
+	}
+	return "", fmt.Errorf("drift_policy %q is not one of %s, %s or %s", spec.DriftPolicy, driftPolicyEnforce, driftPolicyWarn, driftPolicyAdopt)
+}
+
+// hash of the role last written to (or found equal in) vault and last reported drift by role name, vault role that
+// differs from the last applied role was changed outside of this application, role without applied hash (e.g. after
+// restart) is not known to be changed outside, it is updated only when drift policy is enforce
+type roleDrift struct {
+	mu      sync.Mutex
+	applied map[string]string
+	diffs   map[string]string
+}
+
+func newRoleDrift() *roleDrift {
+	return &roleDrift{applied: make(map[string]string), diffs: make(map[string]string)}
+}
+
+// true if vault role is not the role this application applied, false if no role was applied yet
+func (d *roleDrift) drifted(name string, vaultRole vault.Role) bool {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	applied, ok := d.applied[name]
+	return ok && applied != vaultRole.Hash()
+}
+
+// true if role was written to (or found equal in) vault since start
+func (d *roleDrift) known(name string) bool {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.applied[name]
+	return ok
+}
+
+func (d *roleDrift) setApplied(name, hash string) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.applied[name] = hash
+	delete(d.diffs, name)
+}
+
+// true if the drift was not reported yet
+func (d *roleDrift) detected(name, diff string) bool {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.diffs[name] == diff {
+		return false
+	}
+	d.diffs[name] = diff
+	return true
+}
+
+func (d *roleDrift) remove(name string) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.applied, name)
+	delete(d.diffs, name)
+}
+
+// role differs from desired role in vault, returns message reported on the role source, vault role is overwritten,
+// left as it is or adopted depending on drift policy
+func (a Auth) handleDrift(name string, role vaultRole, vaultValue vault.Role, diff vault.RoleDiff) string {
+
+	policy := role.driftPolicy
+	if policy == driftPolicyAdopt && role.adoptKey == "" {
+		policy = driftPolicyWarn
+	}
+	if a.drift.detected(name, diff.String()) {
+		logger.Errorf("vault role %s from %s was changed outside of vault-auth-kubernetes (drift policy %s): %s",
+			name, role.source, role.driftPolicy, diff)
+		roleDriftMetric.Inc(role.driftPolicy)
+	}
+
+	switch policy {
+	case driftPolicyWarn:
+		if role.driftPolicy == driftPolicyAdopt {
+			return fmt.Sprintf("%s was changed in vault, role cannot be adopted (only roles defined as a single config map entry can), vault role was left as it is: %s", name, diff)
+		}
+		return fmt.Sprintf("%s was changed in vault, vault role was left as it is: %s", name, diff)
+	case driftPolicyAdopt:
+		if err := a.adoptRole(role, vaultValue, diff); err != nil {
+			logger.Errorf("adopt vault role %s to %s: %v", name, role.source, err)
+			return fmt.Sprintf("%s was changed in vault, adopting vault role failed: %v: %s", name, err, diff)
+		}
+		// vault role is accepted as applied, desired role matches it once the updated config map is read
+		a.drift.setApplied(name, vaultValue.Hash())
+		return fmt.Sprintf("%s was changed in vault, vault role was adopted to %s key: %s", name, role.adoptKey, diff)
+	}
+
+	hash := role.Hash()
+	if err := a.vaultClient.CreateRole(name, role.Role); err != nil {
+		logger.Errorf("create vault role: %v", err)
+		a.status.roleFailed(name, fmt.Errorf("create vault role: %w", err))
+		return fmt.Sprintf("%s was changed in vault, overwriting vault role failed: %v: %s", name, err, diff)
+	}
+	a.drift.setApplied(name, hash)
+	a.cache.set(name, hash)
+	a.status.roleApplied(name)
+	a.roleWritten(name)
+	return fmt.Sprintf("%s was changed in vault, vault role was overwritten: %s", name, diff)
+}
+
+// role differs from vault role and no role was applied since start (e.g. after restart), it is not known whether vault
+// role or role definition was changed, so vault role is left as it is and it is not adopted either
+func (a Auth) handleUnknownDrift(name string, role vaultRole, diff vault.RoleDiff) string {
+
+	if a.drift.detected(name, diff.String()) {
+		logger.Errorf("vault role %s from %s differs from vault and it was not applied since start (drift policy %s): %s",
+			name, role.source, role.driftPolicy, diff)
+		roleDriftMetric.Inc(role.driftPolicy)
+	}
+	return fmt.Sprintf("%s differs from vault and it was not applied since start, it is not known whether vault or role definition was changed, vault role was left as it is (set drift_policy to enforce or change the role to match vault): %s", name, diff)
+}
+
+// write vault role to the config map entry of the role, role fields that differ are replaced and other fields (e.g.
+// drift_policy, extends) are kept
+func (a Auth) adoptRole(role vaultRole, vaultValue vault.Role, diff vault.RoleDiff) error {
+
+	configMap, err := a.k8sClient.GetConfigMap(role.source.namespace, role.source.name)
+	if err != nil {
+		return fmt.Errorf("get config map: %w", err)
+	}
+	value, ok := configMap.Data[role.adoptKey]
+	if !ok {
+		return fmt.Errorf("config map key %s not found", role.adoptKey)
+	}
+	adopted, err := adoptValue([]byte(value), vaultValue, diff)
+	if err != nil {
+		return err
+	}
+	return a.k8sClient.UpdateConfigMapData(role.source.namespace, role.source.name, role.adoptKey, adopted)
+}
+
+// config map value with fields that differ replaced by vault role, fields that do not differ are left as they are (or
+// not set, if they come from extends or defaults), value is kept in its format (json or yaml)
+func adoptValue(value []byte, vaultValue vault.Role, diff vault.RoleDiff) (string, error) {
+
+	documents, err := decodeDocuments(value)
+	if err != nil {
+		return "", err
+	}
+	if len(documents) != 1 || documents[0].Kind != yaml.MappingNode {
+		return "", errors.New("config map value is not a single role")
+	}
+	var fields map[string]interface{}
+	if err := documents[0].Decode(&fields); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(vaultValue)
+	if err != nil {
+		return "", err
+	}
+	var roleFields map[string]interface{}
+	if err := json.Unmarshal(b, &roleFields); err != nil {
+		return "", err
+	}
+	for _, field := range diff {
+		fields[field.Field] = roleFields[field.Field]
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		b, err = json.MarshalIndent(fields, "", "  ")
+	} else {
+		b, err = yaml.Marshal(fields)
+	}
+	return string(b), err
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewDriftPolicy(t *testing.T) {
+
+	t.Run("when drift policy is not set then enforce is returned", func(t *testing.T) {
+
+		policy, err := newDriftPolicy([]byte(`{"token_policies": ["app"]}`))
+		require.NoError(t, err)
+		assert.Equal(t, driftPolicyEnforce, policy)
+	})
+
+	t.Run("when drift policy is set then it is returned", func(t *testing.T) {
+
+		policy, err := newDriftPolicy([]byte(`{"token_policies": ["app"], "drift_policy": "adopt"}`))
+		require.NoError(t, err)
+		assert.Equal(t, driftPolicyAdopt, policy)
+	})
+
+	t.Run("when drift policy is unknown then error is returned", func(t *testing.T) {
+
+		_, err := newDriftPolicy([]byte(`{"drift_policy": "ignore"}`))
+		require.Error(t, err)
+	})
+}
+
+func TestAdoptValue(t *testing.T) {
+
+	vaultValue := vault.Role{
+		BoundServiceAccountNames:      []string{"app"},
+		BoundServiceAccountNamespaces: []string{"payments"},
+		TokenPolicies:                 []string{"admin"},
+		TokenTTL:                      60,
+	}
+	// bound service account names and namespaces come from extends and are the same
+	diff := vault.RoleDiff{
+		{Field: "token_policies", Desired: `["app"]`, Actual: `["admin"]`},
+		{Field: "token_ttl", Desired: "0", Actual: "60"},
+	}
+
+	t.Run("when value is json then fields that differ are replaced, other fields are kept and json is returned", func(t *testing.T) {
+
+		value := `{"extends": "payments", "drift_policy": "adopt", "token_policies": ["app"]}`
+		adopted, err := adoptValue([]byte(value), vaultValue, diff)
+		require.NoError(t, err)
+
+		expected := `{
+  "drift_policy": "adopt",
+  "extends": "payments",
+  "token_policies": [
+    "admin"
+  ],
+  "token_ttl": 60
+}`
+		assert.Equal(t, expected, adopted)
+	})
+
+	t.Run("when value is yaml then yaml is returned", func(t *testing.T) {
+
+		value := "drift_policy: adopt\ntoken_policies: [app]\n"
+		adopted, err := adoptValue([]byte(value), vaultValue, diff)
+		require.NoError(t, err)
+
+		expected := `drift_policy: adopt
+token_policies:
+    - admin
+token_ttl: 60
+`
+		assert.Equal(t, expected, adopted)
+	})
+
+	t.Run("when value is list of roles then error is returned", func(t *testing.T) {
+
+		_, err := adoptValue([]byte("- name: app\n- name: worker\n"), vaultValue, diff)
+		require.Error(t, err)
+	})
+}
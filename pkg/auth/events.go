@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	eventReasonInvalidRole = "InvalidVaultRole"
+	eventReasonDeniedRole  = "DeniedVaultRole"
+)
+
+// create warning event on the role source, event is created only when messages change to avoid creating the same
+// event on every reload, empty messages clear previously reported event
+func (a Auth) report(source roleSource, reason string, messages []string) {
+
+	// files are not kubernetes objects, messages are only logged
+	if source.kind == fileSourceKind {
+		for _, message := range messages {
+			logger.Errorf("%s %s: %s", reason, source, message)
+		}
+		return
+	}
+
+	key := fmt.Sprintf("%s/%s/%s/%s", source.kind, source.namespace, source.name, reason)
+	if len(messages) == 0 {
+		a.reported.remove(key)
+		return
+	}
+
+	sort.Strings(messages)
+	message := strings.Join(messages, "; ")
+	if !a.reported.set(key, message) {
+		return
+	}
+
+	event := k8s.Event{
+		Kind:      source.kind,
+		Namespace: source.namespace,
+		Name:      source.name,
+		UID:       source.uid,
+		Type:      k8s.EventTypeWarning,
+		Reason:    reason,
+		Message:   message,
+	}
+	if err := a.k8sClient.CreateEvent(event); err != nil {
+		logger.Errorf("create %s event for %s: %v", reason, source, err)
+		// event is created again on the next reload
+		a.reported.remove(key)
+	}
+}
+
+// last reported message by key, events are reported from worker goroutines
+type reportedMessages struct {
+	mu       sync.Mutex
+	messages map[string]string
+}
+
+func newReportedMessages() *reportedMessages {
+	return &reportedMessages{messages: make(map[string]string)}
+}
+
+func (r *reportedMessages) get(key string) string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.messages[key]
+}
+
+// set message, returns false if the message was already set
+func (r *reportedMessages) set(key, message string) bool {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.messages[key] == message {
+		return false
+	}
+	r.messages[key] = message
+	return true
+}
+
+func (r *reportedMessages) remove(key string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.messages, key)
+}
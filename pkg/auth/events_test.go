@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"errors"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/stretchr/testify/mock"
+	"sync"
+	"testing"
+)
+
+func TestAuth_report(t *testing.T) {
+
+	source := roleSource{kind: "ConfigMap", namespace: "payments", name: "vault-roles", uid: "abc"}
+
+	t.Run("when the same messages are reported from workers then event is created once", func(t *testing.T) {
+
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("CreateEvent", mock.MatchedBy(func(e k8s.Event) bool {
+			return e.UID == "abc" && e.Reason == eventReasonInvalidRole && e.Message == "a; b"
+		})).Return(nil).Once()
+
+		a := NewAuth(testConfig, nil, k8sClient)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.report(source, eventReasonInvalidRole, []string{"b", "a"})
+			}()
+		}
+		wg.Wait()
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when messages are cleared then the same messages are reported again", func(t *testing.T) {
+
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("CreateEvent", mock.Anything).Return(nil).Twice()
+
+		a := NewAuth(testConfig, nil, k8sClient)
+		a.report(source, eventReasonInvalidRole, []string{"a"})
+		a.report(source, eventReasonInvalidRole, nil)
+		a.report(source, eventReasonInvalidRole, []string{"a"})
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when event cannot be created then it is created on the next report", func(t *testing.T) {
+
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("CreateEvent", mock.Anything).Return(errors.New("test failure")).Once()
+		k8sClient.On("CreateEvent", mock.Anything).Return(nil).Once()
+
+		a := NewAuth(testConfig, nil, k8sClient)
+		a.report(source, eventReasonInvalidRole, []string{"a"})
+		a.report(source, eventReasonInvalidRole, []string{"a"})
+		a.report(source, eventReasonInvalidRole, []string{"a"})
+		k8sClient.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+)
+
+const (
+	ExportFormatConfigMap = "configmap"
+	ExportFormatFile      = "file"
+
+	// config map with exported mount spec and auth config
+	exportMountConfigMap = "vault-auth-mount"
+	exportMountSpecKey   = "mount-spec.json"
+	exportAuthConfigKey  = "auth-config.json"
+)
+
+type ExportVaultClient interface {
+	ListRoles() ([]string, error)
+	ReadRoleData(name string) (map[string]interface{}, error)
+	ReadAuthTune() (map[string]interface{}, error)
+	ReadAuthKubernetesConfig() (*vault.AuthKubernetesConfig, error)
+	ReadAuthJWTConfig() (*vault.AuthJWTConfig, error)
+}
+
+// roles (and optionally mount spec and auth config) of vault kubernetes auth mount, used to onboard mount with existing
+// roles, roles that are not in vault-auth-roles config map are deleted
+type Export struct {
+	Mount string
+	// mount spec (see mount-spec-file flag) and auth config (kubernetes or jwt), nil if not exported
+	MountSpec  *vault.MountSpec
+	AuthConfig interface{}
+	Roles      []ExportedRole
+}
+
+type ExportedRole struct {
+	Name string
+	Role vault.Role
+	// fields that are set in vault, but cannot be represented by vault-auth-kubernetes role, or reason why the role would
+	// be rejected, written as comments to exported role
+	Warnings []string
+}
+
+// read all roles (and mount spec and auth config of auth type if requested) of the mount
+func NewExport(vaultClient ExportVaultClient, mount, authType string, includeConfig bool) (Export, error) {
+
+	export := Export{Mount: mount}
+	if includeConfig {
+		tune, err := vaultClient.ReadAuthTune()
+		if err != nil {
+			return Export{}, fmt.Errorf("read auth tune: %w", err)
+		}
+		if tune == nil {
+			return Export{}, fmt.Errorf("auth %s is not mounted", mount)
+		}
+		spec := vault.NewMountSpecFromTune(tune)
+		export.MountSpec = &spec
+
+		if authType == vault.AuthTypeJWT {
+			config, err := vaultClient.ReadAuthJWTConfig()
+			if err != nil {
+				return Export{}, fmt.Errorf("read auth jwt config: %w", err)
+			}
+			if config != nil {
+				export.AuthConfig = config
+			}
+		} else {
+			config, err := vaultClient.ReadAuthKubernetesConfig()
+			if err != nil {
+				return Export{}, fmt.Errorf("read auth kubernetes config: %w", err)
+			}
+			if config != nil {
+				export.AuthConfig = config
+			}
+		}
+	}
+
+	roleNames, err := vaultClient.ListRoles()
+	if err != nil {
+		return Export{}, fmt.Errorf("list roles: %w", err)
+	}
+	sort.Strings(roleNames)
+	for _, roleName := range roleNames {
+		data, err := vaultClient.ReadRoleData(roleName)
+		if err != nil {
+			return Export{}, fmt.Errorf("read role %s: %w", roleName, err)
+		}
+		if data == nil {
+			// role was deleted after list
+			continue
+		}
+		role, unsupported, err := vault.NewRoleFromData(data)
+		if err != nil {
+			return Export{}, fmt.Errorf("role %s: %w", roleName, err)
+		}
+
+		exported := ExportedRole{Name: roleName, Role: role}
+		for _, field := range unsupported {
+			exported.Warnings = append(exported.Warnings, fmt.Sprintf("%s is not supported and it is not exported", field))
+		}
+		if rawRole, err := json.Marshal(role); err == nil {
+			if _, err := vault.NewRole(rawRole); err != nil {
+				exported.Warnings = append(exported.Warnings, fmt.Sprintf("role is invalid: %v", err))
+			}
+		}
+		export.Roles = append(export.Roles, exported)
+	}
+	return export, nil
+}
+
+// roles with warnings, exported roles with warnings are not identical to vault roles
+func (e Export) Warnings() []string {
+
+	var out []string
+	for _, role := range e.Roles {
+		for _, warning := range role.Warnings {
+			out = append(out, fmt.Sprintf("%s: %s", role.Name, warning))
+		}
+	}
+	return out
+}
+
+// export in format, configmap or file
+func (e Export) Format(format string) ([]byte, error) {
+
+	switch format {
+	case ExportFormatConfigMap:
+		return e.ConfigMap()
+	case ExportFormatFile:
+		return e.RolesFile()
+	}
+	return nil, fmt.Errorf("export format %q is not one of %s or %s", format, ExportFormatConfigMap, ExportFormatFile)
+}
+
+// vault-auth-roles config map manifest, every role is yaml value of the role name key
+func (e Export) ConfigMap() ([]byte, error) {
+
+	data := &yaml.Node{Kind: yaml.MappingNode}
+	for _, role := range e.Roles {
+		node, err := role.node()
+		if err != nil {
+			return nil, err
+		}
+		value, err := yaml.Marshal(node)
+		if err != nil {
+			return nil, fmt.Errorf("marshal role %s: %w", role.Name, err)
+		}
+		data.Content = append(data.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: role.Name},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: string(value), Style: yaml.LiteralStyle},
+		)
+	}
+
+	manifest := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]string{"name": vaultAuthConfigMap, "namespace": vaultAuthConfigNamespace},
+	}
+	var document yaml.Node
+	if err := document.Encode(manifest); err != nil {
+		return nil, err
+	}
+	document.Content = append(document.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "data"}, data)
+	return e.marshal(&document)
+}
+
+// config map with mount spec (mount-spec.json) and auth config (auth-config.json) as json, nil if they are not exported,
+// config map is not roles source, it is skipped in roles files
+func (e Export) mountConfigMap() (*yaml.Node, error) {
+
+	if e.MountSpec == nil {
+		return nil, nil
+	}
+
+	values := map[string]string{}
+	for key, value := range map[string]interface{}{exportMountSpecKey: e.MountSpec, exportAuthConfigKey: e.AuthConfig} {
+		if value == nil {
+			continue
+		}
+		b, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s: %w", key, err)
+		}
+		values[key] = string(b)
+	}
+
+	manifest := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]string{"name": exportMountConfigMap, "namespace": vaultAuthConfigNamespace},
+	}
+	var node, data yaml.Node
+	if err := node.Encode(manifest); err != nil {
+		return nil, err
+	}
+	if err := data.Encode(values); err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(data.Content); i += 2 {
+		data.Content[i].Style = yaml.LiteralStyle
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "data"}, &data)
+	node.HeadComment = "auth mount spec (mount-spec-file flag) and auth config (vault-kube-host flag and kube config CA, or jwt flags)"
+	return &node, nil
+}
+
+// roles file (see roles-file flag), mapping of role names to roles
+func (e Export) RolesFile() ([]byte, error) {
+
+	document := &yaml.Node{Kind: yaml.MappingNode}
+	for _, role := range e.Roles {
+		node, err := role.node()
+		if err != nil {
+			return nil, err
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: role.Name, HeadComment: node.HeadComment}
+		node.HeadComment = ""
+		document.Content = append(document.Content, key, node)
+	}
+	if len(document.Content) == 0 {
+		document.Style = yaml.FlowStyle
+	}
+	return e.marshal(document)
+}
+
+// yaml document with export header comment, followed by mount config map document if mount config is exported
+func (e Export) marshal(node *yaml.Node) ([]byte, error) {
+
+	headComment := fmt.Sprintf("exported from vault auth mount %s, roles that are not in vault-auth-roles are deleted", e.Mount)
+	out, err := yaml.Marshal(&yaml.Node{Kind: yaml.DocumentNode, HeadComment: headComment, Content: []*yaml.Node{node}})
+	if err != nil {
+		return nil, err
+	}
+
+	mountConfigMap, err := e.mountConfigMap()
+	if err != nil || mountConfigMap == nil {
+		return out, err
+	}
+	b, err := yaml.Marshal(mountConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(out, []byte("---\n")...), b...), nil
+}
+
+// role as yaml mapping, warnings are in head comment
+func (r ExportedRole) node() (*yaml.Node, error) {
+
+	b, err := json.Marshal(r.Role)
+	if err != nil {
+		return nil, fmt.Errorf("marshal role %s: %w", r.Name, err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("unmarshal role %s: %w", r.Name, err)
+	}
+	// keep exported roles short, empty fields are the same as missing fields
+	for k, v := range fields {
+		if v == nil || v == "" || v == float64(0) {
+			delete(fields, k)
+		}
+	}
+
+	var node yaml.Node
+	if err := node.Encode(fields); err != nil {
+		return nil, fmt.Errorf("encode role %s: %w", r.Name, err)
+	}
+	node.HeadComment = strings.Join(r.Warnings, "\n")
+	return &node, nil
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault/vaulttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewExport(t *testing.T) {
+
+	newExportClient := func(t *testing.T) (*vaulttest.Server, *vault.Client) {
+
+		server := vaulttest.NewServer()
+		t.Cleanup(server.Close)
+		server.AddAppRole("role-id", "secret-id", time.Hour, "root")
+		config := vault.Config{
+			HttpClient: &http.Client{Timeout: 5 * time.Second},
+			Host:       server.URL(),
+			RoleId:     "role-id",
+			SecretId:   "secret-id",
+			MinBackoff: time.Millisecond,
+			MaxBackoff: time.Millisecond,
+		}
+		client, err := vault.NewClient(config, reconcileVaultMount)
+		require.NoError(t, err)
+		_, err = client.InitAuthKubernetes("https://kube.host", []byte("--- CA ---"), []byte("jwt"), vault.AuthKubernetesOptions{})
+		require.NoError(t, err)
+
+		// roles created by hand or terraform, with fields vault-auth-kubernetes does not support
+		server.SetRole(reconcileVaultMount, "app", map[string]interface{}{
+			"bound_service_account_names":      []interface{}{"app"},
+			"bound_service_account_namespaces": []interface{}{"payments"},
+			"token_policies":                   []interface{}{"app", "default"},
+			"token_ttl":                        3600,
+			"token_max_ttl":                    7200,
+			"alias_name_source":                "serviceaccount_uid",
+		})
+		server.SetRole(reconcileVaultMount, "worker", map[string]interface{}{
+			"bound_service_account_names":      []interface{}{"worker"},
+			"bound_service_account_namespaces": []interface{}{"payments", "orders"},
+			"token_policies":                   []interface{}{"worker"},
+			"audience":                         "vault",
+		})
+		return server, client
+	}
+
+	t.Run("when roles are exported then unsupported fields are reported", func(t *testing.T) {
+
+		_, client := newExportClient(t)
+		export, err := NewExport(client, reconcileVaultMount, vault.AuthTypeKubernetes, false)
+		require.NoError(t, err)
+
+		require.Len(t, export.Roles, 2)
+		assert.Equal(t, "app", export.Roles[0].Name)
+		assert.Equal(t, []string{"token_max_ttl=7200 is not supported and it is not exported"}, export.Roles[0].Warnings)
+		assert.Equal(t, "worker", export.Roles[1].Name)
+		assert.Empty(t, export.Roles[1].Warnings)
+		assert.Equal(t, []string{"app: token_max_ttl=7200 is not supported and it is not exported"}, export.Warnings())
+		assert.Nil(t, export.MountSpec)
+		assert.Nil(t, export.AuthConfig)
+	})
+
+	t.Run("when roles are exported as config map then config map has the same roles as vault", func(t *testing.T) {
+
+		_, client := newExportClient(t)
+		export, err := NewExport(client, reconcileVaultMount, vault.AuthTypeKubernetes, true)
+		require.NoError(t, err)
+		b, err := export.Format(ExportFormatConfigMap)
+		require.NoError(t, err)
+		assert.Contains(t, string(b), "# token_max_ttl=7200 is not supported and it is not exported")
+
+		var configMap struct {
+			Kind     string            `yaml:"kind"`
+			Metadata map[string]string `yaml:"metadata"`
+			Data     map[string]string `yaml:"data"`
+		}
+		require.NoError(t, yaml.Unmarshal(b, &configMap))
+		assert.Equal(t, "ConfigMap", configMap.Kind)
+		assert.Equal(t, map[string]string{"name": vaultAuthConfigMap, "namespace": vaultAuthConfigNamespace}, configMap.Metadata)
+
+		definitions, violations := configMapRoleDefinitions(k8s.ConfigMap{Data: configMap.Data})
+		require.Empty(t, violations)
+		assertExportedRoles(t, export, definitions)
+	})
+
+	t.Run("when mount config is exported then mount spec and auth config are in mount config map", func(t *testing.T) {
+
+		_, client := newExportClient(t)
+		export, err := NewExport(client, reconcileVaultMount, vault.AuthTypeKubernetes, true)
+		require.NoError(t, err)
+		b, err := export.Format(ExportFormatConfigMap)
+		require.NoError(t, err)
+
+		configMap := exportedMountConfigMap(t, b)
+		spec := vault.DefaultMountSpec()
+		require.NoError(t, json.Unmarshal([]byte(configMap.Data[exportMountSpecKey]), &spec))
+		assert.Equal(t, "Kubernetes auth backend for RUN cluster", spec.Description)
+		assert.Equal(t, "31536000", spec.MaxLeaseTTL)
+
+		var config vault.AuthKubernetesConfig
+		require.NoError(t, json.Unmarshal([]byte(configMap.Data[exportAuthConfigKey]), &config))
+		assert.Equal(t, "https://kube.host", config.KubernetesHost)
+		assert.Equal(t, "--- CA ---", config.KubernetesCACert)
+	})
+
+	t.Run("when mount config of jwt auth is exported then auth config is jwt config", func(t *testing.T) {
+
+		server := vaulttest.NewServer()
+		t.Cleanup(server.Close)
+		server.AddAppRole("role-id", "secret-id", time.Hour, "root")
+		config := vault.Config{
+			HttpClient:  &http.Client{Timeout: 5 * time.Second},
+			Host:        server.URL(),
+			RoleId:      "role-id",
+			SecretId:    "secret-id",
+			AuthType:    vault.AuthTypeJWT,
+			JWTAudience: "vault",
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  time.Millisecond,
+		}
+		client, err := vault.NewClient(config, reconcileVaultMount)
+		require.NoError(t, err)
+		_, err = client.InitAuthJWT("https://kubernetes.default.svc", []string{"--- KEY ---"})
+		require.NoError(t, err)
+
+		export, err := NewExport(client, reconcileVaultMount, vault.AuthTypeJWT, true)
+		require.NoError(t, err)
+		b, err := export.Format(ExportFormatConfigMap)
+		require.NoError(t, err)
+
+		var jwtConfig vault.AuthJWTConfig
+		require.NoError(t, json.Unmarshal([]byte(exportedMountConfigMap(t, b).Data[exportAuthConfigKey]), &jwtConfig))
+		assert.Equal(t, vault.AuthJWTConfig{BoundIssuer: "https://kubernetes.default.svc", JWTValidationPubkeys: []string{"--- KEY ---"}}, jwtConfig)
+	})
+
+	t.Run("when mount config is exported and auth is not mounted then error is returned", func(t *testing.T) {
+
+		server := vaulttest.NewServer()
+		t.Cleanup(server.Close)
+		server.AddAppRole("role-id", "secret-id", time.Hour, "root")
+		config := vault.Config{HttpClient: &http.Client{Timeout: 5 * time.Second}, Host: server.URL(), RoleId: "role-id", SecretId: "secret-id"}
+		client, err := vault.NewClient(config, reconcileVaultMount)
+		require.NoError(t, err)
+
+		_, err = NewExport(client, reconcileVaultMount, vault.AuthTypeKubernetes, true)
+		require.Error(t, err)
+	})
+
+	t.Run("when roles are exported as roles file with mount config then file has the same roles as vault", func(t *testing.T) {
+
+		_, client := newExportClient(t)
+		export, err := NewExport(client, reconcileVaultMount, vault.AuthTypeKubernetes, true)
+		require.NoError(t, err)
+		b, err := export.Format(ExportFormatFile)
+		require.NoError(t, err)
+		assert.NotEmpty(t, exportedMountConfigMap(t, b).Data[exportMountSpecKey])
+
+		file := filepath.Join(t.TempDir(), "roles.yaml")
+		require.NoError(t, os.WriteFile(file, b, 0600))
+		definitions, err := readRoleFile(file)
+		require.NoError(t, err)
+		assertExportedRoles(t, export, definitions)
+	})
+
+	t.Run("when roles are exported as roles file then file has the same roles as vault", func(t *testing.T) {
+
+		_, client := newExportClient(t)
+		export, err := NewExport(client, reconcileVaultMount, vault.AuthTypeKubernetes, false)
+		require.NoError(t, err)
+		b, err := export.Format(ExportFormatFile)
+		require.NoError(t, err)
+
+		file := filepath.Join(t.TempDir(), "roles.yaml")
+		require.NoError(t, os.WriteFile(file, b, 0600))
+		definitions, err := readRoleFile(file)
+		require.NoError(t, err)
+		assertExportedRoles(t, export, definitions)
+	})
+
+	t.Run("when format is unknown then error is returned", func(t *testing.T) {
+
+		_, err := Export{}.Format("crd")
+		require.Error(t, err)
+	})
+}
+
+func assertExportedRoles(t *testing.T, export Export, definitions []roleDefinition) {
+
+	roles, violations := newVaultRoles(roleSource{}, definitions)
+	require.Empty(t, violations)
+	require.Len(t, roles, len(export.Roles))
+	for _, exported := range export.Roles {
+		assert.True(t, exported.Role.Equal(roles[exported.Name].Role), exported.Name)
+	}
+}
+
+// the second document of export output
+func exportedMountConfigMap(t *testing.T, b []byte) k8s.ConfigMap {
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	var roles, mount struct {
+		Metadata map[string]string `yaml:"metadata"`
+		Data     map[string]string `yaml:"data"`
+	}
+	require.NoError(t, decoder.Decode(&roles))
+	require.NoError(t, decoder.Decode(&mount))
+	assert.Equal(t, map[string]string{"name": exportMountConfigMap, "namespace": vaultAuthConfigNamespace}, mount.Metadata)
+	return k8s.ConfigMap{Name: mount.Metadata["name"], Namespace: mount.Metadata["namespace"], Data: mount.Data}
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// characters that make namespace a glob pattern
+const globChars = "*?["
+
+// guardrails are central rules that limit what vault roles can request, every rule that applies to the role has to pass
+// e.g. {"rules": [{"namespace_labels": {"team": "payments"}, "allowed_policies": ["payments-*"], "max_token_ttl": 3600}]}
+type Guardrails struct {
+	Rules []GuardrailRule `json:"rules"`
+}
+
+// rule applies to role bound to any namespace matching namespaces (glob patterns) and namespace labels, rule without
+// namespaces and namespace labels applies to all roles
+type GuardrailRule struct {
+	Namespaces               []string          `json:"namespaces"`
+	NamespaceLabels          map[string]string `json:"namespace_labels"`
+	AllowedPolicies          []string          `json:"allowed_policies"`
+	MaxTokenTTL              int               `json:"max_token_ttl"`
+	ForbidWildcardNamespaces bool              `json:"forbid_wildcard_namespaces"`
+	ForbidWildcardNames      bool              `json:"forbid_wildcard_names"`
+	RequiredAudience         string            `json:"required_audience"`
+	// acl_policies of the role cannot grant paths overlapping these glob patterns nor these capabilities
+	ForbiddenPolicyPaths        []string `json:"forbidden_policy_paths"`
+	ForbiddenPolicyCapabilities []string `json:"forbidden_policy_capabilities"`
+}
+
+func LoadGuardrails(file string) (Guardrails, error) {
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return Guardrails{}, fmt.Errorf("read guardrails file: %w", err)
+	}
+
+	var guardrails Guardrails
+	if err := json.Unmarshal(b, &guardrails); err != nil {
+		return Guardrails{}, fmt.Errorf("unmarshal guardrails: %w", err)
+	}
+	for i, rule := range guardrails.Rules {
+		for _, pattern := range append(append(rule.Namespaces, rule.AllowedPolicies...), rule.ForbiddenPolicyPaths...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return Guardrails{}, fmt.Errorf("rule %d: invalid pattern %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return guardrails, nil
+}
+
+func (g Guardrails) hasNamespaceLabels() bool {
+
+	for _, rule := range g.Rules {
+		if len(rule.NamespaceLabels) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// returns violations of all rules that apply to the role, role is allowed if there are no violations
+func (g Guardrails) check(role vaultRole, namespaces []k8s.Namespace) []string {
+
+	var violations []string
+	for i, rule := range g.Rules {
+		if !rule.appliesTo(role, namespaces) {
+			continue
+		}
+		for _, violation := range rule.check(role) {
+			violations = append(violations, fmt.Sprintf("guardrail rule %d: %s", i, violation))
+		}
+	}
+	return violations
+}
+
+func (r GuardrailRule) appliesTo(role vaultRole, namespaces []k8s.Namespace) bool {
+
+	if len(r.Namespaces) == 0 && len(r.NamespaceLabels) == 0 {
+		return true
+	}
+
+	labelsByNamespace := make(map[string]map[string]string)
+	for _, namespace := range namespaces {
+		labelsByNamespace[namespace.Name] = namespace.Labels
+	}
+
+	for _, namespace := range role.BoundServiceAccountNamespaces {
+		// glob (e.g. '*' or 'payment*') binds role to namespaces that may not exist yet, so labels cannot be checked
+		// and rule applies if its namespaces can match the same namespace
+		if isGlob(namespace) {
+			if len(r.Namespaces) == 0 || overlapsAny(namespace, r.Namespaces) {
+				return true
+			}
+			continue
+		}
+		if r.matchesNamespace(namespace, labelsByNamespace[namespace]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r GuardrailRule) matchesNamespace(namespace string, labels map[string]string) bool {
+
+	if len(r.Namespaces) != 0 && !matchesAny(namespace, r.Namespaces) {
+		return false
+	}
+	for k, v := range r.NamespaceLabels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (r GuardrailRule) check(role vaultRole) []string {
+
+	var violations []string
+	if len(r.AllowedPolicies) != 0 {
+		for _, policy := range role.TokenPolicies {
+			if !matchesAny(policy, r.AllowedPolicies) {
+				violations = append(violations, fmt.Sprintf("token policy %q is not allowed", policy))
+			}
+		}
+	}
+	// token ttl 0 means system default, which is not limited by the role
+	if r.MaxTokenTTL != 0 && (role.TokenTTL == 0 || role.TokenTTL > r.MaxTokenTTL) {
+		violations = append(violations, fmt.Sprintf("token ttl %d is not between 1 and %d", role.TokenTTL, r.MaxTokenTTL))
+	}
+	if r.ForbidWildcardNamespaces && util.StringSliceContains(role.BoundServiceAccountNamespaces, "*") {
+		violations = append(violations, "wildcard bound service account namespaces are not allowed")
+	}
+	if r.ForbidWildcardNames && util.StringSliceContains(role.BoundServiceAccountNames, "*") {
+		violations = append(violations, "wildcard bound service account names are not allowed")
+	}
+	if r.RequiredAudience != "" && role.Audience != r.RequiredAudience {
+		violations = append(violations, fmt.Sprintf("audience %q is required", r.RequiredAudience))
+	}
+	if len(r.ForbiddenPolicyPaths) != 0 || len(r.ForbiddenPolicyCapabilities) != 0 {
+		violations = append(violations, r.checkACLPolicies(role.aclPolicies)...)
+	}
+	return violations
+}
+
+// acl policy documents are checked before they are rendered, template actions and vault templated parts of the path are
+// treated as '*'
+func (r GuardrailRule) checkACLPolicies(aclPolicies map[string]string) []string {
+
+	var names []string
+	for name := range aclPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var violations []string
+	for _, name := range names {
+		paths, err := parsePolicyPaths(aclPolicies[name])
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("acl policy %s cannot be checked: %v", name, err))
+			continue
+		}
+		for _, p := range paths {
+			if overlapsAny(policyPathPattern(p.path), r.ForbiddenPolicyPaths) {
+				violations = append(violations, fmt.Sprintf("acl policy %s path %q is not allowed", name, p.path))
+			}
+			for _, capability := range p.capabilities {
+				if util.StringSliceContains(r.ForbiddenPolicyCapabilities, capability) {
+					violations = append(violations, fmt.Sprintf("acl policy %s path %q capability %q is not allowed", name, p.path, capability))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+func matchesAny(value string, patterns []string) bool {
+
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, globChars)
+}
+
+// true if any of the patterns can match the same value as glob, literal prefixes and suffixes of the patterns are
+// compared, so it can be true for patterns that do not match the same value (e.g. 'a*x' and 'a*y'), but never false
+// for patterns that do
+func overlapsAny(glob string, patterns []string) bool {
+
+	for _, pattern := range patterns {
+		globPrefix, globSuffix := literalAffixes(glob)
+		prefix, suffix := literalAffixes(pattern)
+		if (strings.HasPrefix(globPrefix, prefix) || strings.HasPrefix(prefix, globPrefix)) &&
+			(strings.HasSuffix(globSuffix, suffix) || strings.HasSuffix(suffix, globSuffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pattern before the first and after the last special character, whole pattern if it does not have any
+func literalAffixes(pattern string) (string, string) {
+
+	first := strings.IndexAny(pattern, globChars)
+	if first == -1 {
+		return pattern, pattern
+	}
+	return pattern[:first], pattern[strings.LastIndexAny(pattern, globChars+"]")+1:]
+}
+
+// returns roles that pass guardrails, denied roles are logged and reported on their source
+func (a Auth) applyGuardrails(roles vaultRoles, namespaces []k8s.Namespace) vaultRoles {
+
+	if len(a.config.Guardrails.Rules) == 0 {
+		return roles
+	}
+
+	allowed := make(vaultRoles)
+	deniedBySource := make(map[roleSource][]string)
+	for roleName, role := range roles {
+		violations := a.config.Guardrails.check(role, namespaces)
+		if len(violations) == 0 {
+			allowed[roleName] = role
+			// keep the source, so previously reported event is cleared
+			deniedBySource[role.source] = deniedBySource[role.source]
+			continue
+		}
+		a.status.setDenied(roleName, violations)
+		for _, violation := range violations {
+			logger.Errorf("vault role %s from %s denied: %s", roleName, role.source, violation)
+			deniedBySource[role.source] = append(deniedBySource[role.source], fmt.Sprintf("%s: %s", roleName, violation))
+		}
+	}
+
+	for source, messages := range deniedBySource {
+		a.report(source, eventReasonDeniedRole, messages)
+	}
+	return allowed
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadGuardrails(t *testing.T) {
+
+	t.Run("when guardrails file is valid then rules are returned", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "guardrails.json")
+		content := `{"rules": [{"namespaces": ["kube-*"], "allowed_policies": ["kube-*"], "max_token_ttl": 3600, "forbid_wildcard_names": true}]}`
+		require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+
+		guardrails, err := LoadGuardrails(file)
+		require.NoError(t, err)
+		assert.Equal(t, Guardrails{Rules: []GuardrailRule{{
+			Namespaces:          []string{"kube-*"},
+			AllowedPolicies:     []string{"kube-*"},
+			MaxTokenTTL:         3600,
+			ForbidWildcardNames: true,
+		}}}, guardrails)
+	})
+
+	t.Run("when guardrails file contains invalid pattern then error is returned", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "guardrails.json")
+		require.NoError(t, os.WriteFile(file, []byte(`{"rules": [{"allowed_policies": ["[admin"]}]}`), 0600))
+
+		_, err := LoadGuardrails(file)
+		require.Error(t, err)
+	})
+
+	t.Run("when guardrails file does not exist then error is returned", func(t *testing.T) {
+
+		_, err := LoadGuardrails(filepath.Join(t.TempDir(), "missing.json"))
+		require.Error(t, err)
+	})
+}
+
+func TestGuardrails_check(t *testing.T) {
+
+	namespaces := []k8s.Namespace{
+		{Name: "payments", Labels: map[string]string{"team": "payments"}},
+		{Name: "kube-system"},
+	}
+	guardrails := Guardrails{Rules: []GuardrailRule{
+		{ForbidWildcardNamespaces: true},
+		{NamespaceLabels: map[string]string{"team": "payments"}, AllowedPolicies: []string{"payments-*"}, MaxTokenTTL: 3600},
+		{Namespaces: []string{"kube-*"}, RequiredAudience: "vault"},
+	}}
+
+	t.Run("when role passes all rules that apply to it then there are no violations", func(t *testing.T) {
+
+		role := vaultRole{Role: vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"payments-read"},
+			TokenTTL:                      600,
+		}}
+		assert.Empty(t, guardrails.check(role, namespaces))
+	})
+
+	t.Run("when role violates rule selected by namespace labels then violations are returned", func(t *testing.T) {
+
+		role := vaultRole{Role: vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"payments-read", "admin"},
+		}}
+		assert.Equal(t, []string{
+			`guardrail rule 1: token policy "admin" is not allowed`,
+			"guardrail rule 1: token ttl 0 is not between 1 and 3600",
+		}, guardrails.check(role, namespaces))
+	})
+
+	t.Run("when role is bound to wildcard namespace then all rules apply", func(t *testing.T) {
+
+		role := vaultRole{Role: vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"*"},
+			TokenPolicies:                 []string{"payments-read"},
+			TokenTTL:                      600,
+		}}
+		assert.Equal(t, []string{
+			"guardrail rule 0: wildcard bound service account namespaces are not allowed",
+			`guardrail rule 2: audience "vault" is required`,
+		}, guardrails.check(role, namespaces))
+	})
+
+	t.Run("when role is bound to glob namespace then rules with namespaces matching glob apply", func(t *testing.T) {
+
+		role := vaultRole{Role: vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"kube*"},
+			TokenPolicies:                 []string{"payments-read"},
+			TokenTTL:                      600,
+		}}
+		assert.Equal(t, []string{`guardrail rule 2: audience "vault" is required`}, guardrails.check(role, namespaces))
+	})
+
+	t.Run("when role is bound to glob namespace then rules with namespace labels apply", func(t *testing.T) {
+
+		role := vaultRole{Role: vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"orders", "payment*"},
+			TokenPolicies:                 []string{"admin"},
+			TokenTTL:                      600,
+		}}
+		assert.Equal(t, []string{`guardrail rule 1: token policy "admin" is not allowed`}, guardrails.check(role, namespaces))
+	})
+
+	t.Run("when role is bound to namespace not selected by rules then only rules without selectors apply", func(t *testing.T) {
+
+		role := vaultRole{Role: vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"orders"},
+			TokenPolicies:                 []string{"admin"},
+		}}
+		assert.Empty(t, guardrails.check(role, namespaces))
+	})
+}
+
+func TestGuardrails_checkACLPolicies(t *testing.T) {
+
+	guardrails := Guardrails{Rules: []GuardrailRule{{
+		AllowedPolicies:             []string{"payments-*"},
+		ForbiddenPolicyPaths:        []string{"sys/*", "auth/*"},
+		ForbiddenPolicyCapabilities: []string{"sudo"},
+	}}}
+	newRole := func(aclPolicies map[string]string) vaultRole {
+		return vaultRole{
+			Role:        withPolicyNames(vault.Role{BoundServiceAccountNamespaces: []string{"payments"}}, aclPolicies),
+			aclPolicies: aclPolicies,
+		}
+	}
+
+	t.Run("when acl policy with allowed name grants forbidden path and capability then violations are returned", func(t *testing.T) {
+
+		role := newRole(map[string]string{"payments-kv": `path "*" { capabilities = ["create", "read", "update", "delete", "list", "sudo"] }`})
+		assert.Equal(t, []string{
+			`guardrail rule 0: acl policy payments-kv path "*" is not allowed`,
+			`guardrail rule 0: acl policy payments-kv path "*" capability "sudo" is not allowed`,
+		}, guardrails.check(role, nil))
+	})
+
+	t.Run("when acl policy grants templated or wildcard segment path under forbidden path then violations are returned", func(t *testing.T) {
+
+		role := newRole(map[string]string{"payments-kv": `
+# kv of the role
+path "secret/data/[[ .Role ]]/*" {
+  capabilities = ["read"]
+}
+path "auth/+/login" {
+  capabilities = ["update"]
+}`})
+		assert.Equal(t, []string{`guardrail rule 0: acl policy payments-kv path "auth/+/login" is not allowed`}, guardrails.check(role, nil))
+	})
+
+	t.Run("when acl policy grants allowed paths and capabilities then there are no violations", func(t *testing.T) {
+
+		role := newRole(map[string]string{"payments-kv": `path "secret/data/payments/*" { capabilities = ["read", "list"] }`})
+		assert.Empty(t, guardrails.check(role, nil))
+	})
+
+	t.Run("when acl policy is not made of path blocks then it is denied", func(t *testing.T) {
+
+		role := newRole(map[string]string{"payments-kv": `{"path": {"sys/*": {"capabilities": ["sudo"]}}}`})
+		violations := guardrails.check(role, nil)
+		require.Len(t, violations, 1)
+		assert.Contains(t, violations[0], "acl policy payments-kv cannot be checked")
+	})
+
+	t.Run("when acl policy name is not allowed then violation is returned", func(t *testing.T) {
+
+		role := newRole(map[string]string{"admin": `path "secret/data/payments/*" { capabilities = ["read"] }`})
+		assert.Equal(t, []string{`guardrail rule 0: token policy "admin" is not allowed`}, guardrails.check(role, nil))
+	})
+}
+
+func TestOverlapsAny(t *testing.T) {
+
+	assert.True(t, overlapsAny("payment*", []string{"payments"}))
+	assert.True(t, overlapsAny("payment*", []string{"kube-*", "pay*"}))
+	assert.True(t, overlapsAny("*-prod", []string{"payments-*"}))
+	assert.True(t, overlapsAny("team-?", []string{"team-[ab]"}))
+	assert.False(t, overlapsAny("payment*", []string{"kube-*", "orders"}))
+	assert.False(t, overlapsAny("*-prod", []string{"*-dev"}))
+}
+
+func TestAuth_applyGuardrails(t *testing.T) {
+
+	t.Run("when role is denied then it is not returned and it is reported only once on its source", func(t *testing.T) {
+
+		config := testConfig
+		config.Guardrails = Guardrails{Rules: []GuardrailRule{{AllowedPolicies: []string{"tenant-*"}}}}
+		source := roleSource{kind: "ConfigMap", namespace: "payments", name: "vault-roles", uid: "abc"}
+		roles := vaultRoles{
+			"allowed": {Role: vault.Role{BoundServiceAccountNamespaces: []string{"payments"}, TokenPolicies: []string{"tenant-payments"}}, source: source},
+			"denied":  {Role: vault.Role{BoundServiceAccountNamespaces: []string{"payments"}, TokenPolicies: []string{"admin"}}, source: source},
+		}
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("CreateEvent", mock.MatchedBy(func(e k8s.Event) bool {
+			return e.UID == "abc" && e.Reason == eventReasonDeniedRole &&
+				e.Message == `denied: guardrail rule 0: token policy "admin" is not allowed`
+		})).Return(nil).Once()
+
+		a := NewAuth(config, nil, k8sClient)
+		for i := 0; i < 2; i++ {
+			allowed := a.applyGuardrails(roles, nil)
+			require.Equal(t, 1, len(allowed))
+			assert.Contains(t, allowed, "allowed")
+		}
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when there are no guardrails then all roles are returned", func(t *testing.T) {
+
+		roles := vaultRoles{"admin": {Role: vault.Role{TokenPolicies: []string{"admin"}}}}
+		assert.Equal(t, roles, NewAuth(testConfig, nil, nil).applyGuardrails(roles, nil))
+	})
+}
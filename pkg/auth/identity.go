@@ -0,0 +1,508 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metadata keys of entities and groups written by this application, entity or group is managed by this application if
+// managed_by and mount metadata match
+const (
+	identityManagedByKey      = "managed_by"
+	identityMountKey          = "mount"
+	identityClusterKey        = "cluster"
+	identityNamespaceKey      = "namespace"
+	identityServiceAccountKey = "service_account"
+	identityLabelKey          = "label"
+	identityLabelValueKey     = "label_value"
+
+	identityManagedBy = "vault-auth-kubernetes"
+)
+
+var errIdentityNotManaged = errors.New("exists in vault and it is not managed by vault-auth-kubernetes for this mount")
+
+// entity of managed service account, entity name is 'kubernetes/<mount>/<namespace>/<service-account>'
+type identityEntity struct {
+	name      string
+	metadata  map[string]string
+	aliasName string
+}
+
+// group of entities by namespace ('kubernetes/<mount>/namespace/<namespace>') or by namespace label value
+// ('kubernetes/<mount>/<label>/<value>'), members are entity names
+type identityGroup struct {
+	name     string
+	metadata map[string]string
+	members  []string
+}
+
+// entity id and hash of the last written (or read) entity
+type identityRecord struct {
+	id   string
+	hash string
+}
+
+// entities and groups written by this application, state is refreshed from vault when roles are verified
+type identityState struct {
+	mu       sync.Mutex
+	entities map[string]identityRecord
+	// hash of the last written (or read) group by group name
+	groups map[string]string
+}
+
+func newIdentityState() *identityState {
+	return &identityState{entities: make(map[string]identityRecord), groups: make(map[string]string)}
+}
+
+func (s *identityState) refresh(entities map[string]identityRecord, groups map[string]string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entities, s.groups = entities, groups
+}
+
+func (s *identityState) entity(name string) (identityRecord, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.entities[name]
+	return record, ok
+}
+
+func (s *identityState) setEntity(name string, record identityRecord) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entities[name] = record
+}
+
+func (s *identityState) removeEntity(name string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entities, name)
+}
+
+func (s *identityState) group(name string) (string, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, ok := s.groups[name]
+	return hash, ok
+}
+
+func (s *identityState) setGroup(name, hash string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[name] = hash
+}
+
+func (s *identityState) removeGroup(name string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups, name)
+}
+
+// sorted names of entities and groups written by this application
+func (s *identityState) names() (entities, groups []string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.entities {
+		entities = append(entities, name)
+	}
+	for name := range s.groups {
+		groups = append(groups, name)
+	}
+	sort.Strings(entities)
+	sort.Strings(groups)
+	return entities, groups
+}
+
+// write entities with entity aliases for service accounts of allowed roles and groups for namespaces (or namespace label
+// values), entities and groups that are no longer needed are deleted (entities of denied roles are kept), entities and
+// groups are listed and read from vault only when verify is true
+func (a Auth) reconcileIdentity(serviceAccountsSetByNamespace, keptServiceAccountsSetByNamespace map[string]map[string]struct{}, namespaces []k8s.Namespace, verify bool) {
+
+	if !a.config.Identity {
+		return
+	}
+	accessor := a.vaultClient.AuthAccessor()
+	if accessor == "" {
+		logger.Errorf("identity: auth mount accessor is not known, entities are not written")
+		return
+	}
+	if namespaces == nil {
+		var err error
+		if namespaces, err = a.k8sClient.GetNamespacesMeta(); err != nil {
+			logger.Errorf("identity: get namespaces: %v", err)
+			return
+		}
+	}
+
+	entities, groups, err := a.newIdentity(serviceAccountsSetByNamespace, namespaces)
+	if err != nil {
+		// stop here, otherwise entities of service accounts that could not be listed would be deleted
+		logger.Errorf("identity: %v", err)
+		return
+	}
+	if verify {
+		a.verifyIdentity(accessor)
+	}
+
+	ids := a.writeEntities(entities, accessor)
+	a.pruneEntities(entities, keptServiceAccountsSetByNamespace)
+	a.writeGroups(groups, ids)
+	a.pruneGroups(groups)
+}
+
+// entities of managed service accounts that exist in kubernetes and their groups
+func (a Auth) newIdentity(serviceAccountsSetByNamespace map[string]map[string]struct{}, namespaces []k8s.Namespace) (map[string]identityEntity, map[string]identityGroup, error) {
+
+	aliasNameSource := a.vaultClient.AuthAliasNameSource()
+	entities := make(map[string]identityEntity)
+	groups := make(map[string]identityGroup)
+	for _, namespace := range namespaces {
+		serviceAccountsSet, ok := serviceAccountsSetByNamespace[namespace.Name]
+		if !ok {
+			continue
+		}
+		uids, err := a.k8sClient.GetServiceAccountUIDs(namespace.Name, serviceAccountAnnotations)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get service accounts in %s namespace: %w", namespace.Name, err)
+		}
+
+		group, hasGroup := a.newIdentityGroup(namespace)
+		for serviceAccount := range serviceAccountsSet {
+			uid, ok := uids[serviceAccount]
+			if !ok {
+				continue
+			}
+			entity := a.newIdentityEntity(namespace.Name, serviceAccount, uid, aliasNameSource)
+			entities[entity.name] = entity
+			if hasGroup {
+				group.members = append(group.members, entity.name)
+			}
+		}
+		if hasGroup && len(group.members) != 0 {
+			if existing, ok := groups[group.name]; ok {
+				group.members = append(existing.members, group.members...)
+			}
+			sort.Strings(group.members)
+			groups[group.name] = group
+		}
+	}
+	return entities, groups, nil
+}
+
+func (a Auth) newIdentityEntity(namespace, serviceAccount, uid, aliasNameSource string) identityEntity {
+
+	aliasName := uid
+	switch aliasNameSource {
+	case vault.AliasNameSourceName:
+		aliasName = fmt.Sprintf("%s/%s", namespace, serviceAccount)
+	case vault.AliasNameSourceSubject:
+		aliasName = fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccount)
+	}
+	metadata := a.identityMetadata()
+	metadata[identityNamespaceKey] = namespace
+	metadata[identityServiceAccountKey] = serviceAccount
+	return identityEntity{
+		name:      a.identityEntityName(namespace, serviceAccount),
+		metadata:  metadata,
+		aliasName: aliasName,
+	}
+}
+
+func (a Auth) identityEntityName(namespace, serviceAccount string) string {
+	return fmt.Sprintf("%s/%s/%s", a.vaultMount(), namespace, serviceAccount)
+}
+
+// group of the namespace, namespaces without group label (if the label is set) are not in any group
+func (a Auth) newIdentityGroup(namespace k8s.Namespace) (identityGroup, bool) {
+
+	metadata := a.identityMetadata()
+	label := a.config.IdentityGroupLabel
+	if label == "" {
+		metadata[identityNamespaceKey] = namespace.Name
+		return identityGroup{name: fmt.Sprintf("%s/namespace/%s", a.vaultMount(), namespace.Name), metadata: metadata}, true
+	}
+	value, ok := namespace.Labels[label]
+	if !ok || value == "" {
+		return identityGroup{}, false
+	}
+	metadata[identityLabelKey] = label
+	metadata[identityLabelValueKey] = value
+	return identityGroup{name: fmt.Sprintf("%s/%s/%s", a.vaultMount(), label, value), metadata: metadata}, true
+}
+
+func (a Auth) identityMetadata() map[string]string {
+
+	return map[string]string{
+		identityManagedByKey: identityManagedBy,
+		identityMountKey:     a.vaultMount(),
+		identityClusterKey:   a.config.VaultMount,
+	}
+}
+
+func (a Auth) ownsIdentity(metadata map[string]string) bool {
+	return metadata[identityManagedByKey] == identityManagedBy && metadata[identityMountKey] == a.vaultMount()
+}
+
+// list and read entities and groups of this mount from vault, previous state of entity or group is kept if it cannot
+// be read
+func (a Auth) verifyIdentity(accessor string) {
+
+	prefix := a.vaultMount() + "/"
+	entityNames, err := a.vaultClient.ListEntities()
+	if err != nil {
+		logger.Errorf("verify identity: list entities: %v", err)
+		return
+	}
+	groupNames, err := a.vaultClient.ListGroups()
+	if err != nil {
+		logger.Errorf("verify identity: list groups: %v", err)
+		return
+	}
+
+	entities := make(map[string]identityRecord)
+	for _, name := range entityNames {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		entity, err := a.vaultClient.ReadEntity(name)
+		if err != nil {
+			logger.Errorf("verify identity: read entity %s: %v", name, err)
+			if record, ok := a.identity.entity(name); ok {
+				entities[name] = record
+			}
+			continue
+		}
+		if entity == nil || !a.ownsIdentity(entity.Metadata) {
+			continue
+		}
+		var aliasName string
+		if alias := entity.Alias(accessor); alias != nil {
+			aliasName = alias.Name
+		}
+		entities[name] = identityRecord{id: entity.ID, hash: identityHash(entity.Metadata, aliasName, accessor)}
+	}
+
+	groups := make(map[string]string)
+	for _, name := range groupNames {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		group, err := a.vaultClient.ReadGroup(name)
+		if err != nil {
+			logger.Errorf("verify identity: read group %s: %v", name, err)
+			if hash, ok := a.identity.group(name); ok {
+				groups[name] = hash
+			}
+			continue
+		}
+		if group == nil || !a.ownsIdentity(group.Metadata) {
+			continue
+		}
+		members := append([]string{}, group.MemberEntityIDs...)
+		sort.Strings(members)
+		groups[name] = identityHash(group.Metadata, members)
+	}
+	a.identity.refresh(entities, groups)
+}
+
+// write entities and their aliases, returns entity ids by entity name
+func (a Auth) writeEntities(entities map[string]identityEntity, accessor string) map[string]string {
+
+	var names []string
+	for name := range entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var mu sync.Mutex
+	ids := make(map[string]string)
+	util.ForEach(a.config.Workers, names, func(name string) {
+		id, err := a.writeEntity(entities[name], accessor)
+		if err != nil {
+			logger.Errorf("write identity entity %s: %v", name, err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ids[name] = id
+	})
+	return ids
+}
+
+// write entity and its alias if they differ from the last written entity, entity that exists and is not managed by
+// this application is not changed
+func (a Auth) writeEntity(entity identityEntity, accessor string) (string, error) {
+
+	hash := identityHash(entity.metadata, entity.aliasName, accessor)
+	record, ok := a.identity.entity(entity.name)
+	if ok && record.hash == hash {
+		return record.id, nil
+	}
+	if !ok {
+		existing, err := a.vaultClient.ReadEntity(entity.name)
+		if err != nil {
+			return "", err
+		}
+		if existing != nil && !a.ownsIdentity(existing.Metadata) {
+			return "", fmt.Errorf("entity %w", errIdentityNotManaged)
+		}
+	}
+
+	if err := a.vaultClient.WriteEntity(entity.name, entity.metadata); err != nil {
+		return "", err
+	}
+	written, err := a.vaultClient.ReadEntity(entity.name)
+	if err != nil {
+		return "", err
+	}
+	if written == nil {
+		return "", errors.New("entity not found after write")
+	}
+	if err := a.writeEntityAlias(*written, entity.aliasName, accessor); err != nil {
+		return "", fmt.Errorf("entity alias %s: %w", entity.aliasName, err)
+	}
+	a.identity.setEntity(entity.name, identityRecord{id: written.ID, hash: hash})
+	return written.ID, nil
+}
+
+// entity can have only one alias of the auth mount, alias with old name (e.g. service account was created again) is
+// deleted and alias created by vault on login (anonymous entity) is moved to the entity
+func (a Auth) writeEntityAlias(entity vault.Entity, aliasName, accessor string) error {
+
+	alias := entity.Alias(accessor)
+	if alias != nil && alias.Name == aliasName {
+		return nil
+	}
+	if alias != nil {
+		if err := a.vaultClient.DeleteEntityAlias(alias.ID); err != nil {
+			return err
+		}
+	}
+
+	desired := vault.EntityAlias{Name: aliasName, CanonicalID: entity.ID, MountAccessor: accessor}
+	owner, err := a.vaultClient.LookupEntityByAlias(aliasName, accessor)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		if ownerAlias := owner.Alias(accessor); ownerAlias != nil && ownerAlias.Name == aliasName {
+			logger.Logf("moving entity alias %s from entity %s to entity %s", aliasName, owner.Name, entity.Name)
+			desired.ID = ownerAlias.ID
+		}
+	}
+	return a.vaultClient.WriteEntityAlias(desired)
+}
+
+// delete entities written by this application that are not in desired entities nor entities of kept service accounts,
+// deleted entity aliases are deleted by vault as well
+func (a Auth) pruneEntities(entities map[string]identityEntity, keptServiceAccountsSetByNamespace map[string]map[string]struct{}) {
+
+	kept := make(map[string]struct{})
+	for namespace, serviceAccountsSet := range keptServiceAccountsSetByNamespace {
+		for serviceAccount := range serviceAccountsSet {
+			kept[a.identityEntityName(namespace, serviceAccount)] = struct{}{}
+		}
+	}
+
+	names, _ := a.identity.names()
+	for _, name := range names {
+		if _, ok := entities[name]; ok {
+			continue
+		}
+		if _, ok := kept[name]; ok {
+			continue
+		}
+		if err := a.vaultClient.DeleteEntity(name); err != nil {
+			logger.Errorf("delete identity entity %s: %v", name, err)
+			continue
+		}
+		a.identity.removeEntity(name)
+	}
+}
+
+// write groups with entity ids of written entities, group policies are not changed, so policies can be attached to
+// groups outside of this application
+func (a Auth) writeGroups(groups map[string]identityGroup, ids map[string]string) {
+
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	util.ForEach(a.config.Workers, names, func(name string) {
+		group := groups[name]
+		members := []string{}
+		for _, member := range group.members {
+			if id, ok := ids[member]; ok {
+				members = append(members, id)
+			}
+		}
+		sort.Strings(members)
+		if err := a.writeGroup(group, members); err != nil {
+			logger.Errorf("write identity group %s: %v", name, err)
+		}
+	})
+}
+
+func (a Auth) writeGroup(group identityGroup, members []string) error {
+
+	hash := identityHash(group.metadata, members)
+	current, ok := a.identity.group(group.name)
+	if ok && current == hash {
+		return nil
+	}
+	if !ok {
+		existing, err := a.vaultClient.ReadGroup(group.name)
+		if err != nil {
+			return err
+		}
+		if existing != nil && !a.ownsIdentity(existing.Metadata) {
+			return fmt.Errorf("group %w", errIdentityNotManaged)
+		}
+	}
+	if err := a.vaultClient.WriteGroup(group.name, group.metadata, members); err != nil {
+		return err
+	}
+	a.identity.setGroup(group.name, hash)
+	return nil
+}
+
+func (a Auth) pruneGroups(groups map[string]identityGroup) {
+
+	_, names := a.identity.names()
+	for _, name := range names {
+		if _, ok := groups[name]; ok {
+			continue
+		}
+		if err := a.vaultClient.DeleteGroup(name); err != nil {
+			logger.Errorf("delete identity group %s: %v", name, err)
+			continue
+		}
+		a.identity.removeGroup(name)
+	}
+}
+
+// hash of entity or group fields written by this application, used to skip writes of unchanged entities and groups
+func identityHash(values ...interface{}) string {
+
+	// maps are marshalled with sorted keys
+	b, _ := json.Marshal(values)
+	return string(b)
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// reserved keys, '_defaults' are merged into every role, '_profiles' are named sets of fields role can extend and
+	// '_policy_templates' are named acl policy documents role can reference (see policies.go)
+	defaultsKey        = "_defaults"
+	profilesKey        = "_profiles"
+	policyTemplatesKey = "_policy_templates"
+
+	extendsField   = "extends"
+	listMergeField = "list_merge"
+
+	listMergeAppend  = "append"
+	listMergeReplace = "replace"
+)
+
+// defaults, profiles and policy templates of one source (config map or file)
+type inheritance struct {
+	defaults        map[string]interface{}
+	profiles        map[string]map[string]interface{}
+	policyTemplates map[string]string
+}
+
+// merge defaults and extended profiles into every definition, reserved keys are removed from definitions, invalid
+// defaults, profiles and roles extending unknown profiles are returned as violations
+func inherit(definitions []roleDefinition) ([]roleDefinition, []string) {
+
+	var i inheritance
+	var roles []roleDefinition
+	var violations []string
+	for _, definition := range definitions {
+		switch definition.name {
+		case defaultsKey:
+			if err := json.Unmarshal(definition.raw, &i.defaults); err != nil {
+				violations = append(violations, fmt.Sprintf("%s: %v", defaultsKey, definition.errorf(err)))
+			}
+		case profilesKey:
+			if err := json.Unmarshal(definition.raw, &i.profiles); err != nil {
+				violations = append(violations, fmt.Sprintf("%s: %v", profilesKey, definition.errorf(err)))
+			}
+		case policyTemplatesKey:
+			if err := json.Unmarshal(definition.raw, &i.policyTemplates); err != nil {
+				violations = append(violations, fmt.Sprintf("%s: %v", policyTemplatesKey, definition.errorf(err)))
+			}
+		default:
+			roles = append(roles, definition)
+		}
+	}
+
+	var out []roleDefinition
+	for _, definition := range roles {
+		raw, err := i.apply(definition.name, definition.raw)
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %v", definition.name, definition.errorf(err)))
+			continue
+		}
+		definition.raw = raw
+		out = append(out, definition)
+	}
+	return out, violations
+}
+
+// effective role: defaults, then profiles in 'extends' order and then the role itself, referenced policy templates are
+// added to role acl policies
+func (i inheritance) apply(name string, raw []byte) ([]byte, error) {
+
+	var role map[string]interface{}
+	if err := json.Unmarshal(raw, &role); err != nil {
+		return nil, err
+	}
+
+	extends, err := stringOrSlice(role[extendsField])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", extendsField, err)
+	}
+	layers := []map[string]interface{}{i.defaults}
+	for _, name := range extends {
+		profile, ok := i.profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("profile %q does not exist", name)
+		}
+		layers = append(layers, profile)
+	}
+	layers = append(layers, role)
+
+	// list merge of later layers overrides earlier ones
+	listMerge := make(map[string]string)
+	for _, layer := range layers {
+		modes, ok := layer[listMergeField].(map[string]interface{})
+		if layer[listMergeField] != nil && !ok {
+			return nil, fmt.Errorf("%s has to be mapping of field names to %s or %s", listMergeField, listMergeAppend, listMergeReplace)
+		}
+		for field, mode := range modes {
+			if mode != listMergeAppend && mode != listMergeReplace {
+				return nil, fmt.Errorf("%s: %s field has invalid mode %v", listMergeField, field, mode)
+			}
+			listMerge[field] = mode.(string)
+		}
+	}
+
+	effective := make(map[string]interface{})
+	for _, layer := range layers {
+		effective = deepMerge(effective, layer, listMerge, "")
+	}
+	delete(effective, extendsField)
+	delete(effective, listMergeField)
+	if err := resolvePolicyTemplates(name, effective, i.policyTemplates); err != nil {
+		return nil, err
+	}
+	return json.Marshal(effective)
+}
+
+// merge src into dst, objects are merged recursively, lists are appended (without duplicates) or replaced based on
+// list merge mode of the field path (e.g. 'token_policies'), lists are appended by default
+func deepMerge(dst, src map[string]interface{}, listMerge map[string]string, prefix string) map[string]interface{} {
+
+	out := make(map[string]interface{}, len(dst))
+	for k, v := range dst {
+		out[k] = v
+	}
+	for k, v := range src {
+		field := k
+		if prefix != "" {
+			field = prefix + "." + k
+		}
+		switch srcValue := v.(type) {
+		case map[string]interface{}:
+			if dstValue, ok := out[k].(map[string]interface{}); ok {
+				out[k] = deepMerge(dstValue, srcValue, listMerge, field)
+				continue
+			}
+		case []interface{}:
+			if dstValue, ok := out[k].([]interface{}); ok && listMerge[field] != listMergeReplace {
+				out[k] = appendUnique(dstValue, srcValue)
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func appendUnique(dst, src []interface{}) []interface{} {
+
+	out := append([]interface{}{}, dst...)
+	for _, v := range src {
+		found := false
+		for _, existing := range out {
+			if fmt.Sprint(existing) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func stringOrSlice(v interface{}) ([]string, error) {
+
+	switch value := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		var out []string
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, errors.New("has to be string or list of strings")
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, errors.New("has to be string or list of strings")
+}
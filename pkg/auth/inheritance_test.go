@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestInherit(t *testing.T) {
+
+	configMapData := map[string]string{
+		defaultsKey: `{"token_ttl": 3600, "token_policies": ["default"], "bound_service_account_names": ["vault-agent-injector"]}`,
+		profilesKey: `{"payments": {"token_policies": ["payments"], "bound_service_account_namespaces": ["payments"]}, "short": {"token_ttl": 600}}`,
+	}
+
+	t.Run("when role does not extend profile then defaults are merged into role", func(t *testing.T) {
+
+		data := copyData(configMapData)
+		data["app"] = `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["app"], "token_policies": ["app"]}`
+
+		roles := testVaultRoles(data)
+		require.Equal(t, 1, len(roles))
+		assert.Equal(t, vault.Role{
+			BoundServiceAccountNames:      []string{"vault-agent-injector", "app"},
+			BoundServiceAccountNamespaces: []string{"app"},
+			TokenPolicies:                 []string{"default", "app"},
+			TokenTTL:                      3600,
+		}, roles["app"].Role)
+	})
+
+	t.Run("when role extends profiles then profiles are merged in order after defaults", func(t *testing.T) {
+
+		data := copyData(configMapData)
+		data["app"] = `{"extends": ["payments", "short"], "bound_service_account_names": ["app"]}`
+
+		roles := testVaultRoles(data)
+		assert.Equal(t, vault.Role{
+			BoundServiceAccountNames:      []string{"vault-agent-injector", "app"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"default", "payments"},
+			TokenTTL:                      600,
+		}, roles["app"].Role)
+	})
+
+	t.Run("when role sets list merge to replace then inherited list is replaced", func(t *testing.T) {
+
+		data := copyData(configMapData)
+		data["app"] = `{"extends": "payments", "list_merge": {"token_policies": "replace"}, "token_policies": ["app"]}`
+
+		roles := testVaultRoles(data)
+		assert.Equal(t, []string{"app"}, roles["app"].TokenPolicies)
+		assert.Equal(t, []string{"vault-agent-injector"}, roles["app"].BoundServiceAccountNames)
+	})
+
+	t.Run("when role extends profile that does not exist then role is violation", func(t *testing.T) {
+
+		data := copyData(configMapData)
+		data["app"] = `{"extends": "missing", "bound_service_account_names": ["app"]}`
+
+		definitions, violations := configMapRoleDefinitions(k8s.ConfigMap{Data: data})
+		assert.Empty(t, definitions)
+		assert.Equal(t, []string{`app: profile "missing" does not exist`}, violations)
+	})
+
+	t.Run("when list merge mode is invalid then role is violation", func(t *testing.T) {
+
+		data := copyData(configMapData)
+		data["app"] = `{"list_merge": {"token_policies": "prepend"}, "bound_service_account_names": ["app"]}`
+
+		definitions, violations := configMapRoleDefinitions(k8s.ConfigMap{Data: data})
+		assert.Empty(t, definitions)
+		require.Equal(t, 1, len(violations))
+	})
+}
+
+func TestDeepMerge(t *testing.T) {
+
+	dst := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{"x"}, "c": 1}, "d": []interface{}{"x"}}
+	src := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{"x", "y"}, "e": 2}, "d": []interface{}{"z"}}
+
+	actual := deepMerge(dst, src, map[string]string{"d": listMergeReplace}, "")
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{"b": []interface{}{"x", "y"}, "c": 1, "e": 2},
+		"d": []interface{}{"z"},
+	}, actual)
+}
+
+// --- helper functions ---
+
+func copyData(data map[string]string) map[string]string {
+
+	out := make(map[string]string)
+	for k, v := range data {
+		out[k] = v
+	}
+	return out
+}
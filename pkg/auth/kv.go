@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// custom metadata keys of kv paths written by this application (in addition to identity ownership keys), path is
+// managed by this application if managed_by and mount custom metadata match
+const (
+	kvTeamKey       = "team"
+	kvOrphanedKey   = "orphaned"
+	kvOrphanedAtKey = "orphaned_at"
+
+	defaultKVMount = "secret"
+)
+
+// kv version 2 base path is bootstrapped for every namespace with vault role, base path is '<path>/<namespace>' and
+// path defaults to 'kubernetes/<vault-mount>'
+// e.g. {"mount": "secret", "path": "teams", "max_versions": 10, "delete_version_after": "720h", "team_label": "team"}
+type KVBootstrap struct {
+	Mount              string `json:"mount"`
+	Path               string `json:"path"`
+	MaxVersions        int    `json:"max_versions"`
+	DeleteVersionAfter string `json:"delete_version_after"`
+	// namespace label with owning team, team is not set in custom metadata if the label is not set
+	TeamLabel string `json:"team_label"`
+}
+
+func LoadKVBootstrap(file string) (KVBootstrap, error) {
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return KVBootstrap{}, fmt.Errorf("read kv bootstrap file: %w", err)
+	}
+
+	var bootstrap KVBootstrap
+	if err := json.Unmarshal(b, &bootstrap); err != nil {
+		return KVBootstrap{}, fmt.Errorf("unmarshal kv bootstrap: %w", err)
+	}
+	bootstrap.Mount = strings.Trim(bootstrap.Mount, "/")
+	bootstrap.Path = strings.Trim(bootstrap.Path, "/")
+	if bootstrap.Mount == "" {
+		bootstrap.Mount = defaultKVMount
+	}
+	if bootstrap.MaxVersions < 0 {
+		return KVBootstrap{}, fmt.Errorf("max_versions %d is negative", bootstrap.MaxVersions)
+	}
+	if bootstrap.DeleteVersionAfter != "" {
+		if _, err := time.ParseDuration(bootstrap.DeleteVersionAfter); err != nil {
+			return KVBootstrap{}, fmt.Errorf("delete_version_after: %w", err)
+		}
+	}
+	return bootstrap, nil
+}
+
+// hash of the last written (or read) metadata and whether the path is marked as orphaned
+type kvRecord struct {
+	hash     string
+	orphaned bool
+}
+
+// kv paths written by this application by namespace, state is refreshed from vault when roles are verified
+type kvState struct {
+	mu      sync.Mutex
+	mounted bool
+	paths   map[string]kvRecord
+}
+
+func newKVState() *kvState {
+	return &kvState{paths: make(map[string]kvRecord)}
+}
+
+func (s *kvState) refresh(paths map[string]kvRecord) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = paths
+}
+
+func (s *kvState) get(namespace string) (kvRecord, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.paths[namespace]
+	return record, ok
+}
+
+func (s *kvState) set(namespace string, record kvRecord) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths[namespace] = record
+}
+
+// sorted namespaces of kv paths written by this application
+func (s *kvState) namespaces() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var namespaces []string
+	for namespace := range s.paths {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+func (s *kvState) isMounted() bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mounted
+}
+
+func (s *kvState) setMounted(mounted bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mounted = mounted
+}
+
+// ensure kv mount and write base path metadata of every namespace with allowed vault role, paths of namespaces without
+// roles are marked as orphaned (data is never deleted), kv paths are listed and read from vault only when verify is true
+func (a Auth) bootstrapKV(roles vaultRoles, namespaces []k8s.Namespace, verify bool) {
+
+	if a.config.KVBootstrap == nil {
+		return
+	}
+	if namespaces == nil {
+		var err error
+		if namespaces, err = a.k8sClient.GetNamespacesMeta(); err != nil {
+			logger.Errorf("kv bootstrap: get namespaces: %v", err)
+			return
+		}
+	}
+
+	if verify || !a.kv.isMounted() {
+		mounted, err := a.vaultClient.EnsureKVMount(a.config.KVBootstrap.Mount)
+		if err != nil {
+			a.kv.setMounted(false)
+			logger.Errorf("kv bootstrap: ensure kv mount %s: %v", a.config.KVBootstrap.Mount, err)
+			return
+		}
+		if mounted {
+			logger.Logf("kv bootstrap: mounted kv version 2 at %s", a.config.KVBootstrap.Mount)
+		}
+		a.kv.setMounted(true)
+	}
+	if verify {
+		a.verifyKV()
+	}
+
+	desired := a.newKVPaths(roles, namespaces)
+	var names []string
+	for namespace := range desired {
+		names = append(names, namespace)
+	}
+	sort.Strings(names)
+	util.ForEach(a.config.Workers, names, func(namespace string) {
+		if err := a.writeKVPath(namespace, desired[namespace], false); err != nil {
+			logger.Errorf("kv bootstrap: write %s: %v", a.kvPath(namespace), err)
+		}
+	})
+
+	for _, namespace := range a.kv.namespaces() {
+		if _, ok := desired[namespace]; ok {
+			continue
+		}
+		if err := a.writeKVPath(namespace, nil, true); err != nil {
+			logger.Errorf("kv bootstrap: mark %s as orphaned: %v", a.kvPath(namespace), err)
+		}
+	}
+}
+
+// our custom metadata of base path by namespace, for namespaces that exist and are bound to at least one allowed role
+func (a Auth) newKVPaths(roles vaultRoles, namespaces []k8s.Namespace) map[string]map[string]string {
+
+	serviceAccountsSetByNamespace := roles.getServiceAccountsSetByNamespace()
+	paths := make(map[string]map[string]string)
+	for _, namespace := range namespaces {
+		if _, ok := serviceAccountsSetByNamespace[namespace.Name]; !ok {
+			continue
+		}
+		metadata := a.identityMetadata()
+		metadata[identityNamespaceKey] = namespace.Name
+		if team := namespace.Labels[a.config.KVBootstrap.TeamLabel]; a.config.KVBootstrap.TeamLabel != "" && team != "" {
+			metadata[kvTeamKey] = team
+		}
+		paths[namespace.Name] = metadata
+	}
+	return paths
+}
+
+// write base path metadata if it differs from the last written metadata, path that exists and is not managed by this
+// application is not changed, orphaned path keeps its last metadata with orphaned mark
+func (a Auth) writeKVPath(namespace string, metadata map[string]string, orphaned bool) error {
+
+	record, ok := a.kv.get(namespace)
+	if orphaned && (!ok || record.orphaned) {
+		return nil
+	}
+	if !orphaned && ok && record.hash == kvHash(a.newKVMetadata(metadata)) {
+		return nil
+	}
+
+	path := a.kvPath(namespace)
+	existing, err := a.vaultClient.ReadKVMetadata(a.config.KVBootstrap.Mount, path)
+	if err != nil {
+		return err
+	}
+	if existing != nil && len(existing.CustomMetadata) != 0 && !a.ownsIdentity(existing.CustomMetadata) {
+		return fmt.Errorf("path %w", errIdentityNotManaged)
+	}
+	if orphaned {
+		if existing == nil {
+			return nil
+		}
+		metadata = ownKVMetadata(existing.CustomMetadata)
+		metadata[kvOrphanedKey] = "true"
+		logger.Logf("kv bootstrap: namespace %s has no vault roles, marking %s as orphaned", namespace, path)
+	}
+
+	// custom metadata not written by this application (e.g. added by the team) is kept
+	request := a.newKVMetadata(metadata)
+	hash := kvHash(request)
+	if existing != nil {
+		for k, v := range existing.CustomMetadata {
+			if _, ok := request.CustomMetadata[k]; !ok && !isOwnKVKey(k) {
+				request.CustomMetadata[k] = v
+			}
+		}
+	}
+	if orphaned {
+		request.CustomMetadata[kvOrphanedAtKey] = time.Now().UTC().Format(time.RFC3339)
+	}
+	if err := a.vaultClient.WriteKVMetadata(a.config.KVBootstrap.Mount, path, request); err != nil {
+		return err
+	}
+	a.kv.set(namespace, kvRecord{hash: hash, orphaned: orphaned})
+	return nil
+}
+
+// list and read base paths of this mount from vault, previous state of path is kept if it cannot be read
+func (a Auth) verifyKV() {
+
+	mount := a.config.KVBootstrap.Mount
+	keys, err := a.vaultClient.ListKVMetadata(mount, a.kvBasePath())
+	if err != nil {
+		logger.Errorf("verify kv bootstrap: list %s: %v", a.kvBasePath(), err)
+		return
+	}
+
+	paths := make(map[string]kvRecord)
+	for _, namespace := range keys {
+		if strings.HasSuffix(namespace, "/") {
+			continue
+		}
+		metadata, err := a.vaultClient.ReadKVMetadata(mount, a.kvPath(namespace))
+		if err != nil {
+			logger.Errorf("verify kv bootstrap: read %s: %v", a.kvPath(namespace), err)
+			if record, ok := a.kv.get(namespace); ok {
+				paths[namespace] = record
+			}
+			continue
+		}
+		if metadata == nil || !a.ownsIdentity(metadata.CustomMetadata) {
+			continue
+		}
+		paths[namespace] = kvRecord{hash: kvHash(*metadata), orphaned: metadata.CustomMetadata[kvOrphanedKey] == "true"}
+	}
+	a.kv.refresh(paths)
+}
+
+// metadata request with configured max versions and delete version after
+func (a Auth) newKVMetadata(customMetadata map[string]string) vault.KVMetadata {
+
+	metadata := vault.KVMetadata{
+		MaxVersions:        a.config.KVBootstrap.MaxVersions,
+		DeleteVersionAfter: a.config.KVBootstrap.DeleteVersionAfter,
+		CustomMetadata:     make(map[string]string),
+	}
+	if metadata.DeleteVersionAfter == "" {
+		metadata.DeleteVersionAfter = "0s"
+	}
+	for k, v := range customMetadata {
+		metadata.CustomMetadata[k] = v
+	}
+	return metadata
+}
+
+// custom metadata written by this application, without orphaned timestamp
+func ownKVMetadata(customMetadata map[string]string) map[string]string {
+
+	metadata := make(map[string]string)
+	for k, v := range customMetadata {
+		if isOwnKVKey(k) && k != kvOrphanedAtKey {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+func isOwnKVKey(key string) bool {
+
+	switch key {
+	case identityManagedByKey, identityMountKey, identityClusterKey, identityNamespaceKey, kvTeamKey, kvOrphanedKey, kvOrphanedAtKey:
+		return true
+	}
+	return false
+}
+
+// hash of metadata written by this application, vault returns delete version after normalized (e.g. 720h0m0s)
+func kvHash(metadata vault.KVMetadata) string {
+
+	deleteVersionAfter, _ := time.ParseDuration(metadata.DeleteVersionAfter)
+	return identityHash(ownKVMetadata(metadata.CustomMetadata), metadata.MaxVersions, deleteVersionAfter)
+}
+
+// kv base path of all namespaces
+func (a Auth) kvBasePath() string {
+
+	if a.config.KVBootstrap.Path != "" {
+		return a.config.KVBootstrap.Path
+	}
+	return a.vaultMount()
+}
+
+func (a Auth) kvPath(namespace string) string {
+	return fmt.Sprintf("%s/%s", a.kvBasePath(), namespace)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKVBootstrap(t *testing.T) {
+
+	t.Run("when kv bootstrap file is valid then mount and path are trimmed", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "kv-bootstrap.json")
+		content := `{"mount": "kv/", "path": "/teams/", "max_versions": 10, "delete_version_after": "720h", "team_label": "team"}`
+		require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+
+		bootstrap, err := LoadKVBootstrap(file)
+		require.NoError(t, err)
+		assert.Equal(t, KVBootstrap{Mount: "kv", Path: "teams", MaxVersions: 10, DeleteVersionAfter: "720h", TeamLabel: "team"}, bootstrap)
+	})
+
+	t.Run("when mount is not set then default mount is used", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "kv-bootstrap.json")
+		require.NoError(t, os.WriteFile(file, []byte(`{}`), 0600))
+
+		bootstrap, err := LoadKVBootstrap(file)
+		require.NoError(t, err)
+		assert.Equal(t, KVBootstrap{Mount: "secret"}, bootstrap)
+	})
+
+	t.Run("when delete version after is invalid then error is returned", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "kv-bootstrap.json")
+		require.NoError(t, os.WriteFile(file, []byte(`{"delete_version_after": "30 days"}`), 0600))
+
+		_, err := LoadKVBootstrap(file)
+		require.Error(t, err)
+	})
+}
+
+func TestKVHash(t *testing.T) {
+
+	t.Run("when metadata differs only in orphaned timestamp and duration format then hash is the same", func(t *testing.T) {
+
+		a := vault.KVMetadata{MaxVersions: 5, DeleteVersionAfter: "720h", CustomMetadata: map[string]string{"namespace": "payments", "orphaned": "true"}}
+		b := vault.KVMetadata{MaxVersions: 5, DeleteVersionAfter: "720h0m0s", CustomMetadata: map[string]string{"namespace": "payments", "orphaned": "true",
+			"orphaned_at": "2024-01-01T00:00:00Z", "owner": "alice"}}
+		assert.Equal(t, kvHash(a), kvHash(b))
+	})
+
+	t.Run("when max versions differs then hash differs", func(t *testing.T) {
+
+		a := vault.KVMetadata{MaxVersions: 5, CustomMetadata: map[string]string{"namespace": "payments"}}
+		b := vault.KVMetadata{MaxVersions: 10, CustomMetadata: map[string]string{"namespace": "payments"}}
+		assert.NotEqual(t, kvHash(a), kvHash(b))
+	})
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// json map of role name to login verification status, set on config map role source
+	loginVerificationAnnotation = "vault-auth-kubernetes/login-verification"
+	eventReasonLoginFailed      = "VaultLoginFailed"
+
+	loginPassed  = "passed"
+	loginFailed  = "failed"
+	loginSkipped = "skipped"
+
+	// shortest expiration allowed by TokenRequest API
+	loginTokenExpirationSeconds = 600
+)
+
+var loginVerificationMetric = metrics.NewCounter("vak_login_verification_total", "Number of vault login verifications by result (passed, failed or skipped).", "result")
+
+type loginStatus struct {
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+	Time    string `json:"time"`
+}
+
+// roles written since the last verification and roles that failed verification
+type loginState struct {
+	mu      sync.Mutex
+	pending map[string]struct{}
+	failed  map[string]string
+}
+
+func newLoginState() *loginState {
+
+	return &loginState{
+		pending: make(map[string]struct{}),
+		failed:  make(map[string]string),
+	}
+}
+
+// role is verified by the next verifyLogins call
+func (a Auth) roleWritten(name string) {
+
+	if a.config.LoginVerification {
+		a.login.written(name)
+	}
+}
+
+func (l *loginState) written(name string) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending[name] = struct{}{}
+}
+
+// sorted roles to verify, roles that failed verification are verified again when retry is true, pending roles are cleared
+func (l *loginState) take(retry bool) []string {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if retry {
+		for name := range l.failed {
+			l.pending[name] = struct{}{}
+		}
+	}
+	var names []string
+	for name := range l.pending {
+		names = append(names, name)
+	}
+	l.pending = make(map[string]struct{})
+	sort.Strings(names)
+	return names
+}
+
+func (l *loginState) set(name string, status loginStatus) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if status.Result == loginFailed {
+		l.failed[name] = status.Message
+		return
+	}
+	delete(l.failed, name)
+}
+
+// failure message of the last login verification of the role
+func (l *loginState) failure(name string) (string, bool) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	message, ok := l.failed[name]
+	return message, ok
+}
+
+// failure messages of roles from the source
+func (l *loginState) failures(roles vaultRoles, source roleSource) []string {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var messages []string
+	for name, message := range l.failed {
+		if role, ok := roles[name]; ok && role.source == source {
+			messages = append(messages, fmt.Sprintf("%s: %s", name, message))
+		}
+	}
+	return messages
+}
+
+// login with a short-lived token of bound service account to every role written by this reload (and to roles that
+// failed verification when retry is true), result is recorded on the role source (annotation and event) and in metrics
+func (a Auth) verifyLogins(roles vaultRoles, retry bool) {
+
+	if !a.config.LoginVerification {
+		return
+	}
+
+	var mu sync.Mutex
+	statuses := make(map[roleSource]map[string]loginStatus)
+	util.ForEach(a.config.Workers, a.login.take(retry), func(name string) {
+		role, ok := roles[name]
+		if !ok {
+			a.login.set(name, loginStatus{})
+			return
+		}
+		status := a.verifyLogin(name, role)
+		loginVerificationMetric.Inc(status.Result)
+		a.login.set(name, status)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if statuses[role.source] == nil {
+			statuses[role.source] = make(map[string]loginStatus)
+		}
+		statuses[role.source][name] = status
+	})
+
+	for source, sourceStatuses := range statuses {
+		a.report(source, eventReasonLoginFailed, a.login.failures(roles, source))
+		if source.kind == fileSourceKind {
+			continue
+		}
+		if err := a.writeLoginStatus(source, roles, sourceStatuses); err != nil {
+			logger.Errorf("write login verification status to %s: %v", source, err)
+		}
+	}
+}
+
+func (a Auth) verifyLogin(name string, role vaultRole) loginStatus {
+
+	status := func(result, message string) loginStatus {
+		if result == loginFailed {
+			logger.Errorf("vault role %s login verification failed: %s", name, message)
+		}
+		return loginStatus{Result: result, Message: message, Time: time.Now().UTC().Format(time.RFC3339)}
+	}
+
+	var audiences []string
+	if audience := a.vaultClient.LoginAudience(role.Role); audience != "" {
+		audiences = []string{audience}
+	}
+	var token []byte
+	var serviceAccount string
+	var tokenErr error
+	for _, namespace := range role.BoundServiceAccountNamespaces {
+		for _, name := range role.BoundServiceAccountNames {
+			if strings.Contains(namespace, "*") || strings.Contains(name, "*") || token != nil {
+				continue
+			}
+			if token, tokenErr = a.k8sClient.CreateServiceAccountToken(namespace, name, audiences, loginTokenExpirationSeconds); tokenErr == nil {
+				serviceAccount = fmt.Sprintf("%s/%s", namespace, name)
+			}
+		}
+	}
+	if token == nil {
+		if tokenErr != nil {
+			return status(loginSkipped, fmt.Sprintf("create bound service account token: %v", tokenErr))
+		}
+		return status(loginSkipped, "role does not bind any service account without wildcard")
+	}
+
+	result, err := a.vaultClient.Login(name, token)
+	if err != nil {
+		return status(loginFailed, fmt.Sprintf("login as %s: %v", serviceAccount, err))
+	}
+	if err := a.vaultClient.RevokeToken(result.ClientToken); err != nil {
+		logger.Errorf("vault role %s login verification: revoke token: %v", name, err)
+	}
+
+	if expected, actual := loginPolicies(role.TokenPolicies), loginPolicies(result.TokenPolicies); !stringsEqual(expected, actual) {
+		return status(loginFailed, fmt.Sprintf("login as %s returned policies %v, token_policies are %v", serviceAccount, actual, expected))
+	}
+	return status(loginPassed, "")
+}
+
+// write statuses to the source annotation, statuses of roles that are no longer defined by the source are removed
+func (a Auth) writeLoginStatus(source roleSource, roles vaultRoles, statuses map[string]loginStatus) error {
+
+	configMap, err := a.k8sClient.GetConfigMap(source.namespace, source.name)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]loginStatus)
+	if value := configMap.Annotations[loginVerificationAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			logger.Errorf("%s annotation on %s is not valid, it is overwritten: %v", loginVerificationAnnotation, source, err)
+		}
+	}
+	for name := range current {
+		if role, ok := roles[name]; !ok || role.source != source {
+			delete(current, name)
+		}
+	}
+	for name, status := range statuses {
+		current[name] = status
+	}
+
+	b, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	return a.k8sClient.UpdateConfigMapAnnotation(source.namespace, source.name, loginVerificationAnnotation, string(b))
+}
+
+// sorted policies without default policy (vault adds it to tokens unless token_no_default_policy is set)
+func loginPolicies(policies []string) []string {
+
+	var out []string
+	for _, policy := range policies {
+		if policy != "default" {
+			out = append(out, policy)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func stringsEqual(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
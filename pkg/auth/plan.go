@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"sort"
+)
+
+// plan is effective (defaults and profiles merged) roles from role files, it does not need vault nor kubernetes
+type Plan struct {
+	Roles []PlannedRole `json:"roles"`
+	// role templates are not rendered, because namespaces are not known without cluster
+	Templates []string `json:"templates,omitempty"`
+	Invalid   []string `json:"invalid,omitempty"`
+}
+
+type PlannedRole struct {
+	Name   string     `json:"name"`
+	Source string     `json:"source"`
+	Role   vault.Role `json:"role"`
+	// acl policy documents (not rendered) by policy name
+	ACLPolicies map[string]string `json:"acl_policies,omitempty"`
+	// kubernetes secrets engine role with the same name
+	SecretsEngineRole map[string]interface{} `json:"secrets_engine_role,omitempty"`
+	// guardrail violations, denied role would not be created
+	Denied []string `json:"denied,omitempty"`
+}
+
+func NewPlan(config Config) (Plan, error) {
+
+	files, err := readRoleFiles(config.RolesFile, config.RolesDir)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	var plan Plan
+	roles := make(vaultRoles)
+	for _, file := range files {
+		fileRoles, invalidRoles := newVaultRoles(file.source, file.definitions)
+		fileTemplates, invalidTemplates := newRoleTemplates(file.source, file.definitions)
+		for _, violations := range [][]string{file.violations, invalidRoles, invalidTemplates} {
+			for _, violation := range violations {
+				plan.Invalid = append(plan.Invalid, fmt.Sprintf("%s: %s", file.source, violation))
+			}
+		}
+		for _, t := range fileTemplates {
+			plan.Templates = append(plan.Templates, fmt.Sprintf("%s: %s", t.source, t.key))
+		}
+		roles.merge(fileRoles)
+	}
+
+	for roleName, role := range roles {
+		plan.Roles = append(plan.Roles, PlannedRole{
+			Name:              roleName,
+			Source:            role.source.String(),
+			Role:              role.Role,
+			ACLPolicies:       role.aclPolicies,
+			SecretsEngineRole: role.secretsEngineRole,
+			Denied:            config.Guardrails.check(role, nil),
+		})
+	}
+	sort.Slice(plan.Roles, func(i, j int) bool { return plan.Roles[i].Name < plan.Roles[j].Name })
+	return plan, nil
+}
+
+// plan with invalid or denied roles should not be applied
+func (p Plan) HasViolations() bool {
+
+	if len(p.Invalid) != 0 {
+		return true
+	}
+	for _, role := range p.Roles {
+		if len(role.Denied) != 0 {
+			return true
+		}
+	}
+	return false
+}
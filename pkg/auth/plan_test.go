@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPlan(t *testing.T) {
+
+	content := `
+_defaults:
+  token_ttl: 3600
+  bound_service_account_names: [vault-agent-injector]
+app:
+  bound_service_account_namespaces: [payments]
+  token_policies: [payments]
+admin:
+  bound_service_account_namespaces: [payments]
+  token_policies: [admin]
+namespaces:
+  template: {role_name: "ns-{{.Namespace}}"}
+  token_policies: ["{{.Namespace}}"]
+invalid:
+  bound_service_account_names: ["*"]
+  bound_service_account_namespaces: ["*"]
+`
+	rolesFile := filepath.Join(t.TempDir(), "roles.yaml")
+	require.NoError(t, os.WriteFile(rolesFile, []byte(content), 0600))
+
+	config := Config{
+		RolesFile:  rolesFile,
+		Guardrails: Guardrails{Rules: []GuardrailRule{{AllowedPolicies: []string{"payments"}}}},
+	}
+	plan, err := NewPlan(config)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(plan.Roles))
+	assert.Equal(t, PlannedRole{
+		Name:   "admin",
+		Source: "file " + rolesFile,
+		Role: vault.Role{
+			BoundServiceAccountNames:      []string{"vault-agent-injector"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"admin"},
+			TokenTTL:                      3600,
+		},
+		Denied: []string{`guardrail rule 0: token policy "admin" is not allowed`},
+	}, plan.Roles[0])
+	assert.Equal(t, "app", plan.Roles[1].Name)
+	assert.Empty(t, plan.Roles[1].Denied)
+	assert.Equal(t, []string{"file " + rolesFile + ": namespaces"}, plan.Templates)
+	assert.Equal(t, 1, len(plan.Invalid))
+	assert.True(t, plan.HasViolations())
+}
@@ -0,0 +1,542 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	// role fields, acl policies by policy name and names of policy templates (defined in '_policy_templates' key), policy
+	// names are added to role token policies
+	aclPoliciesField        = "acl_policies"
+	aclPolicyTemplatesField = "acl_policy_templates"
+
+	eventReasonInvalidPolicy = "InvalidVaultPolicy"
+	eventReasonMissingPolicy = "MissingVaultPolicy"
+
+	// first line of every policy written by this application, policy without the header (or with header of another mount)
+	// is not overwritten nor deleted
+	policyOwnerHeader = "# managed by vault-auth-kubernetes, mount %s\n"
+)
+
+var (
+	// vault stores policy names in lower case
+	policyNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+	// hcl path blocks, comments and capabilities of acl policy document
+	policyPathRegexp         = regexp.MustCompile(`path\s+"([^"]*)"\s*\{([^{}]*)\}`)
+	policyCommentRegexp      = regexp.MustCompile(`(?m)(#|//).*$`)
+	policyCapabilitiesRegexp = regexp.MustCompile(`capabilities\s*=\s*\[([^\]]*)\]`)
+	// template actions and vault templated parts of policy path
+	policyPathTemplateRegexp = regexp.MustCompile(`\[\[.*?\]\]|\{\{.*?\}\}`)
+)
+
+type aclPolicySpec struct {
+	ACLPolicies map[string]string `json:"acl_policies"`
+}
+
+// data available in acl policy documents, documents are rendered with [[ ]] delimiters, so vault templated policies
+// (e.g. {{identity.entity.id}}) are written as they are, role is empty for policies from policy files
+// e.g. path "secret/data/[[ .Role ]]/*" { capabilities = ["read"] }
+type policyTemplateData struct {
+	Role     string
+	Mount    string
+	accessor string
+}
+
+// auth mount accessor, policy that uses it is not rendered until the accessor is known (auth is mounted)
+// e.g. path "secret/data/{{identity.entity.aliases.[[ .Accessor ]].metadata.service_account_namespace}}/*" { ... }
+func (d policyTemplateData) Accessor() (string, error) {
+
+	if d.accessor == "" {
+		return "", errors.New("auth mount accessor is not known")
+	}
+	return d.accessor, nil
+}
+
+// acl policy file, policy name is the file name without .hcl extension
+type policyFile struct {
+	name     string
+	file     string
+	document string
+}
+
+// .hcl files in policies directory, empty directory path is skipped
+func readPolicyFiles(dir string) ([]policyFile, error) {
+
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []policyFile
+	for _, entry := range entries {
+		if entry.IsDir() || strings.ToLower(filepath.Ext(entry.Name())) != ".hcl" {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, policyFile{name: strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())), file: file, document: string(b)})
+	}
+	return files, nil
+}
+
+// acl policies of raw role by policy name, policy documents are not rendered
+func newACLPolicies(rawRole []byte) (map[string]string, error) {
+
+	var spec aclPolicySpec
+	if err := json.Unmarshal(rawRole, &spec); err != nil {
+		return nil, fmt.Errorf("unmarshal acl policies: %w", err)
+	}
+	for name, document := range spec.ACLPolicies {
+		if vault.IsBuiltinPolicy(name) || !policyNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("acl policy name %q is invalid", name)
+		}
+		if strings.TrimSpace(document) == "" {
+			return nil, fmt.Errorf("acl policy %s is empty", name)
+		}
+		if _, err := newPolicyTemplate(document); err != nil {
+			return nil, fmt.Errorf("acl policy %s: %w", name, err)
+		}
+	}
+	return spec.ACLPolicies, nil
+}
+
+type policyPath struct {
+	path         string
+	capabilities []string
+}
+
+// path blocks of hcl acl policy document in document order, document with anything else than path blocks and comments
+// (e.g. json policy or nested blocks) is not supported, so it cannot grant paths that are not returned
+func parsePolicyPaths(document string) ([]policyPath, error) {
+
+	document = policyCommentRegexp.ReplaceAllString(document, "")
+	if rest := strings.TrimSpace(policyPathRegexp.ReplaceAllString(document, "")); rest != "" {
+		return nil, fmt.Errorf("only path blocks with capabilities are supported, found %q", strings.SplitN(rest, "\n", 2)[0])
+	}
+
+	var paths []policyPath
+	for _, match := range policyPathRegexp.FindAllStringSubmatch(document, -1) {
+		p := policyPath{path: match[1]}
+		if capabilities := policyCapabilitiesRegexp.FindStringSubmatch(match[2]); capabilities != nil {
+			for _, capability := range strings.Split(capabilities[1], ",") {
+				if capability = strings.Trim(strings.TrimSpace(capability), `"`); capability != "" {
+					p.capabilities = append(p.capabilities, capability)
+				}
+			}
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// glob pattern of policy path, vault '+' path segment wildcard, template actions and vault templated parts are '*'
+func policyPathPattern(path string) string {
+	return strings.ReplaceAll(policyPathTemplateRegexp.ReplaceAllString(path, "*"), "+", "*")
+}
+
+func newPolicyTemplate(text string) (*template.Template, error) {
+	return template.New("").Delims("[[", "]]").Option("missingkey=error").Parse(text)
+}
+
+// policy templates referenced by the role are added to role acl policies as '<role>-<template>' policies
+func resolvePolicyTemplates(roleName string, role map[string]interface{}, templates map[string]string) error {
+
+	names, err := stringOrSlice(role[aclPolicyTemplatesField])
+	if err != nil {
+		return fmt.Errorf("%s: %w", aclPolicyTemplatesField, err)
+	}
+	delete(role, aclPolicyTemplatesField)
+	if len(names) == 0 {
+		return nil
+	}
+
+	policies, ok := role[aclPoliciesField].(map[string]interface{})
+	if role[aclPoliciesField] != nil && !ok {
+		return fmt.Errorf("%s has to be mapping of policy names to policies", aclPoliciesField)
+	}
+	if policies == nil {
+		policies = make(map[string]interface{})
+	}
+	for _, name := range names {
+		document, ok := templates[name]
+		if !ok {
+			return fmt.Errorf("policy template %q does not exist", name)
+		}
+		policyName := fmt.Sprintf("%s-%s", roleName, name)
+		if _, ok := policies[policyName]; ok {
+			return fmt.Errorf("acl policy %s is defined more than once", policyName)
+		}
+		policies[policyName] = document
+	}
+	role[aclPoliciesField] = policies
+	return nil
+}
+
+// role with acl policy names added to token policies
+func withPolicyNames(role vault.Role, policies map[string]string) vault.Role {
+
+	var names []string
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tokenPolicies := append([]string{}, role.TokenPolicies...)
+	for _, name := range names {
+		if !containsFold(tokenPolicies, name) {
+			tokenPolicies = append(tokenPolicies, name)
+		}
+	}
+	if len(tokenPolicies) != 0 {
+		role.TokenPolicies = tokenPolicies
+	}
+	return role
+}
+
+func containsFold(values []string, search string) bool {
+
+	for _, v := range values {
+		if strings.EqualFold(v, search) {
+			return true
+		}
+	}
+	return false
+}
+
+// acl policies written by this application, policy document last written to (or found in) vault by policy name and names
+// of all policies in vault, state is refreshed from vault when roles are verified
+type policyState struct {
+	mu      sync.Mutex
+	managed map[string]string
+	// nil until policies are listed
+	existing map[string]struct{}
+}
+
+func newPolicyState() *policyState {
+	return &policyState{managed: make(map[string]string)}
+}
+
+func (s *policyState) refresh(managed map[string]string, existing map[string]struct{}) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.managed, s.existing = managed, existing
+}
+
+func (s *policyState) get(name string) (string, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	document, ok := s.managed[name]
+	return document, ok
+}
+
+func (s *policyState) set(name, document string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.managed[name] = document
+	if s.existing != nil {
+		s.existing[name] = struct{}{}
+	}
+}
+
+func (s *policyState) remove(name string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.managed, name)
+	delete(s.existing, name)
+}
+
+// names of policies written by this application, sorted
+func (s *policyState) managedNames() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.managed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// true if policy exists in vault, policies that were never listed are assumed to exist
+func (s *policyState) exists(name string) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.existing == nil {
+		return true
+	}
+	_, ok := s.existing[strings.ToLower(name)]
+	return ok
+}
+
+// rendered acl policy and the role that defines it, document is empty if the policy failed to render
+type aclPolicy struct {
+	document string
+	// empty for policy from policy file
+	roleName string
+	source   roleSource
+}
+
+func (p aclPolicy) definedBy() string {
+
+	if p.roleName == "" {
+		return p.source.String()
+	}
+	return fmt.Sprintf("%s role", p.roleName)
+}
+
+// write acl policies of allowed roles, delete policies written by this application that are no longer defined by any
+// role and report roles with invalid acl policies or token policies that do not exist in vault, policies are listed and
+// read from vault only when verify is true
+func (a Auth) reconcilePolicies(roles, allowedRoles vaultRoles, verify bool) {
+
+	invalid := make(map[roleSource][]string)
+	missing := make(map[roleSource][]string)
+	if a.config.ACLPolicies {
+		files, err := readPolicyFiles(a.config.PoliciesDir)
+		if err != nil {
+			// stop here, otherwise policies from files would be deleted
+			logger.Errorf("read acl policy files: %v", err)
+			return
+		}
+		policies := a.renderFilePolicies(files)
+		a.renderPolicies(roles, policies, invalid)
+		if verify {
+			a.verifyPolicies()
+		}
+		a.writePolicies(policies, allowedRoles, invalid)
+		a.prunePolicies(policies)
+		a.missingPolicies(allowedRoles, policies, missing)
+	} else {
+		for roleName, role := range roles {
+			if len(role.aclPolicies) != 0 {
+				invalid[role.source] = append(invalid[role.source], fmt.Sprintf("%s: acl policies are not enabled, acl_policies are not written", roleName))
+			}
+		}
+	}
+
+	sources := make(map[roleSource]struct{})
+	for _, role := range roles {
+		sources[role.source] = struct{}{}
+	}
+	for source := range sources {
+		a.report(source, eventReasonInvalidPolicy, invalid[source])
+		a.report(source, eventReasonMissingPolicy, missing[source])
+	}
+}
+
+// rendered acl policies from policy files by policy name, invalid policies are logged
+func (a Auth) renderFilePolicies(files []policyFile) map[string]aclPolicy {
+
+	policies := make(map[string]aclPolicy)
+	for _, f := range files {
+		if vault.IsBuiltinPolicy(f.name) || !policyNameRegexp.MatchString(f.name) {
+			logger.Errorf("acl policy file %s: policy name %q is invalid", f.file, f.name)
+			continue
+		}
+		document, err := a.renderPolicy("", f.document)
+		if err != nil {
+			logger.Errorf("acl policy file %s: %v", f.file, err)
+		}
+		policies[f.name] = aclPolicy{document: document, source: newFileSource(f.file)}
+	}
+	return policies
+}
+
+// add rendered acl policies of roles to policies by policy name, roles are processed in name order and policy defined by
+// more than one role (or policy file) with different document is reported on the source of the later role
+func (a Auth) renderPolicies(roles vaultRoles, policies map[string]aclPolicy, invalid map[roleSource][]string) {
+
+	var roleNames []string
+	for roleName := range roles {
+		roleNames = append(roleNames, roleName)
+	}
+	sort.Strings(roleNames)
+
+	for _, roleName := range roleNames {
+		role := roles[roleName]
+		var policyNames []string
+		for policyName := range role.aclPolicies {
+			policyNames = append(policyNames, policyName)
+		}
+		sort.Strings(policyNames)
+
+		for _, policyName := range policyNames {
+			document, err := a.renderPolicy(roleName, role.aclPolicies[policyName])
+			if err != nil {
+				invalid[role.source] = append(invalid[role.source], fmt.Sprintf("%s: acl policy %s: %v", roleName, policyName, err))
+			}
+			if existing, ok := policies[policyName]; ok {
+				if existing.document != document {
+					invalid[role.source] = append(invalid[role.source], fmt.Sprintf("%s: acl policy %s is already defined by %s", roleName, policyName, existing.definedBy()))
+				}
+				continue
+			}
+			policies[policyName] = aclPolicy{document: document, roleName: roleName, source: role.source}
+		}
+	}
+}
+
+// policy document rendered for the role and prefixed with owner header
+func (a Auth) renderPolicy(roleName, document string) (string, error) {
+
+	t, err := newPolicyTemplate(document)
+	if err != nil {
+		return "", err
+	}
+	data := policyTemplateData{Role: roleName, Mount: a.vaultMount(), accessor: a.vaultClient.AuthAccessor()}
+	rendered, err := execute(t, data)
+	if err != nil {
+		return "", err
+	}
+	return a.policyHeader() + rendered, nil
+}
+
+func (a Auth) vaultMount() string {
+	return fmt.Sprintf("kubernetes/%s", a.config.VaultMount)
+}
+
+func (a Auth) policyHeader() string {
+	return fmt.Sprintf(policyOwnerHeader, a.vaultMount())
+}
+
+func (a Auth) ownsPolicy(document string) bool {
+	return strings.HasPrefix(document, a.policyHeader())
+}
+
+// list and read policies from vault, policies with owner header of this mount are managed by this application
+func (a Auth) verifyPolicies() {
+
+	names, err := a.vaultClient.ListPolicies()
+	if err != nil {
+		logger.Errorf("verify acl policies: list policies: %v", err)
+		return
+	}
+
+	managed := make(map[string]string)
+	existing := make(map[string]struct{})
+	for _, name := range names {
+		existing[name] = struct{}{}
+		if vault.IsBuiltinPolicy(name) {
+			continue
+		}
+		policy, err := a.vaultClient.ReadPolicy(name)
+		if err != nil {
+			logger.Errorf("verify acl policies: read policy %s: %v", name, err)
+			// keep the last known state, so the policy is not left behind
+			if document, ok := a.policies.get(name); ok {
+				managed[name] = document
+			}
+			continue
+		}
+		if policy != nil && a.ownsPolicy(policy.Policy) {
+			managed[name] = policy.Policy
+		}
+	}
+	a.policies.refresh(managed, existing)
+}
+
+func (a Auth) writePolicies(policies map[string]aclPolicy, allowedRoles vaultRoles, invalid map[roleSource][]string) {
+
+	var names []string
+	for name, policy := range policies {
+		if _, ok := allowedRoles[policy.roleName]; (ok || policy.roleName == "") && policy.document != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var mu sync.Mutex
+	util.ForEach(a.config.Workers, names, func(name string) {
+		policy := policies[name]
+		if err := a.writePolicy(name, policy.document); err != nil {
+			logger.Errorf("write acl policy %s defined by %s: %v", name, policy.definedBy(), err)
+			if errors.Is(err, errPolicyNotManaged) {
+				mu.Lock()
+				defer mu.Unlock()
+				invalid[policy.source] = append(invalid[policy.source], fmt.Sprintf("%s: %v", policy.roleName, err))
+			}
+		}
+	})
+}
+
+var errPolicyNotManaged = errors.New("policy exists in vault and it is not managed by vault-auth-kubernetes for this mount")
+
+// write policy if it differs from the policy last written by this application, policy that exists in vault and was not
+// written by this application is not overwritten
+func (a Auth) writePolicy(name, document string) error {
+
+	managed, ok := a.policies.get(name)
+	if ok && managed == document {
+		return nil
+	}
+	if !ok {
+		existing, err := a.vaultClient.ReadPolicy(name)
+		if err != nil {
+			return err
+		}
+		if existing != nil && !a.ownsPolicy(existing.Policy) {
+			return fmt.Errorf("acl policy %s: %w", name, errPolicyNotManaged)
+		}
+		if existing != nil && existing.Policy == document {
+			a.policies.set(name, document)
+			return nil
+		}
+	}
+	if err := a.vaultClient.WritePolicy(name, document); err != nil {
+		return err
+	}
+	a.policies.set(name, document)
+	return nil
+}
+
+// delete policies written by this application that are not defined by any role (including denied roles) or policy file
+func (a Auth) prunePolicies(policies map[string]aclPolicy) {
+
+	for _, name := range a.policies.managedNames() {
+		if _, ok := policies[name]; ok {
+			continue
+		}
+		if err := a.vaultClient.DeletePolicy(name); err != nil {
+			logger.Errorf("delete acl policy %s: %v", name, err)
+			continue
+		}
+		a.policies.remove(name)
+	}
+}
+
+// token policies of roles that do not exist in vault and are not defined by any role, by role source
+func (a Auth) missingPolicies(roles vaultRoles, policies map[string]aclPolicy, missing map[roleSource][]string) {
+
+	for roleName, role := range roles {
+		for _, policy := range role.TokenPolicies {
+			if _, ok := policies[policy]; ok || a.policies.exists(policy) {
+				continue
+			}
+			missing[role.source] = append(missing[role.source], fmt.Sprintf("%s: token policy %s does not exist in vault", roleName, policy))
+		}
+	}
+}
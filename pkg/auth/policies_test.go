@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestACLPolicies(t *testing.T) {
+
+	t.Run("when role has acl policies and policy templates then policies are added to role and token policies", func(t *testing.T) {
+
+		data := map[string]string{
+			policyTemplatesKey: `{"kv-read": "path \"secret/data/[[ .Role ]]/*\" { capabilities = [\"read\"] }"}`,
+			"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["default"],
+				"acl_policies": {"app-db": "path \"database/creds/app\" { capabilities = [\"read\"] }"}, "acl_policy_templates": ["kv-read"]}`,
+		}
+
+		roles := testVaultRoles(data)
+		require.Equal(t, 1, len(roles))
+		assert.Equal(t, []string{"default", "app-db", "app-kv-read"}, roles["app"].TokenPolicies)
+		assert.Equal(t, map[string]string{
+			"app-db":      `path "database/creds/app" { capabilities = ["read"] }`,
+			"app-kv-read": `path "secret/data/[[ .Role ]]/*" { capabilities = ["read"] }`,
+		}, roles["app"].aclPolicies)
+	})
+
+	t.Run("when acl policy is invalid then role is invalid", func(t *testing.T) {
+
+		for _, role := range []string{
+			`{"bound_service_account_names": ["app"], "acl_policies": {"Upper": "path \"a\" {}"}}`,
+			`{"bound_service_account_names": ["app"], "acl_policies": {"default": "path \"a\" {}"}}`,
+			`{"bound_service_account_names": ["app"], "acl_policies": {"app": ""}}`,
+			`{"bound_service_account_names": ["app"], "acl_policies": {"app": "path \"[[ .Role \" {}"}}`,
+			`{"bound_service_account_names": ["app"], "acl_policy_templates": ["unknown"]}`,
+		} {
+			configMap := k8s.ConfigMap{Data: map[string]string{"app": role}}
+			definitions, violations := configMapRoleDefinitions(configMap)
+			roles, invalid := newVaultRoles(newConfigMapSource(configMap), definitions)
+			assert.Empty(t, roles, role)
+			assert.Len(t, append(violations, invalid...), 1, role)
+		}
+	})
+
+	t.Run("when role template or tenant role has acl policies then role is invalid", func(t *testing.T) {
+
+		role := `{"template": {"role_name": "{{.Namespace}}"}, "acl_policies": {"app": "path \"a\" {}"}}`
+		configMap := k8s.ConfigMap{Data: map[string]string{"app": role}}
+		definitions, _ := configMapRoleDefinitions(configMap)
+		templates, invalid := newRoleTemplates(newConfigMapSource(configMap), definitions)
+		assert.Empty(t, templates)
+		assert.Len(t, invalid, 1)
+
+		definitions, _ = configMapRoleDefinitions(k8s.ConfigMap{Data: map[string]string{"app": `{"acl_policies": {"app": "path \"a\" {}"}}`}})
+		_, _, err := newTenantRole("payments", definitions[0], []string{"*"})
+		assert.Error(t, err)
+	})
+}
+
+func TestParsePolicyPaths(t *testing.T) {
+
+	t.Run("when policy has path blocks and comments then paths with capabilities are returned", func(t *testing.T) {
+
+		paths, err := parsePolicyPaths(`
+# kv
+path "secret/data/[[ .Role ]]/*" {
+  capabilities = ["read", "list"]
+}
+// database
+path "database/creds/app" { capabilities = ["read"] }
+path "secret/metadata/*" {}`)
+		require.NoError(t, err)
+		assert.Equal(t, []policyPath{
+			{path: "secret/data/[[ .Role ]]/*", capabilities: []string{"read", "list"}},
+			{path: "database/creds/app", capabilities: []string{"read"}},
+			{path: "secret/metadata/*"},
+		}, paths)
+	})
+
+	t.Run("when policy has other blocks than path blocks then error is returned", func(t *testing.T) {
+
+		for _, document := range []string{
+			`{"path": {"sys/*": {"capabilities": ["sudo"]}}}`,
+			`path "secret/*" { capabilities = ["read"] allowed_parameters = { "key" = [] } }`,
+			`[[ if .Role ]]path "secret/*" { capabilities = ["read"] }[[ end ]]`,
+		} {
+			_, err := parsePolicyPaths(document)
+			assert.Error(t, err, document)
+		}
+	})
+
+	t.Run("when policy path has template actions or wildcard segments then they are glob wildcards", func(t *testing.T) {
+
+		assert.Equal(t, "secret/data/*/*", policyPathPattern("secret/data/[[ .Role ]]/*"))
+		assert.Equal(t, "secret/data/*/*", policyPathPattern("secret/data/{{identity.entity.name}}/*"))
+		assert.Equal(t, "auth/*/login", policyPathPattern("auth/+/login"))
+	})
+}
+
+func TestAuth_renderPolicies(t *testing.T) {
+
+	vaultClient := &VaultClientMock{}
+	vaultClient.On("AuthAccessor").Return("auth_kubernetes_1a2b3c4d")
+	a := Auth{config: Config{VaultMount: "test-account/test-cluster"}, vaultClient: vaultClient}
+
+	t.Run("when policy is rendered then it has owner header and role data", func(t *testing.T) {
+
+		roles := vaultRoles{"app": vaultRole{aclPolicies: map[string]string{
+			"app": `path "secret/data/[[ .Role ]]/{{identity.entity.aliases.[[ .Accessor ]].metadata.service_account_namespace}}" {} # [[ .Mount ]]`,
+		}}}
+		policies := make(map[string]aclPolicy)
+		invalid := make(map[roleSource][]string)
+
+		a.renderPolicies(roles, policies, invalid)
+		assert.Empty(t, invalid)
+		assert.Equal(t, "# managed by vault-auth-kubernetes, mount kubernetes/test-account/test-cluster\n"+
+			`path "secret/data/app/{{identity.entity.aliases.auth_kubernetes_1a2b3c4d.metadata.service_account_namespace}}" {} # kubernetes/test-account/test-cluster`,
+			policies["app"].document)
+		assert.True(t, a.ownsPolicy(policies["app"].document))
+	})
+
+	t.Run("when accessor is not known then policy that uses it is not rendered", func(t *testing.T) {
+
+		vaultClient := &VaultClientMock{}
+		vaultClient.On("AuthAccessor").Return("")
+		a := Auth{config: Config{VaultMount: "test-account/test-cluster"}, vaultClient: vaultClient}
+		roles := vaultRoles{"app": vaultRole{aclPolicies: map[string]string{"app": `path "{{identity.entity.aliases.[[ .Accessor ]].id}}" {}`}}}
+		policies := make(map[string]aclPolicy)
+		invalid := make(map[roleSource][]string)
+
+		a.renderPolicies(roles, policies, invalid)
+		assert.Equal(t, "", policies["app"].document)
+		require.Len(t, invalid[roleSource{}], 1)
+		assert.Contains(t, invalid[roleSource{}][0], "auth mount accessor is not known")
+	})
+
+	t.Run("when policy file defines the same policy as role then role is reported", func(t *testing.T) {
+
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "shared.hcl"), []byte(`path "a" {}`), 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "Invalid.hcl"), []byte(`path "a" {}`), 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte(`policies`), 0600))
+		files, err := readPolicyFiles(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+
+		policies := a.renderFilePolicies(files)
+		invalid := make(map[roleSource][]string)
+		a.renderPolicies(vaultRoles{"app": vaultRole{aclPolicies: map[string]string{"shared": `path "b" {}`}}}, policies, invalid)
+		assert.Equal(t, []string{"shared"}, sortedPolicyNames(policies))
+		assert.Equal(t, "", policies["shared"].roleName)
+		assert.Equal(t, []string{"app: acl policy shared is already defined by file " + filepath.Join(dir, "shared.hcl")}, invalid[roleSource{}])
+	})
+
+	t.Run("when the same policy is defined by two roles with different documents then the later role is reported", func(t *testing.T) {
+
+		roles := vaultRoles{
+			"app":    vaultRole{aclPolicies: map[string]string{"shared": `path "a" {}`}},
+			"worker": vaultRole{aclPolicies: map[string]string{"shared": `path "b" {}`}},
+			"batch":  vaultRole{aclPolicies: map[string]string{"shared": `path "a" {}`}},
+		}
+		policies := make(map[string]aclPolicy)
+		invalid := make(map[roleSource][]string)
+
+		a.renderPolicies(roles, policies, invalid)
+		assert.Equal(t, "app", policies["shared"].roleName)
+		assert.Equal(t, []string{"worker: acl policy shared is already defined by app role"}, invalid[roleSource{}])
+	})
+}
+
+func sortedPolicyNames(policies map[string]aclPolicy) []string {
+
+	var names []string
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,1697 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"github.com/pete911/vault-auth-kubernetes/pkg/backup"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault/vaulttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authentication "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const reconcileVaultMount = "kubernetes/test-account/test-cluster"
+
+// real k8s and vault clients wired into auth, backed by fake kubernetes clientset and in-memory vault
+type reconcileHarness struct {
+	t      *testing.T
+	kube   *fake.Clientset
+	vault  *vaulttest.Server
+	caFile string
+	// PEM signing keys file, set only in jwt auth mode
+	keysFile string
+	auth     Auth
+	token    []byte
+	// tokens from token requests are not accepted by vault when set, as if vault could not review them
+	loginDenied *atomic.Bool
+}
+
+func newReconcileHarness(t *testing.T, objects ...runtime.Object) *reconcileHarness {
+	return newReconcileHarnessWithAuthType(t, vault.AuthTypeKubernetes, objects...)
+}
+
+func newReconcileHarnessWithAuthType(t *testing.T, authType string, objects ...runtime.Object) *reconcileHarness {
+	return newTestReconcileHarness(t, authType, nil, objects...)
+}
+
+// vault and kubernetes mutations are recorded in audit log
+func newReconcileHarnessWithAudit(t *testing.T, auditLog *audit.Log, objects ...runtime.Object) *reconcileHarness {
+	return newTestReconcileHarness(t, vault.AuthTypeKubernetes, auditLog, objects...)
+}
+
+func newTestReconcileHarness(t *testing.T, authType string, auditLog *audit.Log, objects ...runtime.Object) *reconcileHarness {
+
+	kube := fake.NewSimpleClientset(objects...)
+	// fake clientset does not run token controller, add token secret to every new service account, uid is set as well
+	var uids int64
+	kube.PrependReactor("create", "serviceaccounts", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "" {
+			return false, nil, nil
+		}
+		serviceAccount := action.(k8sTesting.CreateAction).GetObject().(*v1.ServiceAccount)
+		serviceAccount.UID = types.UID(fmt.Sprintf("uid-%d", atomic.AddInt64(&uids, 1)))
+		secret := &v1.Secret{
+			ObjectMeta: meta.ObjectMeta{Namespace: serviceAccount.Namespace, Name: serviceAccount.Name + "-token"},
+			Data:       map[string][]byte{"token": []byte(serviceAccount.Name + "-jwt")},
+		}
+		if err := kube.Tracker().Add(secret); err != nil {
+			return true, nil, err
+		}
+		serviceAccount.Secrets = []v1.ObjectReference{{Name: secret.Name}}
+		return false, nil, nil
+	})
+
+	server := vaulttest.NewServer()
+	t.Cleanup(server.Close)
+	// fake clientset does not issue tokens, token request returns token that vault accepts for the service account
+	var tokens int64
+	loginDenied := &atomic.Bool{}
+	kube.PrependReactor("create", "serviceaccounts", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		create := action.(k8sTesting.CreateActionImpl)
+		tokenRequest := create.GetObject().(*authentication.TokenRequest).DeepCopy()
+		tokenRequest.Status.Token = fmt.Sprintf("%s-%s-login-%d", create.GetNamespace(), create.Name, atomic.AddInt64(&tokens, 1))
+		if !loginDenied.Load() {
+			server.AddServiceAccountToken(tokenRequest.Status.Token, create.GetNamespace(), create.Name, tokenRequest.Spec.Audiences...)
+		}
+		return true, tokenRequest, nil
+	})
+	server.AddPolicy("vault-auth-kubernetes",
+		vaulttest.PathRule{Path: "sys/auth", Capabilities: []string{"list", "read"}},
+		vaulttest.PathRule{Path: "sys/auth/kubernetes/+/+", Capabilities: []string{"list", "read", "create", "update", "delete", "sudo"}},
+		vaulttest.PathRule{Path: "sys/auth/kubernetes/+/+/tune", Capabilities: []string{"read", "update", "sudo"}},
+		vaulttest.PathRule{Path: "auth/kubernetes/+/+/config", Capabilities: []string{"list", "read", "create", "update", "sudo"}},
+		vaulttest.PathRule{Path: "auth/kubernetes/+/+/role/*", Capabilities: []string{"list", "read", "create", "update", "delete"}},
+		vaulttest.PathRule{Path: "auth/kubernetes/+/+/role", Capabilities: []string{"list"}},
+		vaulttest.PathRule{Path: "sys/policies/acl", Capabilities: []string{"list"}},
+		vaulttest.PathRule{Path: "sys/policies/acl/*", Capabilities: []string{"create", "read", "update", "delete"}},
+		vaulttest.PathRule{Path: "identity/entity/name", Capabilities: []string{"list"}},
+		vaulttest.PathRule{Path: "identity/entity/name/*", Capabilities: []string{"create", "read", "update", "delete"}},
+		vaulttest.PathRule{Path: "identity/entity-alias", Capabilities: []string{"create", "update"}},
+		vaulttest.PathRule{Path: "identity/entity-alias/id/*", Capabilities: []string{"update", "delete"}},
+		vaulttest.PathRule{Path: "identity/lookup/entity", Capabilities: []string{"update"}},
+		vaulttest.PathRule{Path: "identity/group/name", Capabilities: []string{"list"}},
+		vaulttest.PathRule{Path: "identity/group/name/*", Capabilities: []string{"create", "read", "update", "delete"}},
+		vaulttest.PathRule{Path: "sys/mounts", Capabilities: []string{"read"}},
+		vaulttest.PathRule{Path: "sys/mounts/secret", Capabilities: []string{"create", "update"}},
+		vaulttest.PathRule{Path: "secret/metadata/*", Capabilities: []string{"list", "create", "read", "update"}},
+		vaulttest.PathRule{Path: "sys/mounts/kubernetes/+/+", Capabilities: []string{"create", "update"}},
+		vaulttest.PathRule{Path: "kubernetes/+/+/config", Capabilities: []string{"read", "create", "update"}},
+		vaulttest.PathRule{Path: "kubernetes/+/+/roles", Capabilities: []string{"list"}},
+		vaulttest.PathRule{Path: "kubernetes/+/+/roles/*", Capabilities: []string{"create", "read", "update", "delete"}},
+	)
+	server.AddAppRole("role-id", "secret-id", time.Hour, "vault-auth-kubernetes")
+
+	vaultConfig := vault.Config{
+		HttpClient: &http.Client{Timeout: 5 * time.Second},
+		Host:       server.URL(),
+		RoleId:     "role-id",
+		SecretId:   "secret-id",
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+
+		AuthType:    authType,
+		JWTAudience: "vault",
+	}
+	k8sClient := k8s.NewClient(kube)
+	if auditLog != nil {
+		vaultConfig.Audit = auditLog.Recorder(audit.SystemVault)
+		k8sClient = k8sClient.WithAudit(auditLog.Recorder(audit.SystemKubernetes))
+	}
+	vaultClient, err := vault.NewClient(vaultConfig, reconcileVaultMount)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, []byte("--- CA ---"), 0600))
+	config := Config{VaultMount: strings.TrimPrefix(reconcileVaultMount, "kubernetes/"), K8sHost: "https://kube.host", K8sCAFile: caFile, Workers: 4}
+
+	h := &reconcileHarness{
+		t:           t,
+		kube:        kube,
+		vault:       server,
+		caFile:      caFile,
+		loginDenied: loginDenied,
+	}
+	if authType == vault.AuthTypeJWT {
+		// fake clientset does not serve issuer discovery, issuer and keys are configured
+		h.keysFile = filepath.Join(t.TempDir(), "sa.pub")
+		require.NoError(t, os.WriteFile(h.keysFile, []byte(testPublicKey), 0600))
+		config.AuthType, config.JWTIssuer, config.JWTKeysFile = vault.AuthTypeJWT, "https://kubernetes.default.svc", h.keysFile
+	}
+	if auditLog != nil {
+		config.Audit = auditLog
+	}
+	h.auth = NewAuth(config, vaultClient, k8sClient)
+
+	if authType != vault.AuthTypeJWT {
+		h.token, err = h.auth.initTokenReviewer()
+		require.NoError(t, err)
+	}
+	require.NoError(t, h.auth.initAuth(h.token))
+	return h
+}
+
+// one pass of the run loop
+func (h *reconcileHarness) reconcile() {
+	h.auth.reconcile(h.token)
+}
+
+func (h *reconcileHarness) setRoles(data map[string]string) {
+
+	configMap := &v1.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{Namespace: vaultAuthConfigNamespace, Name: vaultAuthConfigMap},
+		Data:       data,
+	}
+	configMaps := h.kube.CoreV1().ConfigMaps(vaultAuthConfigNamespace)
+	if _, err := configMaps.Get(context.Background(), vaultAuthConfigMap, meta.GetOptions{}); err != nil {
+		_, err = configMaps.Create(context.Background(), configMap, meta.CreateOptions{})
+		require.NoError(h.t, err)
+		return
+	}
+	_, err := configMaps.Update(context.Background(), configMap, meta.UpdateOptions{})
+	require.NoError(h.t, err)
+}
+
+func (h *reconcileHarness) deleteNamespace(name string) {
+
+	require.NoError(h.t, h.kube.CoreV1().Namespaces().Delete(context.Background(), name, meta.DeleteOptions{}))
+}
+
+func (h *reconcileHarness) vaultRoles() []string {
+
+	roles := h.vault.RoleNames(reconcileVaultMount)
+	sort.Strings(roles)
+	return roles
+}
+
+func (h *reconcileHarness) serviceAccounts(namespace string) []string {
+
+	serviceAccounts, err := h.auth.k8sClient.GetServiceAccounts(namespace, serviceAccountAnnotations)
+	require.NoError(h.t, err)
+	sort.Strings(serviceAccounts)
+	return serviceAccounts
+}
+
+// messages of events with reason created on roles config map
+func (h *reconcileHarness) events(reason string) []string {
+
+	events, err := h.kube.CoreV1().Events(vaultAuthConfigNamespace).List(context.Background(), meta.ListOptions{})
+	require.NoError(h.t, err)
+	var messages []string
+	for _, event := range events.Items {
+		if event.Reason == reason {
+			messages = append(messages, event.Message)
+		}
+	}
+	return messages
+}
+
+func newTestNamespace(name string, labels map[string]string) *v1.Namespace {
+
+	return &v1.Namespace{ObjectMeta: meta.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func TestReconcile(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments"], "token_policies": ["worker"]}`,
+	}
+
+	t.Run("when auth is initialised then token reviewer is created and vault auth is mounted and configured", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil))
+
+		_, err := h.kube.RbacV1().ClusterRoleBindings().Get(context.Background(), tokenReviewerClusterRoleBinding, meta.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "kubernetes", h.vault.Mounts()[reconcileVaultMount].Type)
+		config := h.vault.Config(reconcileVaultMount)
+		assert.Equal(t, "https://kube.host", config["kubernetes_host"])
+		assert.Equal(t, "--- CA ---", config["kubernetes_ca_cert"])
+		assert.Equal(t, "token-reviewer-jwt", config["token_reviewer_jwt"])
+	})
+
+	t.Run("when config map is created then roles and service accounts are created", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+		assert.Equal(t, []string{"app", "worker"}, h.serviceAccounts("payments"))
+		assert.Equal(t, []interface{}{"app"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+	})
+
+	t.Run("when config map is edited then roles and service accounts are updated and removed", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.setRoles(map[string]string{
+			"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app", "shared"]}`,
+		})
+		h.reconcile()
+
+		assert.Equal(t, []string{"app"}, h.vaultRoles())
+		assert.Equal(t, []string{"app"}, h.serviceAccounts("payments"))
+		assert.Equal(t, []interface{}{"app", "shared"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+	})
+
+	t.Run("when config map contains invalid role then event is created and valid roles are reconciled", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{
+			"app":     roles["app"],
+			"invalid": `{"token_policies": "app"}`,
+		})
+		h.reconcile()
+
+		assert.Equal(t, []string{"app"}, h.vaultRoles())
+		events, err := h.kube.CoreV1().Events(vaultAuthConfigNamespace).List(context.Background(), meta.ListOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(events.Items))
+		assert.Equal(t, eventReasonInvalidRole, events.Items[0].Reason)
+	})
+
+	t.Run("when namespace is deleted then role rendered from template is removed", func(t *testing.T) {
+
+		h := newReconcileHarness(t,
+			newTestNamespace(tokenReviewerNamespace, nil),
+			newTestNamespace("payments", map[string]string{"team": "a"}),
+			newTestNamespace("orders", map[string]string{"team": "a"}),
+		)
+		h.setRoles(map[string]string{
+			"namespaces": `{"template": {"role_name": "ns-{{.Namespace}}", "namespace_labels": {"team": "a"}}, "bound_service_account_names": ["app"], "token_policies": ["{{.Namespace}}"]}`,
+		})
+		h.reconcile()
+		assert.Equal(t, []string{"ns-orders", "ns-payments"}, h.vaultRoles())
+
+		h.deleteNamespace("orders")
+		h.reconcile()
+		assert.Equal(t, []string{"ns-payments"}, h.vaultRoles())
+	})
+
+	t.Run("when vault restarts then client logs in again and roles are reconciled", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.vault.Restart()
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+
+		assert.Equal(t, []string{"app"}, h.vaultRoles())
+	})
+
+	t.Run("when vault token expires then client logs in again and roles are reconciled", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+
+		h.vault.Advance(2 * time.Hour)
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+	})
+
+	t.Run("when vault is sealed then roles are reconciled after unseal", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.vault.Seal()
+		h.setRoles(roles)
+		h.reconcile()
+		assert.Empty(t, h.vault.RoleNames(reconcileVaultMount))
+		assert.Empty(t, h.serviceAccounts("payments"))
+
+		h.vault.Unseal()
+		h.reconcile()
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+	})
+
+	t.Run("when kubernetes CA is rotated then vault auth is re-configured", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil))
+		configRequests := countRequests(h.vault, http.MethodPost, "auth/"+reconcileVaultMount+"/config")
+		h.reconcile()
+		assert.Equal(t, configRequests, countRequests(h.vault, http.MethodPost, "auth/"+reconcileVaultMount+"/config"))
+
+		require.NoError(t, os.WriteFile(h.caFile, []byte("--- rotated CA ---"), 0600))
+		h.reconcile()
+
+		assert.Equal(t, "--- rotated CA ---", h.vault.Config(reconcileVaultMount)["kubernetes_ca_cert"])
+		assert.Equal(t, configRequests+1, countRequests(h.vault, http.MethodPost, "auth/"+reconcileVaultMount+"/config"))
+	})
+
+	t.Run("when pem keys file changes then vault auth is re-configured with rotated keys", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil))
+		keysFile := filepath.Join(t.TempDir(), "sa.pub")
+		require.NoError(t, os.WriteFile(keysFile, []byte(testPublicKey), 0600))
+		h.auth.config.PEMKeys, h.auth.config.PEMKeysFile, h.auth.config.Issuer = true, keysFile, "https://kubernetes.default.svc"
+		h.reconcile()
+
+		config := h.vault.Config(reconcileVaultMount)
+		assert.Equal(t, []interface{}{testPublicKey}, config["pem_keys"])
+		assert.Equal(t, "https://kubernetes.default.svc", config["issuer"])
+		configRequests := countRequests(h.vault, http.MethodPost, "auth/"+reconcileVaultMount+"/config")
+		h.reconcile()
+		assert.Equal(t, configRequests, countRequests(h.vault, http.MethodPost, "auth/"+reconcileVaultMount+"/config"))
+
+		require.NoError(t, os.WriteFile(keysFile, []byte(testPublicKey+testRotatedPublicKey), 0600))
+		h.reconcile()
+		assert.Equal(t, []interface{}{testPublicKey, testRotatedPublicKey}, h.vault.Config(reconcileVaultMount)["pem_keys"])
+	})
+
+	t.Run("when vault auth mount is lost then it is mounted and configured again", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+
+		request, err := http.NewRequest(http.MethodDelete, h.vault.URL()+"/v1/sys/auth/"+reconcileVaultMount, nil)
+		require.NoError(t, err)
+		request.Header.Set("X-Vault-Token", h.vault.RootToken())
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		require.Nil(t, h.vault.Config(reconcileVaultMount))
+
+		h.reconcile()
+		assert.Equal(t, "https://kube.host", h.vault.Config(reconcileVaultMount)["kubernetes_host"])
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+	})
+}
+
+func TestReconcile_jwt(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		"worker": `{"bound_service_account_names": ["worker", "cron"], "bound_service_account_namespaces": ["payments"], "audience": "worker", "token_policies": ["worker"]}`,
+	}
+
+	t.Run("when auth type is jwt then jwt auth is mounted with issuer and keys and there is no token reviewer", func(t *testing.T) {
+
+		h := newReconcileHarnessWithAuthType(t, vault.AuthTypeJWT, newTestNamespace(tokenReviewerNamespace, nil))
+
+		_, err := h.kube.RbacV1().ClusterRoleBindings().Get(context.Background(), tokenReviewerClusterRoleBinding, meta.GetOptions{})
+		assert.Error(t, err)
+		assert.Equal(t, "jwt", h.vault.Mounts()[reconcileVaultMount].Type)
+		config := h.vault.Config(reconcileVaultMount)
+		assert.Equal(t, "https://kubernetes.default.svc", config["bound_issuer"])
+		assert.Equal(t, []interface{}{testPublicKey}, config["jwt_validation_pubkeys"])
+	})
+
+	t.Run("when config map is created then jwt roles bound to service account subjects are created", func(t *testing.T) {
+
+		h := newReconcileHarnessWithAuthType(t, vault.AuthTypeJWT, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+		app := h.vault.Role(reconcileVaultMount, "app")
+		assert.Equal(t, "jwt", app["role_type"])
+		assert.Equal(t, "sub", app["user_claim"])
+		assert.Equal(t, "system:serviceaccount:payments:app", app["bound_subject"])
+		assert.Equal(t, []interface{}{"vault"}, app["bound_audiences"])
+		worker := h.vault.Role(reconcileVaultMount, "worker")
+		assert.Equal(t, map[string]interface{}{"sub": []interface{}{"system:serviceaccount:payments:cron", "system:serviceaccount:payments:worker"}}, worker["bound_claims"])
+		assert.Equal(t, []interface{}{"worker"}, worker["bound_audiences"])
+	})
+
+	t.Run("when roles have not changed then jwt roles are not written again", func(t *testing.T) {
+
+		h := newReconcileHarnessWithAuthType(t, vault.AuthTypeJWT, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+		h.auth.cache.clear()
+		h.reconcile()
+
+		assert.Equal(t, 1, countRequests(h.vault, http.MethodPost, "auth/"+reconcileVaultMount+"/role/app"))
+	})
+
+	t.Run("when signing keys file changes then jwt auth is configured with new keys", func(t *testing.T) {
+
+		h := newReconcileHarnessWithAuthType(t, vault.AuthTypeJWT, newTestNamespace(tokenReviewerNamespace, nil))
+		require.NoError(t, os.WriteFile(h.keysFile, []byte(testPublicKey+testRotatedPublicKey), 0600))
+		h.reconcile()
+
+		assert.Equal(t, []interface{}{testPublicKey, testRotatedPublicKey}, h.vault.Config(reconcileVaultMount)["jwt_validation_pubkeys"])
+	})
+
+	t.Run("when identity is enabled then entity aliases are service account subjects", func(t *testing.T) {
+
+		h := newReconcileHarnessWithAuthType(t, vault.AuthTypeJWT, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.config.Identity = true
+		h.setRoles(roles)
+		h.reconcile()
+
+		aliases := h.vault.Entity(reconcileVaultMount + "/payments/app")["aliases"].([]interface{})
+		require.Len(t, aliases, 1)
+		assert.Equal(t, "system:serviceaccount:payments:app", aliases[0].(map[string]interface{})["name"])
+	})
+}
+
+func TestReconcile_concurrent(t *testing.T) {
+
+	t.Run("when there are many namespaces and roles then all of them are reconciled by workers", func(t *testing.T) {
+
+		objects := []runtime.Object{newTestNamespace(tokenReviewerNamespace, nil)}
+		data := make(map[string]string)
+		var expectedRoles []string
+		for i := 0; i < 50; i++ {
+			namespace := fmt.Sprintf("team-%02d", i)
+			objects = append(objects, newTestNamespace(namespace, map[string]string{"tenant": "true"}))
+			expectedRoles = append(expectedRoles, "ns-"+namespace)
+			role := fmt.Sprintf("role-%02d", i)
+			data[role] = fmt.Sprintf(`{"bound_service_account_names": ["%s"], "bound_service_account_namespaces": ["%s"], "token_policies": ["app"]}`, role, namespace)
+			expectedRoles = append(expectedRoles, role)
+		}
+		data["namespaces"] = `{"template": {"role_name": "ns-{{.Namespace}}", "namespace_labels": {"tenant": "true"}}, "bound_service_account_names": ["app"], "token_policies": ["{{.Namespace}}"]}`
+		sort.Strings(expectedRoles)
+
+		h := newReconcileHarness(t, objects...)
+		h.setRoles(data)
+		h.reconcile()
+		assert.Equal(t, expectedRoles, h.vaultRoles())
+		assert.Equal(t, []string{"app", "role-07"}, h.serviceAccounts("team-07"))
+
+		// every role is removed except the first one
+		h.setRoles(map[string]string{"role-00": data["role-00"]})
+		h.reconcile()
+		assert.Equal(t, []string{"role-00"}, h.vaultRoles())
+		assert.Equal(t, []string{"role-00"}, h.serviceAccounts("team-00"))
+		assert.Empty(t, h.serviceAccounts("team-07"))
+	})
+}
+
+func TestReconcile_backup(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments"], "token_policies": ["worker"]}`,
+	}
+	withBackup := func(h *reconcileHarness, store backup.Store) backup.Backup {
+
+		b := backup.NewBackup(h.auth.vaultClient.(*vault.Client), store, reconcileVaultMount, 10)
+		h.auth.config.Backup = b
+		return b
+	}
+
+	t.Run("when roles are deleted then snapshot is taken before and deleted roles can be restored", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		store := backup.NewFileStore(t.TempDir())
+		b := withBackup(h, store)
+		h.setRoles(roles)
+		h.reconcile()
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Empty(t, names, "nothing was deleted, no snapshot is taken")
+
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+		assert.Equal(t, []string{"app"}, h.vaultRoles())
+
+		names, err = store.List()
+		require.NoError(t, err)
+		require.Len(t, names, 1)
+		snapshot, err := store.Load(names[0])
+		require.NoError(t, err)
+		assert.Equal(t, "delete roles worker", snapshot.Reason)
+		assert.Equal(t, []string{"app", "worker"}, snapshot.RoleNames())
+		assert.Equal(t, "<redacted>", snapshot.Config["token_reviewer_jwt"])
+		assert.Equal(t, "https://kube.host", snapshot.Config["kubernetes_host"])
+
+		_, err = b.Restore("", []byte("token-reviewer-jwt"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+		assert.Equal(t, []interface{}{"worker"}, h.vault.Role(reconcileVaultMount, "worker")["token_policies"])
+	})
+
+	t.Run("when auth mount is lost then restore mounts, tunes and configures auth with supplied token reviewer jwt", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		b := withBackup(h, backup.NewFileStore(t.TempDir()))
+		h.setRoles(roles)
+		h.reconcile()
+		_, err := b.Snapshot("backup")
+		require.NoError(t, err)
+
+		request, err := http.NewRequest(http.MethodDelete, h.vault.URL()+"/v1/sys/auth/"+reconcileVaultMount, nil)
+		require.NoError(t, err)
+		request.Header.Set("X-Vault-Token", h.vault.RootToken())
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		_, err = b.Restore("", nil)
+		require.Error(t, err, "token reviewer jwt is not in snapshot")
+
+		_, err = b.Restore("", []byte("restored-jwt"))
+		require.NoError(t, err)
+		assert.Equal(t, 31536000, h.vault.Mounts()[reconcileVaultMount].Config["max_lease_ttl"])
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+		assert.Equal(t, "restored-jwt", h.vault.Config(reconcileVaultMount)["token_reviewer_jwt"])
+		assert.Equal(t, "https://kube.host", h.vault.Config(reconcileVaultMount)["kubernetes_host"])
+	})
+
+	t.Run("when auth mount is lost then snapshot is not taken and roles are removed from cache", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		store := backup.NewFileStore(t.TempDir())
+		b := withBackup(h, store)
+		h.setRoles(roles)
+		h.reconcile()
+
+		request, err := http.NewRequest(http.MethodDelete, h.vault.URL()+"/v1/sys/auth/"+reconcileVaultMount, nil)
+		require.NoError(t, err)
+		request.Header.Set("X-Vault-Token", h.vault.RootToken())
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		_, err = b.Snapshot("backup")
+		require.ErrorIs(t, err, backup.ErrNotMounted)
+		h.auth.deleteVaultRoles(vaultRoles{"app": {}}, false)
+		assert.Equal(t, []string{"app"}, h.auth.cache.names())
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+
+	t.Run("when snapshot fails then roles are not deleted", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		// store directory is a file, snapshot cannot be saved
+		dir := filepath.Join(t.TempDir(), "backup")
+		require.NoError(t, os.WriteFile(dir, nil, 0600))
+		withBackup(h, backup.NewFileStore(dir))
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+	})
+}
+
+func TestReconcile_aclPolicies(t *testing.T) {
+
+	header := "# managed by vault-auth-kubernetes, mount " + reconcileVaultMount + "\n"
+	roles := map[string]string{
+		policyTemplatesKey: `{"kv-read": "path \"secret/data/[[ .Role ]]/*\" { capabilities = [\"read\"] }"}`,
+		"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["default", "shared"],
+			"acl_policy_templates": ["kv-read"]}`,
+		"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments"],
+			"acl_policies": {"worker-db": "path \"database/creds/worker\" { capabilities = [\"read\"] }"}}`,
+	}
+	newHarness := func(t *testing.T) *reconcileHarness {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.config.ACLPolicies = true
+		return h
+	}
+
+	t.Run("when roles define acl policies then policies are written with owner header and added to token policies", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, []string{"app-kv-read", "worker-db"}, h.vault.ACLPolicyNames())
+		assert.Equal(t, header+`path "secret/data/app/*" { capabilities = ["read"] }`, h.vault.ACLPolicy("app-kv-read"))
+		assert.Equal(t, []interface{}{"default", "shared", "app-kv-read"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		assert.Equal(t, []string{"app: token policy shared does not exist in vault"}, h.events(eventReasonMissingPolicy))
+
+		writes := countRequests(h.vault, http.MethodPut, "sys/policies/acl/app-kv-read")
+		h.vault.SetACLPolicy("shared", `path "secret/data/shared/*" { capabilities = ["read"] }`)
+		h.reconcile()
+		assert.Equal(t, writes, countRequests(h.vault, http.MethodPut, "sys/policies/acl/app-kv-read"), "unchanged policy is not written")
+	})
+
+	t.Run("when role no longer defines acl policy then the policy is deleted and policies of other owners are kept", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.vault.SetACLPolicy("team", `path "secret/*" { capabilities = ["read"] }`)
+		h.vault.SetACLPolicy("other-mount", "# managed by vault-auth-kubernetes, mount kubernetes/other/cluster\npath \"a\" {}")
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.setRoles(map[string]string{"app": roles["app"], policyTemplatesKey: roles[policyTemplatesKey]})
+		h.reconcile()
+		assert.Equal(t, []string{"app-kv-read", "other-mount", "team"}, h.vault.ACLPolicyNames())
+		assert.Equal(t, []string{"app"}, h.vaultRoles())
+	})
+
+	t.Run("when acl policy exists and it is not managed by this mount then it is not overwritten", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.vault.SetACLPolicy("worker-db", `path "database/*" { capabilities = ["read"] }`)
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, `path "database/*" { capabilities = ["read"] }`, h.vault.ACLPolicy("worker-db"))
+		require.Len(t, h.events(eventReasonInvalidPolicy), 1)
+		assert.Contains(t, h.events(eventReasonInvalidPolicy)[0], "worker: acl policy worker-db: policy exists in vault and it is not managed")
+	})
+
+	t.Run("when managed acl policy is changed in vault then it is overwritten when policies are verified", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.vault.SetACLPolicy("worker-db", header+`path "database/*" { capabilities = ["read", "update"] }`)
+		h.reconcile()
+		assert.Equal(t, header+`path "database/creds/worker" { capabilities = ["read"] }`, h.vault.ACLPolicy("worker-db"))
+	})
+
+	t.Run("when policy file uses mount accessor then it is written and rendered again when auth is mounted again", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.auth.config.PoliciesDir = t.TempDir()
+		document := `path "secret/data/{{identity.entity.aliases.[[ .Accessor ]].metadata.service_account_namespace}}/*" { capabilities = ["read"] }`
+		require.NoError(t, os.WriteFile(filepath.Join(h.auth.config.PoliciesDir, "namespace-kv.hcl"), []byte(document), 0600))
+		h.setRoles(roles)
+		h.reconcile()
+
+		accessor := h.vault.Mounts()[reconcileVaultMount].Accessor
+		require.NotEmpty(t, accessor)
+		assert.Equal(t, []string{"app-kv-read", "namespace-kv", "worker-db"}, h.vault.ACLPolicyNames())
+		assert.Contains(t, h.vault.ACLPolicy("namespace-kv"), "identity.entity.aliases."+accessor+".metadata")
+
+		request, err := http.NewRequest(http.MethodDelete, h.vault.URL()+"/v1/sys/auth/"+reconcileVaultMount, nil)
+		require.NoError(t, err)
+		request.Header.Set("X-Vault-Token", h.vault.RootToken())
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		h.reconcile()
+		remounted := h.vault.Mounts()[reconcileVaultMount].Accessor
+		assert.NotEqual(t, accessor, remounted)
+		assert.Contains(t, h.vault.ACLPolicy("namespace-kv"), "identity.entity.aliases."+remounted+".metadata")
+
+		require.NoError(t, os.Remove(filepath.Join(h.auth.config.PoliciesDir, "namespace-kv.hcl")))
+		h.reconcile()
+		assert.Equal(t, []string{"app-kv-read", "worker-db"}, h.vault.ACLPolicyNames())
+	})
+
+	t.Run("when acl policy with allowed name grants forbidden path then role is denied and policy is not written", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.auth.config.Guardrails = Guardrails{Rules: []GuardrailRule{{
+			AllowedPolicies:             []string{"default", "shared", "app-*", "worker-*"},
+			ForbiddenPolicyPaths:        []string{"sys/*"},
+			ForbiddenPolicyCapabilities: []string{"sudo"},
+		}}}
+		h.setRoles(map[string]string{
+			policyTemplatesKey: roles[policyTemplatesKey],
+			"app":              roles["app"],
+			"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments"],
+				"acl_policies": {"worker-db": "path \"*\" { capabilities = [\"create\", \"read\", \"update\", \"delete\", \"list\", \"sudo\"] }"}}`,
+		})
+		h.reconcile()
+
+		assert.Equal(t, []string{"app-kv-read"}, h.vault.ACLPolicyNames())
+		assert.Equal(t, []string{"app"}, h.vaultRoles())
+		assert.Equal(t, []string{`worker: guardrail rule 0: acl policy worker-db path "*" capability "sudo" is not allowed; ` +
+			`worker: guardrail rule 0: acl policy worker-db path "*" is not allowed`}, h.events(eventReasonDeniedRole))
+	})
+
+	t.Run("when acl policies are not enabled then policies are not written and roles are reported", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Empty(t, h.vault.ACLPolicyNames())
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+		assert.Equal(t, []string{"app: acl policies are not enabled, acl_policies are not written; worker: acl policies are not enabled, acl_policies are not written"},
+			h.events(eventReasonInvalidPolicy))
+	})
+}
+
+func TestReconcile_identity(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments", "billing"], "token_policies": ["worker"]}`,
+	}
+	entityPrefix := reconcileVaultMount + "/"
+	newHarness := func(t *testing.T) *reconcileHarness {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil),
+			newTestNamespace("payments", map[string]string{"team": "finance"}), newTestNamespace("billing", map[string]string{"team": "finance"}))
+		h.auth.config.Identity = true
+		return h
+	}
+	aliases := func(h *reconcileHarness, entity string) []string {
+
+		var names []string
+		for _, alias := range h.vault.Entity(entity)["aliases"].([]interface{}) {
+			names = append(names, alias.(map[string]interface{})["name"].(string))
+		}
+		return names
+	}
+	serviceAccountUID := func(h *reconcileHarness, namespace, name string) string {
+
+		uids, err := h.auth.k8sClient.GetServiceAccountUIDs(namespace, serviceAccountAnnotations)
+		require.NoError(t, err)
+		return uids[name]
+	}
+
+	t.Run("when identity is enabled then entities with aliases are written for service accounts and groups for namespaces", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, []string{entityPrefix + "billing/worker", entityPrefix + "payments/app", entityPrefix + "payments/worker"}, h.vault.EntityNames())
+		entity := h.vault.Entity(entityPrefix + "payments/app")
+		assert.Equal(t, map[string]interface{}{"managed_by": "vault-auth-kubernetes", "mount": reconcileVaultMount, "cluster": "test-account/test-cluster",
+			"namespace": "payments", "service_account": "app"}, entity["metadata"])
+		assert.Equal(t, []string{serviceAccountUID(h, "payments", "app")}, aliases(h, entityPrefix+"payments/app"))
+
+		assert.Equal(t, []string{entityPrefix + "namespace/billing", entityPrefix + "namespace/payments"}, h.vault.GroupNames())
+		assert.Len(t, h.vault.Group(entityPrefix + "namespace/payments")["member_entity_ids"], 2)
+		assert.Contains(t, h.vault.Group(entityPrefix + "namespace/payments")["member_entity_ids"], entity["id"])
+	})
+
+	t.Run("when service account already logged in then its alias is moved to the entity", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.auth.config.Identity = false
+		h.reconcile()
+		accessor := h.vault.Mounts()[reconcileVaultMount].Accessor
+		h.vault.AddEntityAlias("entity_1234", serviceAccountUID(h, "payments", "app"), accessor)
+
+		h.auth.config.Identity = true
+		h.reconcile()
+		assert.Equal(t, []string{serviceAccountUID(h, "payments", "app")}, aliases(h, entityPrefix+"payments/app"))
+		assert.Empty(t, h.vault.Entity("entity_1234")["aliases"])
+	})
+
+	t.Run("when service account is created again then entity alias is renamed to the new uid", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+		uid := serviceAccountUID(h, "payments", "app")
+
+		require.NoError(t, h.kube.CoreV1().ServiceAccounts("payments").Delete(context.Background(), "app", meta.DeleteOptions{}))
+		require.NoError(t, h.kube.CoreV1().Secrets("payments").Delete(context.Background(), "app-token", meta.DeleteOptions{}))
+		h.reconcile()
+		assert.NotEqual(t, uid, serviceAccountUID(h, "payments", "app"))
+		assert.Equal(t, []string{serviceAccountUID(h, "payments", "app")}, aliases(h, entityPrefix+"payments/app"))
+	})
+
+	t.Run("when role is removed then its entities and empty groups are deleted and group policies are kept", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.vault.AddEntityAlias(entityPrefix+"payments/other", "other", h.vault.Mounts()[reconcileVaultMount].Accessor)
+		h.setRoles(roles)
+		h.reconcile()
+		h.vault.SetGroupPolicies(entityPrefix+"namespace/payments", "payments")
+
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+		assert.Equal(t, []string{entityPrefix + "payments/app", entityPrefix + "payments/other"}, h.vault.EntityNames())
+		assert.Equal(t, []string{entityPrefix + "namespace/payments"}, h.vault.GroupNames())
+		group := h.vault.Group(entityPrefix + "namespace/payments")
+		assert.Equal(t, []interface{}{h.vault.Entity(entityPrefix + "payments/app")["id"]}, group["member_entity_ids"])
+		assert.Equal(t, []interface{}{"payments"}, group["policies"])
+	})
+
+	t.Run("when role is denied by guardrails then its entities are not written and existing entities are kept", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+
+		h.auth.config.Guardrails = Guardrails{Rules: []GuardrailRule{{AllowedPolicies: []string{"worker"}}}}
+		h.setRoles(roles)
+		h.reconcile()
+		assert.Equal(t, []string{entityPrefix + "billing/worker", entityPrefix + "payments/app", entityPrefix + "payments/worker"}, h.vault.EntityNames())
+
+		h.auth.config.Guardrails = Guardrails{Rules: []GuardrailRule{{AllowedPolicies: []string{"app"}}}}
+		h.reconcile()
+		assert.Equal(t, []string{entityPrefix + "billing/worker", entityPrefix + "payments/app", entityPrefix + "payments/worker"}, h.vault.EntityNames())
+
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+		assert.Equal(t, []string{entityPrefix + "payments/app"}, h.vault.EntityNames())
+	})
+
+	t.Run("when new role is denied by guardrails then its entities are not written", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.auth.config.Guardrails = Guardrails{Rules: []GuardrailRule{{AllowedPolicies: []string{"app"}}}}
+		h.setRoles(roles)
+		h.reconcile()
+		assert.Equal(t, []string{entityPrefix + "payments/app"}, h.vault.EntityNames())
+	})
+
+	t.Run("when group label is set then groups are written for label values", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.auth.config.IdentityGroupLabel = "team"
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, []string{entityPrefix + "team/finance"}, h.vault.GroupNames())
+		group := h.vault.Group(entityPrefix + "team/finance")
+		assert.Len(t, group["member_entity_ids"], 3)
+		assert.Equal(t, "finance", group["metadata"].(map[string]interface{})["label_value"])
+	})
+}
+
+func TestReconcile_kvBootstrap(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["billing"], "token_policies": ["worker"]}`,
+	}
+	newHarness := func(t *testing.T) *reconcileHarness {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil),
+			newTestNamespace("payments", map[string]string{"team": "finance"}), newTestNamespace("billing", nil))
+		h.auth.config.KVBootstrap = &KVBootstrap{Mount: "secret", MaxVersions: 10, DeleteVersionAfter: "720h", TeamLabel: "team"}
+		return h
+	}
+	path := func(namespace string) string {
+		return reconcileVaultMount + "/" + namespace
+	}
+	customMetadata := func(h *reconcileHarness, namespace string) map[string]interface{} {
+
+		metadata := h.vault.KVMetadata("secret", path(namespace))
+		require.NotNil(t, metadata)
+		return metadata["custom_metadata"].(map[string]interface{})
+	}
+	metadataWrites := func(h *reconcileHarness) int {
+		var count int
+		for _, request := range h.vault.Requests() {
+			if request.Method == http.MethodPost && strings.HasPrefix(request.Path, "secret/metadata/") {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("when kv bootstrap is enabled then kv is mounted and namespace paths are written with metadata", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, vaulttest.SecretsMount{Type: "kv", Options: map[string]string{"version": "2"}}, h.vault.SecretsMounts()["secret"])
+		metadata := h.vault.KVMetadata("secret", path("payments"))
+		assert.Equal(t, float64(10), metadata["max_versions"])
+		assert.Equal(t, "720h", metadata["delete_version_after"])
+		assert.Equal(t, map[string]interface{}{"managed_by": "vault-auth-kubernetes", "mount": reconcileVaultMount, "cluster": "test-account/test-cluster",
+			"namespace": "payments", "team": "finance"}, customMetadata(h, "payments"))
+		assert.NotContains(t, customMetadata(h, "billing"), "team")
+
+		writes := metadataWrites(h)
+		h.reconcile()
+		assert.Equal(t, writes, metadataWrites(h))
+	})
+
+	t.Run("when namespace has no roles then its path is marked as orphaned and mark is removed when roles are back", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+		h.vault.SetKVVersions("secret", path("billing")+"/db", 3)
+
+		h.setRoles(map[string]string{"app": roles["app"]})
+		h.reconcile()
+		assert.Equal(t, "true", customMetadata(h, "billing")[kvOrphanedKey])
+		assert.NotEmpty(t, customMetadata(h, "billing")[kvOrphanedAtKey])
+		assert.Equal(t, 3, h.vault.KVMetadata("secret", path("billing")+"/db")["current_version"])
+		assert.NotContains(t, customMetadata(h, "payments"), kvOrphanedKey)
+
+		writes := metadataWrites(h)
+		h.reconcile()
+		assert.Equal(t, writes, metadataWrites(h))
+
+		h.setRoles(roles)
+		h.reconcile()
+		assert.NotContains(t, customMetadata(h, "billing"), kvOrphanedKey)
+		assert.NotContains(t, customMetadata(h, "billing"), kvOrphanedAtKey)
+	})
+
+	t.Run("when namespace is deleted then its path is marked as orphaned", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.deleteNamespace("billing")
+		h.reconcile()
+		assert.Equal(t, "true", customMetadata(h, "billing")[kvOrphanedKey])
+		assert.NotNil(t, h.vault.KVMetadata("secret", path("billing")))
+	})
+
+	t.Run("when path has custom metadata of the team then it is kept and path of other owner is not changed", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.vault.MountSecrets("secret", vaulttest.SecretsMount{Type: "kv", Options: map[string]string{"version": "2"}})
+		h.setRoles(roles)
+		h.reconcile()
+
+		metadata := map[string]string{"owner": "alice"}
+		for k, v := range customMetadata(h, "payments") {
+			metadata[k] = v.(string)
+		}
+		require.NoError(t, h.auth.vaultClient.WriteKVMetadata("secret", path("payments"), vault.KVMetadata{CustomMetadata: metadata}))
+		require.NoError(t, h.auth.vaultClient.WriteKVMetadata("secret", path("billing"), vault.KVMetadata{CustomMetadata: map[string]string{"managed_by": "terraform"}}))
+
+		_, err := h.kube.CoreV1().Namespaces().Update(context.Background(), newTestNamespace("payments", map[string]string{"team": "treasury"}), meta.UpdateOptions{})
+		require.NoError(t, err)
+		h.reconcile()
+		assert.Equal(t, "treasury", customMetadata(h, "payments")["team"])
+		assert.Equal(t, "alice", customMetadata(h, "payments")["owner"])
+		assert.Equal(t, map[string]interface{}{"managed_by": "terraform"}, customMetadata(h, "billing"))
+	})
+
+	t.Run("when kv version 1 is mounted then paths are not written", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.vault.MountSecrets("secret", vaulttest.SecretsMount{Type: "kv", Options: map[string]string{"version": "1"}})
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Zero(t, metadataWrites(h))
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+	})
+}
+
+func TestReconcile_secretsEngine(t *testing.T) {
+
+	roles := map[string]string{
+		"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"],
+			"secrets_engine_role": {"service_account_name": "app", "token_default_ttl": "10m"}}`,
+		"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["billing"], "token_policies": ["worker"]}`,
+	}
+	newHarness := func(t *testing.T) *reconcileHarness {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil), newTestNamespace("billing", nil))
+		h.auth.config.SecretsEngine = true
+		h.auth.config.SecretsEngineClusterRole = "vault-secrets-engine"
+		return h
+	}
+	roleWrites := func(h *reconcileHarness) int {
+		return countRequests(h.vault, http.MethodPost, reconcileVaultMount+"/roles/app")
+	}
+
+	t.Run("when secrets engine is enabled then it is mounted and configured with its own service account", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, "kubernetes", h.vault.SecretsMounts()[reconcileVaultMount].Type)
+		config := h.vault.SecretsConfig(reconcileVaultMount)
+		assert.Equal(t, "https://kube.host", config["kubernetes_host"])
+		assert.Equal(t, "--- CA ---", config["kubernetes_ca_cert"])
+		assert.Equal(t, "secrets-engine-jwt", config["service_account_jwt"])
+		assert.Equal(t, true, config["disable_local_ca_jwt"])
+
+		binding, err := h.kube.RbacV1().ClusterRoleBindings().Get(context.Background(), secretsEngineClusterRoleBinding, meta.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "vault-secrets-engine", binding.RoleRef.Name)
+		assert.Equal(t, secretsEngineServiceAccount, binding.Subjects[0].Name)
+
+		configWrites := countRequests(h.vault, http.MethodPost, reconcileVaultMount+"/config")
+		h.reconcile()
+		assert.Equal(t, configWrites, countRequests(h.vault, http.MethodPost, reconcileVaultMount+"/config"))
+	})
+
+	t.Run("when role has secrets engine role then it is written with role namespaces", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, []string{"app"}, h.vault.SecretsRoleNames(reconcileVaultMount))
+		role := h.vault.SecretsRole(reconcileVaultMount, "app")
+		assert.Equal(t, "app", role["service_account_name"])
+		assert.Equal(t, []interface{}{"payments"}, role["allowed_kubernetes_namespaces"])
+		assert.Equal(t, 600, role["token_default_ttl"])
+
+		writes := roleWrites(h)
+		h.reconcile()
+		assert.Equal(t, writes, roleWrites(h))
+	})
+
+	t.Run("when secrets engine role is changed in vault then it is written again", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		require.NoError(t, h.auth.vaultClient.WriteSecretsRole("app", map[string]interface{}{"service_account_name": "admin", "allowed_kubernetes_namespaces": []string{"*"}}))
+		h.reconcile()
+		assert.Equal(t, "app", h.vault.SecretsRole(reconcileVaultMount, "app")["service_account_name"])
+		assert.Equal(t, []interface{}{"payments"}, h.vault.SecretsRole(reconcileVaultMount, "app")["allowed_kubernetes_namespaces"])
+	})
+
+	t.Run("when secrets engine role is removed then it is deleted from vault", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.setRoles(map[string]string{"worker": roles["worker"]})
+		h.reconcile()
+		assert.Empty(t, h.vault.SecretsRoleNames(reconcileVaultMount))
+		assert.Equal(t, []string{"worker"}, h.vaultRoles())
+	})
+
+	t.Run("when CA or token is rotated then secrets engine is configured again", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		require.NoError(t, os.WriteFile(h.caFile, []byte("--- rotated CA ---"), 0600))
+		h.reconcile()
+		assert.Equal(t, "--- rotated CA ---", h.vault.SecretsConfig(reconcileVaultMount)["kubernetes_ca_cert"])
+
+		secret := &v1.Secret{
+			ObjectMeta: meta.ObjectMeta{Namespace: secretsEngineNamespace, Name: secretsEngineServiceAccount + "-token"},
+			Data:       map[string][]byte{"token": []byte("rotated-jwt")},
+		}
+		_, err := h.kube.CoreV1().Secrets(secretsEngineNamespace).Update(context.Background(), secret, meta.UpdateOptions{})
+		require.NoError(t, err)
+		h.reconcile()
+		assert.Equal(t, "rotated-jwt", h.vault.SecretsConfig(reconcileVaultMount)["service_account_jwt"])
+	})
+
+	t.Run("when secrets engine is mounted again then roles are written again", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		request, err := http.NewRequest(http.MethodDelete, h.vault.URL()+"/v1/sys/mounts/"+reconcileVaultMount, nil)
+		require.NoError(t, err)
+		request.Header.Set("X-Vault-Token", h.vault.RootToken())
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		require.Empty(t, h.vault.SecretsRoleNames(reconcileVaultMount))
+
+		h.reconcile()
+		assert.Equal(t, []string{"app"}, h.vault.SecretsRoleNames(reconcileVaultMount))
+	})
+}
+
+func TestReconcile_roleCache(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments"], "token_policies": ["worker"]}`,
+	}
+	roleRequests := func(h *reconcileHarness) int {
+		var count int
+		for _, request := range h.vault.Requests() {
+			if strings.HasPrefix(request.Path, "auth/"+reconcileVaultMount+"/role") {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Run("when roles did not change then vault roles are not read nor written", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.cache = newRoleCache(time.Hour)
+		h.setRoles(roles)
+		h.reconcile()
+		requests := roleRequests(h)
+
+		h.reconcile()
+		assert.Equal(t, requests, roleRequests(h))
+		assert.Equal(t, float64(1), metricsValue("vak_role_cache_hit_ratio"))
+	})
+
+	t.Run("when role changes or is removed then only that role is written", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.cache = newRoleCache(time.Hour)
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.setRoles(map[string]string{
+			"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app", "shared"]}`,
+		})
+		h.reconcile()
+		assert.Equal(t, []string{"app"}, h.vaultRoles())
+		assert.Equal(t, []interface{}{"app", "shared"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+	})
+
+	t.Run("when role drifts in vault then it is fixed after verify interval", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.cache = newRoleCache(time.Hour)
+		h.setRoles(roles)
+		h.reconcile()
+
+		h.vault.SetRole(reconcileVaultMount, "app", map[string]interface{}{"token_policies": []interface{}{"admin"}})
+		h.vault.SetRole(reconcileVaultMount, "unknown", map[string]interface{}{"token_policies": []interface{}{"admin"}})
+		h.reconcile()
+		assert.Equal(t, []interface{}{"admin"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+
+		h.auth.cache.verifiedAt = h.auth.cache.verifiedAt.Add(-time.Hour)
+		h.reconcile()
+		assert.Equal(t, []interface{}{"app"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+	})
+
+	t.Run("when vault auth mount is lost then cache is cleared and roles are created again", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.cache = newRoleCache(time.Hour)
+		h.setRoles(roles)
+		h.reconcile()
+
+		request, err := http.NewRequest(http.MethodDelete, h.vault.URL()+"/v1/sys/auth/"+reconcileVaultMount, nil)
+		require.NoError(t, err)
+		request.Header.Set("X-Vault-Token", h.vault.RootToken())
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		h.reconcile()
+		assert.Equal(t, []string{"app", "worker"}, h.vaultRoles())
+	})
+}
+
+func TestReconcile_drift(t *testing.T) {
+
+	appRole := func(driftPolicy string) string {
+		return fmt.Sprintf(`{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"], "drift_policy": %q}`, driftPolicy)
+	}
+	// role edited directly in vault, new map every time, fake vault updates role in place
+	editedRole := func() map[string]interface{} {
+		return map[string]interface{}{
+			"bound_service_account_names":      []interface{}{"app"},
+			"bound_service_account_namespaces": []interface{}{"payments"},
+			"token_policies":                   []interface{}{"admin"},
+			"token_ttl":                        0,
+			"audience":                         "",
+		}
+	}
+
+	t.Run("when role with enforce policy is changed in vault then it is overwritten and drift is reported", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"app": appRole(driftPolicyEnforce)})
+		h.reconcile()
+		drifts := metricsValue("vak_role_drift_total", driftPolicyEnforce)
+
+		h.vault.SetRole(reconcileVaultMount, "app", editedRole())
+		h.reconcile()
+		assert.Equal(t, []interface{}{"app"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		assert.Equal(t, []string{`app was changed in vault, vault role was overwritten: token_policies: vault ["admin"], desired ["app"]`}, h.events(eventReasonRoleDrift))
+		assert.Equal(t, drifts+1, metricsValue("vak_role_drift_total", driftPolicyEnforce))
+	})
+
+	t.Run("when role with warn policy is changed in vault then it is left as it is and drift is reported once", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"app": appRole(driftPolicyWarn)})
+		h.reconcile()
+
+		h.vault.SetRole(reconcileVaultMount, "app", editedRole())
+		h.reconcile()
+		h.reconcile()
+		assert.Equal(t, []interface{}{"admin"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		assert.Equal(t, []string{`app was changed in vault, vault role was left as it is: token_policies: vault ["admin"], desired ["app"]`}, h.events(eventReasonRoleDrift))
+	})
+
+	t.Run("when role with adopt policy is changed in vault then vault role is written to config map", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"app": appRole(driftPolicyAdopt)})
+		h.reconcile()
+
+		h.vault.SetRole(reconcileVaultMount, "app", editedRole())
+		h.reconcile()
+		configMap, err := h.auth.k8sClient.GetConfigMap(vaultAuthConfigNamespace, vaultAuthConfigMap)
+		require.NoError(t, err)
+		role, err := vault.NewRole([]byte(configMap.Data["app"]))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"admin"}, role.TokenPolicies)
+		assert.Contains(t, configMap.Data["app"], `"drift_policy": "adopt"`)
+		// only fields that differ are adopted
+		assert.NotContains(t, configMap.Data["app"], "audience")
+		assert.NotContains(t, configMap.Data["app"], "token_ttl")
+
+		// adopted role is desired role now, vault role is not changed
+		h.reconcile()
+		assert.Equal(t, []interface{}{"admin"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		assert.Len(t, h.events(eventReasonRoleDrift), 1)
+	})
+
+	t.Run("when role with adopt policy is defined in list then drift is only reported", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"roles": fmt.Sprintf(`[{"name": "app", "bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"], "drift_policy": %q}]`, driftPolicyAdopt)})
+		h.reconcile()
+
+		h.vault.SetRole(reconcileVaultMount, "app", editedRole())
+		h.reconcile()
+		assert.Equal(t, []interface{}{"admin"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		events := h.events(eventReasonRoleDrift)
+		require.Len(t, events, 1)
+		assert.Contains(t, events[0], "role cannot be adopted")
+	})
+
+	t.Run("when role is changed in config map then vault role is updated and no drift is reported", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"app": appRole(driftPolicyWarn)})
+		h.reconcile()
+
+		h.setRoles(map[string]string{"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app", "shared"], "drift_policy": "warn"}`})
+		h.reconcile()
+		assert.Equal(t, []interface{}{"app", "shared"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		assert.Empty(t, h.events(eventReasonRoleDrift))
+	})
+
+	t.Run("when role with enforce policy differs in vault on first reload then vault role is updated and no drift is reported", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.vault.SetRole(reconcileVaultMount, "app", editedRole())
+		h.setRoles(map[string]string{"app": appRole(driftPolicyEnforce)})
+		h.reconcile()
+		assert.Equal(t, []interface{}{"app"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		assert.Empty(t, h.events(eventReasonRoleDrift))
+	})
+
+	t.Run("when role with warn policy is changed in vault during restart then it is left as it is and drift is reported", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"app": appRole(driftPolicyWarn)})
+		h.reconcile()
+
+		// new auth has no applied roles, the same as after restart
+		h.auth = NewAuth(h.auth.config, h.auth.vaultClient, h.auth.k8sClient)
+		h.vault.SetRole(reconcileVaultMount, "app", editedRole())
+		h.reconcile()
+		h.reconcile()
+
+		assert.Equal(t, []interface{}{"admin"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		events := h.events(eventReasonRoleDrift)
+		require.Len(t, events, 1)
+		assert.Contains(t, events[0], `app differs from vault and it was not applied since start`)
+		assert.Contains(t, events[0], `token_policies: vault ["admin"], desired ["app"]`)
+	})
+
+	t.Run("when role with adopt policy differs from vault after restart then it is neither overwritten nor adopted", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{"app": appRole(driftPolicyAdopt)})
+		h.reconcile()
+
+		// new auth has no applied roles, the same as after restart
+		h.auth = NewAuth(h.auth.config, h.auth.vaultClient, h.auth.k8sClient)
+		changed := `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app", "shared"], "drift_policy": "adopt"}`
+		h.setRoles(map[string]string{"app": changed})
+		h.reconcile()
+
+		assert.Equal(t, []interface{}{"app"}, h.vault.Role(reconcileVaultMount, "app")["token_policies"])
+		configMap, err := h.auth.k8sClient.GetConfigMap(vaultAuthConfigNamespace, vaultAuthConfigMap)
+		require.NoError(t, err)
+		assert.Equal(t, changed, configMap.Data["app"])
+		require.Len(t, h.events(eventReasonRoleDrift), 1)
+
+		// role changed to match vault is applied again
+		h.setRoles(map[string]string{"app": appRole(driftPolicyAdopt)})
+		h.reconcile()
+		h.vault.SetRole(reconcileVaultMount, "app", editedRole())
+		h.reconcile()
+		configMap, err = h.auth.k8sClient.GetConfigMap(vaultAuthConfigNamespace, vaultAuthConfigMap)
+		require.NoError(t, err)
+		assert.Contains(t, configMap.Data["app"], `"admin"`)
+	})
+}
+
+func TestReconcile_loginVerification(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"], "audience": "vault"}`,
+		"worker": `{"bound_service_account_names": ["*"], "bound_service_account_namespaces": ["payments"], "token_policies": ["worker"]}`,
+	}
+	newHarness := func(t *testing.T) *reconcileHarness {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.config.LoginVerification = true
+		return h
+	}
+	logins := func(h *reconcileHarness) int {
+		return countRequests(h.vault, http.MethodPost, "auth/"+reconcileVaultMount+"/login")
+	}
+	loginStatuses := func(t *testing.T, h *reconcileHarness) map[string]loginStatus {
+
+		configMap, err := h.kube.CoreV1().ConfigMaps(vaultAuthConfigNamespace).Get(context.Background(), vaultAuthConfigMap, meta.GetOptions{})
+		require.NoError(t, err)
+		statuses := make(map[string]loginStatus)
+		require.NoError(t, json.Unmarshal([]byte(configMap.Annotations[loginVerificationAnnotation]), &statuses))
+		return statuses
+	}
+
+	t.Run("when role is written then login with bound service account passes and token is revoked", func(t *testing.T) {
+
+		h := newHarness(t)
+		passed := metricsValue("vak_login_verification_total", loginPassed)
+		skipped := metricsValue("vak_login_verification_total", loginSkipped)
+		tokens := h.vault.TokenCount()
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, 1, logins(h))
+		assert.Equal(t, tokens, h.vault.TokenCount())
+		statuses := loginStatuses(t, h)
+		assert.Equal(t, loginPassed, statuses["app"].Result)
+		assert.Equal(t, loginSkipped, statuses["worker"].Result)
+		assert.Equal(t, passed+1, metricsValue("vak_login_verification_total", loginPassed))
+		assert.Equal(t, skipped+1, metricsValue("vak_login_verification_total", loginSkipped))
+		assert.Empty(t, h.events(eventReasonLoginFailed))
+
+		// roles did not change, they are not verified again
+		h.reconcile()
+		assert.Equal(t, 1, logins(h))
+	})
+
+	t.Run("when login fails then failure is reported and role is verified again until login passes", func(t *testing.T) {
+
+		h := newHarness(t)
+		failed := metricsValue("vak_login_verification_total", loginFailed)
+		h.loginDenied.Store(true)
+		h.setRoles(roles)
+		h.reconcile()
+
+		statuses := loginStatuses(t, h)
+		assert.Equal(t, loginFailed, statuses["app"].Result)
+		assert.Contains(t, statuses["app"].Message, "login as payments/app")
+		assert.Equal(t, failed+1, metricsValue("vak_login_verification_total", loginFailed))
+		events := h.events(eventReasonLoginFailed)
+		require.Len(t, events, 1)
+		assert.Contains(t, events[0], "app: login as payments/app")
+
+		h.loginDenied.Store(false)
+		h.reconcile()
+		assert.Equal(t, loginPassed, loginStatuses(t, h)["app"].Result)
+		assert.Len(t, h.events(eventReasonLoginFailed), 1)
+	})
+
+	t.Run("when role is changed in vault and overwritten then it is verified again", func(t *testing.T) {
+
+		h := newHarness(t)
+		h.setRoles(roles)
+		h.reconcile()
+
+		role := h.vault.Role(reconcileVaultMount, "app")
+		role["token_policies"] = []interface{}{"admin"}
+		h.vault.SetRole(reconcileVaultMount, "app", role)
+		h.reconcile()
+		assert.Equal(t, 2, logins(h))
+		assert.Equal(t, loginPassed, loginStatuses(t, h)["app"].Result)
+	})
+
+	t.Run("when login verification is not enabled then there is no login", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+
+		assert.Equal(t, 0, logins(h))
+		configMap, err := h.kube.CoreV1().ConfigMaps(vaultAuthConfigNamespace).Get(context.Background(), vaultAuthConfigMap, meta.GetOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, configMap.Annotations, loginVerificationAnnotation)
+	})
+}
+
+func TestReconcile_status(t *testing.T) {
+
+	roles := map[string]string{
+		"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		"legacy": `{"bound_service_account_names": ["legacy"], "bound_service_account_namespaces": ["payments"], "token_policies": ["legacy"]}`,
+	}
+	newServiceAccount := func(name string, annotations map[string]string) *v1.ServiceAccount {
+		return &v1.ServiceAccount{ObjectMeta: meta.ObjectMeta{Namespace: "payments", Name: name, Annotations: annotations}}
+	}
+
+	t.Run("when status is requested before reload then only mount is returned", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil))
+		status := h.auth.Status()
+
+		assert.Equal(t, "kubernetes/"+h.auth.config.VaultMount, status.Mount.Path)
+		assert.Equal(t, "https://kube.host", status.Mount.KubernetesHost)
+		assert.Nil(t, status.Roles)
+		assert.Nil(t, status.Reviewer)
+	})
+
+	t.Run("when roles are reconciled then status has desired and vault state of roles and service accounts", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil),
+			newServiceAccount("legacy", nil))
+		notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		ca, _ := newTestCertificate(t, notAfter)
+		require.NoError(t, os.WriteFile(h.caFile, ca, 0600))
+		h.setRoles(roles)
+		h.reconcile()
+
+		// changed outside of this application after the reload
+		role := h.vault.Role(reconcileVaultMount, "app")
+		role["token_policies"] = []interface{}{"admin"}
+		h.vault.SetRole(reconcileVaultMount, "app", role)
+		h.vault.SetRole(reconcileVaultMount, "manual", map[string]interface{}{"bound_service_account_names": []interface{}{"manual"}})
+		_, err := h.kube.CoreV1().ServiceAccounts("payments").Create(context.Background(), newServiceAccount("old", serviceAccountAnnotations), meta.CreateOptions{})
+		require.NoError(t, err)
+
+		status := h.auth.Status()
+		assert.Empty(t, status.Errors)
+		assert.NotEmpty(t, status.Mount.CAFingerprint)
+		assert.Equal(t, notAfter, *status.Mount.CAExpiry)
+		require.NotNil(t, status.Reviewer)
+		assert.Equal(t, "vault-auth/token-reviewer", status.Reviewer.ServiceAccount)
+		assert.Nil(t, status.Reviewer.IssuedAt)
+
+		require.Len(t, status.Roles, 3)
+		assert.Equal(t, "app", status.Roles[0].Name)
+		assert.Equal(t, RoleDrifted, status.Roles[0].State)
+		assert.Equal(t, `token_policies: vault ["admin"], desired ["app"]`, status.Roles[0].Diff)
+		assert.NotNil(t, status.Roles[0].LastApplied)
+		assert.Equal(t, "legacy", status.Roles[1].Name)
+		assert.Equal(t, RoleSynced, status.Roles[1].State)
+		assert.Equal(t, "manual", status.Roles[2].Name)
+		assert.Equal(t, RoleUnmanaged, status.Roles[2].State)
+
+		assert.Equal(t, []ServiceAccountStatus{
+			{Namespace: "payments", Name: "app", State: ServiceAccountManaged, Roles: []string{"app"}},
+			{Namespace: "payments", Name: "legacy", State: ServiceAccountUnmanaged, Roles: []string{"legacy"}},
+			{Namespace: "payments", Name: "old", State: ServiceAccountOrphaned},
+		}, status.ServiceAccounts)
+
+		require.Len(t, status.Reloads, 1)
+		assert.Equal(t, reconcileCompleted, status.Reloads[0].Result)
+		assert.Equal(t, 2, status.Reloads[0].Roles)
+	})
+
+	t.Run("when status is requested again before reload then vault is not read", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(roles)
+		h.reconcile()
+		reads := func() int {
+			return countRequests(h.vault, http.MethodGet, "sys/auth")
+		}
+
+		first := h.auth.Status()
+		count := reads()
+		role := h.vault.Role(reconcileVaultMount, "app")
+		role["token_policies"] = []interface{}{"admin"}
+		h.vault.SetRole(reconcileVaultMount, "app", role)
+		assert.Equal(t, first, h.auth.Status())
+		assert.Equal(t, count, reads())
+
+		h.reconcile()
+		count = reads()
+		status := h.auth.Status()
+		assert.Equal(t, count+1, reads())
+		require.Len(t, status.Reloads, 2)
+	})
+
+	t.Run("when auth type is jwt then mount has type and issuer of jwt auth", func(t *testing.T) {
+
+		h := newReconcileHarnessWithAuthType(t, vault.AuthTypeJWT, newTestNamespace(tokenReviewerNamespace, nil))
+		status := h.auth.Status()
+
+		assert.Equal(t, "kubernetes/"+h.auth.config.VaultMount, status.Mount.Path)
+		assert.Equal(t, vault.AuthTypeJWT, status.Mount.Type)
+		assert.Equal(t, "https://kubernetes.default.svc", status.Mount.Issuer)
+		assert.Equal(t, 1, status.Mount.PEMKeys)
+		assert.Empty(t, status.Mount.Error)
+	})
+
+	t.Run("when roles are denied or vault is sealed then it is in status", func(t *testing.T) {
+
+		h := newReconcileHarness(t, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.auth.config.Guardrails = Guardrails{Rules: []GuardrailRule{{AllowedPolicies: []string{"app"}}}}
+		h.setRoles(roles)
+		h.reconcile()
+		h.vault.Seal()
+		h.reconcile()
+		h.vault.Unseal()
+
+		status := h.auth.Status()
+		require.Len(t, status.Roles, 2)
+		assert.Equal(t, RoleDenied, status.Roles[1].State)
+		assert.NotEmpty(t, status.Roles[1].LastError)
+		require.Len(t, status.Reloads, 2)
+		assert.Equal(t, reconcileSkipped, status.Reloads[1].Result)
+		assert.Len(t, status.Reloads[1].Errors, 1)
+	})
+}
+
+func TestReconcile_audit(t *testing.T) {
+
+	newRolesConfigMap := func(data map[string]string) *v1.ConfigMap {
+		return &v1.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace:       vaultAuthConfigNamespace,
+				Name:            vaultAuthConfigMap,
+				ResourceVersion: "7",
+				ManagedFields:   []meta.ManagedFieldsEntry{{Manager: "kubectl-edit"}},
+			},
+			Data: data,
+		}
+	}
+	records := func(t *testing.T, store audit.FileStore) []audit.Record {
+
+		records, err := store.Records()
+		require.NoError(t, err)
+		_, err = audit.Verify(records, nil)
+		require.NoError(t, err)
+		return records
+	}
+	find := func(records []audit.Record, target, action string) *audit.Record {
+		for _, record := range records {
+			if record.Target == target && record.Action == action {
+				return &record
+			}
+		}
+		return nil
+	}
+
+	t.Run("when roles are reconciled then mutations are recorded with roles config map as source", func(t *testing.T) {
+
+		store := audit.NewFileStore(filepath.Join(t.TempDir(), "audit.log"))
+		auditLog, err := audit.NewLog(nil, store)
+		require.NoError(t, err)
+		roles := map[string]string{
+			"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		}
+		h := newReconcileHarnessWithAudit(t, auditLog, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil),
+			newRolesConfigMap(roles))
+		h.reconcile()
+
+		reconciled := records(t, store)
+		role := find(reconciled, "auth/"+reconcileVaultMount+"/role/app", audit.ActionCreate)
+		require.NotNil(t, role)
+		assert.Equal(t, audit.OutcomeSuccess, role.Outcome)
+		assert.Empty(t, role.Before)
+		assert.NotEmpty(t, role.After)
+		assert.Equal(t, &audit.Source{Kind: configMapSourceKind, Namespace: vaultAuthConfigNamespace, Name: vaultAuthConfigMap, ResourceVersion: "7", Manager: "kubectl-edit"}, role.Source)
+
+		serviceAccount := find(reconciled, "serviceaccounts/payments/app", audit.ActionCreate)
+		require.NotNil(t, serviceAccount)
+		assert.Equal(t, role.Source, serviceAccount.Source)
+		// auth config is not defined by any role
+		config := find(reconciled, "auth/"+reconcileVaultMount+"/config", audit.ActionCreate)
+		require.NotNil(t, config)
+		assert.Nil(t, config.Source)
+
+		// nothing has changed, so nothing is written
+		h.reconcile()
+		assert.Len(t, records(t, store), len(reconciled))
+	})
+
+	t.Run("when role is removed then role deletion is recorded with the config map it was removed from", func(t *testing.T) {
+
+		store := audit.NewFileStore(filepath.Join(t.TempDir(), "audit.log"))
+		auditLog, err := audit.NewLog(nil, store)
+		require.NoError(t, err)
+		h := newReconcileHarnessWithAudit(t, auditLog, newTestNamespace(tokenReviewerNamespace, nil), newTestNamespace("payments", nil))
+		h.setRoles(map[string]string{
+			"app":    `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+			"worker": `{"bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments"], "token_policies": ["worker"]}`,
+		})
+		h.reconcile()
+		created := find(records(t, store), "auth/"+reconcileVaultMount+"/role/worker", audit.ActionCreate)
+		require.NotNil(t, created)
+
+		h.setRoles(map[string]string{
+			"app": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "token_policies": ["app"]}`,
+		})
+		h.reconcile()
+
+		reconciled := records(t, store)
+		deleted := find(reconciled, "auth/"+reconcileVaultMount+"/role/worker", audit.ActionDelete)
+		require.NotNil(t, deleted)
+		assert.Equal(t, created.After, deleted.Before)
+		assert.Empty(t, deleted.After)
+		require.NotNil(t, deleted.Source)
+		assert.Equal(t, vaultAuthConfigMap, deleted.Source.Name)
+		serviceAccount := find(reconciled, "serviceaccounts/payments/worker", audit.ActionDelete)
+		require.NotNil(t, serviceAccount)
+		assert.Equal(t, deleted.Source, serviceAccount.Source)
+	})
+}
+
+func metricsValue(name string, labelValues ...string) float64 {
+	return metrics.DefaultRegistry.Value(name, labelValues...)
+}
+
+func countRequests(server *vaulttest.Server, method, path string) int {
+
+	var count int
+	for _, request := range server.Requests() {
+		if request.Method == method && request.Path == path {
+			count++
+		}
+	}
+	return count
+}
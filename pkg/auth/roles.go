@@ -1,25 +1,141 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
 	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
 	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"sort"
 )
 
-type vaultRoles map[string]vault.Role
+// object the role was defined in, invalid or denied roles are reported back to the source
+type roleSource struct {
+	kind      string
+	namespace string
+	name      string
+	uid       string
+	// resource version and field manager of the latest change (e.g. kubectl-edit, not user) of config map, recorded in
+	// audit log
+	resourceVersion string
+	manager         string
+}
+
+const (
+	configMapSourceKind = "ConfigMap"
+	fileSourceKind      = "File"
+)
+
+func newConfigMapSource(configMap k8s.ConfigMap) roleSource {
+
+	return roleSource{
+		kind:            configMapSourceKind,
+		namespace:       configMap.Namespace,
+		name:            configMap.Name,
+		uid:             configMap.UID,
+		resourceVersion: configMap.ResourceVersion,
+		manager:         configMap.Manager,
+	}
+}
+
+func newFileSource(file string) roleSource {
+	return roleSource{kind: fileSourceKind, name: file}
+}
+
+func (s roleSource) auditSource() *audit.Source {
+
+	return &audit.Source{
+		Kind:            s.kind,
+		Namespace:       s.namespace,
+		Name:            s.name,
+		ResourceVersion: s.resourceVersion,
+		Manager:         s.manager,
+	}
+}
+
+func (s roleSource) String() string {
+
+	if s.kind == fileSourceKind {
+		return fmt.Sprintf("file %s", s.name)
+	}
+	return fmt.Sprintf("%s %s in %s namespace", s.kind, s.name, s.namespace)
+}
+
+type vaultRole struct {
+	vault.Role
+	source roleSource
+	// enforce, warn or adopt, see drift.go
+	driftPolicy string
+	// config map key the role is defined in, empty if vault role cannot be adopted (role is defined in a file, list of
+	// roles, template or tenant config map)
+	adoptKey string
+	// acl policy documents by policy name, see policies.go
+	aclPolicies map[string]string
+	// kubernetes secrets engine role with the same name as vault role, see secrets.go
+	secretsEngineRole map[string]interface{}
+}
+
+type vaultRoles map[string]vaultRole
 
-func newVaultRoles(configMapData map[string]string) vaultRoles {
+// roles from definitions, role templates are skipped (see newRoleTemplates), invalid roles are returned as violations
+func newVaultRoles(source roleSource, definitions []roleDefinition) (vaultRoles, []string) {
 
 	roles := make(vaultRoles)
-	for roleName, rawRole := range configMapData {
-		role, err := vault.NewRole([]byte(rawRole))
+	var violations []string
+	for _, definition := range definitions {
+		if isRoleTemplate(definition.raw) {
+			continue
+		}
+		role, err := definition.newRole()
+		var driftPolicy string
+		var aclPolicies map[string]string
+		var secretsEngineRole map[string]interface{}
+		if err == nil {
+			driftPolicy, err = definition.driftPolicy()
+		}
+		if err == nil {
+			aclPolicies, err = definition.aclPolicies()
+		}
+		if err == nil {
+			secretsEngineRole, err = definition.secretsEngineRole()
+		}
+		if err == nil {
+			if _, ok := roles[definition.name]; ok {
+				err = errors.New("role is defined more than once")
+			}
+		}
 		if err != nil {
-			logger.Errorf("new vault role %s from config map %s in %s namespace: %v",
-				roleName, vaultAuthConfigMap, vaultAuthConfigNamespace, err)
+			logger.Errorf("new vault role %s from %s: %v", definition.name, source, err)
+			violations = append(violations, fmt.Sprintf("%s: %v", definition.name, err))
+			continue
+		}
+		r := vaultRole{
+			Role:              withPolicyNames(role, aclPolicies),
+			source:            source,
+			driftPolicy:       driftPolicy,
+			aclPolicies:       aclPolicies,
+			secretsEngineRole: withAllowedNamespaces(secretsEngineRole, role),
+		}
+		if definition.standalone && source.kind == configMapSourceKind {
+			r.adoptKey = definition.name
+		}
+		roles[definition.name] = r
+	}
+	return roles, violations
+}
+
+// add roles that are not already present, roles defined explicitly in config map take precedence over roles from
+// other sources (templates, tenant config maps)
+func (v vaultRoles) merge(roles vaultRoles) {
+
+	for roleName, role := range roles {
+		if existing, ok := v[roleName]; ok {
+			logger.Errorf("role %s from %s already exists in %s, skipping", roleName, role.source, existing.source)
 			continue
 		}
-		roles[roleName] = role
+		v[roleName] = role
 	}
-	return roles
 }
 
 func (v vaultRoles) getServiceAccountsSetByNamespace() map[string]map[string]struct{} {
@@ -37,3 +153,16 @@ func (v vaultRoles) getServiceAccountsSetByNamespace() map[string]map[string]str
 	}
 	return serviceAccountsByNamespace
 }
+
+// sorted names of roles that bind service account, bound names and namespaces can be globs
+func (v vaultRoles) boundRoles(namespace, serviceAccount string) []string {
+
+	var names []string
+	for name, vaultRole := range v {
+		if matchesAny(namespace, vaultRole.BoundServiceAccountNamespaces) && matchesAny(serviceAccount, vaultRole.BoundServiceAccountNames) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -13,9 +14,26 @@ func TestNewVaultRoles(t *testing.T) {
 			"invalid-role": `{"bound_service_account_names": ["*"], "bound_service_account_namespaces": ["*"], "token_policies": ["test"]}`,
 		}
 
-		vaultRoles := newVaultRoles(configMapData)
+		vaultRoles := testVaultRoles(configMapData)
 		assert.Equal(t, 1, len(vaultRoles))
 	})
+
+	t.Run("when role has drift policy then it is set and only role defined as single config map entry can be adopted", func(t *testing.T) {
+		configMapData := map[string]string{
+			"app":     `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "drift_policy": "adopt"}`,
+			"workers": `[{"name": "worker", "bound_service_account_names": ["worker"], "bound_service_account_namespaces": ["payments"], "drift_policy": "adopt"}]`,
+			"search":  `{"bound_service_account_names": ["search"], "bound_service_account_namespaces": ["search"]}`,
+			"invalid": `{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["payments"], "drift_policy": "ignore"}`,
+		}
+
+		vaultRoles := testVaultRoles(configMapData)
+		assert.Equal(t, 3, len(vaultRoles))
+		assert.Equal(t, driftPolicyAdopt, vaultRoles["app"].driftPolicy)
+		assert.Equal(t, "app", vaultRoles["app"].adoptKey)
+		assert.Equal(t, driftPolicyAdopt, vaultRoles["worker"].driftPolicy)
+		assert.Empty(t, vaultRoles["worker"].adoptKey)
+		assert.Equal(t, driftPolicyEnforce, vaultRoles["search"].driftPolicy)
+	})
 }
 
 func TestVaultRoles_GetServiceAccountsSetByNamespace(t *testing.T) {
@@ -30,6 +48,24 @@ func TestVaultRoles_GetServiceAccountsSetByNamespace(t *testing.T) {
 		"test":        {"default": {}, "test": {}},
 	}
 
-	actual := newVaultRoles(configMapData).getServiceAccountsSetByNamespace()
+	actual := testVaultRoles(configMapData).getServiceAccountsSetByNamespace()
 	assert.Equal(t, expcted, actual)
 }
+
+// --- helper functions ---
+
+func testVaultRoles(configMapData map[string]string) vaultRoles {
+
+	configMap := k8s.ConfigMap{Data: configMapData}
+	definitions, _ := configMapRoleDefinitions(configMap)
+	roles, _ := newVaultRoles(newConfigMapSource(configMap), definitions)
+	return roles
+}
+
+func testRoleTemplates(configMapData map[string]string) roleTemplates {
+
+	configMap := k8s.ConfigMap{Data: configMapData}
+	definitions, _ := configMapRoleDefinitions(configMap)
+	templates, _ := newRoleTemplates(newConfigMapSource(configMap), definitions)
+	return templates
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	// service account used by vault kubernetes secrets engine to create service accounts, tokens and role bindings,
+	// it is bound to the configured cluster role
+	secretsEngineServiceAccount     = "secrets-engine"
+	secretsEngineNamespace          = "vault-auth"
+	secretsEngineClusterRoleBinding = "vault-auth-secrets-engine"
+
+	secretsEngineRoleField = "secrets_engine_role"
+)
+
+var (
+	// kubernetes secrets engine role has to have exactly one of these fields
+	secretsEngineRoleKinds = []string{"service_account_name", "kubernetes_role_name", "generated_role_rules"}
+	// ttl fields vault returns as number of seconds
+	secretsEngineRoleTTLs = []string{"token_default_ttl", "token_max_ttl"}
+)
+
+// kubernetes secrets engine role (https://developer.hashicorp.com/vault/api-docs/secret/kubernetes#create-role) defined
+// by vault role, e.g. {"secrets_engine_role": {"service_account_name": "app", "token_default_ttl": "10m"}}
+type secretsEngineRoleSpec struct {
+	SecretsEngineRole map[string]interface{} `json:"secrets_engine_role"`
+}
+
+// secrets engine role from raw role, nil if the role does not define secrets engine role, ttls are converted to number
+// of seconds, allowed kubernetes namespaces are set by withAllowedNamespaces
+func newSecretsEngineRole(rawRole []byte) (map[string]interface{}, error) {
+
+	var spec secretsEngineRoleSpec
+	if err := json.Unmarshal(rawRole, &spec); err != nil {
+		return nil, fmt.Errorf("unmarshal %s: %w", secretsEngineRoleField, err)
+	}
+	if spec.SecretsEngineRole == nil {
+		return nil, nil
+	}
+
+	var kinds int
+	for _, kind := range secretsEngineRoleKinds {
+		if v, ok := spec.SecretsEngineRole[kind]; ok && v != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, fmt.Errorf("%s has to have one of service_account_name, kubernetes_role_name or generated_role_rules", secretsEngineRoleField)
+	}
+	for _, field := range secretsEngineRoleTTLs {
+		v, ok := spec.SecretsEngineRole[field]
+		if !ok {
+			continue
+		}
+		seconds, err := vault.ValueSeconds(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", secretsEngineRoleField, field, err)
+		}
+		spec.SecretsEngineRole[field] = seconds
+	}
+	return spec.SecretsEngineRole, nil
+}
+
+// secrets engine role can issue credentials in namespaces the vault role is bound to, unless the namespaces are set
+func withAllowedNamespaces(secretsEngineRole map[string]interface{}, role vault.Role) map[string]interface{} {
+
+	if secretsEngineRole == nil {
+		return nil
+	}
+	out := make(map[string]interface{})
+	for k, v := range secretsEngineRole {
+		out[k] = v
+	}
+	if _, ok := out["allowed_kubernetes_namespaces"]; !ok {
+		out["allowed_kubernetes_namespaces"] = role.BoundServiceAccountNamespaces
+	}
+	return out
+}
+
+// secrets engine roles written by this application (hash of the last written role by name), every role in the secrets
+// engine mount is managed by this application, state is refreshed from vault when roles are verified
+type secretsEngineState struct {
+	mu    sync.Mutex
+	roles map[string]string
+}
+
+func newSecretsEngineState() *secretsEngineState {
+	return &secretsEngineState{roles: make(map[string]string)}
+}
+
+func (s *secretsEngineState) refresh(roles map[string]string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles = roles
+}
+
+func (s *secretsEngineState) get(name string) (string, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, ok := s.roles[name]
+	return hash, ok
+}
+
+func (s *secretsEngineState) set(name, hash string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[name] = hash
+}
+
+func (s *secretsEngineState) remove(name string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.roles, name)
+}
+
+func (s *secretsEngineState) names() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// secrets engine service account bound to cluster role, secrets engine is mounted and configured with service account
+// token, kubernetes host and CA, vault is updated only if host, CA or token has changed
+func (a Auth) initSecretsEngine() error {
+
+	if !a.config.SecretsEngine {
+		return nil
+	}
+	if err := a.k8sClient.CreateServiceAccount(secretsEngineNamespace, secretsEngineServiceAccount, nil); err != nil {
+		return fmt.Errorf("create service account: %w", err)
+	}
+	if err := a.k8sClient.CreateClusterRoleBinding(secretsEngineClusterRoleBinding, a.config.SecretsEngineClusterRole, secretsEngineNamespace, secretsEngineServiceAccount); err != nil {
+		return fmt.Errorf("create cluster role binding: %w", err)
+	}
+	// token is read on every reload, so rotated token is pushed to vault
+	token, err := a.k8sClient.GetServiceAccountToken(secretsEngineNamespace, secretsEngineServiceAccount)
+	if err != nil {
+		return fmt.Errorf("get service account token: %w", err)
+	}
+
+	ca, err := a.k8sCA()
+	if err != nil {
+		return err
+	}
+	mounted, err := a.vaultClient.InitSecretsKubernetes(a.config.K8sHost, ca, token)
+	if mounted {
+		// secrets engine was mounted again, roles in vault are gone
+		a.secretsEngine.refresh(make(map[string]string))
+	}
+	return err
+}
+
+// write secrets engine roles defined by vault roles and delete secrets engine roles that no vault role defines, roles
+// are listed and read from vault only when verify is true
+func (a Auth) reconcileSecretsEngine(roles vaultRoles, verify bool) {
+
+	if !a.config.SecretsEngine {
+		return
+	}
+
+	desired := make(map[string]map[string]interface{})
+	for name, role := range roles {
+		if role.secretsEngineRole != nil {
+			desired[name] = role.secretsEngineRole
+		}
+	}
+	if verify {
+		if err := a.verifySecretsEngine(desired); err != nil {
+			logger.Errorf("verify secrets engine roles: %v", err)
+			return
+		}
+	}
+
+	for _, name := range a.secretsEngine.names() {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := a.vaultClient.DeleteSecretsRole(name); err != nil {
+			logger.Errorf("delete secrets engine role %s: %v", name, err)
+			continue
+		}
+		a.secretsEngine.remove(name)
+	}
+
+	var names []string
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	util.ForEach(a.config.Workers, names, func(name string) {
+		hash := secretsEngineRoleHash(desired[name])
+		if existing, ok := a.secretsEngine.get(name); ok && existing == hash {
+			return
+		}
+		if err := a.vaultClient.WriteSecretsRole(name, desired[name]); err != nil {
+			logger.Errorf("write secrets engine role %s: %v", name, err)
+			return
+		}
+		a.secretsEngine.set(name, hash)
+	})
+}
+
+// list and read secrets engine roles, role that differs from desired role (or cannot be read) is written again
+func (a Auth) verifySecretsEngine(desired map[string]map[string]interface{}) error {
+
+	names, err := a.vaultClient.ListSecretsRoles()
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	roles := make(map[string]string)
+	util.ForEach(a.config.Workers, names, func(name string) {
+		var hash string
+		if role, ok := desired[name]; ok {
+			vaultRole, err := a.vaultClient.ReadSecretsRole(name)
+			if err != nil {
+				logger.Errorf("verify secrets engine roles: read role %s: %v", name, err)
+			}
+			if err == nil && secretsEngineRoleEqual(role, vaultRole) {
+				hash = secretsEngineRoleHash(role)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		roles[name] = hash
+	})
+	a.secretsEngine.refresh(roles)
+	return nil
+}
+
+// desired role fields are equal to fields of role read from vault, fields that are not in desired role are ignored
+func secretsEngineRoleEqual(desired, vaultRole map[string]interface{}) bool {
+
+	if vaultRole == nil {
+		return false
+	}
+	for k, v := range desired {
+		// compare json representation, numbers and lists read from vault are float64 and []interface{}
+		want, _ := json.Marshal(v)
+		got, _ := json.Marshal(vaultRole[k])
+		var wantValue, gotValue interface{}
+		if json.Unmarshal(want, &wantValue) != nil || json.Unmarshal(got, &gotValue) != nil || !reflect.DeepEqual(wantValue, gotValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func secretsEngineRoleHash(role map[string]interface{}) string {
+
+	// maps are marshalled with sorted keys
+	b, _ := json.Marshal(role)
+	return string(b)
+}
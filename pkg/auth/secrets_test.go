@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewSecretsEngineRole(t *testing.T) {
+
+	t.Run("when role does not have secrets engine role then nil is returned", func(t *testing.T) {
+
+		secretsEngineRole, err := newSecretsEngineRole([]byte(`{"bound_service_account_names": ["app"]}`))
+		require.NoError(t, err)
+		assert.Nil(t, secretsEngineRole)
+	})
+
+	t.Run("when secrets engine role has ttls then they are converted to seconds", func(t *testing.T) {
+
+		secretsEngineRole, err := newSecretsEngineRole([]byte(`{"secrets_engine_role": {"service_account_name": "app", "token_default_ttl": "10m", "token_max_ttl": 3600}}`))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"service_account_name": "app", "token_default_ttl": 600, "token_max_ttl": 3600}, secretsEngineRole)
+	})
+
+	t.Run("when secrets engine role has more than one kind then error is returned", func(t *testing.T) {
+
+		_, err := newSecretsEngineRole([]byte(`{"secrets_engine_role": {"service_account_name": "app", "kubernetes_role_name": "edit"}}`))
+		require.Error(t, err)
+	})
+
+	t.Run("when secrets engine role has no kind then error is returned", func(t *testing.T) {
+
+		_, err := newSecretsEngineRole([]byte(`{"secrets_engine_role": {"token_default_ttl": "10m"}}`))
+		require.Error(t, err)
+	})
+
+	t.Run("when ttl is invalid then error is returned", func(t *testing.T) {
+
+		_, err := newSecretsEngineRole([]byte(`{"secrets_engine_role": {"service_account_name": "app", "token_default_ttl": "ten minutes"}}`))
+		require.Error(t, err)
+	})
+}
+
+func TestWithAllowedNamespaces(t *testing.T) {
+
+	role := vault.Role{BoundServiceAccountNamespaces: []string{"payments"}}
+
+	t.Run("when allowed namespaces are not set then role namespaces are used", func(t *testing.T) {
+
+		secretsEngineRole := map[string]interface{}{"service_account_name": "app"}
+		out := withAllowedNamespaces(secretsEngineRole, role)
+		assert.Equal(t, []string{"payments"}, out["allowed_kubernetes_namespaces"])
+		assert.NotContains(t, secretsEngineRole, "allowed_kubernetes_namespaces")
+	})
+
+	t.Run("when allowed namespaces are set then they are kept", func(t *testing.T) {
+
+		out := withAllowedNamespaces(map[string]interface{}{"service_account_name": "app", "allowed_kubernetes_namespaces": []interface{}{"billing"}}, role)
+		assert.Equal(t, []interface{}{"billing"}, out["allowed_kubernetes_namespaces"])
+	})
+}
+
+func TestSecretsEngineRoleEqual(t *testing.T) {
+
+	desired := map[string]interface{}{"service_account_name": "app", "allowed_kubernetes_namespaces": []string{"payments"}, "token_default_ttl": 600}
+
+	t.Run("when vault role has the same fields and defaults then roles are equal", func(t *testing.T) {
+
+		vaultRole := map[string]interface{}{"service_account_name": "app", "allowed_kubernetes_namespaces": []interface{}{"payments"},
+			"token_default_ttl": float64(600), "token_max_ttl": float64(0), "kubernetes_role_type": "Role"}
+		assert.True(t, secretsEngineRoleEqual(desired, vaultRole))
+	})
+
+	t.Run("when vault role has different namespaces then roles are not equal", func(t *testing.T) {
+
+		vaultRole := map[string]interface{}{"service_account_name": "app", "allowed_kubernetes_namespaces": []interface{}{"*"}, "token_default_ttl": float64(600)}
+		assert.False(t, secretsEngineRoleEqual(desired, vaultRole))
+	})
+}
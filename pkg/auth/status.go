@@ -0,0 +1,599 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/util"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	StatusFormatTable = "table"
+	StatusFormatJSON  = "json"
+	StatusFormatYAML  = "yaml"
+
+	// role sync states
+	RoleSynced    = "synced"
+	RoleMissing   = "missing"
+	RoleDrifted   = "drifted"
+	RoleDenied    = "denied"
+	RoleUnmanaged = "unmanaged"
+	RoleUnknown   = "unknown"
+
+	// service account states, unmanaged service account is bound by role, but it was not created by this application,
+	// orphaned service account was created by this application, but it is not bound by any role
+	ServiceAccountManaged   = "managed"
+	ServiceAccountUnmanaged = "unmanaged"
+	ServiceAccountOrphaned  = "orphaned"
+	ServiceAccountMissing   = "missing"
+
+	defaultStatusHistory = 10
+)
+
+// state of vault auth mount, roles and service accounts, desired state and errors are from the last reload, vault and
+// kubernetes state is read by the first status request after the reload
+type Status struct {
+	Time            time.Time              `json:"time"`
+	Mount           MountStatus            `json:"mount"`
+	Reviewer        *ReviewerStatus        `json:"reviewer,omitempty"`
+	Roles           []RoleStatus           `json:"roles"`
+	ServiceAccounts []ServiceAccountStatus `json:"service_accounts"`
+	Reloads         []ReloadResult         `json:"reloads"`
+	// vault and kubernetes read errors, status is not complete
+	Errors []string `json:"errors,omitempty"`
+}
+
+type MountStatus struct {
+	Path           string `json:"path"`
+	Type           string `json:"type"`
+	Accessor       string `json:"accessor,omitempty"`
+	KubernetesHost string `json:"kubernetes_host,omitempty"`
+	Issuer         string `json:"issuer,omitempty"`
+	PEMKeys        int    `json:"pem_keys"`
+	// sha256 fingerprint of the first CA certificate and expiry of the certificate that expires first
+	CAFingerprint string     `json:"ca_fingerprint,omitempty"`
+	CAExpiry      *time.Time `json:"ca_expiry,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// token reviewer service account token, issued at is set only if token has iat claim (legacy secret tokens do not),
+// age is from read time otherwise
+type ReviewerStatus struct {
+	ServiceAccount string     `json:"service_account"`
+	IssuedAt       *time.Time `json:"issued_at,omitempty"`
+	ReadAt         time.Time  `json:"read_at"`
+	Age            string     `json:"age"`
+}
+
+type RoleStatus struct {
+	Name        string      `json:"name"`
+	Source      string      `json:"source,omitempty"`
+	State       string      `json:"state"`
+	Desired     *vault.Role `json:"desired,omitempty"`
+	Actual      *vault.Role `json:"actual,omitempty"`
+	Diff        string      `json:"diff,omitempty"`
+	LastApplied *time.Time  `json:"last_applied,omitempty"`
+	LastError   string      `json:"last_error,omitempty"`
+}
+
+type ServiceAccountStatus struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+type ReloadResult struct {
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration"`
+	Result   string    `json:"result"`
+	Roles    int       `json:"roles"`
+	Errors   []string  `json:"errors,omitempty"`
+}
+
+// desired state, errors and results of the last reloads, set during reload and read by status requests
+type statusState struct {
+	mu      sync.Mutex
+	history int
+	// nil until the first reload reads roles
+	roles vaultRoles
+	// roles that were desired by previous reloads, but they were removed from their source (e.g. config map), deleted
+	// roles are attributed to them in audit log
+	removed vaultRoles
+	denied  map[string]string
+	// service accounts by namespace, bound by roles
+	serviceAccounts map[string]map[string]struct{}
+	applied         map[string]time.Time
+	errors          map[string]string
+	reviewerToken   []byte
+	reviewerReadAt  time.Time
+	reloads         []ReloadResult
+	// errors of the current reload
+	reloadErrors []string
+	// status read after the last reload (nil until it is requested), generation is incremented by every reload, so
+	// status read during reload is not kept, only one status is read at a time
+	current    *Status
+	generation int
+	readMu     sync.Mutex
+}
+
+func newStatusState(history int) *statusState {
+
+	if history == 0 {
+		history = defaultStatusHistory
+	}
+	return &statusState{
+		history: history,
+		denied:  make(map[string]string),
+		applied: make(map[string]time.Time),
+		errors:  make(map[string]string),
+	}
+}
+
+func (s *statusState) finishReload(start time.Time, result string, errs ...string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reload := ReloadResult{
+		Start:    start.UTC(),
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+		Result:   result,
+		Roles:    len(s.roles),
+		Errors:   append(s.reloadErrors, errs...),
+	}
+	s.reloads = append(s.reloads, reload)
+	if len(s.reloads) > s.history {
+		s.reloads = s.reloads[len(s.reloads)-s.history:]
+	}
+	s.reloadErrors = nil
+	s.current = nil
+	s.generation++
+}
+
+// error of the current reload
+func (s *statusState) reloadError(format string, args ...interface{}) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadErrors = append(s.reloadErrors, fmt.Sprintf(format, args...))
+}
+
+// roles and service accounts of this reload, set before guardrails are applied
+func (s *statusState) setDesired(roles vaultRoles, serviceAccounts map[string]map[string]struct{}) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.removed == nil {
+		s.removed = make(vaultRoles)
+	}
+	for name, role := range s.roles {
+		if _, ok := roles[name]; !ok {
+			s.removed[name] = role
+		}
+	}
+	for name := range roles {
+		delete(s.removed, name)
+	}
+	s.roles = roles
+	s.serviceAccounts = serviceAccounts
+	s.denied = make(map[string]string)
+}
+
+func (s *statusState) setDenied(name string, violations []string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[name] = strings.Join(violations, "; ")
+}
+
+func (s *statusState) roleApplied(name string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied[name] = time.Now().UTC()
+	delete(s.errors, name)
+}
+
+func (s *statusState) roleFailed(name string, err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[name] = err.Error()
+	s.reloadErrors = append(s.reloadErrors, fmt.Sprintf("vault role %s: %v", name, err))
+}
+
+func (s *statusState) setReviewerToken(token []byte) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.reviewerToken, token) {
+		s.reviewerToken, s.reviewerReadAt = token, time.Now().UTC()
+	}
+}
+
+// status of vault auth mount, roles and service accounts, vault and kubernetes are read only by the first request after
+// reload and the same status is returned until the next reload, so status requests do not add load on vault and
+// kubernetes
+func (a Auth) Status() Status {
+
+	a.status.readMu.Lock()
+	defer a.status.readMu.Unlock()
+
+	a.status.mu.Lock()
+	current, generation := a.status.current, a.status.generation
+	a.status.mu.Unlock()
+	if current != nil {
+		return *current
+	}
+
+	status := a.readStatus()
+	a.status.mu.Lock()
+	defer a.status.mu.Unlock()
+	if generation == a.status.generation {
+		a.status.current = &status
+	}
+	return status
+}
+
+// status with vault and kubernetes state read now
+func (a Auth) readStatus() Status {
+
+	a.status.mu.Lock()
+	roles := a.status.roles
+	denied := copyStrings(a.status.denied)
+	errs := copyStrings(a.status.errors)
+	applied := make(map[string]time.Time)
+	for k, v := range a.status.applied {
+		applied[k] = v
+	}
+	serviceAccounts := a.status.serviceAccounts
+	reviewerToken, reviewerReadAt := a.status.reviewerToken, a.status.reviewerReadAt
+	reloads := append([]ReloadResult{}, a.status.reloads...)
+	a.status.mu.Unlock()
+
+	status := Status{
+		Time:    time.Now().UTC(),
+		Mount:   a.mountStatus(),
+		Reloads: reloads,
+	}
+	if reviewerToken != nil {
+		status.Reviewer = newReviewerStatus(reviewerToken, reviewerReadAt, status.Time)
+	}
+	if roles != nil {
+		var roleErrs, serviceAccountErrs []string
+		status.Roles, roleErrs = a.roleStatuses(roles, denied, errs, applied)
+		status.ServiceAccounts, serviceAccountErrs = a.serviceAccountStatuses(roles, serviceAccounts)
+		status.Errors = append(roleErrs, serviceAccountErrs...)
+	}
+	return status
+}
+
+func (a Auth) mountStatus() MountStatus {
+
+	mount := MountStatus{Path: a.vaultClient.AuthMount(), Type: a.authType(), Accessor: a.vaultClient.AuthAccessor()}
+	authType, err := a.vaultClient.ReadAuthType()
+	if err != nil {
+		mount.Error = err.Error()
+		return mount
+	}
+	if authType == "" {
+		mount.Error = "auth is not mounted"
+		return mount
+	}
+	// type of the mount in vault, it differs from auth type only if the mount was replaced outside of this application
+	if mount.Type != authType {
+		mount.Error = fmt.Sprintf("auth is mounted with type %s, expected %s", authType, mount.Type)
+		mount.Type = authType
+		return mount
+	}
+	if authType == vault.AuthTypeJWT {
+		config, err := a.vaultClient.ReadAuthJWTConfig()
+		if err != nil {
+			mount.Error = err.Error()
+			return mount
+		}
+		if config != nil {
+			mount.Issuer, mount.PEMKeys = config.BoundIssuer, len(config.JWTValidationPubkeys)
+		}
+		return mount
+	}
+
+	config, err := a.vaultClient.ReadAuthKubernetesConfig()
+	if err != nil {
+		mount.Error = err.Error()
+		return mount
+	}
+	if config == nil {
+		mount.Error = "auth is not configured"
+		return mount
+	}
+	mount.KubernetesHost, mount.Issuer, mount.PEMKeys = config.KubernetesHost, config.Issuer, len(config.PEMKeys)
+	if config.KubernetesCACert != "" {
+		fingerprint, expiry, err := caFingerprint([]byte(config.KubernetesCACert))
+		if err != nil {
+			mount.Error = fmt.Sprintf("kubernetes CA: %v", err)
+			return mount
+		}
+		mount.CAFingerprint, mount.CAExpiry = fingerprint, &expiry
+	}
+	return mount
+}
+
+// desired roles with vault roles, vault roles that are not desired are unmanaged (they are deleted on the next reload)
+func (a Auth) roleStatuses(roles vaultRoles, denied, errs map[string]string, applied map[string]time.Time) ([]RoleStatus, []string) {
+
+	var names []string
+	for name := range roles {
+		names = append(names, name)
+	}
+	var readErrs []string
+	vaultNames, err := a.vaultClient.ListRoles()
+	if err != nil {
+		readErrs = append(readErrs, fmt.Sprintf("list vault roles: %v", err))
+	}
+	for _, name := range vaultNames {
+		if _, ok := roles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	var mu sync.Mutex
+	var statuses []RoleStatus
+	util.ForEach(a.config.Workers, names, func(name string) {
+		roleStatus := RoleStatus{Name: name, LastError: errs[name]}
+		if t, ok := applied[name]; ok {
+			roleStatus.LastApplied = &t
+		}
+		if role, ok := roles[name]; ok {
+			roleStatus.Source, roleStatus.Desired = role.source.String(), &role.Role
+		}
+		if message, ok := a.login.failure(name); ok && roleStatus.LastError == "" {
+			roleStatus.LastError = fmt.Sprintf("login verification: %s", message)
+		}
+
+		actual, readErr := a.vaultClient.ReadRole(name)
+		roleStatus.Actual = actual
+		switch {
+		case readErr != nil:
+			roleStatus.State, roleStatus.LastError = RoleUnknown, readErr.Error()
+		case roleStatus.Desired == nil:
+			roleStatus.State = RoleUnmanaged
+		case denied[name] != "":
+			roleStatus.State, roleStatus.LastError = RoleDenied, denied[name]
+		case actual == nil:
+			roleStatus.State = RoleMissing
+		default:
+			roleStatus.State = RoleSynced
+			if diff := roleStatus.Desired.Diff(*actual); len(diff) != 0 {
+				roleStatus.State, roleStatus.Diff = RoleDrifted, diff.String()
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		statuses = append(statuses, roleStatus)
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, readErrs
+}
+
+// service accounts bound by roles and service accounts created by this application in all namespaces
+func (a Auth) serviceAccountStatuses(roles vaultRoles, desired map[string]map[string]struct{}) ([]ServiceAccountStatus, []string) {
+
+	namespaces, err := a.k8sClient.GetNamespaces()
+	if err != nil {
+		return nil, []string{fmt.Sprintf("get namespaces: %v", err)}
+	}
+
+	var mu sync.Mutex
+	var statuses []ServiceAccountStatus
+	var readErrs []string
+	util.ForEach(a.config.Workers, namespaces, func(namespace string) {
+		managed, err := a.k8sClient.GetServiceAccounts(namespace, serviceAccountAnnotations)
+		var all []string
+		if err == nil && len(desired[namespace]) != 0 {
+			all, err = a.k8sClient.GetServiceAccounts(namespace, nil)
+		}
+		if err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			readErrs = append(readErrs, fmt.Sprintf("get service accounts in %s namespace: %v", namespace, err))
+			return
+		}
+
+		var namespaceStatuses []ServiceAccountStatus
+		for name := range desired[namespace] {
+			// glob is not a service account
+			if strings.Contains(name, "*") {
+				continue
+			}
+			state := ServiceAccountMissing
+			switch {
+			case util.StringSliceContains(managed, name):
+				state = ServiceAccountManaged
+			case util.StringSliceContains(all, name):
+				state = ServiceAccountUnmanaged
+			}
+			namespaceStatuses = append(namespaceStatuses, ServiceAccountStatus{Namespace: namespace, Name: name, State: state, Roles: roles.boundRoles(namespace, name)})
+		}
+		for _, name := range managed {
+			if _, ok := desired[namespace][name]; !ok {
+				namespaceStatuses = append(namespaceStatuses, ServiceAccountStatus{Namespace: namespace, Name: name, State: ServiceAccountOrphaned})
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		statuses = append(statuses, namespaceStatuses...)
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Namespace != statuses[j].Namespace {
+			return statuses[i].Namespace < statuses[j].Namespace
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	sort.Strings(readErrs)
+	return statuses, readErrs
+}
+
+func newReviewerStatus(token []byte, readAt, now time.Time) *ReviewerStatus {
+
+	reviewer := &ReviewerStatus{
+		ServiceAccount: fmt.Sprintf("%s/%s", tokenReviewerNamespace, tokenReviewerServiceAccount),
+		ReadAt:         readAt,
+	}
+	from := readAt
+	if issuedAt, ok := jwtIssuedAt(token); ok {
+		reviewer.IssuedAt, from = &issuedAt, issuedAt
+	}
+	reviewer.Age = now.Sub(from).Round(time.Second).String()
+	return reviewer
+}
+
+// iat claim of jwt, signature is not verified
+func jwtIssuedAt(token []byte) (time.Time, bool) {
+
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		IssuedAt int64 `json:"iat"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.IssuedAt == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.IssuedAt, 0).UTC(), true
+}
+
+// sha256 fingerprint (colon separated hex) of the first certificate and expiry of the certificate that expires first
+func caFingerprint(ca []byte) (string, time.Time, error) {
+
+	var fingerprint string
+	var expiry time.Time
+	for block, rest := pem.Decode(ca); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if fingerprint == "" {
+			sum := sha256.Sum256(cert.Raw)
+			hex := make([]string, len(sum))
+			for i, b := range sum {
+				hex[i] = fmt.Sprintf("%02X", b)
+			}
+			fingerprint = strings.Join(hex, ":")
+		}
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter.UTC()
+		}
+	}
+	if fingerprint == "" {
+		return "", time.Time{}, fmt.Errorf("no PEM certificate found")
+	}
+	return fingerprint, expiry, nil
+}
+
+// status in format, table, json or yaml
+func (s Status) Format(format string) ([]byte, error) {
+
+	switch format {
+	case StatusFormatTable:
+		return s.Table(), nil
+	case StatusFormatJSON:
+		b, err := json.MarshalIndent(s, "", "  ")
+		return append(b, '\n'), err
+	case StatusFormatYAML:
+		return s.YAML()
+	}
+	return nil, fmt.Errorf("status format %q is not one of %s, %s or %s", format, StatusFormatTable, StatusFormatJSON, StatusFormatYAML)
+}
+
+// yaml with the same field names and order as json
+func (s Status) YAML() ([]byte, error) {
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(b, &node); err != nil {
+		return nil, err
+	}
+	blockStyle(&node)
+	return yaml.Marshal(&node)
+}
+
+// json is decoded as flow style yaml with quoted strings
+func blockStyle(node *yaml.Node) {
+
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+func (s Status) Table() []byte {
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNT\tTYPE\tACCESSOR\tKUBERNETES HOST\tISSUER\tPEM KEYS\tCA FINGERPRINT\tCA EXPIRY\tERROR")
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", s.Mount.Path, s.Mount.Type, s.Mount.Accessor, s.Mount.KubernetesHost,
+		s.Mount.Issuer, s.Mount.PEMKeys, s.Mount.CAFingerprint, formatTime(s.Mount.CAExpiry), s.Mount.Error)
+	if s.Reviewer != nil {
+		fmt.Fprintln(w, "\nREVIEWER\tISSUED AT\tREAD AT\tAGE")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Reviewer.ServiceAccount, formatTime(s.Reviewer.IssuedAt), formatTime(&s.Reviewer.ReadAt), s.Reviewer.Age)
+	}
+
+	fmt.Fprintln(w, "\nROLE\tSTATE\tSOURCE\tLAST APPLIED\tDIFF\tLAST ERROR")
+	for _, role := range s.Roles {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", role.Name, role.State, role.Source, formatTime(role.LastApplied), role.Diff, role.LastError)
+	}
+
+	fmt.Fprintln(w, "\nNAMESPACE\tSERVICE ACCOUNT\tSTATE\tROLES")
+	for _, serviceAccount := range s.ServiceAccounts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", serviceAccount.Namespace, serviceAccount.Name, serviceAccount.State, strings.Join(serviceAccount.Roles, ","))
+	}
+
+	fmt.Fprintln(w, "\nRELOAD\tRESULT\tDURATION\tROLES\tERRORS")
+	for _, reload := range s.Reloads {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", formatTime(&reload.Start), reload.Result, reload.Duration, reload.Roles, strings.Join(reload.Errors, "; "))
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func formatTime(t *time.Time) string {
+
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func copyStrings(in map[string]string) map[string]string {
+
+	out := make(map[string]string)
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCAFingerprint(t *testing.T) {
+
+	t.Run("when CA has more certificates then fingerprint is of the first and expiry of the earliest", func(t *testing.T) {
+
+		notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		first, raw := newTestCertificate(t, notAfter)
+		second, _ := newTestCertificate(t, notAfter.AddDate(-1, 0, 0))
+
+		fingerprint, expiry, err := caFingerprint(append(first, second...))
+		require.NoError(t, err)
+		sum := sha256.Sum256(raw)
+		assert.Equal(t, strings.ToUpper(fmt.Sprintf("%x", sum[:2])), strings.ReplaceAll(fingerprint[:5], ":", ""))
+		assert.Len(t, strings.Split(fingerprint, ":"), 32)
+		assert.Equal(t, notAfter.AddDate(-1, 0, 0), expiry)
+	})
+
+	t.Run("when CA has no certificate then error is returned", func(t *testing.T) {
+
+		_, _, err := caFingerprint([]byte("--- CA ---"))
+		assert.Error(t, err)
+	})
+}
+
+func TestJWTIssuedAt(t *testing.T) {
+
+	t.Run("when token has iat claim then issued at is returned", func(t *testing.T) {
+
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"iat": 1700000000, "sub": "system:serviceaccount:vault-auth:token-reviewer"}`))
+		issuedAt, ok := jwtIssuedAt([]byte("header." + claims + ".signature"))
+		require.True(t, ok)
+		assert.Equal(t, time.Unix(1700000000, 0).UTC(), issuedAt)
+	})
+
+	t.Run("when token does not have iat claim then it is not returned", func(t *testing.T) {
+
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub": "system:serviceaccount:vault-auth:token-reviewer"}`))
+		_, ok := jwtIssuedAt([]byte("header." + claims + ".signature"))
+		assert.False(t, ok)
+		_, ok = jwtIssuedAt([]byte("token-reviewer-jwt"))
+		assert.False(t, ok)
+	})
+}
+
+func TestStatusState(t *testing.T) {
+
+	t.Run("when there are more reloads than history then the last reloads are kept", func(t *testing.T) {
+
+		s := newStatusState(2)
+		start := time.Now()
+		s.finishReload(start, reconcileSkipped, "vault is sealed")
+		s.reloadError("init vault auth kubernetes: timeout")
+		s.finishReload(start, reconcileCompleted)
+		s.finishReload(start, reconcileCompleted)
+
+		require.Len(t, s.reloads, 2)
+		assert.Equal(t, []string{"init vault auth kubernetes: timeout"}, s.reloads[0].Errors)
+		assert.Empty(t, s.reloads[1].Errors)
+	})
+
+	t.Run("when role is applied after failure then error is cleared", func(t *testing.T) {
+
+		s := newStatusState(0)
+		s.roleFailed("app", errors.New("permission denied"))
+		assert.Equal(t, "permission denied", s.errors["app"])
+
+		s.roleApplied("app")
+		assert.NotContains(t, s.errors, "app")
+		assert.Contains(t, s.applied, "app")
+		assert.Equal(t, defaultStatusHistory, s.history)
+	})
+}
+
+func TestStatus_Format(t *testing.T) {
+
+	status := Status{
+		Time:  time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+		Mount: MountStatus{Path: "kubernetes/test-cluster", Type: "kubernetes", KubernetesHost: "https://kube.host"},
+		Roles: []RoleStatus{{
+			Name:    "app",
+			State:   RoleDrifted,
+			Desired: &vault.Role{BoundServiceAccountNames: []string{"app"}, TokenPolicies: []string{"true"}},
+			Diff:    `token_policies: vault ["admin"], desired ["true"]`,
+		}},
+		ServiceAccounts: []ServiceAccountStatus{{Namespace: "payments", Name: "app", State: ServiceAccountManaged, Roles: []string{"app"}}},
+		Reloads:         []ReloadResult{{Result: reconcileCompleted, Duration: "10ms", Roles: 1}},
+	}
+
+	t.Run("when format is yaml then fields are json field names in block style", func(t *testing.T) {
+
+		b, err := status.Format(StatusFormatYAML)
+		require.NoError(t, err)
+		out := string(b)
+		assert.Contains(t, out, "service_accounts:\n")
+		assert.Contains(t, out, "  kubernetes_host: https://kube.host\n")
+		assert.Contains(t, out, "bound_service_account_names:\n")
+		// string that would be read as bool is quoted
+		assert.Contains(t, out, `- "true"`)
+	})
+
+	t.Run("when format is table then every section has header", func(t *testing.T) {
+
+		b, err := status.Format(StatusFormatTable)
+		require.NoError(t, err)
+		out := string(b)
+		for _, header := range []string{"MOUNT", "ROLE", "NAMESPACE", "RELOAD"} {
+			assert.Contains(t, out, header)
+		}
+		assert.Regexp(t, `app\s+drifted`, out)
+	})
+
+	t.Run("when format is not valid then error is returned", func(t *testing.T) {
+
+		_, err := status.Format("xml")
+		assert.Error(t, err)
+	})
+}
+
+// self-signed PEM certificate and its DER bytes
+func newTestCertificate(t *testing.T, notAfter time.Time) ([]byte, []byte) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kubernetes"},
+		NotBefore:    notAfter.AddDate(-10, 0, 0),
+		NotAfter:     notAfter,
+		IsCA:         true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}), raw
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"text/template"
+)
+
+const (
+	// namespaces labelled with 'vak-role-templates: disabled' are excluded from all role templates
+	roleTemplatesNamespaceLabel    = "vak-role-templates"
+	roleTemplatesNamespaceDisabled = "disabled"
+)
+
+// role template is config map entry with 'template' field, it is expanded into one vault role for every matching namespace
+// e.g. {"template": {"role_name": "ns-{{.Namespace}}"}, "bound_service_account_names": ["vault-agent-injector"], "token_policies": ["{{.Namespace}}"]}
+type roleTemplate struct {
+	key             string
+	source          roleSource
+	roleName        *template.Template
+	namespaceLabels map[string]string
+	role            vault.Role
+	driftPolicy     string
+	// secrets engine role is not rendered, allowed kubernetes namespaces default to the rendered role namespaces
+	secretsEngineRole map[string]interface{}
+}
+
+type roleTemplateSpec struct {
+	Template *struct {
+		RoleName        string            `json:"role_name"`
+		NamespaceLabels map[string]string `json:"namespace_labels"`
+	} `json:"template"`
+}
+
+// data available in role template
+type roleTemplateData struct {
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+type roleTemplates []roleTemplate
+
+// role templates from definitions, invalid templates are returned as violations
+func newRoleTemplates(source roleSource, definitions []roleDefinition) (roleTemplates, []string) {
+
+	var templates roleTemplates
+	var violations []string
+	for _, definition := range definitions {
+		if !isRoleTemplate(definition.raw) {
+			continue
+		}
+		t, err := newRoleTemplate(definition.name, definition.raw)
+		if err != nil {
+			err = definition.errorf(err)
+			logger.Errorf("new role template %s from %s: %v", definition.name, source, err)
+			violations = append(violations, fmt.Sprintf("%s: %v", definition.name, err))
+			continue
+		}
+		t.source = source
+		templates = append(templates, t)
+	}
+	return templates, violations
+}
+
+func isRoleTemplate(rawRole []byte) bool {
+
+	var spec roleTemplateSpec
+	if err := json.Unmarshal(rawRole, &spec); err != nil {
+		return false
+	}
+	return spec.Template != nil
+}
+
+func newRoleTemplate(key string, rawRole []byte) (roleTemplate, error) {
+
+	var spec roleTemplateSpec
+	if err := json.Unmarshal(rawRole, &spec); err != nil {
+		return roleTemplate{}, fmt.Errorf("unmarshal role template: %w", err)
+	}
+	if spec.Template.RoleName == "" {
+		return roleTemplate{}, errors.New("role template is missing role_name")
+	}
+
+	roleName, err := newTemplate(spec.Template.RoleName)
+	if err != nil {
+		return roleTemplate{}, fmt.Errorf("parse role_name: %w", err)
+	}
+
+	// role is not sanitized nor validated until it is rendered for a namespace
+	var role vault.Role
+	if err := json.Unmarshal(rawRole, &role); err != nil {
+		return roleTemplate{}, fmt.Errorf("unmarshal vault role: %w", err)
+	}
+	driftPolicy, err := newDriftPolicy(rawRole)
+	if err != nil {
+		return roleTemplate{}, err
+	}
+	// the same policy would be defined by every rendered role
+	if policies, err := newACLPolicies(rawRole); err != nil || len(policies) != 0 {
+		return roleTemplate{}, errors.New("acl policies are not allowed in role templates")
+	}
+	secretsEngineRole, err := newSecretsEngineRole(rawRole)
+	if err != nil {
+		return roleTemplate{}, err
+	}
+
+	return roleTemplate{
+		key:               key,
+		roleName:          roleName,
+		namespaceLabels:   spec.Template.NamespaceLabels,
+		role:              role,
+		driftPolicy:       driftPolicy,
+		secretsEngineRole: secretsEngineRole,
+	}, nil
+}
+
+// expand templates into vault roles for every matching namespace, namespace that fails to render is skipped
+func (r roleTemplates) expand(namespaces []k8s.Namespace) vaultRoles {
+
+	roles := make(vaultRoles)
+	for _, t := range r {
+		for _, namespace := range namespaces {
+			if !t.matches(namespace) {
+				continue
+			}
+			roleName, role, err := t.render(namespace)
+			if err != nil {
+				logger.Errorf("render role template %s for %s namespace: %v", t.key, namespace.Name, err)
+				continue
+			}
+			if _, ok := roles[roleName]; ok {
+				logger.Errorf("render role template %s for %s namespace: role %s already exists", t.key, namespace.Name, roleName)
+				continue
+			}
+			roles[roleName] = vaultRole{
+				Role:              role,
+				source:            t.source,
+				driftPolicy:       t.driftPolicy,
+				secretsEngineRole: withAllowedNamespaces(t.secretsEngineRole, role),
+			}
+		}
+	}
+	return roles
+}
+
+func (t roleTemplate) matches(namespace k8s.Namespace) bool {
+
+	if namespace.Labels[roleTemplatesNamespaceLabel] == roleTemplatesNamespaceDisabled {
+		return false
+	}
+	for k, v := range t.namespaceLabels {
+		if namespace.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (t roleTemplate) render(namespace k8s.Namespace) (string, vault.Role, error) {
+
+	data := roleTemplateData{
+		Namespace:   namespace.Name,
+		Labels:      namespace.Labels,
+		Annotations: namespace.Annotations,
+	}
+
+	roleName, err := execute(t.roleName, data)
+	if err != nil {
+		return "", vault.Role{}, fmt.Errorf("role_name: %w", err)
+	}
+	if roleName == "" {
+		return "", vault.Role{}, errors.New("role_name rendered to empty string")
+	}
+
+	role := t.role
+	if role.BoundServiceAccountNames, err = renderStrings(role.BoundServiceAccountNames, data); err != nil {
+		return "", vault.Role{}, fmt.Errorf("bound_service_account_names: %w", err)
+	}
+	if role.BoundServiceAccountNamespaces, err = renderStrings(role.BoundServiceAccountNamespaces, data); err != nil {
+		return "", vault.Role{}, fmt.Errorf("bound_service_account_namespaces: %w", err)
+	}
+	if role.TokenPolicies, err = renderStrings(role.TokenPolicies, data); err != nil {
+		return "", vault.Role{}, fmt.Errorf("token_policies: %w", err)
+	}
+	// role is bound to the rendered namespace, unless template says otherwise
+	if len(role.BoundServiceAccountNamespaces) == 0 {
+		role.BoundServiceAccountNamespaces = []string{namespace.Name}
+	}
+
+	// sanitize and validate rendered role the same way as roles from config map
+	rawRole, err := json.Marshal(role)
+	if err != nil {
+		return "", vault.Role{}, fmt.Errorf("marshal vault role: %w", err)
+	}
+	role, err = vault.NewRole(rawRole)
+	if err != nil {
+		return "", vault.Role{}, err
+	}
+	return roleName, role, nil
+}
+
+func renderStrings(in []string, data roleTemplateData) ([]string, error) {
+
+	var out []string
+	for _, v := range in {
+		t, err := newTemplate(v)
+		if err != nil {
+			return nil, err
+		}
+		rendered, err := execute(t, data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rendered)
+	}
+	return out, nil
+}
+
+func newTemplate(text string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(text)
+}
+
+func execute(t *template.Template, data interface{}) (string, error) {
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewRoleTemplates(t *testing.T) {
+
+	t.Run("when config map contains roles and role templates then only role templates are returned", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"default":    `{"bound_service_account_names": ["default"], "bound_service_account_namespaces": ["default"], "token_policies": ["test"]}`,
+			"namespaces": `{"template": {"role_name": "ns-{{.Namespace}}"}, "bound_service_account_names": ["vault-agent-injector"], "token_policies": ["{{.Namespace}}"]}`,
+		}
+
+		templates := testRoleTemplates(configMapData)
+		require.Equal(t, 1, len(templates))
+		assert.Equal(t, "namespaces", templates[0].key)
+		assert.Equal(t, 1, len(testVaultRoles(configMapData)))
+	})
+
+	t.Run("when role template is missing role name then it is skipped", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"namespaces": `{"template": {}, "bound_service_account_names": ["vault-agent-injector"], "token_policies": ["{{.Namespace}}"]}`,
+		}
+		assert.Equal(t, 0, len(testRoleTemplates(configMapData)))
+	})
+
+	t.Run("when role template has invalid role name template then it is skipped", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"namespaces": `{"template": {"role_name": "ns-{{.Namespace"}, "bound_service_account_names": ["vault-agent-injector"]}`,
+		}
+		assert.Equal(t, 0, len(testRoleTemplates(configMapData)))
+	})
+}
+
+func TestRoleTemplates_expand(t *testing.T) {
+
+	namespaces := []k8s.Namespace{
+		{Name: "default"},
+		{Name: "payments", Labels: map[string]string{"vault": "enabled", "team": "payments"}},
+		{Name: "orders", Labels: map[string]string{"vault": "enabled", "team": "orders", roleTemplatesNamespaceLabel: roleTemplatesNamespaceDisabled}},
+		{Name: "search", Labels: map[string]string{"vault": "enabled"}},
+	}
+
+	t.Run("when template has namespace labels then roles are rendered only for matching namespaces that did not opt out", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"namespaces": `{
+				"template": {"role_name": "ns-{{.Namespace}}", "namespace_labels": {"vault": "enabled"}},
+				"bound_service_account_names": ["vault-agent-injector"],
+				"token_policies": ["{{.Namespace}}", "default"],
+				"token_ttl": 3600
+			}`,
+		}
+
+		source := roleSource{kind: configMapSourceKind}
+		roles := testRoleTemplates(configMapData).expand(namespaces)
+		expected := vaultRoles{
+			"ns-payments": {Role: vault.Role{
+				BoundServiceAccountNames:      []string{"vault-agent-injector"},
+				BoundServiceAccountNamespaces: []string{"payments"},
+				TokenPolicies:                 []string{"payments", "default"},
+				TokenTTL:                      3600,
+			}, source: source, driftPolicy: driftPolicyEnforce},
+			"ns-search": {Role: vault.Role{
+				BoundServiceAccountNames:      []string{"vault-agent-injector"},
+				BoundServiceAccountNamespaces: []string{"search"},
+				TokenPolicies:                 []string{"search", "default"},
+				TokenTTL:                      3600,
+			}, source: source, driftPolicy: driftPolicyEnforce},
+		}
+		assert.Equal(t, expected, roles)
+	})
+
+	t.Run("when template references missing label then namespace without the label is skipped", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"teams": `{"template": {"role_name": "team-{{.Labels.team}}"}, "bound_service_account_names": ["vault-agent-injector"], "token_policies": ["{{.Labels.team}}"]}`,
+		}
+
+		roles := testRoleTemplates(configMapData).expand(namespaces)
+		require.Equal(t, 1, len(roles))
+		assert.Equal(t, vault.Role{
+			BoundServiceAccountNames:      []string{"vault-agent-injector"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"payments"},
+		}, roles["team-payments"].Role)
+	})
+
+	t.Run("when rendered role names are not unique then only the first role is kept", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"namespaces": `{"template": {"role_name": "shared"}, "bound_service_account_names": ["vault-agent-injector"], "token_policies": ["{{.Namespace}}"]}`,
+		}
+
+		roles := testRoleTemplates(configMapData).expand(namespaces)
+		assert.Equal(t, 1, len(roles))
+	})
+
+	t.Run("when rendered role is invalid then it is skipped", func(t *testing.T) {
+
+		configMapData := map[string]string{
+			"namespaces": `{"template": {"role_name": "ns-{{.Namespace}}"}, "bound_service_account_names": ["*"], "bound_service_account_namespaces": ["*"]}`,
+		}
+
+		roles := testRoleTemplates(configMapData).expand(namespaces)
+		assert.Equal(t, 0, len(roles))
+	})
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+)
+
+const (
+	// config maps labelled with 'vak-roles: "true"' in any namespace contain tenant (self-service) roles
+	tenantRolesLabelSelector = "vak-roles=true"
+	// separates namespace and role name in tenant role name, namespace names (dns labels) cannot contain it, so tenant
+	// roles from different namespaces cannot collide
+	tenantRoleSeparator = "."
+)
+
+// tenant roles are read from labelled config maps in any namespace, roles are constrained to the config map namespace:
+// role name is prefixed with namespace, bound service account namespaces are set to the config map namespace and token
+// policies have to match one of the centrally configured allowed policies, tenant role that collides with central role
+// (config map, files, templates) is reported on the tenant config map
+func (a Auth) getTenantRoles(centralRoles vaultRoles) (vaultRoles, error) {
+
+	configMaps, err := a.k8sClient.GetConfigMaps(tenantRolesLabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make(vaultRoles)
+	for _, configMap := range configMaps {
+		if configMap.Namespace == vaultAuthConfigNamespace && configMap.Name == vaultAuthConfigMap {
+			continue
+		}
+
+		source := newConfigMapSource(configMap)
+		definitions, violations := configMapRoleDefinitions(configMap)
+		for _, definition := range definitions {
+			roleName, role, err := newTenantRole(configMap.Namespace, definition, a.config.TenantAllowedPolicies)
+			var driftPolicy string
+			if err == nil {
+				driftPolicy, err = definition.driftPolicy()
+			}
+			if err == nil {
+				if _, ok := roles[roleName]; ok {
+					err = errors.New("role is defined more than once")
+				}
+				if central, ok := centralRoles[roleName]; ok {
+					err = fmt.Errorf("role %s already exists in %s", roleName, central.source)
+				}
+			}
+			if err != nil {
+				logger.Errorf("tenant role %s from %s: %v", definition.name, source, err)
+				violations = append(violations, fmt.Sprintf("%s: %v", definition.name, err))
+				continue
+			}
+			// tenant roles are not adopted, vault role could bypass allowed policies
+			roles[roleName] = vaultRole{Role: role, source: source, driftPolicy: driftPolicy}
+		}
+		a.report(source, eventReasonInvalidRole, violations)
+	}
+	return roles, nil
+}
+
+func newTenantRole(namespace string, definition roleDefinition, allowedPolicies []string) (string, vault.Role, error) {
+
+	if isRoleTemplate(definition.raw) {
+		return "", vault.Role{}, errors.New("role templates are not allowed in tenant config maps")
+	}
+
+	role, err := definition.newRole()
+	if err != nil {
+		return "", vault.Role{}, err
+	}
+	// acl policy could grant access beyond allowed policies
+	if policies, err := definition.aclPolicies(); err != nil || len(policies) != 0 {
+		return "", vault.Role{}, errors.New("acl policies are not allowed in tenant roles")
+	}
+	// secrets engine role could issue credentials for any kubernetes service account
+	if secretsEngineRole, err := definition.secretsEngineRole(); err != nil || secretsEngineRole != nil {
+		return "", vault.Role{}, errors.New("secrets engine roles are not allowed in tenant roles")
+	}
+
+	for _, policy := range role.TokenPolicies {
+		if !matchesAny(policy, allowedPolicies) {
+			return "", vault.Role{}, fmt.Errorf("token policy %q is not allowed", policy)
+		}
+	}
+	role.BoundServiceAccountNamespaces = []string{namespace}
+	return namespace + tenantRoleSeparator + definition.name, role, nil
+}
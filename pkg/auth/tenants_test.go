@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewTenantRole(t *testing.T) {
+
+	allowedPolicies := []string{"tenant-*", "default"}
+
+	t.Run("when tenant role has allowed policies then role is prefixed with namespace and bound to the namespace", func(t *testing.T) {
+
+		rawRole := []byte(`{"bound_service_account_names": ["app"], "bound_service_account_namespaces": ["*"], "token_policies": ["tenant-payments", "default"]}`)
+		roleName, role, err := newTenantRole("payments", roleDefinition{name: "app", raw: rawRole}, allowedPolicies)
+		require.NoError(t, err)
+
+		assert.Equal(t, "payments.app", roleName)
+		assert.Equal(t, vault.Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"tenant-payments", "default"},
+		}, role)
+	})
+
+	t.Run("when tenant role has policy that is not allowed then error is returned", func(t *testing.T) {
+
+		rawRole := []byte(`{"bound_service_account_names": ["app"], "token_policies": ["tenant-payments", "admin"]}`)
+		_, _, err := newTenantRole("payments", roleDefinition{name: "app", raw: rawRole}, allowedPolicies)
+		require.Error(t, err)
+	})
+
+	t.Run("when tenant role is role template then error is returned", func(t *testing.T) {
+
+		rawRole := []byte(`{"template": {"role_name": "{{.Namespace}}"}, "bound_service_account_names": ["app"], "token_policies": ["default"]}`)
+		_, _, err := newTenantRole("payments", roleDefinition{name: "app", raw: rawRole}, allowedPolicies)
+		require.Error(t, err)
+	})
+
+	t.Run("when tenant role has secrets engine role then error is returned", func(t *testing.T) {
+
+		rawRole := []byte(`{"bound_service_account_names": ["app"], "token_policies": ["tenant-payments"], "secrets_engine_role": {"service_account_name": "app"}}`)
+		_, _, err := newTenantRole("payments", roleDefinition{name: "app", raw: rawRole}, allowedPolicies)
+		require.Error(t, err)
+	})
+
+	t.Run("when tenant role is invalid then error is returned", func(t *testing.T) {
+
+		_, _, err := newTenantRole("payments", roleDefinition{name: "app", raw: []byte(`invalid`)}, allowedPolicies)
+		require.Error(t, err)
+	})
+}
+
+func TestAuth_getTenantRoles(t *testing.T) {
+
+	config := testConfig
+	config.TenantAllowedPolicies = []string{"tenant-*"}
+
+	t.Run("when tenant config map has invalid role then valid roles are returned and violation is reported only once", func(t *testing.T) {
+
+		configMaps := []k8s.ConfigMap{
+			{Namespace: vaultAuthConfigNamespace, Name: vaultAuthConfigMap, Data: map[string]string{
+				"central": `{"bound_service_account_names": ["app"], "token_policies": ["admin"]}`,
+			}},
+			{Namespace: "payments", Name: "vault-roles", UID: "abc", Data: map[string]string{
+				"app":   `{"bound_service_account_names": ["app"], "token_policies": ["tenant-payments"]}`,
+				"admin": `{"bound_service_account_names": ["app"], "token_policies": ["admin"]}`,
+			}},
+		}
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMaps", tenantRolesLabelSelector).Return(configMaps, nil)
+		k8sClient.On("CreateEvent", mock.MatchedBy(func(e k8s.Event) bool {
+			return e.Namespace == "payments" && e.Name == "vault-roles" && e.UID == "abc" && e.Type == k8s.EventTypeWarning &&
+				e.Message == `admin: token policy "admin" is not allowed`
+		})).Return(nil).Once()
+
+		a := NewAuth(config, nil, k8sClient)
+		for i := 0; i < 2; i++ {
+			roles, err := a.getTenantRoles(nil)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(roles))
+			assert.Contains(t, roles, "payments.app")
+		}
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when tenant role name exists in central roles then tenant role is skipped and reported on tenant config map", func(t *testing.T) {
+
+		configMaps := []k8s.ConfigMap{
+			{Namespace: "payments", Name: "vault-roles", UID: "abc", Data: map[string]string{
+				"app":    `{"bound_service_account_names": ["app"], "token_policies": ["tenant-payments"]}`,
+				"worker": `{"bound_service_account_names": ["worker"], "token_policies": ["tenant-payments"]}`,
+			}},
+		}
+		central := roleSource{kind: configMapSourceKind, namespace: vaultAuthConfigNamespace, name: vaultAuthConfigMap}
+		centralRoles := vaultRoles{"payments.app": {Role: vault.Role{TokenPolicies: []string{"admin"}}, source: central}}
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMaps", tenantRolesLabelSelector).Return(configMaps, nil)
+		k8sClient.On("CreateEvent", mock.MatchedBy(func(e k8s.Event) bool {
+			return e.Namespace == "payments" && e.Name == "vault-roles" && e.Reason == eventReasonInvalidRole &&
+				e.Message == fmt.Sprintf("app: role payments.app already exists in %s", central)
+		})).Return(nil).Once()
+
+		roles, err := NewAuth(config, nil, k8sClient).getTenantRoles(centralRoles)
+		require.NoError(t, err)
+		assert.Len(t, roles, 1)
+		assert.Contains(t, roles, "payments.worker")
+		k8sClient.AssertExpectations(t)
+	})
+
+	t.Run("when tenant roles from different namespaces have names that would collide with dash then they do not", func(t *testing.T) {
+
+		configMaps := []k8s.ConfigMap{
+			{Namespace: "a-b", Name: "vault-roles", Data: map[string]string{
+				"c": `{"bound_service_account_names": ["c"], "token_policies": ["tenant-a"]}`,
+			}},
+			{Namespace: "a", Name: "vault-roles", Data: map[string]string{
+				"b-c": `{"bound_service_account_names": ["c"], "token_policies": ["tenant-a"]}`,
+			}},
+		}
+		k8sClient := new(K8sClientMock)
+		k8sClient.On("GetConfigMaps", tenantRolesLabelSelector).Return(configMaps, nil)
+
+		roles, err := NewAuth(config, nil, k8sClient).getTenantRoles(nil)
+		require.NoError(t, err)
+		assert.Len(t, roles, 2)
+		assert.Contains(t, roles, "a-b.c")
+		assert.Contains(t, roles, "a.b-c")
+	})
+}
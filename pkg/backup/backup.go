@@ -0,0 +1,264 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"sort"
+	"time"
+)
+
+const (
+	// snapshot format version, snapshots with newer version are not restored
+	Version = 1
+
+	// snapshot names are UTC creation times, so they sort from the oldest
+	nameLayout = "20060102-150405.000"
+
+	redacted = "<redacted>"
+)
+
+const (
+	tokenReviewerJWTField    = "token_reviewer_jwt"
+	tokenReviewerJWTSetField = "token_reviewer_jwt_set"
+)
+
+var (
+	// auth config fields that are not stored in snapshots
+	redactedConfigFields = []string{tokenReviewerJWTField}
+	// auth config fields returned by vault that cannot be written, true token_reviewer_jwt_set means that the redacted
+	// token reviewer jwt has to be re-supplied on restore
+	readOnlyConfigFields = []string{tokenReviewerJWTSetField}
+
+	// snapshot is not taken, because auth is not mounted, there are no roles or config to lose
+	ErrNotMounted = errors.New("auth is not mounted")
+)
+
+type VaultClient interface {
+	ReadAuthTune() (map[string]interface{}, error)
+	ReadAuthKubernetesConfigData() (map[string]interface{}, error)
+	ListRoles() ([]string, error)
+	ReadRoleData(name string) (map[string]interface{}, error)
+	MountAuthKubernetes() (bool, error)
+	TuneAuth(tune map[string]interface{}) error
+	WriteAuthConfigData(data map[string]interface{}) error
+	WriteRoleData(name string, data map[string]interface{}) error
+}
+
+// stored snapshots, names are returned sorted from the oldest
+type Store interface {
+	Save(snapshot Snapshot) error
+	List() ([]string, error)
+	Load(name string) (Snapshot, error)
+	Delete(name string) error
+}
+
+// vault auth kubernetes mount at a point in time, tune, config and roles are stored as returned by vault
+type Snapshot struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Mount     string    `json:"mount"`
+	// why was the snapshot taken, e.g. backup command or roles that were about to be deleted
+	Reason string                            `json:"reason"`
+	Tune   map[string]interface{}            `json:"tune"`
+	Config map[string]interface{}            `json:"config"`
+	Roles  map[string]map[string]interface{} `json:"roles"`
+}
+
+// role names in snapshot, sorted
+func (s Snapshot) RoleNames() []string {
+
+	var names []string
+	for name := range s.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type Backup struct {
+	vaultClient VaultClient
+	store       Store
+	mount       string
+	// number of snapshots kept in store, the oldest snapshots are deleted, all snapshots are kept if 0
+	keep int
+	now  func() time.Time
+}
+
+func NewBackup(vaultClient VaultClient, store Store, mount string, keep int) Backup {
+
+	return Backup{
+		vaultClient: vaultClient,
+		store:       store,
+		mount:       mount,
+		keep:        keep,
+		now:         time.Now,
+	}
+}
+
+// take snapshot of the auth mount and save it to store, the oldest snapshots over retention limit are deleted
+func (b Backup) Snapshot(reason string) (Snapshot, error) {
+
+	createdAt := b.now().UTC()
+	snapshot := Snapshot{
+		Version:   Version,
+		Name:      createdAt.Format(nameLayout),
+		CreatedAt: createdAt,
+		Mount:     b.mount,
+		Reason:    reason,
+		Roles:     make(map[string]map[string]interface{}),
+	}
+
+	var err error
+	if snapshot.Tune, err = b.vaultClient.ReadAuthTune(); err != nil {
+		return Snapshot{}, fmt.Errorf("read auth tune: %w", err)
+	}
+	if snapshot.Tune == nil {
+		return Snapshot{}, fmt.Errorf("%s: %w", b.mount, ErrNotMounted)
+	}
+	if snapshot.Config, err = b.vaultClient.ReadAuthKubernetesConfigData(); err != nil {
+		return Snapshot{}, fmt.Errorf("read auth config: %w", err)
+	}
+	for _, field := range redactedConfigFields {
+		if _, ok := snapshot.Config[field]; ok {
+			snapshot.Config[field] = redacted
+		}
+	}
+
+	roleNames, err := b.vaultClient.ListRoles()
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("list roles: %w", err)
+	}
+	for _, roleName := range roleNames {
+		data, err := b.vaultClient.ReadRoleData(roleName)
+		if err != nil {
+			return Snapshot{}, fmt.Errorf("read role %s: %w", roleName, err)
+		}
+		if data != nil {
+			snapshot.Roles[roleName] = data
+		}
+	}
+
+	if err := b.store.Save(snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("save snapshot %s: %w", snapshot.Name, err)
+	}
+	logger.Logf("snapshot %s of %s auth with %d roles saved: %s", snapshot.Name, b.mount, len(snapshot.Roles), reason)
+	if err := b.prune(); err != nil {
+		logger.Errorf("delete old snapshots: %v", err)
+	}
+	return snapshot, nil
+}
+
+// mount auth (if it is missing), tune it, write auth config and all snapshot roles, roles that are not in snapshot are
+// left as they are, token reviewer jwt is not in snapshot, it is re-supplied by tokenReviewerJWT (required if snapshot
+// config had it), latest snapshot is restored if name is empty
+func (b Backup) Restore(name string, tokenReviewerJWT []byte) (Snapshot, error) {
+
+	snapshot, err := b.load(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if snapshot.Version > Version {
+		return Snapshot{}, fmt.Errorf("snapshot %s version %d is newer than supported version %d", snapshot.Name, snapshot.Version, Version)
+	}
+	if snapshot.Mount != b.mount {
+		return Snapshot{}, fmt.Errorf("snapshot %s is of %s auth, not %s", snapshot.Name, snapshot.Mount, b.mount)
+	}
+
+	config, err := restoredConfig(snapshot.Config, tokenReviewerJWT)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s: %w", snapshot.Name, err)
+	}
+
+	mounted, err := b.vaultClient.MountAuthKubernetes()
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("mount auth: %w", err)
+	}
+	if mounted {
+		logger.Logf("%s auth was not mounted, it has been mounted", b.mount)
+	}
+	if len(snapshot.Tune) != 0 {
+		if err := b.vaultClient.TuneAuth(snapshot.Tune); err != nil {
+			return Snapshot{}, fmt.Errorf("tune auth: %w", err)
+		}
+	}
+	if len(config) != 0 {
+		if err := b.vaultClient.WriteAuthConfigData(config); err != nil {
+			return Snapshot{}, fmt.Errorf("write auth config: %w", err)
+		}
+	}
+
+	var errs []error
+	for _, roleName := range snapshot.RoleNames() {
+		if err := b.vaultClient.WriteRoleData(roleName, snapshot.Roles[roleName]); err != nil {
+			errs = append(errs, fmt.Errorf("write role %s: %w", roleName, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Snapshot{}, err
+	}
+	logger.Logf("snapshot %s of %s auth with %d roles restored", snapshot.Name, b.mount, len(snapshot.Roles))
+	return snapshot, nil
+}
+
+// snapshot auth config without redacted and read only fields, token reviewer jwt is set if it is not empty, error is
+// returned if snapshot config had token reviewer jwt and it is not supplied
+func restoredConfig(snapshotConfig map[string]interface{}, tokenReviewerJWT []byte) (map[string]interface{}, error) {
+
+	if len(snapshotConfig) == 0 {
+		return nil, nil
+	}
+
+	_, redactedJWT := snapshotConfig[tokenReviewerJWTField]
+	jwtSet, _ := snapshotConfig[tokenReviewerJWTSetField].(bool)
+	if (redactedJWT || jwtSet) && len(tokenReviewerJWT) == 0 {
+		return nil, errors.New("auth config has token reviewer jwt that is not in snapshot and it is not supplied")
+	}
+
+	config := make(map[string]interface{})
+	for k, v := range snapshotConfig {
+		config[k] = v
+	}
+	for _, field := range append(redactedConfigFields, readOnlyConfigFields...) {
+		delete(config, field)
+	}
+	if len(tokenReviewerJWT) != 0 {
+		config[tokenReviewerJWTField] = string(tokenReviewerJWT)
+	}
+	return config, nil
+}
+
+// snapshot by name, or the latest snapshot if name is empty
+func (b Backup) load(name string) (Snapshot, error) {
+
+	if name != "" {
+		return b.store.Load(name)
+	}
+	names, err := b.store.List()
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("list snapshots: %w", err)
+	}
+	if len(names) == 0 {
+		return Snapshot{}, errors.New("no snapshots found")
+	}
+	return b.store.Load(names[len(names)-1])
+}
+
+func (b Backup) prune() error {
+
+	if b.keep <= 0 {
+		return nil
+	}
+	names, err := b.store.List()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(names)-b.keep; i++ {
+		if err := b.store.Delete(names[i]); err != nil {
+			return err
+		}
+		logger.Logf("snapshot %s deleted, retention is %d snapshots", names[i], b.keep)
+	}
+	return nil
+}
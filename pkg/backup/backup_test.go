@@ -0,0 +1,262 @@
+package backup
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+const testMount = "kubernetes/test-account/test-cluster"
+
+func TestBackup_Snapshot(t *testing.T) {
+
+	newVaultClient := func() *VaultClientMock {
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ReadAuthTune").Return(map[string]interface{}{"description": "test"}, nil)
+		vaultClient.On("ReadAuthKubernetesConfigData").Return(map[string]interface{}{"kubernetes_host": "https://kube", "token_reviewer_jwt": "jwt"}, nil)
+		vaultClient.On("ListRoles").Return([]string{"app", "deleted"}, nil)
+		vaultClient.On("ReadRoleData", "app").Return(map[string]interface{}{"token_policies": []interface{}{"app"}}, nil)
+		vaultClient.On("ReadRoleData", "deleted").Return(nil, nil)
+		return vaultClient
+	}
+
+	t.Run("when snapshot is taken then tune, redacted config and roles are saved", func(t *testing.T) {
+
+		store := NewFileStore(t.TempDir())
+		b := NewBackup(newVaultClient(), store, testMount, 10)
+		b.now = func() time.Time { return time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC) }
+
+		snapshot, err := b.Snapshot("backup command")
+		require.NoError(t, err)
+		assert.Equal(t, "20261018-123000.000", snapshot.Name)
+
+		loaded, err := store.Load(snapshot.Name)
+		require.NoError(t, err)
+		assert.Equal(t, Version, loaded.Version)
+		assert.Equal(t, testMount, loaded.Mount)
+		assert.Equal(t, "backup command", loaded.Reason)
+		assert.Equal(t, map[string]interface{}{"description": "test"}, loaded.Tune)
+		assert.Equal(t, map[string]interface{}{"kubernetes_host": "https://kube", "token_reviewer_jwt": "<redacted>"}, loaded.Config)
+		assert.Equal(t, map[string]map[string]interface{}{"app": {"token_policies": []interface{}{"app"}}}, loaded.Roles)
+	})
+
+	t.Run("when there are more snapshots than retention then the oldest are deleted", func(t *testing.T) {
+
+		store := NewFileStore(t.TempDir())
+		b := NewBackup(newVaultClient(), store, testMount, 2)
+		now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+		for i := 0; i < 3; i++ {
+			b.now = func() time.Time { return now.Add(time.Duration(i) * time.Second) }
+			_, err := b.Snapshot("backup command")
+			require.NoError(t, err)
+		}
+
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"20261018-123001.000", "20261018-123002.000"}, names)
+	})
+
+	t.Run("when auth is not mounted then snapshot is not saved and not mounted error is returned", func(t *testing.T) {
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ReadAuthTune").Return(nil, nil)
+		store := NewFileStore(t.TempDir())
+
+		_, err := NewBackup(vaultClient, store, testMount, 10).Snapshot("backup command")
+		require.ErrorIs(t, err, ErrNotMounted)
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Empty(t, names)
+		vaultClient.AssertNotCalled(t, "ListRoles")
+	})
+
+	t.Run("when roles cannot be read then snapshot is not saved", func(t *testing.T) {
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("ReadAuthTune").Return(map[string]interface{}{"description": "test"}, nil)
+		vaultClient.On("ReadAuthKubernetesConfigData").Return(nil, nil)
+		vaultClient.On("ListRoles").Return(nil, errors.New("permission denied"))
+		store := NewFileStore(t.TempDir())
+
+		_, err := NewBackup(vaultClient, store, testMount, 10).Snapshot("backup command")
+		require.Error(t, err)
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+}
+
+func TestBackup_Restore(t *testing.T) {
+
+	snapshot := func(name, mount string, version int) Snapshot {
+
+		return Snapshot{
+			Version: version,
+			Name:    name,
+			Mount:   mount,
+			Tune:    map[string]interface{}{"description": "test"},
+			Roles: map[string]map[string]interface{}{
+				"app":    {"token_policies": []interface{}{"app"}},
+				"worker": {"token_policies": []interface{}{"worker"}},
+			},
+		}
+	}
+
+	t.Run("when snapshot name is not set then the latest snapshot is restored", func(t *testing.T) {
+
+		store := NewFileStore(t.TempDir())
+		require.NoError(t, store.Save(snapshot("20261018-120000.000", testMount, Version)))
+		latest := snapshot("20261018-130000.000", testMount, Version)
+		delete(latest.Roles, "worker")
+		require.NoError(t, store.Save(latest))
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("MountAuthKubernetes").Return(false, nil)
+		vaultClient.On("TuneAuth", map[string]interface{}{"description": "test"}).Return(nil)
+		vaultClient.On("WriteRoleData", "app", map[string]interface{}{"token_policies": []interface{}{"app"}}).Return(nil)
+
+		restored, err := NewBackup(vaultClient, store, testMount, 10).Restore("", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "20261018-130000.000", restored.Name)
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when snapshot has auth config then config is restored with supplied token reviewer jwt", func(t *testing.T) {
+
+		store := NewFileStore(t.TempDir())
+		withConfig := snapshot("20261018-120000.000", testMount, Version)
+		withConfig.Config = map[string]interface{}{"kubernetes_host": "https://kube", "token_reviewer_jwt": "<redacted>", "token_reviewer_jwt_set": true}
+		require.NoError(t, store.Save(withConfig))
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("MountAuthKubernetes").Return(true, nil)
+		vaultClient.On("TuneAuth", mock.Anything).Return(nil)
+		vaultClient.On("WriteAuthConfigData", map[string]interface{}{"kubernetes_host": "https://kube", "token_reviewer_jwt": "jwt"}).Return(nil)
+		vaultClient.On("WriteRoleData", mock.Anything, mock.Anything).Return(nil)
+
+		_, err := NewBackup(vaultClient, store, testMount, 10).Restore("", []byte("jwt"))
+		require.NoError(t, err)
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when snapshot config had token reviewer jwt and it is not supplied then nothing is restored", func(t *testing.T) {
+
+		store := NewFileStore(t.TempDir())
+		withConfig := snapshot("20261018-120000.000", testMount, Version)
+		withConfig.Config = map[string]interface{}{"kubernetes_host": "https://kube", "token_reviewer_jwt_set": true}
+		require.NoError(t, store.Save(withConfig))
+		vaultClient := new(VaultClientMock)
+
+		_, err := NewBackup(vaultClient, store, testMount, 10).Restore("", nil)
+		require.Error(t, err)
+		vaultClient.AssertNotCalled(t, "MountAuthKubernetes")
+	})
+
+	t.Run("when role write fails then other roles are restored and error is returned", func(t *testing.T) {
+
+		store := NewFileStore(t.TempDir())
+		require.NoError(t, store.Save(snapshot("20261018-120000.000", testMount, Version)))
+
+		vaultClient := new(VaultClientMock)
+		vaultClient.On("MountAuthKubernetes").Return(true, nil)
+		vaultClient.On("TuneAuth", mock.Anything).Return(nil)
+		vaultClient.On("WriteRoleData", "app", mock.Anything).Return(errors.New("bad request"))
+		vaultClient.On("WriteRoleData", "worker", mock.Anything).Return(nil)
+
+		_, err := NewBackup(vaultClient, store, testMount, 10).Restore("20261018-120000.000", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "write role app")
+		vaultClient.AssertExpectations(t)
+	})
+
+	t.Run("when snapshot is of another mount or newer version then it is not restored", func(t *testing.T) {
+
+		store := NewFileStore(t.TempDir())
+		require.NoError(t, store.Save(snapshot("20261018-120000.000", "kubernetes/other", Version)))
+		require.NoError(t, store.Save(snapshot("20261018-130000.000", testMount, Version+1)))
+		vaultClient := new(VaultClientMock)
+		b := NewBackup(vaultClient, store, testMount, 10)
+
+		_, err := b.Restore("20261018-120000.000", nil)
+		require.Error(t, err)
+		_, err = b.Restore("20261018-130000.000", nil)
+		require.Error(t, err)
+		vaultClient.AssertNotCalled(t, "MountAuthKubernetes")
+	})
+
+	t.Run("when there are no snapshots then error is returned", func(t *testing.T) {
+
+		_, err := NewBackup(new(VaultClientMock), NewFileStore(t.TempDir()), testMount, 10).Restore("", nil)
+		require.Error(t, err)
+	})
+}
+
+// --- mocks ---
+
+type VaultClientMock struct {
+	mock.Mock
+}
+
+func (m *VaultClientMock) ReadAuthTune() (map[string]interface{}, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]interface{}), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadAuthKubernetesConfigData() (map[string]interface{}, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]interface{}), args.Error(1)
+}
+
+func (m *VaultClientMock) ListRoles() ([]string, error) {
+
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *VaultClientMock) ReadRoleData(name string) (map[string]interface{}, error) {
+
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]interface{}), args.Error(1)
+}
+
+func (m *VaultClientMock) MountAuthKubernetes() (bool, error) {
+
+	args := m.Called()
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *VaultClientMock) TuneAuth(tune map[string]interface{}) error {
+
+	args := m.Called(tune)
+	return args.Error(0)
+}
+
+func (m *VaultClientMock) WriteAuthConfigData(data map[string]interface{}) error {
+
+	args := m.Called(data)
+	return args.Error(0)
+}
+
+func (m *VaultClientMock) WriteRoleData(name string, data map[string]interface{}) error {
+
+	args := m.Called(name, data)
+	return args.Error(0)
+}
@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	StoreFile   = "file"
+	StoreSecret = "secret"
+
+	fileExtension = ".json"
+
+	secretNamePrefix = "vak-backup-"
+	secretLabel      = "vak-backup"
+	secretDataKey    = "snapshot.json"
+)
+
+// snapshots as json files named by snapshot name in directory
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) FileStore {
+	return FileStore{dir: dir}
+}
+
+func (f FileStore) Save(snapshot Snapshot) error {
+
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(f.path(snapshot.Name), b, 0600)
+}
+
+func (f FileStore) List() ([]string, error) {
+
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), fileExtension) {
+			names = append(names, strings.TrimSuffix(entry.Name(), fileExtension))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f FileStore) Load(name string) (Snapshot, error) {
+
+	b, err := os.ReadFile(f.path(name))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return unmarshalSnapshot(name, b)
+}
+
+func (f FileStore) Delete(name string) error {
+	return os.Remove(f.path(name))
+}
+
+func (f FileStore) path(name string) string {
+	return filepath.Join(f.dir, name+fileExtension)
+}
+
+type SecretsClient interface {
+	CreateSecret(secret k8s.Secret) error
+	GetSecret(namespace, name string) (k8s.Secret, error)
+	GetSecrets(namespace, labelSelector string) ([]k8s.Secret, error)
+	DeleteSecret(namespace, name string) error
+}
+
+// snapshots as kubernetes secrets (labelled 'vak-backup=true') named 'vak-backup-<snapshot name>', secret size is
+// limited to 1MB
+type SecretStore struct {
+	client    SecretsClient
+	namespace string
+}
+
+func NewSecretStore(client SecretsClient, namespace string) SecretStore {
+	return SecretStore{client: client, namespace: namespace}
+}
+
+func (s SecretStore) Save(snapshot Snapshot) error {
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.client.CreateSecret(k8s.Secret{
+		Namespace: s.namespace,
+		Name:      secretNamePrefix + snapshot.Name,
+		Labels:    map[string]string{secretLabel: "true"},
+		Data:      map[string][]byte{secretDataKey: b},
+	})
+}
+
+func (s SecretStore) List() ([]string, error) {
+
+	secrets, err := s.client.GetSecrets(s.namespace, secretLabel+"=true")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, secret := range secrets {
+		names = append(names, strings.TrimPrefix(secret.Name, secretNamePrefix))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s SecretStore) Load(name string) (Snapshot, error) {
+
+	secret, err := s.client.GetSecret(s.namespace, secretNamePrefix+name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	b, ok := secret.Data[secretDataKey]
+	if !ok {
+		return Snapshot{}, fmt.Errorf("secret %s does not have %s key", secret.Name, secretDataKey)
+	}
+	return unmarshalSnapshot(name, b)
+}
+
+func (s SecretStore) Delete(name string) error {
+	return s.client.DeleteSecret(s.namespace, secretNamePrefix+name)
+}
+
+func unmarshalSnapshot(name string, b []byte) (Snapshot, error) {
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return Snapshot{}, fmt.Errorf("unmarshal snapshot %s: %w", name, err)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"github.com/pete911/vault-auth-kubernetes/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+
+	t.Run("when directory does not exist then no snapshots are listed and save creates it", func(t *testing.T) {
+
+		store := NewFileStore(filepath.Join(t.TempDir(), "backup"))
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Empty(t, names)
+
+		require.NoError(t, store.Save(Snapshot{Version: Version, Name: "20261018-120000.000", Mount: testMount}))
+		names, err = store.List()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"20261018-120000.000"}, names)
+	})
+
+	t.Run("when directory has other files then only snapshots are listed", func(t *testing.T) {
+
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), nil, 0600))
+		store := NewFileStore(dir)
+		require.NoError(t, store.Save(Snapshot{Name: "20261018-130000.000"}))
+		require.NoError(t, store.Save(Snapshot{Name: "20261018-120000.000"}))
+
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"20261018-120000.000", "20261018-130000.000"}, names)
+
+		require.NoError(t, store.Delete("20261018-120000.000"))
+		_, err = store.Load("20261018-120000.000")
+		require.Error(t, err)
+	})
+}
+
+func TestSecretStore(t *testing.T) {
+
+	t.Run("when snapshot is saved then it is stored in labelled secret", func(t *testing.T) {
+
+		store := NewSecretStore(k8s.NewClient(fake.NewSimpleClientset()), "vault-auth")
+		snapshot := Snapshot{
+			Version: Version,
+			Name:    "20261018-120000.000",
+			Mount:   testMount,
+			Roles:   map[string]map[string]interface{}{"app": {"token_policies": []interface{}{"app"}}},
+		}
+		require.NoError(t, store.Save(snapshot))
+
+		names, err := store.List()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"20261018-120000.000"}, names)
+
+		loaded, err := store.Load("20261018-120000.000")
+		require.NoError(t, err)
+		assert.Equal(t, snapshot.Roles, loaded.Roles)
+
+		require.NoError(t, store.Delete("20261018-120000.000"))
+		names, err = store.List()
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+}
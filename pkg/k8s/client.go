@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/pete911/vault-auth-kubernetes/logger"
+	authentication "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
 	apiRBAC "k8s.io/api/rbac/v1"
 	apiErrors "k8s.io/apimachinery/pkg/api/errors"
@@ -32,6 +33,7 @@ type serviceAccountInterface interface {
 	Delete(ctx context.Context, name string, opts meta.DeleteOptions) error
 	Get(ctx context.Context, name string, opts meta.GetOptions) (*v1.ServiceAccount, error)
 	List(ctx context.Context, opts meta.ListOptions) (*v1.ServiceAccountList, error)
+	CreateToken(ctx context.Context, name string, tokenRequest *authentication.TokenRequest, opts meta.CreateOptions) (*authentication.TokenRequest, error)
 }
 
 type serviceAccountsGetter interface {
@@ -39,7 +41,10 @@ type serviceAccountsGetter interface {
 }
 
 type secretsInterface interface {
+	Create(ctx context.Context, secret *v1.Secret, opts meta.CreateOptions) (*v1.Secret, error)
+	Delete(ctx context.Context, name string, opts meta.DeleteOptions) error
 	Get(ctx context.Context, name string, opts meta.GetOptions) (*v1.Secret, error)
+	List(ctx context.Context, opts meta.ListOptions) (*v1.SecretList, error)
 }
 
 type secretsGetter interface {
@@ -48,12 +53,22 @@ type secretsGetter interface {
 
 type configMapsInterface interface {
 	Get(ctx context.Context, name string, opts meta.GetOptions) (*v1.ConfigMap, error)
+	List(ctx context.Context, opts meta.ListOptions) (*v1.ConfigMapList, error)
+	Update(ctx context.Context, configMap *v1.ConfigMap, opts meta.UpdateOptions) (*v1.ConfigMap, error)
 }
 
 type configMapsGetter interface {
 	ConfigMaps(namespace string) configMapsInterface
 }
 
+type eventsInterface interface {
+	Create(ctx context.Context, event *v1.Event, opts meta.CreateOptions) (*v1.Event, error)
+}
+
+type eventsGetter interface {
+	Events(namespace string) eventsInterface
+}
+
 // --- ------------------------------------------------------- ---
 
 type serviceAccounts struct {
@@ -80,25 +95,69 @@ func (c configMaps) ConfigMaps(namespace string) configMapsInterface {
 	return c.getter.ConfigMaps(namespace)
 }
 
+type events struct {
+	getter core.EventsGetter
+}
+
+func (e events) Events(namespace string) eventsInterface {
+	return e.getter.Events(namespace)
+}
+
 // --- ------------------------------------------------------- ---
 
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// called after mutation of kubernetes object, target is '<resource>/<namespace>/<name>' ('<resource>/<name>' for
+// cluster objects), before and after are objects (nil if object did not exist), err is error of the mutation, events
+// and service account tokens are not audited
+type AuditFunc func(target, action string, before, after interface{}, err error)
+
 type Client struct {
 	namespace             namespaceInterface
 	serviceAccountsGetter serviceAccountsGetter
 	secretsGetter         secretsGetter
 	configMapsGetter      configMapsGetter
+	eventsGetter          eventsGetter
 	clusterRoleBinding    clusterRoleBindingInterface
+	raw                   rawInterface
+	// called after every mutation, mutations are not audited if nil
+	audit AuditFunc
 }
 
-func NewClient(clientSet *kubernetes.Clientset) Client {
+func NewClient(clientSet kubernetes.Interface) Client {
 
 	return Client{
 		namespace:             clientSet.CoreV1().Namespaces(),
 		serviceAccountsGetter: serviceAccounts{getter: clientSet.CoreV1()},
 		secretsGetter:         secrets{getter: clientSet.CoreV1()},
 		configMapsGetter:      configMaps{getter: clientSet.CoreV1()},
+		eventsGetter:          events{getter: clientSet.CoreV1()},
 		clusterRoleBinding:    clientSet.RbacV1().ClusterRoleBindings(),
+		raw:                   raw{client: clientSet.Discovery().RESTClient()},
+	}
+}
+
+// copy of client with mutations audited by audit func
+func (c Client) WithAudit(audit AuditFunc) Client {
+
+	c.audit = audit
+	return c
+}
+
+func (c Client) record(target, action string, before, after interface{}, err error) {
+
+	if c.audit == nil {
+		return
+	}
+	// object returned by failed mutation is not the object state
+	if err != nil {
+		after = nil
 	}
+	c.audit(target, action, before, after, err)
 }
 
 func (c Client) GetNamespaces() ([]string, error) {
@@ -115,63 +174,339 @@ func (c Client) GetNamespaces() ([]string, error) {
 	return namespaces, nil
 }
 
-func (c Client) GetConfigMapData(namespace, name string) (map[string]string, error) {
+// namespace name with labels and annotations, used when metadata is needed e.g. to render role templates
+type Namespace struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+func (c Client) GetNamespacesMeta() ([]Namespace, error) {
+
+	namespaceList, err := c.namespace.List(context.Background(), meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []Namespace
+	for _, namespace := range namespaceList.Items {
+		namespaces = append(namespaces, Namespace{
+			Name:        namespace.Name,
+			Labels:      namespace.Labels,
+			Annotations: namespace.Annotations,
+		})
+	}
+	return namespaces, nil
+}
+
+type ConfigMap struct {
+	Namespace       string
+	Name            string
+	UID             string
+	ResourceVersion string
+	// field manager of the latest managed fields entry, e.g. kubectl-edit or helm, it is name of the client, not user
+	Manager     string
+	Annotations map[string]string
+	Data        map[string]string
+}
+
+func (c Client) GetConfigMap(namespace, name string) (ConfigMap, error) {
 
 	cm, err := c.configMapsGetter.ConfigMaps(namespace).Get(context.Background(), name, meta.GetOptions{})
 	if err != nil || cm == nil {
+		return ConfigMap{}, err
+	}
+	return newConfigMap(cm), nil
+}
+
+// get config maps in all namespaces matching label selector e.g. 'vak-roles=true'
+func (c Client) GetConfigMaps(labelSelector string) ([]ConfigMap, error) {
+
+	configMapList, err := c.configMapsGetter.ConfigMaps("").List(context.Background(), meta.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
 		return nil, err
 	}
-	return cm.Data, nil
+
+	var configMaps []ConfigMap
+	for _, cm := range configMapList.Items {
+		configMaps = append(configMaps, newConfigMap(&cm))
+	}
+	return configMaps, nil
+}
+
+// set value of one config map key, update fails with conflict error if config map was changed since it was read
+func (c Client) UpdateConfigMapData(namespace, name, key, value string) error {
+
+	cm, err := c.configMapsGetter.ConfigMaps(namespace).Get(context.Background(), name, meta.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		return fmt.Errorf("config map %s in %s namespace not found", name, namespace)
+	}
+
+	updated := cm.DeepCopy()
+	if updated.Data == nil {
+		updated.Data = make(map[string]string)
+	}
+	updated.Data[key] = value
+	updated, err = c.configMapsGetter.ConfigMaps(namespace).Update(context.Background(), updated, meta.UpdateOptions{})
+	c.record(configMapTarget(namespace, name), auditUpdate, cm, updated, err)
+	if err != nil {
+		return err
+	}
+	logger.Logf("config map %s in %s namespace updated, key %s", name, namespace, key)
+	return nil
+}
+
+// set value of one config map annotation, update fails with conflict error if config map was changed since it was read
+func (c Client) UpdateConfigMapAnnotation(namespace, name, key, value string) error {
+
+	cm, err := c.configMapsGetter.ConfigMaps(namespace).Get(context.Background(), name, meta.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		return fmt.Errorf("config map %s in %s namespace not found", name, namespace)
+	}
+
+	updated := cm.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	updated.Annotations[key] = value
+	updated, err = c.configMapsGetter.ConfigMaps(namespace).Update(context.Background(), updated, meta.UpdateOptions{})
+	c.record(configMapTarget(namespace, name), auditUpdate, cm, updated, err)
+	if err != nil {
+		return err
+	}
+	logger.Logf("config map %s in %s namespace updated, annotation %s", name, namespace, key)
+	return nil
+}
+
+func configMapTarget(namespace, name string) string {
+	return fmt.Sprintf("configmaps/%s/%s", namespace, name)
+}
+
+func newConfigMap(cm *v1.ConfigMap) ConfigMap {
+
+	return ConfigMap{
+		Namespace:       cm.Namespace,
+		Name:            cm.Name,
+		UID:             string(cm.UID),
+		ResourceVersion: cm.ResourceVersion,
+		Manager:         latestManager(cm.ManagedFields),
+		Annotations:     cm.Annotations,
+		Data:            cm.Data,
+	}
+}
+
+// manager of the latest managed fields entry, entries without time are older than entries with time
+func latestManager(managedFields []meta.ManagedFieldsEntry) string {
+
+	var manager string
+	var latest time.Time
+	for _, entry := range managedFields {
+		if manager == "" || (entry.Time != nil && !entry.Time.Time.Before(latest)) {
+			manager = entry.Manager
+			if entry.Time != nil {
+				latest = entry.Time.Time
+			}
+		}
+	}
+	return manager
+}
+
+type Secret struct {
+	Namespace string
+	Name      string
+	Labels    map[string]string
+	Data      map[string][]byte
+}
+
+func (c Client) CreateSecret(secret Secret) error {
+
+	s := &v1.Secret{
+		ObjectMeta: meta.ObjectMeta{Namespace: secret.Namespace, Name: secret.Name, Labels: secret.Labels},
+		Data:       secret.Data,
+	}
+	created, err := c.secretsGetter.Secrets(secret.Namespace).Create(context.Background(), s, meta.CreateOptions{})
+	c.record(secretTarget(secret.Namespace, secret.Name), auditCreate, nil, created, err)
+	if err != nil {
+		return err
+	}
+	logger.Logf("secret %s in %s namespace created", secret.Name, secret.Namespace)
+	return nil
+}
+
+func (c Client) GetSecret(namespace, name string) (Secret, error) {
+
+	s, err := c.secretsGetter.Secrets(namespace).Get(context.Background(), name, meta.GetOptions{})
+	if err != nil || s == nil {
+		return Secret{}, err
+	}
+	return newSecret(s), nil
+}
+
+// get secrets in namespace matching label selector e.g. 'vak-backup=true'
+func (c Client) GetSecrets(namespace, labelSelector string) ([]Secret, error) {
+
+	secretList, err := c.secretsGetter.Secrets(namespace).List(context.Background(), meta.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Secret
+	for _, s := range secretList.Items {
+		out = append(out, newSecret(&s))
+	}
+	return out, nil
+}
+
+func (c Client) DeleteSecret(namespace, name string) error {
+
+	var existing *v1.Secret
+	if c.audit != nil {
+		existing, _ = c.secretsGetter.Secrets(namespace).Get(context.Background(), name, meta.GetOptions{})
+	}
+	if err := c.secretsGetter.Secrets(namespace).Delete(context.Background(), name, meta.DeleteOptions{}); err != nil {
+		if apiErrors.IsNotFound(err) {
+			return nil
+		}
+		c.record(secretTarget(namespace, name), auditDelete, existing, nil, err)
+		return err
+	}
+	c.record(secretTarget(namespace, name), auditDelete, existing, nil, nil)
+	logger.Logf("secret %s in %s namespace deleted", name, namespace)
+	return nil
+}
+
+func secretTarget(namespace, name string) string {
+	return fmt.Sprintf("secrets/%s/%s", namespace, name)
+}
+
+func newSecret(s *v1.Secret) Secret {
+
+	return Secret{
+		Namespace: s.Namespace,
+		Name:      s.Name,
+		Labels:    s.Labels,
+		Data:      s.Data,
+	}
+}
+
+// event reported on kubernetes object, e.g. invalid role in config map
+type Event struct {
+	Kind      string
+	Namespace string
+	Name      string
+	UID       string
+	Type      string
+	Reason    string
+	Message   string
+}
+
+func (c Client) CreateEvent(event Event) error {
+
+	e := newEvent(event, time.Now())
+	if _, err := c.eventsGetter.Events(event.Namespace).Create(context.Background(), e, meta.CreateOptions{}); err != nil {
+		return err
+	}
+	logger.Logf("%s event %s created for %s %s in %s namespace", event.Type, event.Reason, event.Kind, event.Name, event.Namespace)
+	return nil
 }
 
 func (c Client) GetServiceAccounts(namespace string, annotations map[string]string) ([]string, error) {
 
-	serviceAccountsList, err := c.serviceAccountsGetter.ServiceAccounts(namespace).List(context.Background(), meta.ListOptions{})
+	serviceAccounts, err := c.listServiceAccounts(namespace, annotations)
 	if err != nil {
 		return nil, err
 	}
 
 	var serviceAccountNames []string
+	for _, serviceAccount := range serviceAccounts {
+		serviceAccountNames = append(serviceAccountNames, serviceAccount.Name)
+	}
+	return serviceAccountNames, nil
+}
+
+// service account uids by service account name, uid changes when service account is created again
+func (c Client) GetServiceAccountUIDs(namespace string, annotations map[string]string) (map[string]string, error) {
+
+	serviceAccounts, err := c.listServiceAccounts(namespace, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make(map[string]string)
+	for _, serviceAccount := range serviceAccounts {
+		uids[serviceAccount.Name] = string(serviceAccount.UID)
+	}
+	return uids, nil
+}
+
+// service accounts that have any of the annotations, or all service accounts if annotations are empty
+func (c Client) listServiceAccounts(namespace string, annotations map[string]string) ([]v1.ServiceAccount, error) {
+
+	serviceAccountsList, err := c.serviceAccountsGetter.ServiceAccounts(namespace).List(context.Background(), meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var serviceAccounts []v1.ServiceAccount
 	for _, serviceAccount := range serviceAccountsList.Items {
 		if len(annotations) == 0 {
-			serviceAccountNames = append(serviceAccountNames, serviceAccount.Name)
+			serviceAccounts = append(serviceAccounts, serviceAccount)
 			continue
 		}
 		for serviceAccountAnnotationKey, serviceAccountAnnotationValue := range serviceAccount.Annotations {
 			if annotations[serviceAccountAnnotationKey] != serviceAccountAnnotationValue {
 				continue
 			}
-			serviceAccountNames = append(serviceAccountNames, serviceAccount.Name)
+			serviceAccounts = append(serviceAccounts, serviceAccount)
 		}
 	}
-	return serviceAccountNames, nil
+	return serviceAccounts, nil
 }
 
 func (c Client) CreateServiceAccount(namespace, name string, annotations map[string]string) error {
 
 	serviceAccount := newServiceAccount(namespace, name, annotations)
-	if _, err := c.serviceAccountsGetter.ServiceAccounts(namespace).Create(context.Background(), serviceAccount, meta.CreateOptions{}); err != nil {
+	created, err := c.serviceAccountsGetter.ServiceAccounts(namespace).Create(context.Background(), serviceAccount, meta.CreateOptions{})
+	if err != nil {
 		if apiErrors.IsAlreadyExists(err) {
 			return nil
 		}
+		c.record(serviceAccountTarget(namespace, name), auditCreate, nil, nil, err)
 		return err
 	}
+	c.record(serviceAccountTarget(namespace, name), auditCreate, nil, created, nil)
 	logger.Logf("service account %s in %s namespace created", name, namespace)
 	return nil
 }
 
 func (c Client) DeleteServiceAccount(namespace, name string) error {
 
+	var existing *v1.ServiceAccount
+	if c.audit != nil {
+		existing, _ = c.serviceAccountsGetter.ServiceAccounts(namespace).Get(context.Background(), name, meta.GetOptions{})
+	}
 	if err := c.serviceAccountsGetter.ServiceAccounts(namespace).Delete(context.Background(), name, meta.DeleteOptions{}); err != nil {
 		if apiErrors.IsNotFound(err) {
 			return nil
 		}
+		c.record(serviceAccountTarget(namespace, name), auditDelete, existing, nil, err)
 		return err
 	}
+	c.record(serviceAccountTarget(namespace, name), auditDelete, existing, nil, nil)
 	logger.Logf("service account %s in %s namespace deleted", name, namespace)
 	return nil
 }
 
+func serviceAccountTarget(namespace, name string) string {
+	return fmt.Sprintf("serviceaccounts/%s/%s", namespace, name)
+}
+
 func (c Client) GetServiceAccountToken(serviceAccountNamespace, serviceAccountName string) ([]byte, error) {
 
 	serviceAccount, err := c.getServiceAccount(serviceAccountNamespace, serviceAccountName, 5)
@@ -193,6 +528,22 @@ func (c Client) GetServiceAccountToken(serviceAccountNamespace, serviceAccountNa
 	return nil, fmt.Errorf("%s secret does not have data.token field", secret.Name)
 }
 
+// short-lived service account token (TokenRequest API), token has API server audience if audiences are not set
+func (c Client) CreateServiceAccountToken(namespace, name string, audiences []string, expirationSeconds int64) ([]byte, error) {
+
+	tokenRequest := &authentication.TokenRequest{
+		Spec: authentication.TokenRequestSpec{Audiences: audiences, ExpirationSeconds: &expirationSeconds},
+	}
+	tokenRequest, err := c.serviceAccountsGetter.ServiceAccounts(namespace).CreateToken(context.Background(), name, tokenRequest, meta.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if tokenRequest == nil || tokenRequest.Status.Token == "" {
+		return nil, fmt.Errorf("token request for service account %s in %s namespace did not return token", name, namespace)
+	}
+	return []byte(tokenRequest.Status.Token), nil
+}
+
 // secret/token is not set initially on new service account, it takes some time for kubernetes to create it
 // it is advisable to set retries to 2 or higher to make sure that secrets are populated
 func (c Client) getServiceAccount(namespace, name string, retries int) (*v1.ServiceAccount, error) {
@@ -218,6 +569,13 @@ func (c Client) CreateAuthDelegatorClusterRoleBinding(bindingName, serviceAccoun
 	return c.createClusterRoleBinding(clusterRoleBinding)
 }
 
+// bind cluster role to service account, binding is updated if it differs (e.g. cluster role changed)
+func (c Client) CreateClusterRoleBinding(bindingName, clusterRole, serviceAccountNamespace, serviceAccountName string) error {
+
+	clusterRoleBinding := newClusterRoleBinding(bindingName, clusterRole, serviceAccountNamespace, serviceAccountName)
+	return c.createClusterRoleBinding(clusterRoleBinding)
+}
+
 func (c Client) createClusterRoleBinding(clusterRoleBinding *apiRBAC.ClusterRoleBinding) error {
 
 	existingClusterRoleBinding, err := c.clusterRoleBinding.Get(context.Background(), clusterRoleBinding.Name, meta.GetOptions{})
@@ -225,7 +583,8 @@ func (c Client) createClusterRoleBinding(clusterRoleBinding *apiRBAC.ClusterRole
 		if apiErrors.IsNotFound(err) {
 			// new role binding
 			logger.Logf("creating new %s cluster role binding", clusterRoleBinding.Name)
-			_, err = c.clusterRoleBinding.Create(context.Background(), clusterRoleBinding, meta.CreateOptions{})
+			created, err := c.clusterRoleBinding.Create(context.Background(), clusterRoleBinding, meta.CreateOptions{})
+			c.record(clusterRoleBindingTarget(clusterRoleBinding.Name), auditCreate, nil, created, err)
 			return err
 		}
 		return err
@@ -236,10 +595,15 @@ func (c Client) createClusterRoleBinding(clusterRoleBinding *apiRBAC.ClusterRole
 	}
 
 	logger.Logf("updating role binding %s", existingClusterRoleBinding.Name)
-	_, err = c.clusterRoleBinding.Update(context.Background(), clusterRoleBinding, meta.UpdateOptions{})
+	updated, err := c.clusterRoleBinding.Update(context.Background(), clusterRoleBinding, meta.UpdateOptions{})
+	c.record(clusterRoleBindingTarget(clusterRoleBinding.Name), auditUpdate, existingClusterRoleBinding, updated, err)
 	return err
 }
 
+func clusterRoleBindingTarget(name string) string {
+	return fmt.Sprintf("clusterrolebindings/%s", name)
+}
+
 func isClusterRoleBindingEqual(rb1, rb2 *apiRBAC.ClusterRoleBinding) bool {
 
 	equalMeta := rb1.Name == rb2.Name
@@ -2,15 +2,27 @@ package k8s
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	authentication "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
 	apiRBAC "k8s.io/api/rbac/v1"
 	apiErrors "k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"math/big"
+	"reflect"
 	"testing"
+	"time"
 )
 
 var serviceAccountAnnotations = map[string]string{"vak-managed": "true"}
@@ -44,6 +56,42 @@ func TestClient_GetNamespaces(t *testing.T) {
 	})
 }
 
+func TestClient_GetNamespacesMeta(t *testing.T) {
+
+	t.Run("when get namespaces request is successful then namespaces with labels and annotations are returned", func(t *testing.T) {
+
+		namespaceMock := new(NamespaceMock)
+		namespaceMock.On("List", context.Background(), mock.Anything, mock.Anything).Return(&v1.NamespaceList{Items: []v1.Namespace{
+			{ObjectMeta: meta.ObjectMeta{Name: "default"}},
+			{ObjectMeta: meta.ObjectMeta{
+				Name:        "payments",
+				Labels:      map[string]string{"team": "payments"},
+				Annotations: map[string]string{"owner": "payments@example.com"},
+			}},
+		}}, nil)
+		c := Client{namespace: namespaceMock}
+
+		namespaces, err := c.GetNamespacesMeta()
+		require.NoError(t, err)
+
+		expected := []Namespace{
+			{Name: "default"},
+			{Name: "payments", Labels: map[string]string{"team": "payments"}, Annotations: map[string]string{"owner": "payments@example.com"}},
+		}
+		assert.Equal(t, expected, namespaces)
+	})
+
+	t.Run("when get namespaces request fails then error is returned", func(t *testing.T) {
+
+		namespaceMock := new(NamespaceMock)
+		namespaceMock.On("List", context.Background(), mock.Anything, mock.Anything).Return(nil, errors.New("test failure"))
+		c := Client{namespace: namespaceMock}
+
+		_, err := c.GetNamespacesMeta()
+		require.Error(t, err)
+	})
+}
+
 func TestClient_GetConfigMap(t *testing.T) {
 
 	t.Run("when returned config map is nil then no error is returned", func(t *testing.T) {
@@ -52,9 +100,9 @@ func TestClient_GetConfigMap(t *testing.T) {
 		configMapMock.On("Get", context.Background(), "vault-auth-roles", meta.GetOptions{}).Return(nil, nil)
 		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
 
-		cm, err := c.GetConfigMapData("kube-system", "vault-auth-roles")
+		cm, err := c.GetConfigMap("kube-system", "vault-auth-roles")
 		require.NoError(t, err)
-		assert.Nil(t, cm)
+		assert.Nil(t, cm.Data)
 	})
 
 	t.Run("when get config map fails then error is returned", func(t *testing.T) {
@@ -63,13 +111,20 @@ func TestClient_GetConfigMap(t *testing.T) {
 		configMapMock.On("Get", context.Background(), "vault-auth-roles", meta.GetOptions{}).Return(nil, errors.New("test failuer"))
 		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
 
-		_, err := c.GetConfigMapData("kube-system", "vault-auth-roles")
+		_, err := c.GetConfigMap("kube-system", "vault-auth-roles")
 		require.Error(t, err)
 	})
 
 	t.Run("when get config map is successful then no error is returned", func(t *testing.T) {
 
 		expectedConfigMap := &v1.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{
+				Namespace:       "kube-system",
+				Name:            "vault-auth-roles",
+				UID:             "abc",
+				ResourceVersion: "7",
+				ManagedFields:   []meta.ManagedFieldsEntry{{Manager: "helm"}},
+			},
 			Data: map[string]string{
 				"test-role": `{"bound_service_account_names": ["default"], "bound_service_account_namespaces": ["*"], "token_policies": ["test"]}`,
 			},
@@ -78,9 +133,174 @@ func TestClient_GetConfigMap(t *testing.T) {
 		configMapMock.On("Get", context.Background(), "vault-auth-roles", meta.GetOptions{}).Return(expectedConfigMap, nil)
 		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
 
-		actualConfigMapData, err := c.GetConfigMapData("kube-system", "vault-auth-roles")
+		actualConfigMap, err := c.GetConfigMap("kube-system", "vault-auth-roles")
 		require.NoError(t, err)
-		assert.Equal(t, expectedConfigMap.Data, actualConfigMapData)
+		expected := ConfigMap{Namespace: "kube-system", Name: "vault-auth-roles", UID: "abc", ResourceVersion: "7", Manager: "helm", Data: expectedConfigMap.Data}
+		assert.Equal(t, expected, actualConfigMap)
+	})
+}
+
+func TestClient_GetConfigMaps(t *testing.T) {
+
+	t.Run("when get config maps is successful then config maps from all namespaces are returned", func(t *testing.T) {
+
+		configMapList := &v1.ConfigMapList{Items: []v1.ConfigMap{
+			{ObjectMeta: meta.ObjectMeta{Namespace: "payments", Name: "vault-roles", UID: "abc"}, Data: map[string]string{"app": "{}"}},
+			{ObjectMeta: meta.ObjectMeta{Namespace: "orders", Name: "vault-roles", UID: "def"}},
+		}}
+		configMapMock := new(ConfigMapsMock)
+		configMapMock.On("List", context.Background(), meta.ListOptions{LabelSelector: "vak-roles=true"}).Return(configMapList, nil)
+		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
+
+		configMaps, err := c.GetConfigMaps("vak-roles=true")
+		require.NoError(t, err)
+
+		expected := []ConfigMap{
+			{Namespace: "payments", Name: "vault-roles", UID: "abc", Data: map[string]string{"app": "{}"}},
+			{Namespace: "orders", Name: "vault-roles", UID: "def"},
+		}
+		assert.Equal(t, expected, configMaps)
+	})
+
+	t.Run("when get config maps fails then error is returned", func(t *testing.T) {
+
+		configMapMock := new(ConfigMapsMock)
+		configMapMock.On("List", context.Background(), meta.ListOptions{LabelSelector: "vak-roles=true"}).Return(nil, errors.New("test failure"))
+		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
+
+		_, err := c.GetConfigMaps("vak-roles=true")
+		require.Error(t, err)
+	})
+}
+
+func TestClient_UpdateConfigMapData(t *testing.T) {
+
+	t.Run("when config map key is updated then other keys are kept", func(t *testing.T) {
+
+		configMap := &v1.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{Namespace: "vault-auth", Name: "vault-auth-roles", ResourceVersion: "7"},
+			Data:       map[string]string{"app": `{"token_policies": ["app"]}`, "worker": `{"token_policies": ["worker"]}`},
+		}
+		expected := configMap.DeepCopy()
+		expected.Data["app"] = `{"token_policies": ["admin"]}`
+
+		configMapMock := new(ConfigMapsMock)
+		configMapMock.On("Get", context.Background(), "vault-auth-roles", meta.GetOptions{}).Return(configMap, nil)
+		configMapMock.On("Update", context.Background(), expected, meta.UpdateOptions{}).Return(expected, nil).Once()
+		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
+
+		err := c.UpdateConfigMapData("vault-auth", "vault-auth-roles", "app", `{"token_policies": ["admin"]}`)
+		require.NoError(t, err)
+		configMapMock.AssertExpectations(t)
+		assert.Equal(t, `{"token_policies": ["app"]}`, configMap.Data["app"])
+	})
+
+	t.Run("when update fails then error is returned", func(t *testing.T) {
+
+		configMapMock := new(ConfigMapsMock)
+		configMapMock.On("Get", context.Background(), "vault-auth-roles", meta.GetOptions{}).Return(&v1.ConfigMap{}, nil)
+		configMapMock.On("Update", context.Background(), mock.Anything, meta.UpdateOptions{}).Return(nil, errors.New("conflict"))
+		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
+
+		err := c.UpdateConfigMapData("vault-auth", "vault-auth-roles", "app", "{}")
+		require.Error(t, err)
+	})
+}
+
+func TestClient_UpdateConfigMapAnnotation(t *testing.T) {
+
+	t.Run("when config map annotation is updated then data and other annotations are kept", func(t *testing.T) {
+
+		configMap := &v1.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{Namespace: "vault-auth", Name: "vault-auth-roles", Annotations: map[string]string{"owner": "platform"}},
+			Data:       map[string]string{"app": `{"token_policies": ["app"]}`},
+		}
+		expected := configMap.DeepCopy()
+		expected.Annotations["status"] = "passed"
+
+		configMapMock := new(ConfigMapsMock)
+		configMapMock.On("Get", context.Background(), "vault-auth-roles", meta.GetOptions{}).Return(configMap, nil)
+		configMapMock.On("Update", context.Background(), expected, meta.UpdateOptions{}).Return(expected, nil).Once()
+		c := Client{configMapsGetter: &ConfigMapsGetterMock{getter: configMapMock}}
+
+		require.NoError(t, c.UpdateConfigMapAnnotation("vault-auth", "vault-auth-roles", "status", "passed"))
+		configMapMock.AssertExpectations(t)
+		assert.NotContains(t, configMap.Annotations, "status")
+	})
+}
+
+func TestClient_Secrets(t *testing.T) {
+
+	t.Run("when secret is created then it has labels and data", func(t *testing.T) {
+
+		secretsMock := new(SecretsMock)
+		secretsMock.On("Create", context.Background(), mock.MatchedBy(func(s *v1.Secret) bool {
+			return s.Namespace == "vault-auth" && s.Name == "backup" && s.Labels["vak-backup"] == "true" && string(s.Data["snapshot.json"]) == "{}"
+		}), meta.CreateOptions{}).Return(&v1.Secret{}, nil)
+		c := Client{secretsGetter: SecretsGetterMock{getter: secretsMock}}
+
+		err := c.CreateSecret(Secret{Namespace: "vault-auth", Name: "backup", Labels: map[string]string{"vak-backup": "true"}, Data: map[string][]byte{"snapshot.json": []byte("{}")}})
+		require.NoError(t, err)
+		secretsMock.AssertExpectations(t)
+	})
+
+	t.Run("when secrets are listed by label selector then secrets are returned", func(t *testing.T) {
+
+		secretsMock := new(SecretsMock)
+		secretsMock.On("List", context.Background(), meta.ListOptions{LabelSelector: "vak-backup=true"}).Return(&v1.SecretList{Items: []v1.Secret{
+			{ObjectMeta: meta.ObjectMeta{Namespace: "vault-auth", Name: "backup"}, Data: map[string][]byte{"snapshot.json": []byte("{}")}},
+		}}, nil)
+		c := Client{secretsGetter: SecretsGetterMock{getter: secretsMock}}
+
+		secrets, err := c.GetSecrets("vault-auth", "vak-backup=true")
+		require.NoError(t, err)
+		assert.Equal(t, []Secret{{Namespace: "vault-auth", Name: "backup", Data: map[string][]byte{"snapshot.json": []byte("{}")}}}, secrets)
+	})
+
+	t.Run("when deleted secret does not exist then no error is returned", func(t *testing.T) {
+
+		secretsMock := new(SecretsMock)
+		returnErr := &apiErrors.StatusError{ErrStatus: meta.Status{Status: "Failure", Message: `secrets "backup" not found`, Reason: "NotFound", Code: 404}}
+		secretsMock.On("Delete", context.Background(), "backup", meta.DeleteOptions{}).Return(returnErr)
+		c := Client{secretsGetter: SecretsGetterMock{getter: secretsMock}}
+
+		require.NoError(t, c.DeleteSecret("vault-auth", "backup"))
+	})
+}
+
+func TestClient_CreateEvent(t *testing.T) {
+
+	event := Event{
+		Kind:      "ConfigMap",
+		Namespace: "payments",
+		Name:      "vault-roles",
+		UID:       "abc",
+		Type:      EventTypeWarning,
+		Reason:    "InvalidRole",
+		Message:   "test message",
+	}
+
+	t.Run("when event is created then it references involved object and no error is returned", func(t *testing.T) {
+
+		eventsMock := new(EventsMock)
+		eventsMock.On("Create", context.Background(), mock.MatchedBy(func(e *v1.Event) bool {
+			return e.Namespace == "payments" && e.InvolvedObject.Name == "vault-roles" && e.InvolvedObject.Kind == "ConfigMap" &&
+				string(e.InvolvedObject.UID) == "abc" && e.Reason == "InvalidRole" && e.Message == "test message" && e.Type == EventTypeWarning
+		}), mock.Anything).Return(nil, nil)
+		c := Client{eventsGetter: EventsGetterMock{getter: eventsMock}}
+
+		require.NoError(t, c.CreateEvent(event))
+		eventsMock.AssertExpectations(t)
+	})
+
+	t.Run("when event creation fails then error is returned", func(t *testing.T) {
+
+		eventsMock := new(EventsMock)
+		eventsMock.On("Create", context.Background(), mock.Anything, mock.Anything).Return(nil, errors.New("test failure"))
+		c := Client{eventsGetter: EventsGetterMock{getter: eventsMock}}
+
+		require.Error(t, c.CreateEvent(event))
+		eventsMock.AssertExpectations(t)
 	})
 }
 
@@ -132,6 +352,25 @@ func TestClient_GetServiceAccounts(t *testing.T) {
 	})
 }
 
+func TestClient_GetServiceAccountUIDs(t *testing.T) {
+
+	t.Run("when get service account uids is requested with annotations then uids of annotated service accounts are returned", func(t *testing.T) {
+
+		annotations := map[string]string{"vak-managed": "true"}
+		serviceAccounts := &v1.ServiceAccountList{Items: []v1.ServiceAccount{
+			{ObjectMeta: meta.ObjectMeta{Name: "default", UID: "abc"}},
+			{ObjectMeta: meta.ObjectMeta{Name: "vault", UID: "def", Annotations: annotations}},
+		}}
+		serviceAccountMock := new(ServiceAccountMock)
+		serviceAccountMock.On("List", context.Background(), meta.ListOptions{}).Return(serviceAccounts, nil)
+		c := Client{serviceAccountsGetter: &ServiceAccountsGetterMock{getter: serviceAccountMock}}
+
+		uids, err := c.GetServiceAccountUIDs("default", annotations)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"vault": "def"}, uids)
+	})
+}
+
 func TestClient_CreateServiceAccount(t *testing.T) {
 
 	t.Run("when service account is created in non existing namespace then error is returned", func(t *testing.T) {
@@ -213,6 +452,34 @@ func TestClient_DeleteServiceAccount(t *testing.T) {
 	})
 }
 
+func TestClient_CreateServiceAccountToken(t *testing.T) {
+
+	t.Run("when token is requested then token with audiences and expiration is returned", func(t *testing.T) {
+
+		expiration := int64(600)
+		expected := &authentication.TokenRequest{Spec: authentication.TokenRequestSpec{Audiences: []string{"vault"}, ExpirationSeconds: &expiration}}
+		serviceAccountMock := new(ServiceAccountMock)
+		serviceAccountMock.On("CreateToken", context.Background(), "app", expected, meta.CreateOptions{}).
+			Return(&authentication.TokenRequest{Status: authentication.TokenRequestStatus{Token: "app-jwt"}}, nil)
+		c := Client{serviceAccountsGetter: ServiceAccountsGetterMock{getter: serviceAccountMock}}
+
+		token, err := c.CreateServiceAccountToken("payments", "app", []string{"vault"}, 600)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("app-jwt"), token)
+		serviceAccountMock.AssertExpectations(t)
+	})
+
+	t.Run("when token request does not return token then error is returned", func(t *testing.T) {
+
+		serviceAccountMock := new(ServiceAccountMock)
+		serviceAccountMock.On("CreateToken", context.Background(), "app", mock.Anything, meta.CreateOptions{}).Return(&authentication.TokenRequest{}, nil)
+		c := Client{serviceAccountsGetter: ServiceAccountsGetterMock{getter: serviceAccountMock}}
+
+		_, err := c.CreateServiceAccountToken("payments", "app", nil, 600)
+		require.Error(t, err)
+	})
+}
+
 func TestClient_GetServiceAccountToken(t *testing.T) {
 
 	t.Run("when service account has references to existing token then token and no error is returned", func(t *testing.T) {
@@ -376,8 +643,85 @@ func TestClient_CreateAuthDelegatorClusterRoleBinding(t *testing.T) {
 	})
 }
 
+func TestClient_CreateClusterRoleBinding(t *testing.T) {
+
+	t.Run("when cluster role binding does not exist then role binding to the cluster role is created", func(t *testing.T) {
+
+		clusterRoleBindingMock := new(ClusterRoleBindingMock)
+		expectedRoleBinding := newClusterRoleBinding("vault-auth-secrets-engine", "vault-secrets-engine", "vault-auth", "secrets-engine")
+		returnErr := &apiErrors.StatusError{ErrStatus: meta.Status{Status: "Failure", Message: `clusterrolebinding "vault-auth-secrets-engine" not found`, Reason: "NotFound", Code: 404}}
+		clusterRoleBindingMock.On("Get", context.Background(), "vault-auth-secrets-engine", mock.Anything).Return(nil, returnErr)
+		clusterRoleBindingMock.On("Create", context.Background(), expectedRoleBinding, mock.Anything).Return(nil, nil)
+		c := Client{clusterRoleBinding: clusterRoleBindingMock}
+
+		err := c.CreateClusterRoleBinding("vault-auth-secrets-engine", "vault-secrets-engine", "vault-auth", "secrets-engine")
+		require.NoError(t, err)
+		assert.Equal(t, "vault-secrets-engine", expectedRoleBinding.RoleRef.Name)
+		clusterRoleBindingMock.AssertExpectations(t)
+	})
+}
+
+func TestClient_GetServiceAccountIssuer(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig", "n": "%s", "e": "%s"}]}`, n, e)
+
+	t.Run("when API server returns issuer and jwks then issuer and PEM keys are returned", func(t *testing.T) {
+
+		rawMock := new(RawMock)
+		rawMock.On("GetRaw", mock.Anything, "/.well-known/openid-configuration").Return([]byte(`{"issuer": "https://kubernetes.default.svc", "jwks_uri": "https://10.0.0.1:443/openid/v1/jwks"}`), nil)
+		rawMock.On("GetRaw", mock.Anything, "/openid/v1/jwks").Return([]byte(jwks), nil)
+		c := Client{raw: rawMock}
+
+		issuer, err := c.GetServiceAccountIssuer()
+		require.NoError(t, err)
+		assert.Equal(t, "https://kubernetes.default.svc", issuer.Issuer)
+		require.Len(t, issuer.Keys, 1)
+
+		block, _ := pem.Decode([]byte(issuer.Keys[0]))
+		require.NotNil(t, block)
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+		assert.True(t, key.PublicKey.Equal(publicKey))
+	})
+
+	t.Run("when API server returns error then error is returned", func(t *testing.T) {
+
+		rawMock := new(RawMock)
+		rawMock.On("GetRaw", mock.Anything, "/.well-known/openid-configuration").Return(nil, errors.New("forbidden"))
+		c := Client{raw: rawMock}
+
+		_, err := c.GetServiceAccountIssuer()
+		require.Error(t, err)
+	})
+
+	t.Run("when jwks has unsupported key type then error is returned", func(t *testing.T) {
+
+		_, err := JWKSToPEM([]byte(`{"keys": [{"kty": "oct", "kid": "test", "k": "c2VjcmV0"}]}`))
+		require.Error(t, err)
+	})
+}
+
 // --- mocks ---
 
+type RawMock struct {
+	mock.Mock
+}
+
+func (m *RawMock) GetRaw(ctx context.Context, path string) ([]byte, error) {
+
+	args := m.Called(ctx, path)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+// --- ---
+
 type ClusterRoleBindingMock struct {
 	mock.Mock
 }
@@ -448,13 +792,46 @@ func (m *ServiceAccountMock) List(ctx context.Context, options meta.ListOptions)
 	return args.Get(0).(*v1.ServiceAccountList), args.Error(1)
 }
 
+func (m *ServiceAccountMock) CreateToken(ctx context.Context, name string, tokenRequest *authentication.TokenRequest, options meta.CreateOptions) (*authentication.TokenRequest, error) {
+
+	args := m.Called(ctx, name, tokenRequest, options)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*authentication.TokenRequest), args.Error(1)
+}
+
 // --- ---
 
 type SecretsMock struct {
 	mock.Mock
 }
 
-func (m SecretsMock) Get(ctx context.Context, name string, options meta.GetOptions) (*v1.Secret, error) {
+func (m *SecretsMock) Create(ctx context.Context, secret *v1.Secret, options meta.CreateOptions) (*v1.Secret, error) {
+
+	args := m.Called(ctx, secret, options)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*v1.Secret), args.Error(1)
+}
+
+func (m *SecretsMock) Delete(ctx context.Context, name string, options meta.DeleteOptions) error {
+
+	args := m.Called(ctx, name, options)
+	return args.Error(0)
+}
+
+func (m *SecretsMock) List(ctx context.Context, options meta.ListOptions) (*v1.SecretList, error) {
+
+	args := m.Called(ctx, options)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*v1.SecretList), args.Error(1)
+}
+
+func (m *SecretsMock) Get(ctx context.Context, name string, options meta.GetOptions) (*v1.Secret, error) {
 
 	args := m.Called(ctx, name, options)
 	if args.Get(0) == nil {
@@ -478,6 +855,39 @@ func (m ConfigMapsMock) Get(ctx context.Context, name string, options meta.GetOp
 	return args.Get(0).(*v1.ConfigMap), args.Error(1)
 }
 
+func (m *ConfigMapsMock) List(ctx context.Context, options meta.ListOptions) (*v1.ConfigMapList, error) {
+
+	args := m.Called(ctx, options)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*v1.ConfigMapList), args.Error(1)
+}
+
+func (m *ConfigMapsMock) Update(ctx context.Context, configMap *v1.ConfigMap, options meta.UpdateOptions) (*v1.ConfigMap, error) {
+
+	args := m.Called(ctx, configMap, options)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*v1.ConfigMap), args.Error(1)
+}
+
+// --- ---
+
+type EventsMock struct {
+	mock.Mock
+}
+
+func (m *EventsMock) Create(ctx context.Context, event *v1.Event, options meta.CreateOptions) (*v1.Event, error) {
+
+	args := m.Called(ctx, event, options)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*v1.Event), args.Error(1)
+}
+
 // --- ---
 
 type ServiceAccountsGetterMock struct {
@@ -510,6 +920,16 @@ func (c ConfigMapsGetterMock) ConfigMaps(namespace string) configMapsInterface {
 
 // --- ---
 
+type EventsGetterMock struct {
+	getter *EventsMock
+}
+
+func (e EventsGetterMock) Events(namespace string) eventsInterface {
+	return e.getter
+}
+
+// --- ---
+
 type NamespaceMock struct {
 	mock.Mock
 }
@@ -522,3 +942,90 @@ func (m NamespaceMock) List(ctx context.Context, opts meta.ListOptions) (*v1.Nam
 	}
 	return args.Get(0).(*v1.NamespaceList), args.Error(1)
 }
+
+func TestClient_WithAudit(t *testing.T) {
+
+	type mutation struct {
+		target string
+		action string
+		before bool
+		after  bool
+		err    error
+	}
+	newAuditedClient := func(objects ...runtime.Object) (Client, *[]mutation) {
+		var mutations []mutation
+		c := NewClient(fake.NewSimpleClientset(objects...)).WithAudit(func(target, action string, before, after interface{}, err error) {
+			mutations = append(mutations, mutation{target: target, action: action, before: !isNil(before), after: !isNil(after), err: err})
+		})
+		return c, &mutations
+	}
+
+	t.Run("when service account is created and deleted then both mutations are audited", func(t *testing.T) {
+
+		c, mutations := newAuditedClient()
+		require.NoError(t, c.CreateServiceAccount("payments", "app", serviceAccountAnnotations))
+		// already exists, nothing is created
+		require.NoError(t, c.CreateServiceAccount("payments", "app", serviceAccountAnnotations))
+		require.NoError(t, c.DeleteServiceAccount("payments", "app"))
+		// does not exist, nothing is deleted
+		require.NoError(t, c.DeleteServiceAccount("payments", "app"))
+
+		assert.Equal(t, []mutation{
+			{target: "serviceaccounts/payments/app", action: "create", after: true},
+			{target: "serviceaccounts/payments/app", action: "delete", before: true},
+		}, *mutations)
+	})
+
+	t.Run("when config map is updated then before and after are audited", func(t *testing.T) {
+
+		configMap := &v1.ConfigMap{ObjectMeta: meta.ObjectMeta{Namespace: "vault-auth", Name: "vault-auth-roles"}}
+		c, mutations := newAuditedClient(configMap)
+		require.NoError(t, c.UpdateConfigMapAnnotation("vault-auth", "vault-auth-roles", "status", "passed"))
+
+		assert.Equal(t, []mutation{{target: "configmaps/vault-auth/vault-auth-roles", action: "update", before: true, after: true}}, *mutations)
+	})
+
+	t.Run("when cluster role binding is not changed then it is not audited", func(t *testing.T) {
+
+		c, mutations := newAuditedClient()
+		require.NoError(t, c.CreateClusterRoleBinding("vault-secrets-engine", "vault-secrets-engine", "vault-auth", "secrets-engine"))
+		require.NoError(t, c.CreateClusterRoleBinding("vault-secrets-engine", "vault-secrets-engine", "vault-auth", "secrets-engine"))
+		require.NoError(t, c.CreateClusterRoleBinding("vault-secrets-engine", "edit", "vault-auth", "secrets-engine"))
+
+		assert.Equal(t, []mutation{
+			{target: "clusterrolebindings/vault-secrets-engine", action: "create", after: true},
+			{target: "clusterrolebindings/vault-secrets-engine", action: "update", before: true, after: true},
+		}, *mutations)
+	})
+
+	t.Run("when mutation fails then error is audited without after", func(t *testing.T) {
+
+		secret := &v1.Secret{ObjectMeta: meta.ObjectMeta{Namespace: "vault-auth", Name: "backup"}}
+		c, mutations := newAuditedClient(secret)
+		require.Error(t, c.CreateSecret(Secret{Namespace: "vault-auth", Name: "backup"}))
+
+		require.Len(t, *mutations, 1)
+		assert.Equal(t, "secrets/vault-auth/backup", (*mutations)[0].target)
+		assert.False(t, (*mutations)[0].after)
+		assert.Error(t, (*mutations)[0].err)
+	})
+}
+
+func TestLatestManager(t *testing.T) {
+
+	older := meta.NewTime(time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC))
+	newer := meta.NewTime(older.Add(time.Hour))
+
+	assert.Empty(t, latestManager(nil))
+	assert.Equal(t, "kubectl-edit", latestManager([]meta.ManagedFieldsEntry{
+		{Manager: "helm", Time: &older},
+		{Manager: "kubectl-edit", Time: &newer},
+		{Manager: "vault-auth-kubernetes"},
+	}))
+	assert.Equal(t, "kubectl-client-side-apply", latestManager([]meta.ManagedFieldsEntry{{Manager: "kubectl-client-side-apply"}}))
+}
+
+// audited objects are typed nil pointers when object does not exist
+func isNil(v interface{}) bool {
+	return v == nil || reflect.ValueOf(v).IsNil()
+}
@@ -0,0 +1,143 @@
+package k8s
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"k8s.io/client-go/rest"
+	"math/big"
+)
+
+const (
+	openIDConfigurationPath = "/.well-known/openid-configuration"
+	jwksPath                = "/openid/v1/jwks"
+)
+
+// service account issuer and public keys (PEM) that sign service account tokens
+type ServiceAccountIssuer struct {
+	Issuer string
+	Keys   []string
+}
+
+type rawInterface interface {
+	GetRaw(ctx context.Context, path string) ([]byte, error)
+}
+
+type raw struct {
+	client rest.Interface
+}
+
+func (r raw) GetRaw(ctx context.Context, path string) ([]byte, error) {
+
+	if r.client == nil {
+		return nil, errors.New("kubernetes client does not support raw requests")
+	}
+	return r.client.Get().AbsPath(path).DoRaw(ctx)
+}
+
+// service account issuer from API server discovery document and signing keys from API server JWKS converted to PEM
+func (c Client) GetServiceAccountIssuer() (ServiceAccountIssuer, error) {
+
+	b, err := c.raw.GetRaw(context.Background(), openIDConfigurationPath)
+	if err != nil {
+		return ServiceAccountIssuer{}, fmt.Errorf("get %s: %w", openIDConfigurationPath, err)
+	}
+	var configuration struct {
+		Issuer string `json:"issuer"`
+	}
+	if err := json.Unmarshal(b, &configuration); err != nil {
+		return ServiceAccountIssuer{}, fmt.Errorf("unmarshal %s: %w", openIDConfigurationPath, err)
+	}
+
+	if b, err = c.raw.GetRaw(context.Background(), jwksPath); err != nil {
+		return ServiceAccountIssuer{}, fmt.Errorf("get %s: %w", jwksPath, err)
+	}
+	keys, err := JWKSToPEM(b)
+	if err != nil {
+		return ServiceAccountIssuer{}, fmt.Errorf("%s: %w", jwksPath, err)
+	}
+	return ServiceAccountIssuer{Issuer: configuration.Issuer, Keys: keys}, nil
+}
+
+// RSA and EC keys of JSON web key set as PEM encoded public keys
+func JWKSToPEM(jwks []byte) ([]string, error) {
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &set); err != nil {
+		return nil, fmt.Errorf("unmarshal jwks: %w", err)
+	}
+
+	var keys []string
+	for _, key := range set.Keys {
+		var publicKey interface{}
+		switch key.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(key.N)
+			e, errE := base64.RawURLEncoding.DecodeString(key.E)
+			if err := errors.Join(errN, errE); err != nil {
+				return nil, fmt.Errorf("key %s: %w", key.Kid, err)
+			}
+			publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[key.Crv]
+			if !ok {
+				return nil, fmt.Errorf("key %s: unsupported curve %s", key.Kid, key.Crv)
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(key.X)
+			y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+			if err := errors.Join(errX, errY); err != nil {
+				return nil, fmt.Errorf("key %s: %w", key.Kid, err)
+			}
+			publicKey = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			return nil, fmt.Errorf("key %s: unsupported key type %s", key.Kid, key.Kty)
+		}
+
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", key.Kid, err)
+		}
+		keys = append(keys, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks does not have any keys")
+	}
+	return keys, nil
+}
+
+// PEM encoded public keys (e.g. content of service account signing key file), every key is returned as separate PEM
+func ParsePEMKeys(b []byte) ([]string, error) {
+
+	var keys []string
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+		keys = append(keys, string(pem.EncodeToMemory(block)))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM encoded public keys found")
+	}
+	return keys, nil
+}
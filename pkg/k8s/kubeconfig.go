@@ -9,17 +9,22 @@ import (
 )
 
 type Kubeconfig struct {
-	Host      string
-	CA        []byte
+	Host string
+	CA   []byte
+	// CA file, empty if CA is set as data in kubeconfig, in-cluster CA file is updated when cluster CA is rotated
+	CAFile    string
 	Clientset *kubernetes.Clientset
 }
 
-func LoadKubeconfig(kubeconfigPath string) (Kubeconfig, error) {
+// load kubeconfig, qps and burst limit requests to kubernetes API (client-go defaults are used if not set)
+func LoadKubeconfig(kubeconfigPath string, qps float32, burst int) (Kubeconfig, error) {
 
 	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
 	if err != nil {
 		return Kubeconfig{}, err
 	}
+	restConfig.QPS = qps
+	restConfig.Burst = burst
 
 	clientset, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
@@ -34,6 +39,7 @@ func LoadKubeconfig(kubeconfigPath string) (Kubeconfig, error) {
 	return Kubeconfig{
 		Host:      restConfig.Host,
 		CA:        ca,
+		CAFile:    restConfig.TLSClientConfig.CAFile,
 		Clientset: clientset,
 	}, nil
 }
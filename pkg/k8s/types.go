@@ -1,12 +1,26 @@
 package k8s
 
 import (
+	"fmt"
 	v1 "k8s.io/api/core/v1"
 	rbacV1 "k8s.io/api/rbac/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+const (
+	eventSourceComponent = "vault-auth-kubernetes"
+
+	EventTypeNormal  = v1.EventTypeNormal
+	EventTypeWarning = v1.EventTypeWarning
 )
 
 func newAuthDelegatorClusterRoleBinding(bindingName, serviceAccountNamespace, serviceAccountName string) *rbacV1.ClusterRoleBinding {
+	return newClusterRoleBinding(bindingName, "system:auth-delegator", serviceAccountNamespace, serviceAccountName)
+}
+
+func newClusterRoleBinding(bindingName, clusterRole, serviceAccountNamespace, serviceAccountName string) *rbacV1.ClusterRoleBinding {
 
 	return &rbacV1.ClusterRoleBinding{
 		TypeMeta: metaV1.TypeMeta{
@@ -19,7 +33,7 @@ func newAuthDelegatorClusterRoleBinding(bindingName, serviceAccountNamespace, se
 		RoleRef: rbacV1.RoleRef{
 			APIGroup: "rbac.authorization.k8s.io",
 			Kind:     "ClusterRole",
-			Name:     "system:auth-delegator",
+			Name:     clusterRole,
 		},
 		Subjects: []rbacV1.Subject{
 			{
@@ -45,3 +59,33 @@ func newServiceAccount(namespace, name string, annotations map[string]string) *v
 		},
 	}
 }
+
+func newEvent(event Event, now time.Time) *v1.Event {
+
+	timestamp := metaV1.NewTime(now)
+	return &v1.Event{
+		TypeMeta: metaV1.TypeMeta{
+			Kind:       "Event",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metaV1.ObjectMeta{
+			// same naming as kubernetes event recorder - <object-name>.<timestamp>
+			Name:      fmt.Sprintf("%s.%x", event.Name, now.UnixNano()),
+			Namespace: event.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       event.Kind,
+			APIVersion: "v1",
+			Namespace:  event.Namespace,
+			Name:       event.Name,
+			UID:        types.UID(event.UID),
+		},
+		Type:           event.Type,
+		Reason:         event.Reason,
+		Message:        event.Message,
+		Source:         v1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+	}
+}
@@ -0,0 +1,191 @@
+// Package metrics is minimal registry of counters and gauges exposed in prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType = "counter"
+	gaugeType   = "gauge"
+)
+
+// default registry, exposed by Handler
+var DefaultRegistry = NewRegistry()
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// metric family, values by label values joined with '\xff'
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]float64
+}
+
+type Counter struct {
+	registry *Registry
+	family   *family
+}
+
+type Gauge struct {
+	registry *Registry
+	family   *family
+}
+
+// new counter in default registry
+func NewCounter(name, help string, labels ...string) Counter {
+	return DefaultRegistry.NewCounter(name, help, labels...)
+}
+
+// new gauge in default registry
+func NewGauge(name, help string, labels ...string) Gauge {
+	return DefaultRegistry.NewGauge(name, help, labels...)
+}
+
+// prometheus text format handler of default registry
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) Counter {
+	return Counter{registry: r, family: r.register(name, help, counterType, labels)}
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) Gauge {
+	return Gauge{registry: r, family: r.register(name, help, gaugeType, labels)}
+}
+
+// metric registered twice (e.g. in tests) returns the existing family
+func (r *Registry) register(name, help, kind string, labels []string) *family {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	r.families[name] = f
+	return f
+}
+
+// increment counter, label values have to be in the same order as labels
+func (c Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c Counter) Add(v float64, labelValues ...string) {
+
+	c.registry.mu.Lock()
+	defer c.registry.mu.Unlock()
+	c.family.values[c.family.key(labelValues)] += v
+}
+
+func (g Gauge) Set(v float64, labelValues ...string) {
+
+	g.registry.mu.Lock()
+	defer g.registry.mu.Unlock()
+	g.family.values[g.family.key(labelValues)] = v
+}
+
+// set gauge to 1 if true, 0 otherwise
+func (g Gauge) SetBool(v bool, labelValues ...string) {
+
+	if v {
+		g.Set(1, labelValues...)
+		return
+	}
+	g.Set(0, labelValues...)
+}
+
+// remove all values, e.g. when label value (active vault host) changes
+func (g Gauge) Reset() {
+
+	g.registry.mu.Lock()
+	defer g.registry.mu.Unlock()
+	g.family.values = make(map[string]float64)
+}
+
+// value of counter or gauge, used in tests
+func (r *Registry) Value(name string, labelValues ...string) float64 {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		return 0
+	}
+	return f.values[f.key(labelValues)]
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// write metrics in prometheus text format, families and values are sorted
+func (r *Registry) Write(w io.Writer) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+			return err
+		}
+		var keys []string
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelPairs(key), strconv.FormatFloat(f.values[key], 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *family) key(labelValues []string) string {
+
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", f.name, f.labels, labelValues))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (f *family) labelPairs(key string) string {
+
+	if len(f.labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	var pairs []string
+	for i, label := range f.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
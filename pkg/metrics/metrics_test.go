@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+
+	t.Run("when counters and gauges are set then they are written in prometheus text format", func(t *testing.T) {
+
+		r := NewRegistry()
+		requests := r.NewCounter("test_requests_total", "Number of requests.", "code")
+		sealed := r.NewGauge("test_sealed", "Whether vault is sealed.")
+		requests.Inc("200")
+		requests.Inc("200")
+		requests.Add(3, "503")
+		sealed.SetBool(true)
+
+		var b bytes.Buffer
+		require.NoError(t, r.Write(&b))
+		expected := `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="503"} 3
+# HELP test_sealed Whether vault is sealed.
+# TYPE test_sealed gauge
+test_sealed 1
+`
+		assert.Equal(t, expected, b.String())
+		assert.Equal(t, float64(2), r.Value("test_requests_total", "200"))
+	})
+
+	t.Run("when metric is registered twice then existing metric is returned", func(t *testing.T) {
+
+		r := NewRegistry()
+		r.NewGauge("test_gauge", "Test gauge.").Set(5)
+		assert.Equal(t, float64(5), r.Value("test_gauge"))
+		r.NewGauge("test_gauge", "Test gauge.").Set(6)
+		assert.Equal(t, float64(6), r.Value("test_gauge"))
+	})
+
+	t.Run("when gauge is reset then previous label values are removed", func(t *testing.T) {
+
+		r := NewRegistry()
+		active := r.NewGauge("test_active", "Active host.", "host")
+		active.Set(1, "https://vault-0")
+		active.Reset()
+		active.Set(1, "https://vault-1")
+
+		assert.Equal(t, float64(0), r.Value("test_active", "https://vault-0"))
+		assert.Equal(t, float64(1), r.Value("test_active", "https://vault-1"))
+	})
+
+	t.Run("when registry is served over http then metrics are returned", func(t *testing.T) {
+
+		r := NewRegistry()
+		r.NewGauge("test_up", "Test up.").Set(1)
+
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Contains(t, res.Body.String(), "test_up 1\n")
+	})
+}
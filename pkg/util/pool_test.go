@@ -0,0 +1,53 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+
+	t.Run("when items are processed then fn is called for every item", func(t *testing.T) {
+
+		var mu sync.Mutex
+		var out []int
+		ForEach(3, []int{1, 2, 3, 4, 5}, func(i int) {
+			mu.Lock()
+			defer mu.Unlock()
+			out = append(out, i)
+		})
+		assert.ElementsMatch(t, []int{1, 2, 3, 4, 5}, out)
+	})
+
+	t.Run("when there are more items than workers then at most workers items are processed concurrently", func(t *testing.T) {
+
+		var running, maxRunning int32
+		ForEach(2, make([]int, 10), func(int) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+		assert.Equal(t, int32(2), maxRunning)
+	})
+
+	t.Run("when workers is not set then items are processed sequentially", func(t *testing.T) {
+
+		var out []string
+		ForEach(0, []string{"a", "b", "c"}, func(s string) { out = append(out, s) })
+		assert.Equal(t, []string{"a", "b", "c"}, out)
+	})
+
+	t.Run("when there are no items then fn is not called", func(t *testing.T) {
+
+		ForEach(5, nil, func(int) { t.Fail() })
+	})
+}
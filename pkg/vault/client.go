@@ -2,20 +2,37 @@ package vault
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"golang.org/x/time/rate"
 	"io"
 	"io/ioutil"
+	"math/rand/v2"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	vaultVersion        = "v1"
 	kubernetesMountType = "kubernetes"
 	httpNumberOfRetries = 3 // it is advisable to set this to 2 or higher, so token can be re-generated if it expires
+
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	// path was not read before write, so it is not known if it was created or updated
+	auditWrite = "write"
+
+	defaultMinBackoff = 250 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+	// longest Retry-After that is honoured, so misbehaving server or proxy cannot block reconcile loop
+	maxRetryAfter = time.Minute
 )
 
 type HttpClient interface {
@@ -25,22 +42,95 @@ type HttpClient interface {
 type Config struct {
 	HttpClient HttpClient
 	Host       string
-	RoleId     string
-	SecretId   string
+	// other nodes of HA vault cluster, active node is found by sys/health probe
+	Hosts    []string
+	RoleId   string
+	SecretId string
+	// exponential backoff (with jitter) between retries, NewClient sets defaults if not set
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// requests per second and burst, requests are not rate limited if QPS is not set
+	QPS   float64
+	Burst int
+	// auth mount settings, auth is tuned when it differs from the spec, DefaultMountSpec is used only to mount auth if
+	// not set
+	MountSpec *MountSpec
+	// kubernetes (default) or jwt auth method, roles are translated to jwt roles bound to JWTAudience (unless role has
+	// audience) when auth type is jwt
+	AuthType    string
+	JWTAudience string
+	// called after every write and delete, mutations are not audited if nil
+	Audit AuditFunc
 }
 
+// called after vault mutation, target is vault path, after is the request body, before is audit.Digested of the previous
+// request written to the path, nil if path did not exist or audit.Unknown, err is error of the mutation, logins are not
+// audited
+type AuditFunc func(target, action string, before, after interface{}, err error)
+
 type Client struct {
-	config Config
-	mount  string
-	token  string
+	config  Config
+	mount   string
+	token   string
+	limiter *rate.Limiter
+	// sleep between retries, time.Sleep if nil
+	sleep func(time.Duration)
+	// auth is tuned to mount spec only if it was set in config
+	mountSpec MountSpec
+	tuneMount bool
+
+	mu sync.Mutex
+	// active vault host and its last known health
+	host   string
+	health Health
+	// last logged mount spec difference that cannot be tuned
+	mountWarning string
+	// auth mount accessor, it changes when auth is mounted again
+	accessor string
+	// alias_name_source of auth config, empty until auth config is read
+	aliasNameSource string
+	// hash of service account JWT last written to kubernetes secrets engine config
+	secretsJWT string
+	// audit state, whether path existed when it was read last time and digest of the last request written to path (request
+	// is not kept, it can have tokens)
+	reads   map[string]bool
+	written map[string]string
 }
 
 func NewClient(config Config, authK8sMount string) (*Client, error) {
 
 	config.Host = strings.TrimSuffix(config.Host, "/")
+	if config.Host == "" && len(config.Hosts) != 0 {
+		config.Host, config.Hosts = config.Hosts[0], config.Hosts[1:]
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
 	c := &Client{
-		mount:  strings.Trim(authK8sMount, "/"),
-		config: config,
+		mount:     strings.Trim(authK8sMount, "/"),
+		config:    config,
+		mountSpec: DefaultMountSpec(),
+		reads:     make(map[string]bool),
+		written:   make(map[string]string),
+	}
+	if config.MountSpec != nil {
+		c.mountSpec, c.tuneMount = *config.MountSpec, true
+	}
+	if config.QPS > 0 {
+		c.limiter = rate.NewLimiter(rate.Limit(config.QPS), max(config.Burst, 1))
+	}
+	if httpClient, ok := config.HttpClient.(*http.Client); ok {
+		redirectClient := *httpClient
+		redirectClient.CheckRedirect = c.checkRedirect
+		c.config.HttpClient = &redirectClient
+	}
+	if hosts := c.hosts(); len(hosts) > 1 {
+		if _, err := c.CheckHealth(); err != nil {
+			logger.Errorf("vault health: %v", err)
+		}
 	}
 
 	if err := c.appRoleLogin(httpNumberOfRetries); err != nil {
@@ -50,28 +140,181 @@ func NewClient(config Config, authK8sMount string) (*Client, error) {
 }
 
 // initialise auth kubernetes, check if there is auth mount 'kubernetes/<account>/<cluster>', if not, mount and tune
-// kubeJWT arg is service account JWT used to github the TokenReview API to validate other JWTs during login
-func (c *Client) InitAuthKubernetes(kubernetesHost string, kubernetesCACert, tokenReviewerJWT []byte) error {
+// kubeJWT arg is service account JWT used to github the TokenReview API to validate other JWTs during login, auth is
+// re-configured when kubernetes host, CA or options in vault differ (e.g. CA or signing keys were rotated or vault lost
+// the config) and tuned when it differs from mount spec, mounted is true if auth was not mounted and it has been
+// mounted by this call (all roles in vault are gone)
+func (c *Client) InitAuthKubernetes(kubernetesHost string, kubernetesCACert, tokenReviewerJWT []byte, options AuthKubernetesOptions) (mounted bool, err error) {
 
-	logger.Logf("initialising %s kubernetes auth", c.mount)
-	mounted, err := c.isAuthKubernetesMounted()
+	mount, err := c.authKubernetesMount()
 	if err != nil {
-		return err
+		return false, err
 	}
-	if mounted {
-		logger.Log("kubernetes auth is already mounted")
-		return nil
+	if mounted = mount == nil; mounted {
+		logger.Logf("initialising %s kubernetes auth", c.mount)
+		if err := c.mountAuthKubernetes(); err != nil {
+			return false, err
+		}
+		// accessor is generated by vault when auth is mounted
+		if mount, err = c.authKubernetesMount(); err != nil {
+			return mounted, err
+		}
+	}
+	c.setAccessor(mount)
+	if c.tuneMount {
+		c.tuneAuthKubernetes(mount)
+	}
+
+	config, err := c.ReadAuthKubernetesConfig()
+	if err != nil {
+		return mounted, err
+	}
+	if config != nil {
+		c.setAliasNameSource(config.AliasNameSource)
+	}
+	if config != nil && config.KubernetesHost == kubernetesHost && config.KubernetesCACert == string(kubernetesCACert) && config.hasOptions(options) {
+		return mounted, nil
 	}
+	if config != nil {
+		warnPartialPEMKeys(config.PEMKeys, options.PEMKeys)
+	}
+	return mounted, c.configureAuthKubernetes(kubernetesHost, kubernetesCACert, tokenReviewerJWT, options)
+}
 
+// mount auth kubernetes if it is not mounted, mounted is true if auth has been mounted by this call
+func (c *Client) MountAuthKubernetes() (mounted bool, err error) {
+
+	mount, err := c.authKubernetesMount()
+	if err != nil || mount != nil {
+		return false, err
+	}
+	logger.Logf("initialising %s kubernetes auth", c.mount)
 	if err := c.mountAuthKubernetes(); err != nil {
-		return err
+		return false, err
+	}
+	return true, nil
+}
+
+// read auth mount tune (description, lease ttls, ...), nil tune and nil error is returned if auth is not mounted
+func (c *Client) ReadAuthTune() (map[string]interface{}, error) {
+
+	mount, err := c.authKubernetesMount()
+	if err != nil || mount == nil {
+		return nil, err
+	}
+	return c.readAuthTune()
+}
+
+func (c *Client) readAuthTune() (map[string]interface{}, error) {
+
+	path := fmt.Sprintf("sys/auth/%s/tune", c.mount)
+	response := &struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// tune auth when it differs from mount spec, errors are only logged, so auth config and roles are managed even if tune
+// is not allowed by vault policy
+func (c *Client) tuneAuthKubernetes(mount *authMount) {
+
+	if mount != nil && (mount.Local != c.mountSpec.Local || mount.SealWrap != c.mountSpec.SealWrap) {
+		c.warnMount(fmt.Sprintf("auth %s local (%t) or seal_wrap (%t) differs from mount spec, it can be changed only by mounting auth again",
+			c.mount, mount.Local, mount.SealWrap))
+	}
+
+	tune, err := c.readAuthTune()
+	if err != nil {
+		logger.Errorf("read auth %s tune: %v", c.mount, err)
+		return
 	}
+	diff := c.mountSpec.tuneDiff(tune)
+	if diff == nil {
+		return
+	}
+	logger.Logf("auth %s tune differs from mount spec: %v", c.mount, diff)
+	if err := c.TuneAuth(diff); err != nil {
+		logger.Errorf("tune auth %s: %v", c.mount, err)
+	}
+}
+
+// auth mount accessor (e.g. auth_kubernetes_1a2b3c4d) as of the last InitAuthKubernetes call, empty if auth was not
+// initialised
+func (c *Client) AuthAccessor() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accessor
+}
+
+func (c *Client) setAccessor(mount *authMount) {
+
+	if mount == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accessor != "" && c.accessor != mount.Accessor {
+		logger.Logf("auth %s accessor changed from %s to %s", c.mount, c.accessor, mount.Accessor)
+	}
+	c.accessor = mount.Accessor
+}
+
+// alias name source of auth config, entity alias name is service account uid for 'serviceaccount_uid' (vault default) and
+// '<namespace>/<name>' for 'serviceaccount_name'
+func (c *Client) AuthAliasNameSource() string {
 
-	if err := c.configureAuthKubernetes(kubernetesHost, kubernetesCACert, tokenReviewerJWT); err != nil {
+	if c.authType() == AuthTypeJWT {
+		return AliasNameSourceSubject
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aliasNameSource == "" {
+		return AliasNameSourceUID
+	}
+	return c.aliasNameSource
+}
+
+func (c *Client) setAliasNameSource(source string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aliasNameSource = source
+}
+
+// log mount warning only when it changes, so it is not logged on every reload
+func (c *Client) warnMount(warning string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mountWarning != warning {
+		logger.Error(warning)
+		c.mountWarning = warning
+	}
+}
+
+// tune auth mount, only fields present in tune are changed
+func (c *Client) TuneAuth(tune map[string]interface{}) error {
+
+	path := fmt.Sprintf("sys/auth/%s/tune", c.mount)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, tune)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	logger.Logf("tuning auth kubernetes: POST %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
 }
 
 func (c *Client) DeleteAuthKubernetes() error {
@@ -93,37 +336,37 @@ func (c *Client) DeleteAuthKubernetes() error {
 
 	logger.Logf("deleting auth kubernetes: DELETE %s", path)
 	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
-	return c.doJsonRequest(jsonRequest, nil, errorHandlers, httpNumberOfRetries)
+	return c.doJsonMutation(jsonRequest, errorHandlers)
 }
 
 func (c *Client) CreateRole(name string, role Role) error {
 
-	existingRole, err := c.readRole(name)
+	existingRole, err := c.ReadRole(name)
 	if err != nil {
 		return err
 	}
 	if existingRole != nil {
-		if role.Equal(*existingRole) {
+		diff := role.Diff(*existingRole)
+		if len(diff) == 0 {
 			return nil
 		}
-		logger.Logf("role %s has changed", name)
-		logger.Logf("old role: %+v", role)
+		logger.Logf("role %s has changed: %s", name, diff)
 	}
 
 	path := fmt.Sprintf("auth/%s/role/%s", c.mount, name)
-	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, role)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, c.roleRequest(role))
 	if err != nil {
 		return err
 	}
 
 	logger.Logf("creating role: POST %s %+v", path, role)
 	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
-	return c.doJsonRequest(jsonRequest, nil, errorHandlers, httpNumberOfRetries)
+	return c.doJsonMutation(jsonRequest, errorHandlers)
 }
 
 func (c *Client) DeleteRole(name string) error {
 
-	existingRole, err := c.readRole(name)
+	existingRole, err := c.ReadRole(name)
 	if err != nil || existingRole == nil {
 		return err
 	}
@@ -136,11 +379,20 @@ func (c *Client) DeleteRole(name string) error {
 
 	logger.Logf("deleting role: DELETE %s", path)
 	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
-	return c.doJsonRequest(jsonRequest, nil, errorHandlers, httpNumberOfRetries)
+	return c.doJsonMutation(jsonRequest, errorHandlers)
 }
 
-// read role, when 404 is returned from vault, nil role and nil error is returned
-func (c *Client) readRole(name string) (*Role, error) {
+// read role, when 404 is returned from vault, nil role and nil error is returned, jwt role is returned as kubernetes
+// role
+func (c *Client) ReadRole(name string) (*Role, error) {
+
+	if c.authType() == AuthTypeJWT {
+		data, err := c.ReadRoleData(name)
+		if err != nil {
+			return nil, err
+		}
+		return c.roleFromData(data)
+	}
 
 	path := fmt.Sprintf("auth/%s/role/%s", c.mount, name)
 	response := &struct {
@@ -159,6 +411,54 @@ func (c *Client) readRole(name string) (*Role, error) {
 	return response.Data, nil
 }
 
+// read role with all fields returned by vault, when 404 is returned from vault, nil data and nil error is returned
+func (c *Client) ReadRoleData(name string) (map[string]interface{}, error) {
+
+	path := fmt.Sprintf("auth/%s/role/%s", c.mount, name)
+	response := &struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// write role with fields as they are (e.g. role data read from vault), role is not compared with existing role
+func (c *Client) WriteRoleData(name string, data map[string]interface{}) error {
+
+	path := fmt.Sprintf("auth/%s/role/%s", c.mount, name)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, data)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("writing role: POST %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+// write auth config with fields as they are (e.g. config data read from vault), config is not compared with vault
+func (c *Client) WriteAuthConfigData(data map[string]interface{}) error {
+
+	path := fmt.Sprintf("auth/%s/config", c.mount)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, data)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("writing auth config: POST %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
 // list roles, when 404 is returned from vault, nil roles and nil error is returned
 func (c *Client) ListRoles() ([]string, error) {
 
@@ -184,39 +484,123 @@ func (c *Client) ListRoles() ([]string, error) {
 func (c *Client) mountAuthKubernetes() error {
 
 	path := fmt.Sprintf("sys/auth/%s", c.mount)
-	request := struct {
-		Type        string            `json:"type"`
-		Description string            `json:"description"`
-		Config      map[string]string `json:"config,omitempty"`
-	}{
-		Type:        kubernetesMountType,
-		Description: "Kubernetes auth backend for RUN cluster",
-		Config:      map[string]string{"max_lease_ttl": "8760h"},
-	}
-
-	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, request)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, c.mountSpec.mountRequest(c.authType()))
 	if err != nil {
 		return err
 	}
 
 	logger.Logf("mounting auth kubernetes: POST %s", path)
 	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
-	return c.doJsonRequest(jsonRequest, nil, errorHandlers, httpNumberOfRetries)
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+type AuthKubernetesConfig struct {
+	KubernetesHost   string   `json:"kubernetes_host"`
+	KubernetesCACert string   `json:"kubernetes_ca_cert"`
+	AliasNameSource  string   `json:"alias_name_source"`
+	PEMKeys          []string `json:"pem_keys"`
+	Issuer           string   `json:"issuer"`
+	// nil if vault does not return the field
+	DisableISSValidation *bool `json:"disable_iss_validation"`
+	DisableLocalCAJWT    bool  `json:"disable_local_ca_jwt"`
+}
+
+// optional auth kubernetes config, service account tokens are validated with pem keys (service account signing public
+// keys) when set, all options are always written, so previous values are cleared
+type AuthKubernetesOptions struct {
+	PEMKeys              []string `json:"pem_keys"`
+	Issuer               string   `json:"issuer"`
+	DisableISSValidation bool     `json:"disable_iss_validation"`
+	DisableLocalCAJWT    bool     `json:"disable_local_ca_jwt"`
+}
+
+// config has the same options, pem keys are compared regardless of order
+func (c AuthKubernetesConfig) hasOptions(options AuthKubernetesOptions) bool {
+
+	if c.DisableISSValidation != nil && *c.DisableISSValidation != options.DisableISSValidation {
+		return false
+	}
+	return equalKeys(c.PEMKeys, options.PEMKeys) && c.Issuer == options.Issuer && c.DisableLocalCAJWT == options.DisableLocalCAJWT
 }
 
-func (c *Client) configureAuthKubernetes(kubernetesHost string, kubernetesCACert, tokenReviewerJWT []byte) error {
+// warn when vault has only some of the signing keys (e.g. cluster signing key was added during rotation), tokens signed
+// with missing keys are rejected by vault until config is updated
+func warnPartialPEMKeys(configured, keys []string) {
+
+	present := make(map[string]struct{})
+	for _, key := range configured {
+		present[strings.TrimSpace(key)] = struct{}{}
+	}
+	var found int
+	for _, key := range keys {
+		if _, ok := present[strings.TrimSpace(key)]; ok {
+			found++
+		}
+	}
+	if found != 0 && found < len(keys) {
+		logger.Errorf("auth kubernetes config has only %d of %d service account signing keys, updating pem keys", found, len(keys))
+	}
+}
+
+// read auth kubernetes config, when 404 is returned from vault (auth is not configured), nil config and nil error is returned
+func (c *Client) ReadAuthKubernetesConfig() (*AuthKubernetesConfig, error) {
+
+	path := fmt.Sprintf("auth/%s/config", c.mount)
+	response := &struct {
+		Data *AuthKubernetesConfig `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// read auth kubernetes config with all fields returned by vault, when 404 is returned from vault (auth is not
+// configured), nil config and nil error is returned
+func (c *Client) ReadAuthKubernetesConfigData() (map[string]interface{}, error) {
+
+	path := fmt.Sprintf("auth/%s/config", c.mount)
+	response := &struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+func (c *Client) configureAuthKubernetes(kubernetesHost string, kubernetesCACert, tokenReviewerJWT []byte, options AuthKubernetesOptions) error {
 
 	logger.Logf("kubernetes host: %s", kubernetesHost)
 	logger.Logf("kubernetes ca:\n%s", kubernetesCACert)
+	if len(options.PEMKeys) != 0 {
+		logger.Logf("kubernetes issuer: %q, %d pem keys", options.Issuer, len(options.PEMKeys))
+	}
 	path := fmt.Sprintf("auth/%s/config", c.mount)
 	request := struct {
 		KubernetesHost   string `json:"kubernetes_host"`
 		KubernetesCACert string `json:"kubernetes_ca_cert"`
 		TokenReviewerJWT string `json:"token_reviewer_jwt"`
+		AuthKubernetesOptions
 	}{
-		KubernetesHost:   kubernetesHost,
-		KubernetesCACert: string(kubernetesCACert),
-		TokenReviewerJWT: string(tokenReviewerJWT),
+		KubernetesHost:        kubernetesHost,
+		KubernetesCACert:      string(kubernetesCACert),
+		TokenReviewerJWT:      string(tokenReviewerJWT),
+		AuthKubernetesOptions: options,
 	}
 
 	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, request)
@@ -226,38 +610,75 @@ func (c *Client) configureAuthKubernetes(kubernetesHost string, kubernetesCACert
 
 	logger.Logf("configuring auth kubernetes: POST %s", path)
 	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
-	return c.doJsonRequest(jsonRequest, nil, errorHandlers, httpNumberOfRetries)
+	return c.doJsonMutation(jsonRequest, errorHandlers)
 }
 
 func (c *Client) isAuthKubernetesMounted() (bool, error) {
 
+	mount, err := c.authKubernetesMount()
+	return mount != nil, err
+}
+
+// auth mount as listed in sys/auth
+type authMount struct {
+	Type     string `json:"type"`
+	Accessor string `json:"accessor"`
+	Local    bool   `json:"local"`
+	SealWrap bool   `json:"seal_wrap"`
+}
+
+// path of auth mount e.g. 'kubernetes/<account>/<cluster>'
+func (c *Client) AuthMount() string {
+	return c.mount
+}
+
+// type of auth mount as listed in sys/auth (kubernetes or jwt), empty if auth is not mounted
+func (c *Client) ReadAuthType() (string, error) {
+
+	mount, err := c.readAuthMount()
+	if err != nil || mount == nil {
+		return "", err
+	}
+	return mount.Type, nil
+}
+
+// auth kubernetes mount, nil if auth is not mounted, error if auth is mounted with different type
+func (c *Client) authKubernetesMount() (*authMount, error) {
+
+	mount, err := c.readAuthMount()
+	if err != nil || mount == nil {
+		return nil, err
+	}
+	if mount.Type != c.authType() {
+		return nil, fmt.Errorf("found %s/ auth backend but with incorrect type %s", c.mount, mount.Type)
+	}
+	return mount, nil
+}
+
+// auth mount of any type, nil if auth is not mounted
+func (c *Client) readAuthMount() (*authMount, error) {
+
 	path := "sys/auth"
 	response := struct {
-		Data map[string]struct {
-			Type string `json:"type"`
-		} `json:"data"`
+		Data map[string]authMount `json:"data"`
 	}{}
 
 	jsonRequest, err := c.newJsonRequest(http.MethodGet, path, nil)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	logger.Logf("checking if auth kubernetes is mounted: GET %s", path)
 	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
 	if err := c.doJsonRequest(jsonRequest, &response, errorHandlers, httpNumberOfRetries); err != nil {
-		return false, err
+		return nil, err
 	}
 
 	for key, val := range response.Data {
 		if strings.Trim(key, "/") == c.mount {
-			if val.Type != kubernetesMountType {
-				return false, fmt.Errorf("found %s auth backend but with incorrect type %s", key, val.Type)
-			}
-			return true, nil
+			return &val, nil
 		}
 	}
-	return false, nil
+	return nil, nil
 }
 
 func (c *Client) newJsonRequest(method, path string, jsonRequestBody interface{}) (*http.Request, error) {
@@ -282,39 +703,212 @@ func (c *Client) newJsonRequest(method, path string, jsonRequestBody interface{}
 }
 
 // http request, request and response body can be nil, retries is number of retries if request fails,
-// it is advisable to specify 2 or more retries, in case token expires we can retry with newly generated token
+// it is advisable to specify 2 or more retries, in case token expires we can retry with newly generated token,
+// network errors, 429 and 5xx responses are retried with backoff, other error responses are returned immediately
 func (c *Client) doJsonRequest(request *http.Request, jsonResponseBody interface{}, errorHandlers []errorHandler, retries int) error {
 
-	if retries == 0 {
-		return errors.New("number of retries exceeded")
-	}
+	var lastErr error
+	var retryAfter time.Duration
+	for attempt := 0; attempt < retries; attempt++ {
+		remaining := retries - attempt
+		if attempt != 0 {
+			c.wait(c.backoff(attempt, retryAfter))
+			if err := rewindBody(request); err != nil {
+				return err
+			}
+			c.setRequestHost(request)
+		}
 
-	request.Header.Set("X-Vault-Token", c.token)
-	responseErrs, err := c.doHttpRequest(request, jsonResponseBody)
-	if err != nil {
-		logger.Errorf("%v: remaining retries %d", err, retries)
-		return c.doJsonRequest(request, jsonResponseBody, errorHandlers, retries-1)
-	}
+		request.Header.Set("X-Vault-Token", c.getToken())
+		responseErrs, err := c.doHttpRequest(request, jsonResponseBody)
+		if err == nil {
+			c.setAuditRead(request, responseErrs)
+		}
+		if err != nil {
+			logger.Errorf("%v: remaining retries %d", err, remaining)
+			lastErr, retryAfter = err, 0
+			c.failover()
+			continue
+		}
+		if responseErrs == nil {
+			return nil
+		}
 
-	if responseErrs != nil {
 		for _, handler := range errorHandlers {
-			stop, err := handler(c, responseErrs, jsonResponseBody, retries)
+			stop, err := handler(c, responseErrs, jsonResponseBody, remaining)
 			if stop || err != nil {
 				return err
 			}
 		}
-		logger.Errorf("response errors: %s: remaining retries %d", responseErrs, retries)
-		return c.doJsonRequest(request, jsonResponseBody, errorHandlers, retries-1)
+		if !responseErrs.retryable() {
+			return responseErrs
+		}
+		logger.Errorf("response errors: %s: remaining retries %d", responseErrs, remaining)
+		lastErr, retryAfter = responseErrs, responseErrs.retryAfter
+		if errors.Is(responseErrs, ErrSealed) {
+			c.failover()
+		}
+	}
+
+	if lastErr == nil {
+		return errors.New("number of retries exceeded")
+	}
+	return fmt.Errorf("number of retries exceeded: %w", lastErr)
+}
+
+// json request that changes vault state, response body is not read, mutation is audited if audit is set, vault is not
+// read for audit, after is the request body and before is digest of the previous mutation of the path, nil if path was
+// read as not found, or unknown if it was neither written since start nor read as not found, action is create or update
+// if the path was read before the mutation (e.g. role is read by CreateRole), write otherwise
+func (c *Client) doJsonMutation(request *http.Request, errorHandlers []errorHandler) error {
+
+	if c.config.Audit == nil {
+		return c.doJsonRequest(request, nil, errorHandlers, httpNumberOfRetries)
+	}
+
+	path := auditPath(request)
+	existed, read := c.auditRead(path)
+	err := c.doJsonRequest(request, nil, errorHandlers, httpNumberOfRetries)
+	if request.Method == http.MethodDelete && read && !existed {
+		// nothing was deleted
+		return err
 	}
+
+	c.mu.Lock()
+	digest, written := c.written[path]
+	var after interface{}
+	if err == nil && request.Method != http.MethodDelete {
+		after = requestBody(request)
+		c.written[path] = audit.Digest(after)
+	}
+	if err == nil && request.Method == http.MethodDelete {
+		delete(c.written, path)
+	}
+	c.mu.Unlock()
+
+	var before interface{} = audit.Unknown
+	switch {
+	case written:
+		before = audit.Digested(digest)
+	case read && !existed:
+		before = nil
+	}
+	action := auditWrite
+	switch {
+	case request.Method == http.MethodDelete:
+		action = auditDelete
+	case written || (read && existed):
+		action = auditUpdate
+	case read:
+		action = auditCreate
+	}
+	c.config.Audit(path, action, before, after, err)
+	return err
+}
+
+// whether path existed when it was read the last time, read is false if path was not read since the last mutation
+func (c *Client) auditRead(path string) (existed, read bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	existed, read = c.reads[path]
+	delete(c.reads, path)
+	return existed, read
+}
+
+// remember whether read path exists, responseErrs is nil if read succeeded, reads are only kept when audit is set
+func (c *Client) setAuditRead(request *http.Request, responseErrs *responseErrors) {
+
+	if c.config.Audit == nil || request.Method != http.MethodGet {
+		return
+	}
+	if responseErrs != nil && responseErrs.status != http.StatusNotFound {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reads[auditPath(request)] = responseErrs == nil
+}
+
+// vault path of request without api version
+func auditPath(request *http.Request) string {
+	return strings.TrimPrefix(request.URL.Path, fmt.Sprintf("/%s/", vaultVersion))
+}
+
+// json request body, nil if request has no body
+func requestBody(request *http.Request) interface{} {
+
+	if request.GetBody == nil {
+		return nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.NewDecoder(body).Decode(&v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// exponential backoff with jitter (random value between half and full backoff), Retry-After is honoured if it is longer
+func (c *Client) backoff(attempt int, retryAfter time.Duration) time.Duration {
+
+	backoff := c.config.MinBackoff << (attempt - 1)
+	if backoff > c.config.MaxBackoff || backoff <= 0 {
+		backoff = c.config.MaxBackoff
+	}
+	if backoff > 1 {
+		backoff = backoff/2 + rand.N(backoff/2)
+	}
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+	if retryAfter > backoff {
+		return retryAfter
+	}
+	return backoff
+}
+
+func (c *Client) wait(d time.Duration) {
+
+	if d <= 0 {
+		return
+	}
+	if c.sleep != nil {
+		c.sleep(d)
+		return
+	}
+	time.Sleep(d)
+}
+
+// reset request body before retry, so the same body is sent again
+func rewindBody(request *http.Request) error {
+
+	if request.Body == nil || request.GetBody == nil {
+		return nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return fmt.Errorf("rewind request body: %w", err)
+	}
+	request.Body = body
 	return nil
 }
 
 func (c *Client) doHttpRequest(request *http.Request, jsonResponseBody interface{}) (*responseErrors, error) {
 
+	if c.limiter != nil {
+		if err := c.limiter.Wait(context.Background()); err != nil {
+			return nil, fmt.Errorf("rate limit: %w", err)
+		}
+	}
 	response, err := c.config.HttpClient.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("http httpClient do: %w", err)
 	}
+	c.followedRedirect(request, response)
 
 	defer response.Body.Close()
 	responseBody, err := ioutil.ReadAll(response.Body)
@@ -331,10 +925,15 @@ func (c *Client) doHttpRequest(request *http.Request, jsonResponseBody interface
 				return nil, fmt.Errorf("unmarshal json response: %w", err)
 			}
 		}
-		return &responseErrors{status: response.StatusCode, errors: errs.Errors}, nil
+		return &responseErrors{
+			status:     response.StatusCode,
+			errors:     errs.Errors,
+			retryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now()),
+		}, nil
 	}
 
-	if jsonResponseBody != nil {
+	// 204 responses have no body
+	if jsonResponseBody != nil && len(responseBody) != 0 {
 		if err := json.Unmarshal(responseBody, jsonResponseBody); err != nil {
 			return nil, fmt.Errorf("unmarshal json response: %w", err)
 		}
@@ -374,12 +973,21 @@ func (c *Client) appRoleLogin(retries int) error {
 
 	logger.Logf("app role login: renewable %t, lease duration %d, token policies %v",
 		response.Auth.Renewable, response.Auth.LeaseDuration, response.Auth.TokenPolicies)
+	c.mu.Lock()
 	c.token = response.Auth.ClientToken
+	c.mu.Unlock()
 	return nil
 }
 
+func (c *Client) getToken() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
 func (c *Client) buildVaultUrl(path string) string {
 
 	// trim last '/', vault returns 400 (Bad Request) if url ends with '/'
-	return fmt.Sprintf("%s/%s/%s", c.config.Host, vaultVersion, strings.Trim(path, "/"))
+	return fmt.Sprintf("%s/%s/%s", c.activeHost(), vaultVersion, strings.Trim(path, "/"))
 }
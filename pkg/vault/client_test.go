@@ -3,10 +3,14 @@ package vault
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/pkg/audit"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault/vaulttest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -74,15 +78,61 @@ func TestNewClient(t *testing.T) {
 
 func TestClient_InitAuthKubernetes(t *testing.T) {
 
-	t.Run("when auth is already mounted then init is skipped and no error is returned", func(t *testing.T) {
+	t.Run("when auth is already mounted and configured then init is skipped and no error is returned", func(t *testing.T) {
 
 		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 
-			assert.Equal(t, "/v1/sys/auth", req.URL.Path)
+			assert.Equal(t, http.MethodGet, req.Method)
 			assert.Equal(t, "ABC123", req.Header.Get("X-Vault-Token"))
 
+			if req.URL.Path == "/v1/sys/auth" {
+				res.WriteHeader(http.StatusOK)
+				res.Write([]byte(listAuthMethodsResponse))
+				return
+			}
+			assert.Equal(t, "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config", req.URL.Path)
 			res.WriteHeader(http.StatusOK)
-			res.Write([]byte(listAuthMethodsResponse))
+			res.Write([]byte(`{"data": {"kubernetes_host": "https://backend.kube.com", "kubernetes_ca_cert": "CA"}}`))
+		}))
+		defer func() { testServer.Close() }()
+
+		v := &Client{
+			config: Config{HttpClient: testHttpClient, Host: testServer.URL},
+			mount:  authK8sMount,
+			token:  "ABC123",
+		}
+
+		mounted, err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"), AuthKubernetesOptions{})
+		require.NoError(t, err)
+		assert.False(t, mounted)
+		assert.Equal(t, "auth_kubernetes_def", v.AuthAccessor())
+	})
+
+	t.Run("when auth is already mounted but kubernetes CA has changed then it is re-configured", func(t *testing.T) {
+
+		var configured bool
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+			if req.URL.Path == "/v1/sys/auth" && req.Method == http.MethodGet {
+				res.WriteHeader(http.StatusOK)
+				res.Write([]byte(listAuthMethodsResponse))
+				return
+			}
+			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config" && req.Method == http.MethodGet {
+				res.WriteHeader(http.StatusOK)
+				res.Write([]byte(`{"data": {"kubernetes_host": "https://backend.kube.com", "kubernetes_ca_cert": "OLD CA"}}`))
+				return
+			}
+			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config" && req.Method == http.MethodGet {
+				res.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config" && req.Method == http.MethodPost {
+				configured = true
+				res.WriteHeader(http.StatusNoContent)
+				return
+			}
+			res.WriteHeader(http.StatusInternalServerError)
 		}))
 		defer func() { testServer.Close() }()
 
@@ -92,8 +142,9 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 			token:  "ABC123",
 		}
 
-		err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"))
+		_, err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"), AuthKubernetesOptions{})
 		require.NoError(t, err)
+		assert.True(t, configured)
 	})
 
 	t.Run("when list auth mounts request fails then error is returned", func(t *testing.T) {
@@ -113,7 +164,7 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 			token:  "ABC123",
 		}
 
-		err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"))
+		_, err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"), AuthKubernetesOptions{})
 		require.Error(t, err)
 	})
 
@@ -135,7 +186,7 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 			token:  "ABC123",
 		}
 
-		err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"))
+		_, err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"), AuthKubernetesOptions{})
 		require.Error(t, err)
 	})
 
@@ -152,6 +203,10 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 				res.WriteHeader(http.StatusOK)
 				return
 			}
+			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config" && req.Method == http.MethodGet {
+				res.WriteHeader(http.StatusNotFound)
+				return
+			}
 			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config" && req.Method == http.MethodPost {
 				res.WriteHeader(http.StatusOK)
 				return
@@ -166,8 +221,9 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 			token:  "ABC123",
 		}
 
-		err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"))
+		mounted, err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"), AuthKubernetesOptions{})
 		require.NoError(t, err)
+		assert.True(t, mounted)
 	})
 
 	t.Run("when auth is not mounted and mounting fails then error is returned", func(t *testing.T) {
@@ -193,7 +249,7 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 			token:  "ABC123",
 		}
 
-		err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"))
+		_, err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"), AuthKubernetesOptions{})
 		require.Error(t, err)
 	})
 
@@ -210,6 +266,10 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 				res.WriteHeader(http.StatusOK)
 				return
 			}
+			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config" && req.Method == http.MethodGet {
+				res.WriteHeader(http.StatusNotFound)
+				return
+			}
 			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/config" && req.Method == http.MethodPost {
 				res.WriteHeader(http.StatusInternalServerError)
 				return
@@ -224,7 +284,7 @@ func TestClient_InitAuthKubernetes(t *testing.T) {
 			token:  "ABC123",
 		}
 
-		err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"))
+		_, err := v.InitAuthKubernetes("https://backend.kube.com", []byte("CA"), []byte("JWT"), AuthKubernetesOptions{})
 		require.Error(t, err)
 	})
 }
@@ -400,6 +460,178 @@ func TestClient_jsonRequest(t *testing.T) {
 	})
 }
 
+func TestClient_retries(t *testing.T) {
+
+	newTestClient := func(host string, waits *[]time.Duration) *Client {
+		return &Client{
+			config: Config{HttpClient: testHttpClient, Host: host, MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second},
+			mount:  authK8sMount,
+			token:  "ABC123",
+			sleep:  func(d time.Duration) { *waits = append(*waits, d) },
+		}
+	}
+
+	t.Run("when vault returns validation error then request is not retried and validation error is returned", func(t *testing.T) {
+
+		var requests int
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			requests++
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(`{"errors":["invalid request"]}`))
+		}))
+		defer func() { testServer.Close() }()
+
+		var waits []time.Duration
+		_, err := newTestClient(testServer.URL, &waits).isAuthKubernetesMounted()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrValidation)
+		assert.Equal(t, 1, requests)
+		assert.Empty(t, waits)
+	})
+
+	t.Run("when vault is sealed then request is retried with backoff and sealed error is returned", func(t *testing.T) {
+
+		var requests int
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			requests++
+			res.WriteHeader(http.StatusServiceUnavailable)
+			res.Write([]byte(`{"errors":["Vault is sealed"]}`))
+		}))
+		defer func() { testServer.Close() }()
+
+		var waits []time.Duration
+		_, err := newTestClient(testServer.URL, &waits).isAuthKubernetesMounted()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrSealed)
+		assert.Equal(t, httpNumberOfRetries, requests)
+		require.Equal(t, httpNumberOfRetries-1, len(waits))
+		assert.True(t, waits[0] >= 50*time.Millisecond && waits[0] <= 100*time.Millisecond, waits[0])
+		assert.True(t, waits[1] >= 100*time.Millisecond && waits[1] <= 200*time.Millisecond, waits[1])
+	})
+
+	t.Run("when vault is rate limiting then Retry-After is honoured and request is retried", func(t *testing.T) {
+
+		var requests int
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			requests++
+			if requests == 1 {
+				res.Header().Set("Retry-After", "3")
+				res.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+			res.Write([]byte(listAuthMethodsResponse))
+		}))
+		defer func() { testServer.Close() }()
+
+		var waits []time.Duration
+		mounted, err := newTestClient(testServer.URL, &waits).isAuthKubernetesMounted()
+		require.NoError(t, err)
+		assert.True(t, mounted)
+		assert.Equal(t, []time.Duration{3 * time.Second}, waits)
+	})
+
+	t.Run("when vault returns unexpected not found then request is not retried and not found error is returned", func(t *testing.T) {
+
+		var requests int
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			requests++
+			res.WriteHeader(http.StatusNotFound)
+		}))
+		defer func() { testServer.Close() }()
+
+		var waits []time.Duration
+		err := newTestClient(testServer.URL, &waits).mountAuthKubernetes()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.Equal(t, 1, requests)
+	})
+
+	t.Run("when permission is denied after token is re-generated then permission denied error is returned", func(t *testing.T) {
+
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/v1/auth/approle/login" {
+				res.WriteHeader(http.StatusOK)
+				res.Write([]byte(authAppRoleResponse))
+				return
+			}
+			res.WriteHeader(http.StatusForbidden)
+			res.Write([]byte(`{"errors":["permission denied"]}`))
+		}))
+		defer func() { testServer.Close() }()
+
+		var waits []time.Duration
+		_, err := newTestClient(testServer.URL, &waits).isAuthKubernetesMounted()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrPermissionDenied)
+	})
+}
+
+func TestClient_rateLimit(t *testing.T) {
+
+	t.Run("when QPS is set then requests are rate limited", func(t *testing.T) {
+
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/v1/auth/approle/login" {
+				res.Write([]byte(authAppRoleResponse))
+				return
+			}
+			res.Write([]byte(listAuthMethodsResponse))
+		}))
+		defer func() { testServer.Close() }()
+
+		c, err := NewClient(Config{HttpClient: testHttpClient, Host: testServer.URL, QPS: 20, Burst: 1}, authK8sMount)
+		require.NoError(t, err)
+
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			_, err := c.isAuthKubernetesMounted()
+			require.NoError(t, err)
+		}
+		// login used the burst, 4 requests wait 50ms each
+		assert.True(t, time.Since(start) >= 150*time.Millisecond, time.Since(start))
+	})
+}
+
+func TestClient_backoff(t *testing.T) {
+
+	c := &Client{config: Config{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+
+	t.Run("when attempts increase then backoff grows exponentially up to max backoff", func(t *testing.T) {
+
+		for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 5: time.Second, 40: time.Second} {
+			backoff := c.backoff(attempt, 0)
+			assert.True(t, backoff >= max/2 && backoff <= max, "attempt %d: %v", attempt, backoff)
+		}
+	})
+
+	t.Run("when Retry-After is longer than backoff then it is used, but not longer than max Retry-After", func(t *testing.T) {
+
+		assert.Equal(t, 10*time.Second, c.backoff(1, 10*time.Second))
+		assert.Equal(t, maxRetryAfter, c.backoff(1, time.Hour))
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("when Retry-After is in seconds then duration is returned", func(t *testing.T) {
+		assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	})
+
+	t.Run("when Retry-After is http date then duration until the date is returned", func(t *testing.T) {
+		assert.Equal(t, 30*time.Second, parseRetryAfter("Mon, 01 Jan 2024 10:00:30 GMT", now))
+	})
+
+	t.Run("when Retry-After is empty, invalid or in the past then zero is returned", func(t *testing.T) {
+		assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+		assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+		assert.Equal(t, time.Duration(0), parseRetryAfter("-1", now))
+		assert.Equal(t, time.Duration(0), parseRetryAfter("Mon, 01 Jan 2024 09:00:00 GMT", now))
+	})
+}
+
 func TestClient_CreateRole(t *testing.T) {
 
 	t.Run("when create role is successful then no error is returned", func(t *testing.T) {
@@ -505,6 +737,52 @@ func TestClient_CreateRole(t *testing.T) {
 	})
 }
 
+func TestClient_ReadRole(t *testing.T) {
+
+	t.Run("when role exists then role is returned", func(t *testing.T) {
+
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+			if req.URL.Path == "/v1/auth/kubernetes/hcom-sandbox-aws/backend/role/test2" && req.Method == http.MethodGet {
+				res.WriteHeader(http.StatusOK)
+				res.Write([]byte(`{"data": {"bound_service_account_names": ["default"], "token_policies": ["admin"], "token_ttl": 60}}`))
+				return
+			}
+			res.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer func() { testServer.Close() }()
+
+		v := &Client{
+			config: Config{HttpClient: testHttpClient, Host: testServer.URL},
+			mount:  authK8sMount,
+			token:  "ABC123",
+		}
+
+		role, err := v.ReadRole("test2")
+		require.NoError(t, err)
+		require.NotNil(t, role)
+		assert.Equal(t, Role{BoundServiceAccountNames: []string{"default"}, TokenPolicies: []string{"admin"}, TokenTTL: 60}, *role)
+	})
+
+	t.Run("when role does not exist then nil role and no error is returned", func(t *testing.T) {
+
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusNotFound)
+		}))
+		defer func() { testServer.Close() }()
+
+		v := &Client{
+			config: Config{HttpClient: testHttpClient, Host: testServer.URL},
+			mount:  authK8sMount,
+			token:  "ABC123",
+		}
+
+		role, err := v.ReadRole("test2")
+		require.NoError(t, err)
+		assert.Nil(t, role)
+	})
+}
+
 func TestClient_DeleteRole(t *testing.T) {
 
 	t.Run("when delete role is successful then no error is returned", func(t *testing.T) {
@@ -834,3 +1112,555 @@ var listRolesResponse = `
 	"warnings": null,
 	"auth": null
 }`
+
+func TestClient_FakeVault(t *testing.T) {
+
+	newFakeVault := func() *vaulttest.Server {
+
+		s := vaulttest.NewServer()
+		s.AddPolicy("vault-auth-kubernetes",
+			vaulttest.PathRule{Path: "sys/auth", Capabilities: []string{"read"}},
+			vaulttest.PathRule{Path: "sys/auth/kubernetes/+/+", Capabilities: []string{"create", "update", "delete", "sudo"}},
+			vaulttest.PathRule{Path: "sys/auth/kubernetes/+/+/tune", Capabilities: []string{"read", "update", "sudo"}},
+			vaulttest.PathRule{Path: "auth/kubernetes/+/+/config", Capabilities: []string{"create", "read", "update"}},
+			vaulttest.PathRule{Path: "auth/kubernetes/+/+/role", Capabilities: []string{"list"}},
+			vaulttest.PathRule{Path: "auth/kubernetes/+/+/role/*", Capabilities: []string{"create", "read", "update", "delete"}},
+			vaulttest.PathRule{Path: "sys/policies/acl", Capabilities: []string{"list"}},
+			vaulttest.PathRule{Path: "sys/policies/acl/*", Capabilities: []string{"create", "read", "update", "delete"}},
+		)
+		s.AddAppRole("role-id", "secret-id", time.Minute, "vault-auth-kubernetes")
+		return s
+	}
+	newClient := func(t *testing.T, s *vaulttest.Server) *Client {
+
+		config := Config{HttpClient: testHttpClient, Host: s.URL(), RoleId: "role-id", SecretId: "secret-id", MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		c, err := NewClient(config, authK8sMount)
+		require.NoError(t, err)
+		return c
+	}
+
+	t.Run("when auth is initialised then mount is created and configured", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		c := newClient(t, s)
+
+		mounted, err := c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), AuthKubernetesOptions{})
+		require.NoError(t, err)
+		assert.True(t, mounted)
+		assert.Equal(t, "kubernetes", s.Mounts()[authK8sMount].Type)
+		assert.Equal(t, "https://kube", s.Config(authK8sMount)["kubernetes_host"])
+	})
+
+	t.Run("when roles are created and deleted then vault roles are updated", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		c := newClient(t, s)
+
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"app"}, TokenPolicies: []string{"app"}}
+		require.NoError(t, c.CreateRole("app", role))
+		require.NoError(t, c.CreateRole("worker", role))
+
+		roles, err := c.ListRoles()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app", "worker"}, roles)
+
+		require.NoError(t, c.DeleteRole("worker"))
+		assert.Equal(t, []string{"app"}, s.RoleNames(authK8sMount))
+	})
+
+	t.Run("when auth is not mounted then tune is nil and mount creates auth", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		c := newClient(t, s)
+
+		tune, err := c.ReadAuthTune()
+		require.NoError(t, err)
+		assert.Nil(t, tune)
+
+		mounted, err := c.MountAuthKubernetes()
+		require.NoError(t, err)
+		assert.True(t, mounted)
+		mounted, err = c.MountAuthKubernetes()
+		require.NoError(t, err)
+		assert.False(t, mounted)
+	})
+
+	t.Run("when auth is tuned then tune is read back", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes", Description: "test", Config: map[string]interface{}{"max_lease_ttl": 31536000}})
+		c := newClient(t, s)
+
+		require.NoError(t, c.TuneAuth(map[string]interface{}{"default_lease_ttl": "1h"}))
+		tune, err := c.ReadAuthTune()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"description": "test", "default_lease_ttl": float64(3600), "max_lease_ttl": float64(31536000)}, tune)
+	})
+
+	t.Run("when role data is written then fields are written as they are", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		c := newClient(t, s)
+
+		data := map[string]interface{}{"bound_service_account_names": []interface{}{"app"}, "audience": "vault"}
+		require.NoError(t, c.WriteRoleData("app", data))
+		read, err := c.ReadRoleData("app")
+		require.NoError(t, err)
+		assert.Equal(t, data, read)
+
+		config, err := c.ReadAuthKubernetesConfigData()
+		require.NoError(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("when mount spec is set then auth is mounted with spec and tuned when it drifts", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		spec := MountSpec{Description: "payments", DefaultLeaseTTL: "1h", MaxLeaseTTL: "24h", ListingVisibility: "unauth", SealWrap: true}
+		config := Config{HttpClient: testHttpClient, Host: s.URL(), RoleId: "role-id", SecretId: "secret-id", MountSpec: &spec}
+		c, err := NewClient(config, authK8sMount)
+		require.NoError(t, err)
+
+		_, err = c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), AuthKubernetesOptions{})
+		require.NoError(t, err)
+		mount := s.Mounts()[authK8sMount]
+		assert.Equal(t, "payments", mount.Description)
+		assert.True(t, mount.SealWrap)
+		assert.Equal(t, map[string]interface{}{"default_lease_ttl": 3600, "max_lease_ttl": 86400, "listing_visibility": "unauth"}, mount.Config)
+
+		// no drift, tune is only read
+		_, err = c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), AuthKubernetesOptions{})
+		require.NoError(t, err)
+		assert.NotContains(t, s.Requests(), vaulttest.Request{Method: http.MethodPost, Path: "sys/auth/" + authK8sMount + "/tune"})
+
+		request, err := http.NewRequest(http.MethodPost, s.URL()+"/v1/sys/auth/"+authK8sMount+"/tune", strings.NewReader(`{"max_lease_ttl": "768h", "description": "edited"}`))
+		require.NoError(t, err)
+		request.Header.Set("X-Vault-Token", s.RootToken())
+		response, err := testHttpClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		_, err = c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), AuthKubernetesOptions{})
+		require.NoError(t, err)
+		mount = s.Mounts()[authK8sMount]
+		assert.Equal(t, "payments", mount.Description)
+		assert.Equal(t, 86400, mount.Config["max_lease_ttl"])
+	})
+
+	t.Run("when mount spec is not set then auth is mounted with default spec and it is not tuned", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		c := newClient(t, s)
+
+		_, err := c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), AuthKubernetesOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "Kubernetes auth backend for RUN cluster", s.Mounts()[authK8sMount].Description)
+		assert.Equal(t, 31536000, s.Mounts()[authK8sMount].Config["max_lease_ttl"])
+		for _, request := range s.Requests() {
+			assert.NotContains(t, request.Path, "/tune")
+		}
+	})
+
+	t.Run("when acl policy is written then it is listed, read and deleted", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		c := newClient(t, s)
+
+		require.NoError(t, c.WritePolicy("app", `path "secret/data/app/*" { capabilities = ["read"] }`))
+		names, err := c.ListPolicies()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app", "default", "root"}, names)
+
+		policy, err := c.ReadPolicy("app")
+		require.NoError(t, err)
+		assert.Equal(t, &Policy{Name: "app", Policy: `path "secret/data/app/*" { capabilities = ["read"] }`}, policy)
+
+		require.NoError(t, c.DeletePolicy("app"))
+		policy, err = c.ReadPolicy("app")
+		require.NoError(t, err)
+		assert.Nil(t, policy)
+		assert.Empty(t, s.ACLPolicyNames())
+	})
+
+	t.Run("when auth kubernetes options change then auth is configured with pem keys and issuer", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		c := newClient(t, s)
+
+		options := AuthKubernetesOptions{PEMKeys: []string{"key-1"}, Issuer: "https://issuer", DisableLocalCAJWT: true}
+		_, err := c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), options)
+		require.NoError(t, err)
+		config := s.Config(authK8sMount)
+		assert.Equal(t, []interface{}{"key-1"}, config["pem_keys"])
+		assert.Equal(t, "https://issuer", config["issuer"])
+		assert.Equal(t, false, config["disable_iss_validation"])
+		assert.Equal(t, true, config["disable_local_ca_jwt"])
+
+		configWrites := len(s.Requests())
+		_, err = c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), options)
+		require.NoError(t, err)
+		for _, request := range s.Requests()[configWrites:] {
+			assert.NotEqual(t, http.MethodPost, request.Method)
+		}
+
+		// signing key rotation
+		options.PEMKeys = []string{"key-2", "key-1"}
+		_, err = c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), options)
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"key-2", "key-1"}, s.Config(authK8sMount)["pem_keys"])
+	})
+
+	t.Run("when service account logs in then token policies are returned and token is revoked", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.AddServiceAccountToken("app-jwt", "payments", "app")
+		c := newClient(t, s)
+
+		_, err := c.InitAuthKubernetes("https://kube", []byte("--- CA ---"), []byte("jwt"), AuthKubernetesOptions{})
+		require.NoError(t, err)
+		require.NoError(t, c.CreateRole("app", Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"payments"}, TokenPolicies: []string{"app"}}))
+		tokens := s.TokenCount()
+
+		result, err := c.Login("app", []byte("app-jwt"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default", "app"}, result.TokenPolicies)
+		assert.Equal(t, tokens+1, s.TokenCount())
+		require.NoError(t, c.RevokeToken(result.ClientToken))
+		assert.Equal(t, tokens, s.TokenCount())
+
+		_, err = c.Login("app", []byte("other-jwt"))
+		require.Error(t, err)
+	})
+
+	t.Run("when jwt auth is initialised then jwt mount is created and configured with issuer and keys", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		config := Config{HttpClient: testHttpClient, Host: s.URL(), RoleId: "role-id", SecretId: "secret-id", AuthType: AuthTypeJWT, JWTAudience: "vault"}
+		c, err := NewClient(config, authK8sMount)
+		require.NoError(t, err)
+
+		mounted, err := c.InitAuthJWT("https://issuer", []string{"key-1"})
+		require.NoError(t, err)
+		assert.True(t, mounted)
+		assert.Equal(t, "jwt", s.Mounts()[authK8sMount].Type)
+		assert.Equal(t, "https://issuer", s.Config(authK8sMount)["bound_issuer"])
+		assert.Equal(t, AliasNameSourceSubject, c.AuthAliasNameSource())
+
+		configWrites := len(s.Requests())
+		mounted, err = c.InitAuthJWT("https://issuer", []string{"key-1"})
+		require.NoError(t, err)
+		assert.False(t, mounted)
+		for _, request := range s.Requests()[configWrites:] {
+			assert.NotEqual(t, http.MethodPost, request.Method)
+		}
+
+		_, err = c.InitAuthJWT("https://issuer", []string{"key-1", "key-2"})
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"key-1", "key-2"}, s.Config(authK8sMount)["jwt_validation_pubkeys"])
+	})
+
+	t.Run("when auth type is jwt then roles are written as jwt roles and read back as kubernetes roles", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "jwt"})
+		config := Config{HttpClient: testHttpClient, Host: s.URL(), RoleId: "role-id", SecretId: "secret-id", AuthType: AuthTypeJWT, JWTAudience: "vault"}
+		c, err := NewClient(config, authK8sMount)
+		require.NoError(t, err)
+
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"payments"}, TokenPolicies: []string{"app"}}
+		require.NoError(t, c.CreateRole("app", role))
+		data := s.Role(authK8sMount, "app")
+		assert.Equal(t, "system:serviceaccount:payments:app", data["bound_subject"])
+		assert.Equal(t, []interface{}{"vault"}, data["bound_audiences"])
+		assert.Equal(t, "sub", data["user_claim"])
+
+		vaultRole, err := c.ReadRole("app")
+		require.NoError(t, err)
+		assert.True(t, role.Equal(*vaultRole))
+
+		role.BoundServiceAccountNamespaces = []string{"payments", "billing"}
+		require.NoError(t, c.CreateRole("app", role))
+		data = s.Role(authK8sMount, "app")
+		assert.Equal(t, "", data["bound_subject"])
+		assert.Equal(t, map[string]interface{}{"sub": []interface{}{"system:serviceaccount:billing:app", "system:serviceaccount:payments:app"}}, data["bound_claims"])
+
+		vaultRole, err = c.ReadRole("app")
+		require.NoError(t, err)
+		assert.True(t, role.Equal(*vaultRole))
+	})
+
+	t.Run("when token expires then client logs in again", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		c := newClient(t, s)
+
+		s.Advance(2 * time.Minute)
+		_, err := c.ListRoles()
+		require.NoError(t, err)
+	})
+
+	t.Run("when create role request fails then it is retried with the same body", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		c := newClient(t, s)
+
+		s.InjectFault(vaulttest.Fault{Method: http.MethodPost, Path: "auth/*", Status: http.StatusInternalServerError, Count: 1})
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"app"}, TokenPolicies: []string{"app"}, TokenTTL: 60}
+		require.NoError(t, c.CreateRole("app", role))
+		assert.Equal(t, float64(60), s.Role(authK8sMount, "app")["token_ttl"])
+	})
+
+	t.Run("when vault returns server errors then request is retried", func(t *testing.T) {
+
+		s := newFakeVault()
+		defer s.Close()
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		c := newClient(t, s)
+
+		s.InjectFault(vaulttest.Fault{Method: "LIST", Path: "auth/*", Status: http.StatusInternalServerError, Count: 1})
+		_, err := c.ListRoles()
+		require.NoError(t, err)
+
+		s.InjectFault(vaulttest.Fault{Method: "LIST", Path: "auth/*", Status: http.StatusInternalServerError})
+		_, err = c.ListRoles()
+		require.Error(t, err)
+	})
+
+	newHAClient := func(hosts ...string) (*Client, error) {
+
+		config := Config{HttpClient: testHttpClient, Hosts: hosts, RoleId: "role-id", SecretId: "secret-id", MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		return NewClient(config, authK8sMount)
+	}
+
+	t.Run("when multiple hosts are configured then active node is used", func(t *testing.T) {
+
+		active, standby := newFakeVault(), newFakeVault()
+		defer active.Close()
+		defer standby.Close()
+		standby.SetStandby(active.URL())
+		active.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+
+		c, err := newHAClient(standby.URL(), active.URL())
+		require.NoError(t, err)
+		assert.Equal(t, Health{Host: active.URL(), Initialized: true}, withoutCheckedAt(c.Health()))
+
+		_, err = c.ListRoles()
+		require.NoError(t, err)
+		assert.Equal(t, []vaulttest.Request{{Method: http.MethodGet, Path: "sys/health"}}, standby.Requests())
+	})
+
+	t.Run("when active node steps down then standby redirect is followed and client switches to new active node", func(t *testing.T) {
+
+		first, second := newFakeVault(), newFakeVault()
+		defer first.Close()
+		defer second.Close()
+		second.SetStandby(first.URL())
+		first.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		second.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+
+		c, err := newHAClient(first.URL(), second.URL())
+		require.NoError(t, err)
+
+		first.SetStandby(second.URL())
+		second.SetStandby("")
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"app"}, TokenPolicies: []string{"app"}}
+		require.NoError(t, c.CreateRole("app", role))
+		assert.Equal(t, []string{"app"}, second.RoleNames(authK8sMount))
+		assert.Equal(t, second.URL(), c.activeHost())
+	})
+
+	t.Run("when standby redirects to unknown host then redirect is not followed", func(t *testing.T) {
+
+		active, standby := newFakeVault(), newFakeVault()
+		defer active.Close()
+		defer standby.Close()
+		standby.SetStandby(active.URL())
+
+		_, err := newHAClient(standby.URL())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not one of vault hosts")
+		assert.Empty(t, active.Requests())
+	})
+
+	t.Run("when active node is down then client fails over to another node", func(t *testing.T) {
+
+		first, second := newFakeVault(), newFakeVault()
+		defer second.Close()
+		first.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		second.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+
+		c, err := newHAClient(first.URL(), second.URL())
+		require.NoError(t, err)
+		assert.Equal(t, first.URL(), c.activeHost())
+
+		first.Close()
+		_, err = c.ListRoles()
+		require.NoError(t, err)
+		assert.Equal(t, second.URL(), c.activeHost())
+	})
+
+	t.Run("when all nodes are sealed then health reports sealed cluster", func(t *testing.T) {
+
+		first, second := newFakeVault(), newFakeVault()
+		defer first.Close()
+		defer second.Close()
+		c, err := newHAClient(first.URL(), second.URL())
+		require.NoError(t, err)
+
+		first.Seal()
+		second.Seal()
+		health, err := c.CheckHealth()
+		require.NoError(t, err)
+		assert.True(t, health.Sealed)
+		assert.Equal(t, float64(1), metrics.DefaultRegistry.Value("vak_vault_sealed"))
+
+		_, err = c.ListRoles()
+		assert.ErrorIs(t, err, ErrSealed)
+
+		second.Unseal()
+		health, err = c.CheckHealth()
+		require.NoError(t, err)
+		assert.Equal(t, Health{Host: second.URL(), Initialized: true}, withoutCheckedAt(health))
+		assert.Equal(t, float64(0), metrics.DefaultRegistry.Value("vak_vault_sealed"))
+	})
+}
+
+func withoutCheckedAt(health Health) Health {
+
+	health.CheckedAt = time.Time{}
+	return health
+}
+
+func TestClient_audit(t *testing.T) {
+
+	type mutation struct {
+		target string
+		action string
+		before interface{}
+		after  interface{}
+		err    error
+	}
+	newAuditedClient := func(t *testing.T) (*Client, *vaulttest.Server, *[]mutation) {
+
+		s := vaulttest.NewServer()
+		s.AddPolicy("vault-auth-kubernetes",
+			vaulttest.PathRule{Path: "auth/kubernetes/+/+/role/*", Capabilities: []string{"create", "read", "update", "delete"}},
+			vaulttest.PathRule{Path: "sys/policies/acl/*", Capabilities: []string{"create", "read", "update", "delete"}},
+		)
+		s.AddAppRole("role-id", "secret-id", time.Minute, "vault-auth-kubernetes")
+		s.Mount(authK8sMount, vaulttest.Mount{Type: "kubernetes"})
+		t.Cleanup(s.Close)
+
+		var mutations []mutation
+		config := Config{HttpClient: testHttpClient, Host: s.URL(), RoleId: "role-id", SecretId: "secret-id", MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		config.Audit = func(target, action string, before, after interface{}, err error) {
+			mutations = append(mutations, mutation{target: target, action: action, before: before, after: after, err: err})
+		}
+		c, err := NewClient(config, authK8sMount)
+		require.NoError(t, err)
+		return c, s, &mutations
+	}
+
+	t.Run("when role is created, updated and deleted then mutations are audited with request bodies and digests", func(t *testing.T) {
+
+		c, _, mutations := newAuditedClient(t)
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"app"}, TokenPolicies: []string{"app"}}
+		require.NoError(t, c.CreateRole("app", role))
+		role.TokenPolicies = []string{"admin"}
+		require.NoError(t, c.CreateRole("app", role))
+		require.NoError(t, c.DeleteRole("app"))
+
+		require.Len(t, *mutations, 3)
+		path := fmt.Sprintf("auth/%s/role/app", authK8sMount)
+		created, updated, deleted := (*mutations)[0], (*mutations)[1], (*mutations)[2]
+		assert.Equal(t, mutation{target: path, action: auditCreate, after: created.after}, created)
+		assert.Equal(t, []interface{}{"app"}, created.after.(map[string]interface{})["token_policies"])
+		assert.Equal(t, auditUpdate, updated.action)
+		assert.Equal(t, audit.Digested(audit.Digest(created.after)), updated.before)
+		assert.Equal(t, []interface{}{"admin"}, updated.after.(map[string]interface{})["token_policies"])
+		assert.Equal(t, auditDelete, deleted.action)
+		assert.Equal(t, audit.Digested(audit.Digest(updated.after)), deleted.before)
+		assert.Nil(t, deleted.after)
+	})
+
+	t.Run("when policy read as not found is deleted then nothing is audited", func(t *testing.T) {
+
+		c, _, mutations := newAuditedClient(t)
+		policy, err := c.ReadPolicy("app")
+		require.NoError(t, err)
+		require.Nil(t, policy)
+		require.NoError(t, c.DeletePolicy("app"))
+		assert.Empty(t, *mutations)
+	})
+
+	t.Run("when policy is deleted without read then delete is audited", func(t *testing.T) {
+
+		c, _, mutations := newAuditedClient(t)
+		require.NoError(t, c.DeletePolicy("app"))
+		assert.Equal(t, []mutation{{target: "sys/policies/acl/app", action: auditDelete, before: audit.Unknown}}, *mutations)
+	})
+
+	t.Run("when role is audited then vault is not read for audit", func(t *testing.T) {
+
+		c, s, _ := newAuditedClient(t)
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"app"}, TokenPolicies: []string{"app"}}
+		require.NoError(t, c.CreateRole("app", role))
+		require.NoError(t, c.DeleteRole("app"))
+		var reads int
+		for _, request := range s.Requests() {
+			if request.Method == http.MethodGet && request.Path == fmt.Sprintf("auth/%s/role/app", authK8sMount) {
+				reads++
+			}
+		}
+		// role is read once by CreateRole and once by DeleteRole
+		assert.Equal(t, 2, reads)
+	})
+
+	t.Run("when mutation fails then error is audited", func(t *testing.T) {
+
+		c, _, mutations := newAuditedClient(t)
+		require.Error(t, c.WriteKVMetadata("secret", "payments", KVMetadata{}))
+
+		require.Len(t, *mutations, 1)
+		assert.Equal(t, "secret/metadata/payments", (*mutations)[0].target)
+		assert.Equal(t, auditWrite, (*mutations)[0].action)
+		assert.Error(t, (*mutations)[0].err)
+		assert.Equal(t, audit.Unknown, (*mutations)[0].before)
+		assert.Nil(t, (*mutations)[0].after)
+	})
+
+	t.Run("when role that exists is written then previous request is not kept and before is unknown", func(t *testing.T) {
+
+		c, s, mutations := newAuditedClient(t)
+		s.SetRole(authK8sMount, "app", map[string]interface{}{"token_policies": []interface{}{"app"}})
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"app"}, TokenPolicies: []string{"admin"}}
+		require.NoError(t, c.CreateRole("app", role))
+		role.TokenPolicies = []string{"app"}
+		require.NoError(t, c.CreateRole("app", role))
+
+		require.Len(t, *mutations, 2)
+		assert.Equal(t, auditUpdate, (*mutations)[0].action)
+		assert.Equal(t, audit.Unknown, (*mutations)[0].before)
+		assert.Equal(t, audit.Digested(audit.Digest((*mutations)[0].after)), (*mutations)[1].before)
+		path := fmt.Sprintf("auth/%s/role/app", authK8sMount)
+		assert.Equal(t, map[string]string{path: audit.Digest((*mutations)[1].after)}, c.written)
+	})
+}
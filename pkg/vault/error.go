@@ -1,9 +1,23 @@
 package vault
 
 import (
+	"errors"
 	"fmt"
 	"github.com/pete911/vault-auth-kubernetes/logger"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const sealedError = "Vault is sealed"
+
+// errors returned by client, can be checked with errors.Is
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrSealed           = errors.New("vault is sealed")
+	ErrNotFound         = errors.New("not found")
+	ErrValidation       = errors.New("validation failed")
 )
 
 type errorHandler func(c *Client, responseErrs *responseErrors, jsonResponseBody interface{}, retries int) (stop bool, err error)
@@ -18,9 +32,13 @@ func expectedNotFoundErrorHandler(c *Client, responseErrs *responseErrors, jsonR
 	return false, nil
 }
 
+// re-generates token, request is retried with the new token, error is returned if there are no retries left
 func permissionDeniedErrorHandler(c *Client, responseErrs *responseErrors, _ interface{}, retries int) (bool, error) {
 
 	if responseErrs.contains("permission denied") {
+		if retries <= 1 {
+			return true, responseErrs
+		}
 		logger.Error("permission denied: re-generating token")
 		if err := c.appRoleLogin(retries - 1); err != nil {
 			return true, fmt.Errorf("app role login: %w", err)
@@ -32,6 +50,8 @@ func permissionDeniedErrorHandler(c *Client, responseErrs *responseErrors, _ int
 type responseErrors struct {
 	status int
 	errors []string
+	// parsed Retry-After header, zero if not set
+	retryAfter time.Duration
 }
 
 func (r *responseErrors) contains(msg string) bool {
@@ -44,6 +64,34 @@ func (r *responseErrors) contains(msg string) bool {
 	return false
 }
 
+// 429, 5xx and permission denied (token can be re-generated) are retried, other responses are terminal
+func (r *responseErrors) retryable() bool {
+
+	if r.status == http.StatusTooManyRequests || r.status/100 == 5 {
+		return true
+	}
+	return r.contains("permission denied")
+}
+
+func (r *responseErrors) Error() string {
+	return r.String()
+}
+
+func (r *responseErrors) Unwrap() error {
+
+	switch {
+	case r.status == http.StatusForbidden:
+		return ErrPermissionDenied
+	case r.status == http.StatusServiceUnavailable && r.contains(sealedError):
+		return ErrSealed
+	case r.status == http.StatusNotFound:
+		return ErrNotFound
+	case r.status == http.StatusBadRequest || r.status == http.StatusUnprocessableEntity:
+		return ErrValidation
+	}
+	return nil
+}
+
 func (r *responseErrors) String() string {
 
 	errs := strings.Join(r.errors, ", ")
@@ -51,3 +99,21 @@ func (r *responseErrors) String() string {
 	errs = strings.ReplaceAll(errs, "\n", "")
 	return fmt.Sprintf("%d %q", r.status, errs)
 }
+
+// Retry-After header in seconds or http date, zero is returned if the header is not set or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,218 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maximum number of followed standby redirects
+const maxRedirects = 3
+
+var (
+	vaultSealedMetric  = metrics.NewGauge("vak_vault_sealed", "Whether all vault nodes are sealed (1) or not (0).")
+	vaultStandbyMetric = metrics.NewGauge("vak_vault_standby", "Whether client uses standby vault node (1) because no active node was found.")
+	vaultUpMetric      = metrics.NewGauge("vak_vault_up", "Whether vault node is reachable (1) or not (0).", "host")
+	vaultActiveMetric  = metrics.NewGauge("vak_vault_active_host", "Vault node used by client.", "host")
+)
+
+// health of vault node used by client, found by sys/health probe of all vault hosts
+type Health struct {
+	Host        string    `json:"host"`
+	Initialized bool      `json:"initialized"`
+	Sealed      bool      `json:"sealed"`
+	Standby     bool      `json:"standby"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+type nodeHealth struct {
+	Initialized        bool `json:"initialized"`
+	Sealed             bool `json:"sealed"`
+	Standby            bool `json:"standby"`
+	PerformanceStandby bool `json:"performance_standby"`
+}
+
+// last known health, zero value if health was not checked yet
+func (c *Client) Health() Health {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.health
+}
+
+// probe sys/health of all vault hosts and switch to active node, if there is no active node, unsealed standby node is
+// used (standby redirects requests to active node), error is returned if no vault host is reachable
+func (c *Client) CheckHealth() (Health, error) {
+
+	var active, standby, sealed *Health
+	for _, host := range c.hosts() {
+		node, err := c.nodeHealth(host)
+		vaultUpMetric.SetBool(err == nil, host)
+		if err != nil {
+			logger.Errorf("vault %s health: %v", host, err)
+			continue
+		}
+		h := &Health{Host: host, Initialized: node.Initialized, Sealed: node.Sealed, Standby: node.Standby || node.PerformanceStandby}
+		switch {
+		case h.Sealed || !h.Initialized:
+			if sealed == nil {
+				sealed = h
+			}
+		case h.Standby:
+			if standby == nil {
+				standby = h
+			}
+		default:
+			if active == nil {
+				active = h
+			}
+		}
+	}
+
+	var health *Health
+	for _, h := range []*Health{active, standby, sealed} {
+		if h != nil {
+			health = h
+			break
+		}
+	}
+	if health == nil {
+		return Health{}, errors.New("no vault host is reachable")
+	}
+	health.CheckedAt = time.Now()
+	c.setHealth(*health)
+	return *health, nil
+}
+
+func (c *Client) setHealth(health Health) {
+
+	c.mu.Lock()
+	previous := c.host
+	c.health = health
+	if !health.Sealed {
+		c.host = health.Host
+	}
+	current := c.host
+	c.mu.Unlock()
+
+	if previous != "" && previous != current {
+		logger.Logf("switching vault host from %s to %s", previous, current)
+	}
+	vaultSealedMetric.SetBool(health.Sealed)
+	vaultStandbyMetric.SetBool(health.Standby)
+	vaultActiveMetric.Reset()
+	vaultActiveMetric.Set(1, current)
+}
+
+func (c *Client) nodeHealth(host string) (nodeHealth, error) {
+
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s/sys/health", host, vaultVersion), nil)
+	if err != nil {
+		return nodeHealth{}, fmt.Errorf("new http request: %w", err)
+	}
+	response, err := c.config.HttpClient.Do(request)
+	if err != nil {
+		return nodeHealth{}, fmt.Errorf("http httpClient do: %w", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nodeHealth{}, fmt.Errorf("read response body: %w", err)
+	}
+
+	// sys/health returns non 2xx status for standby (429, 473), sealed (503) and uninitialised (501) nodes
+	var node nodeHealth
+	if err := json.Unmarshal(body, &node); err != nil {
+		return nodeHealth{}, fmt.Errorf("%d status: unmarshal json response: %w", response.StatusCode, err)
+	}
+	return node, nil
+}
+
+// all configured vault hosts, without trailing '/' and duplicates
+func (c *Client) hosts() []string {
+
+	var out []string
+	seen := make(map[string]struct{})
+	for _, host := range append([]string{c.config.Host}, c.config.Hosts...) {
+		host = strings.TrimSuffix(strings.TrimSpace(host), "/")
+		if _, ok := seen[host]; ok || host == "" {
+			continue
+		}
+		seen[host] = struct{}{}
+		out = append(out, host)
+	}
+	return out
+}
+
+// vault host requests are sent to
+func (c *Client) activeHost() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.host != "" {
+		return c.host
+	}
+	return c.config.Host
+}
+
+// switch to another vault node after network error or sealed response, only if there are multiple hosts
+func (c *Client) failover() {
+
+	if len(c.hosts()) < 2 {
+		return
+	}
+	if _, err := c.CheckHealth(); err != nil {
+		logger.Errorf("vault failover: %v", err)
+	}
+}
+
+// standby nodes redirect (307) requests to active node, redirects are followed only to configured vault hosts (vault
+// token is sent with the redirected request) and https is never downgraded to http
+func (c *Client) checkRedirect(request *http.Request, via []*http.Request) error {
+
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if via[0].URL.Scheme == "https" && request.URL.Scheme != "https" {
+		return fmt.Errorf("redirect from https to %s is not allowed", request.URL.Scheme)
+	}
+	for _, host := range c.hosts() {
+		if u, err := url.Parse(host); err == nil && u.Scheme == request.URL.Scheme && u.Host == request.URL.Host {
+			return nil
+		}
+	}
+	return fmt.Errorf("redirect to %s is not allowed, it is not one of vault hosts", request.URL.Host)
+}
+
+// use redirect target as active host, so next requests do not need to be redirected
+func (c *Client) followedRedirect(request *http.Request, response *http.Response) {
+
+	if response.Request == nil || response.Request.URL.Host == request.URL.Host {
+		return
+	}
+	host := fmt.Sprintf("%s://%s", response.Request.URL.Scheme, response.Request.URL.Host)
+	c.mu.Lock()
+	previous := c.host
+	c.host = host
+	c.mu.Unlock()
+	logger.Logf("vault %s redirected request to %s, switching vault host", previous, host)
+}
+
+// point request to active host, host can change between retries
+func (c *Client) setRequestHost(request *http.Request) {
+
+	u, err := url.Parse(c.activeHost())
+	if err != nil {
+		return
+	}
+	request.URL.Scheme = u.Scheme
+	request.URL.Host = u.Host
+	request.Host = ""
+}
@@ -0,0 +1,200 @@
+package vault
+
+import (
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"net/http"
+)
+
+// auth kubernetes alias_name_source values
+const (
+	AliasNameSourceUID  = "serviceaccount_uid"
+	AliasNameSourceName = "serviceaccount_name"
+)
+
+// https://developer.hashicorp.com/vault/api-docs/secret/identity/entity#read-entity-by-name
+type Entity struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata"`
+	Aliases  []EntityAlias     `json:"aliases"`
+}
+
+// alias returns entity alias of the auth mount (accessor), nil if the entity has no alias of the mount
+func (e Entity) Alias(mountAccessor string) *EntityAlias {
+
+	for _, alias := range e.Aliases {
+		if alias.MountAccessor == mountAccessor {
+			return &alias
+		}
+	}
+	return nil
+}
+
+// https://developer.hashicorp.com/vault/api-docs/secret/identity/entity-alias
+type EntityAlias struct {
+	ID            string `json:"id,omitempty"`
+	Name          string `json:"name"`
+	CanonicalID   string `json:"canonical_id"`
+	MountAccessor string `json:"mount_accessor"`
+}
+
+// https://developer.hashicorp.com/vault/api-docs/secret/identity/group#read-group-by-name
+type Group struct {
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	Metadata        map[string]string `json:"metadata"`
+	MemberEntityIDs []string          `json:"member_entity_ids"`
+}
+
+// list entity names
+func (c *Client) ListEntities() ([]string, error) {
+	return c.listIdentity("identity/entity/name")
+}
+
+// read entity by name, when 404 is returned from vault, nil entity and nil error is returned
+func (c *Client) ReadEntity(name string) (*Entity, error) {
+
+	response := &struct {
+		Data *Entity `json:"data"`
+	}{}
+	if err := c.readIdentity(fmt.Sprintf("identity/entity/name/%s", name), response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// create or update entity by name, fields that are not in the request (e.g. policies) are not changed by vault
+func (c *Client) WriteEntity(name string, metadata map[string]string) error {
+
+	path := fmt.Sprintf("identity/entity/name/%s", name)
+	return c.writeIdentity(path, map[string]interface{}{"metadata": metadata})
+}
+
+func (c *Client) DeleteEntity(name string) error {
+	return c.deleteIdentity(fmt.Sprintf("identity/entity/name/%s", name))
+}
+
+// entity that has alias with the name on the auth mount (accessor), nil entity and nil error is returned if there is
+// no such alias
+func (c *Client) LookupEntityByAlias(aliasName, mountAccessor string) (*Entity, error) {
+
+	response := &struct {
+		Data *Entity `json:"data"`
+	}{}
+
+	request := map[string]string{"alias_name": aliasName, "alias_mount_accessor": mountAccessor}
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, "identity/lookup/entity", request)
+	if err != nil {
+		return nil, err
+	}
+
+	// vault returns 204 with no body if the alias does not exist
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// create entity alias, or update it when alias has id (e.g. alias name changed or alias is moved to another entity)
+func (c *Client) WriteEntityAlias(alias EntityAlias) error {
+
+	path := "identity/entity-alias"
+	if alias.ID != "" {
+		path = fmt.Sprintf("identity/entity-alias/id/%s", alias.ID)
+	}
+	request := map[string]interface{}{"name": alias.Name, "canonical_id": alias.CanonicalID, "mount_accessor": alias.MountAccessor}
+	return c.writeIdentity(path, request)
+}
+
+func (c *Client) DeleteEntityAlias(id string) error {
+	return c.deleteIdentity(fmt.Sprintf("identity/entity-alias/id/%s", id))
+}
+
+// list group names
+func (c *Client) ListGroups() ([]string, error) {
+	return c.listIdentity("identity/group/name")
+}
+
+// read group by name, when 404 is returned from vault, nil group and nil error is returned
+func (c *Client) ReadGroup(name string) (*Group, error) {
+
+	response := &struct {
+		Data *Group `json:"data"`
+	}{}
+	if err := c.readIdentity(fmt.Sprintf("identity/group/name/%s", name), response); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// create or update internal group by name, fields that are not in the request (e.g. policies) are not changed by vault
+func (c *Client) WriteGroup(name string, metadata map[string]string, memberEntityIDs []string) error {
+
+	path := fmt.Sprintf("identity/group/name/%s", name)
+	if memberEntityIDs == nil {
+		memberEntityIDs = []string{}
+	}
+	request := map[string]interface{}{"type": "internal", "metadata": metadata, "member_entity_ids": memberEntityIDs}
+	return c.writeIdentity(path, request)
+}
+
+func (c *Client) DeleteGroup(name string) error {
+	return c.deleteIdentity(fmt.Sprintf("identity/group/name/%s", name))
+}
+
+func (c *Client) listIdentity(path string) ([]string, error) {
+
+	response := struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest("LIST", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, &response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data.Keys, nil
+}
+
+func (c *Client) readIdentity(path string, response interface{}) error {
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	return c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries)
+}
+
+func (c *Client) writeIdentity(path string, request interface{}) error {
+
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, request)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("writing identity: POST %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+func (c *Client) deleteIdentity(path string) error {
+
+	jsonRequest, err := c.newJsonRequest(http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("deleting identity: DELETE %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
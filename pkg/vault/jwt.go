@@ -0,0 +1,260 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// auth method mounted at 'kubernetes/<account>/<cluster>', roles are written as jwt roles when auth type is jwt, so
+// vault validates service account tokens with cluster signing keys and does not call TokenReview API
+const (
+	AuthTypeKubernetes = "kubernetes"
+	AuthTypeJWT        = "jwt"
+
+	// jwt role user_claim value (and entity alias name) is 'system:serviceaccount:<namespace>:<name>'
+	AliasNameSourceSubject = "subject"
+
+	serviceAccountSubjectPrefix = "system:serviceaccount:"
+)
+
+// jwt role fields that vault returns, but kubernetes role does not have them, they are not returned by ReadRole
+var jwtRoleFields = []string{"role_type", "user_claim", "user_claim_json_pointer", "bound_subject", "bound_claims",
+	"bound_claims_type", "bound_audiences", "claim_mappings", "groups_claim", "oidc_scopes", "allowed_redirect_uris",
+	"verbose_oidc_logging", "max_age", "clock_skew_leeway", "expiration_leeway", "not_before_leeway"}
+
+// https://developer.hashicorp.com/vault/api-docs/auth/jwt#read-config
+type AuthJWTConfig struct {
+	BoundIssuer          string   `json:"bound_issuer"`
+	JWTValidationPubkeys []string `json:"jwt_validation_pubkeys"`
+}
+
+// https://developer.hashicorp.com/vault/api-docs/auth/jwt#create-update-role, bound subject and claims are always sent,
+// so the previous value is cleared
+type jwtRole struct {
+	RoleType        string                 `json:"role_type"`
+	UserClaim       string                 `json:"user_claim"`
+	BoundSubject    string                 `json:"bound_subject"`
+	BoundClaims     map[string]interface{} `json:"bound_claims"`
+	BoundClaimsType string                 `json:"bound_claims_type"`
+	BoundAudiences  []string               `json:"bound_audiences"`
+	TokenPolicies   []string               `json:"token_policies"`
+	TokenTTL        int                    `json:"token_ttl"`
+}
+
+// initialise auth jwt, check if there is auth mount 'kubernetes/<account>/<cluster>', if not, mount and tune, auth is
+// re-configured when issuer or validation public keys in vault differ (e.g. cluster signing key was rotated), mounted
+// is true if auth was not mounted and it has been mounted by this call (all roles in vault are gone)
+func (c *Client) InitAuthJWT(issuer string, validationPubkeys []string) (mounted bool, err error) {
+
+	mount, err := c.authKubernetesMount()
+	if err != nil {
+		return false, err
+	}
+	if mounted = mount == nil; mounted {
+		logger.Logf("initialising %s jwt auth", c.mount)
+		if err := c.mountAuthKubernetes(); err != nil {
+			return false, err
+		}
+		if mount, err = c.authKubernetesMount(); err != nil {
+			return mounted, err
+		}
+	}
+	c.setAccessor(mount)
+	if c.tuneMount {
+		c.tuneAuthKubernetes(mount)
+	}
+
+	config, err := c.ReadAuthJWTConfig()
+	if err != nil {
+		return mounted, err
+	}
+	if config != nil && config.BoundIssuer == issuer && equalKeys(config.JWTValidationPubkeys, validationPubkeys) {
+		return mounted, nil
+	}
+	return mounted, c.configureAuthJWT(issuer, validationPubkeys)
+}
+
+// read auth jwt config, when 404 is returned from vault (auth is not configured), nil config and nil error is returned
+func (c *Client) ReadAuthJWTConfig() (*AuthJWTConfig, error) {
+
+	path := fmt.Sprintf("auth/%s/config", c.mount)
+	response := &struct {
+		Data *AuthJWTConfig `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+func (c *Client) configureAuthJWT(issuer string, validationPubkeys []string) error {
+
+	logger.Logf("jwt issuer: %s, %d validation public keys", issuer, len(validationPubkeys))
+	path := fmt.Sprintf("auth/%s/config", c.mount)
+	request := AuthJWTConfig{BoundIssuer: issuer, JWTValidationPubkeys: validationPubkeys}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, request)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("configuring auth jwt: POST %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+// auth method type, kubernetes if auth type is not set
+func (c *Client) authType() string {
+
+	if c.config.AuthType == "" {
+		return AuthTypeKubernetes
+	}
+	return c.config.AuthType
+}
+
+// role request body, kubernetes role as it is or jwt role translated from kubernetes role
+func (c *Client) roleRequest(role Role) interface{} {
+
+	if c.authType() != AuthTypeJWT {
+		return role
+	}
+	return newJWTRole(role, c.config.JWTAudience)
+}
+
+// jwt role that binds service accounts the same way as kubernetes role, role without audience is bound to default
+// audience, single service account is bound by subject, otherwise subjects of all namespace and name combinations are
+// bound by sub claim (glob if there is wildcard)
+func newJWTRole(role Role, defaultAudience string) jwtRole {
+
+	audience := role.Audience
+	if audience == "" {
+		audience = defaultAudience
+	}
+	out := jwtRole{
+		RoleType:        AuthTypeJWT,
+		UserClaim:       "sub",
+		BoundClaims:     map[string]interface{}{},
+		BoundClaimsType: "string",
+		BoundAudiences:  []string{audience},
+		TokenPolicies:   role.TokenPolicies,
+		TokenTTL:        role.TokenTTL,
+	}
+
+	var subjects []string
+	for _, namespace := range sortedCopy(role.BoundServiceAccountNamespaces) {
+		for _, name := range sortedCopy(role.BoundServiceAccountNames) {
+			subjects = append(subjects, serviceAccountSubject(namespace, name))
+		}
+	}
+	if len(subjects) == 1 && !strings.Contains(subjects[0], "*") {
+		out.BoundSubject = subjects[0]
+		return out
+	}
+	out.BoundClaims["sub"] = subjects
+	if strings.Contains(strings.Join(subjects, ","), "*") {
+		out.BoundClaimsType = "glob"
+	}
+	return out
+}
+
+// jwt role data read from vault as kubernetes role data, bound subjects are split into service account namespaces and
+// names, audience is empty if it is the default audience, other jwt role fields are removed
+func kubernetesRoleData(data map[string]interface{}, defaultAudience string) map[string]interface{} {
+
+	out := make(map[string]interface{})
+	for k, v := range data {
+		out[k] = v
+	}
+	for _, field := range jwtRoleFields {
+		delete(out, field)
+	}
+
+	var subjects []string
+	if subject, ok := data["bound_subject"].(string); ok && subject != "" {
+		subjects = append(subjects, subject)
+	}
+	if claims, ok := data["bound_claims"].(map[string]interface{}); ok {
+		subjects = append(subjects, sortedStrings(claims["sub"])...)
+	}
+	namespaces, names := make(map[string]struct{}), make(map[string]struct{})
+	for _, subject := range subjects {
+		if namespace, name, ok := strings.Cut(strings.TrimPrefix(subject, serviceAccountSubjectPrefix), ":"); ok {
+			namespaces[namespace], names[name] = struct{}{}, struct{}{}
+		}
+	}
+	out["bound_service_account_namespaces"] = setKeys(namespaces)
+	out["bound_service_account_names"] = setKeys(names)
+
+	if audiences := sortedStrings(data["bound_audiences"]); len(audiences) != 0 && audiences[0] != defaultAudience {
+		out["audience"] = audiences[0]
+	}
+	return out
+}
+
+// role data as role, jwt role data is translated to kubernetes role
+func (c *Client) roleFromData(data map[string]interface{}) (*Role, error) {
+
+	if data == nil {
+		return nil, nil
+	}
+	if data["role_type"] != nil {
+		data = kubernetesRoleData(data, c.config.JWTAudience)
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var role Role
+	if err := json.Unmarshal(b, &role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func serviceAccountSubject(namespace, name string) string {
+	return fmt.Sprintf("%s%s:%s", serviceAccountSubjectPrefix, namespace, name)
+}
+
+func setKeys(set map[string]struct{}) []string {
+
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keys are equal regardless of order and surrounding white space
+func equalKeys(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	trim := func(in []string) []string {
+		var out []string
+		for _, v := range in {
+			out = append(out, strings.TrimSpace(v))
+		}
+		sort.Strings(out)
+		return out
+	}
+	ta, tb := trim(a), trim(b)
+	for i := range ta {
+		if ta[i] != tb[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package vault
+
+import (
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"net/http"
+)
+
+// https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2#read-secret-metadata
+type KVMetadata struct {
+	MaxVersions        int               `json:"max_versions"`
+	DeleteVersionAfter string            `json:"delete_version_after"`
+	CustomMetadata     map[string]string `json:"custom_metadata"`
+}
+
+// mount kv version 2 secrets engine if it is not mounted, error is returned if there is different secrets engine (or
+// kv version 1) mounted at the path, mounted is true if kv has been mounted by this call
+func (c *Client) EnsureKVMount(path string) (mounted bool, err error) {
+
+	mount, err := c.secretsMountAt(path)
+	if err != nil {
+		return false, err
+	}
+	if mount != nil {
+		if mount.Type != "kv" || mount.Options["version"] != "2" {
+			return false, fmt.Errorf("secrets engine mounted at %s is not kv version 2", path)
+		}
+		return false, nil
+	}
+
+	logger.Logf("mounting kv version 2 at %s", path)
+	if err := c.mountSecrets(path, secretsMount{Type: "kv", Options: map[string]string{"version": "2"}}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// list keys under the path, folders end with '/', nil keys and nil error is returned if the path does not exist
+func (c *Client) ListKVMetadata(mount, path string) ([]string, error) {
+
+	response := struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest("LIST", fmt.Sprintf("%s/metadata/%s", mount, path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, &response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data.Keys, nil
+}
+
+// read kv metadata, when 404 is returned from vault, nil metadata and nil error is returned
+func (c *Client) ReadKVMetadata(mount, path string) (*KVMetadata, error) {
+
+	response := &struct {
+		Data *KVMetadata `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, fmt.Sprintf("%s/metadata/%s", mount, path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// create or update kv metadata, custom metadata replaces custom metadata in vault, secret versions are not changed
+func (c *Client) WriteKVMetadata(mount, path string, metadata KVMetadata) error {
+
+	metadataPath := fmt.Sprintf("%s/metadata/%s", mount, path)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, metadataPath, metadata)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("writing kv metadata: POST %s", metadataPath)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
@@ -0,0 +1,66 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// auth of service account login
+type LoginResult struct {
+	ClientToken   string   `json:"client_token"`
+	TokenPolicies []string `json:"token_policies"`
+}
+
+// login to auth mount with service account token the same way as applications do, login is not retried, so login
+// errors (e.g. audience or bound service account mismatch) are returned immediately
+func (c *Client) Login(role string, serviceAccountJWT []byte) (LoginResult, error) {
+
+	path := fmt.Sprintf("auth/%s/login", c.mount)
+	request := map[string]string{"role": role, "jwt": string(serviceAccountJWT)}
+	response := &struct {
+		Auth *LoginResult `json:"auth"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, request)
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	if err := c.doJsonRequest(jsonRequest, response, nil, 1); err != nil {
+		return LoginResult{}, err
+	}
+	if response.Auth == nil || response.Auth.ClientToken == "" {
+		return LoginResult{}, errors.New("login response does not have client token")
+	}
+	return *response.Auth, nil
+}
+
+// revoke token returned by login, token revokes itself, so no policy is needed
+func (c *Client) RevokeToken(token string) error {
+
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, "auth/token/revoke-self", nil)
+	if err != nil {
+		return err
+	}
+	jsonRequest.Header.Set("X-Vault-Token", token)
+
+	responseErrs, err := c.doHttpRequest(jsonRequest, nil)
+	if err != nil {
+		return err
+	}
+	if responseErrs != nil {
+		return responseErrs
+	}
+	return nil
+}
+
+// audience of service account token that can login with the role, empty audience (API server audience) for
+// kubernetes role without audience
+func (c *Client) LoginAudience(role Role) string {
+
+	if role.Audience == "" && c.authType() == AuthTypeJWT {
+		return c.config.JWTAudience
+	}
+	return role.Audience
+}
@@ -0,0 +1,226 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// auth mount settings, set when auth is mounted and tuned (sys/auth/<mount>/tune) when they differ from vault, empty
+// fields are not managed, local and seal wrap can be set only when auth is mounted
+// e.g. {"description": "payments cluster", "default_lease_ttl": "1h", "max_lease_ttl": "24h", "listing_visibility": "unauth"}
+type MountSpec struct {
+	Description              string   `json:"description"`
+	DefaultLeaseTTL          string   `json:"default_lease_ttl"`
+	MaxLeaseTTL              string   `json:"max_lease_ttl"`
+	ListingVisibility        string   `json:"listing_visibility"`
+	AuditNonHMACRequestKeys  []string `json:"audit_non_hmac_request_keys"`
+	AuditNonHMACResponseKeys []string `json:"audit_non_hmac_response_keys"`
+	TokenType                string   `json:"token_type"`
+	PluginVersion            string   `json:"plugin_version"`
+	Local                    bool     `json:"local"`
+	SealWrap                 bool     `json:"seal_wrap"`
+}
+
+// mount spec used when mount spec file is not set, auth is not tuned
+func DefaultMountSpec() MountSpec {
+
+	return MountSpec{
+		Description: "Kubernetes auth backend for RUN cluster",
+		MaxLeaseTTL: "8760h",
+	}
+}
+
+// mount spec from json file, fields that are not in the file are set to DefaultMountSpec values
+func LoadMountSpec(file string) (MountSpec, error) {
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return MountSpec{}, fmt.Errorf("read mount spec file: %w", err)
+	}
+
+	spec := DefaultMountSpec()
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return MountSpec{}, fmt.Errorf("unmarshal mount spec: %w", err)
+	}
+	return spec, spec.validate()
+}
+
+func (s MountSpec) validate() error {
+
+	for field, ttl := range map[string]string{"default_lease_ttl": s.DefaultLeaseTTL, "max_lease_ttl": s.MaxLeaseTTL} {
+		if _, err := ttlSeconds(ttl); ttl != "" && err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+	switch s.ListingVisibility {
+	case "", "unauth", "hidden":
+	default:
+		return fmt.Errorf("listing_visibility %q is not one of unauth or hidden", s.ListingVisibility)
+	}
+	switch s.TokenType {
+	case "", "default-service", "default-batch", "service", "batch":
+	default:
+		return fmt.Errorf("token_type %q is not one of default-service, default-batch, service or batch", s.TokenType)
+	}
+	return nil
+}
+
+// sys/auth/<mount> request body
+func (s MountSpec) mountRequest(mountType string) map[string]interface{} {
+
+	request := map[string]interface{}{
+		"type":        mountType,
+		"description": s.Description,
+		"local":       s.Local,
+		"seal_wrap":   s.SealWrap,
+	}
+	if s.PluginVersion != "" {
+		request["plugin_version"] = s.PluginVersion
+	}
+	config := s.tuneFields()
+	delete(config, "description")
+	delete(config, "plugin_version")
+	if len(config) != 0 {
+		request["config"] = config
+	}
+	return request
+}
+
+// mount spec of auth tune read from vault, ttls are set as number of seconds, local and seal wrap are not part of tune
+func NewMountSpecFromTune(tune map[string]interface{}) MountSpec {
+
+	var spec MountSpec
+	for field, value := range map[string]*string{
+		"description":        &spec.Description,
+		"listing_visibility": &spec.ListingVisibility,
+		"token_type":         &spec.TokenType,
+		"plugin_version":     &spec.PluginVersion,
+	} {
+		*value, _ = tune[field].(string)
+	}
+	for field, value := range map[string]*string{"default_lease_ttl": &spec.DefaultLeaseTTL, "max_lease_ttl": &spec.MaxLeaseTTL} {
+		if seconds, err := ValueSeconds(tune[field]); err == nil && seconds != 0 {
+			*value = strconv.Itoa(seconds)
+		}
+	}
+	for field, value := range map[string]*[]string{
+		"audit_non_hmac_request_keys":  &spec.AuditNonHMACRequestKeys,
+		"audit_non_hmac_response_keys": &spec.AuditNonHMACResponseKeys,
+	} {
+		*value = sortedStrings(tune[field])
+	}
+	return spec
+}
+
+// managed tune fields
+func (s MountSpec) tuneFields() map[string]interface{} {
+
+	fields := make(map[string]interface{})
+	for k, v := range map[string]string{
+		"description":        s.Description,
+		"default_lease_ttl":  s.DefaultLeaseTTL,
+		"max_lease_ttl":      s.MaxLeaseTTL,
+		"listing_visibility": s.ListingVisibility,
+		"token_type":         s.TokenType,
+		"plugin_version":     s.PluginVersion,
+	} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	if s.AuditNonHMACRequestKeys != nil {
+		fields["audit_non_hmac_request_keys"] = s.AuditNonHMACRequestKeys
+	}
+	if s.AuditNonHMACResponseKeys != nil {
+		fields["audit_non_hmac_response_keys"] = s.AuditNonHMACResponseKeys
+	}
+	return fields
+}
+
+// managed tune fields that differ from tune read from vault, nil if there is no difference
+func (s MountSpec) tuneDiff(tune map[string]interface{}) map[string]interface{} {
+
+	diff := make(map[string]interface{})
+	for field, desired := range s.tuneFields() {
+		if !tuneValueEqual(field, desired, tune[field]) {
+			diff[field] = desired
+		}
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	return diff
+}
+
+func tuneValueEqual(field string, desired, actual interface{}) bool {
+
+	switch field {
+	case "default_lease_ttl", "max_lease_ttl":
+		desiredSeconds, err := ttlSeconds(desired.(string))
+		if err != nil {
+			return false
+		}
+		actualSeconds, err := ValueSeconds(actual)
+		return err == nil && desiredSeconds == actualSeconds
+	case "audit_non_hmac_request_keys", "audit_non_hmac_response_keys":
+		// explicit empty list clears keys, vault does not return the field when there are no keys
+		desiredKeys, actualKeys := sortedStrings(desired), sortedStrings(actual)
+		if len(desiredKeys) == 0 {
+			return len(actualKeys) == 0
+		}
+		return reflect.DeepEqual(desiredKeys, actualKeys)
+	}
+	if actual == nil {
+		actual = ""
+	}
+	return desired == actual
+}
+
+// ttl as seconds, ttl is duration (e.g. 1h) or number of seconds
+func ttlSeconds(ttl string) (int, error) {
+
+	if seconds, err := strconv.Atoi(ttl); err == nil {
+		return seconds, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %q: %w", ttl, err)
+	}
+	return int(d.Seconds()), nil
+}
+
+// ttl as seconds, ttl is number of seconds (as returned by vault), duration (e.g. 1h) or number of seconds as string
+func ValueSeconds(v interface{}) (int, error) {
+
+	switch value := v.(type) {
+	case float64:
+		return int(value), nil
+	case int:
+		return value, nil
+	case string:
+		return ttlSeconds(value)
+	}
+	return 0, fmt.Errorf("invalid ttl %v", v)
+}
+
+// string or interface list (as unmarshalled from json) as sorted strings, nil if v is not a list, empty list is kept
+func sortedStrings(v interface{}) []string {
+
+	var out []string
+	switch list := v.(type) {
+	case []string:
+		out = append(make([]string, 0, len(list)), list...)
+	case []interface{}:
+		out = make([]string, 0, len(list))
+		for _, item := range list {
+			out = append(out, fmt.Sprint(item))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,128 @@
+package vault
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMountSpec(t *testing.T) {
+
+	t.Run("when mount spec file is loaded then fields that are not in the file are defaults", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "mount-spec.json")
+		require.NoError(t, os.WriteFile(file, []byte(`{"default_lease_ttl": "1h", "audit_non_hmac_request_keys": ["role"], "local": true}`), 0600))
+
+		spec, err := LoadMountSpec(file)
+		require.NoError(t, err)
+		expected := DefaultMountSpec()
+		expected.DefaultLeaseTTL = "1h"
+		expected.AuditNonHMACRequestKeys = []string{"role"}
+		expected.Local = true
+		assert.Equal(t, expected, spec)
+	})
+
+	t.Run("when mount spec file has empty audit keys then keys are empty, not missing", func(t *testing.T) {
+
+		file := filepath.Join(t.TempDir(), "mount-spec.json")
+		require.NoError(t, os.WriteFile(file, []byte(`{"audit_non_hmac_request_keys": []}`), 0600))
+
+		spec, err := LoadMountSpec(file)
+		require.NoError(t, err)
+		assert.Equal(t, []string{}, spec.AuditNonHMACRequestKeys)
+		assert.Nil(t, spec.AuditNonHMACResponseKeys)
+	})
+
+	t.Run("when mount spec has invalid values then error is returned", func(t *testing.T) {
+
+		for _, content := range []string{`{"max_lease_ttl": "1 year"}`, `{"listing_visibility": "public"}`, `{"token_type": "jwt"}`, `[]`} {
+			file := filepath.Join(t.TempDir(), "mount-spec.json")
+			require.NoError(t, os.WriteFile(file, []byte(content), 0600))
+
+			_, err := LoadMountSpec(file)
+			assert.Error(t, err, content)
+		}
+	})
+}
+
+func TestNewMountSpecFromTune(t *testing.T) {
+
+	t.Run("when mount spec is created from vault tune then it has no diff with the tune", func(t *testing.T) {
+
+		tune := map[string]interface{}{
+			"description":                 "test",
+			"default_lease_ttl":           float64(3600),
+			"max_lease_ttl":               float64(31536000),
+			"force_no_cache":              false,
+			"audit_non_hmac_request_keys": []interface{}{"role", "jwt"},
+			"token_type":                  "default-service",
+		}
+		spec := NewMountSpecFromTune(tune)
+		assert.Equal(t, MountSpec{
+			Description:             "test",
+			DefaultLeaseTTL:         "3600",
+			MaxLeaseTTL:             "31536000",
+			AuditNonHMACRequestKeys: []string{"jwt", "role"},
+			TokenType:               "default-service",
+		}, spec)
+		assert.NoError(t, spec.validate())
+		assert.Nil(t, spec.tuneDiff(tune))
+	})
+}
+
+func TestMountSpec_tuneDiff(t *testing.T) {
+
+	spec := MountSpec{
+		Description:             "test",
+		DefaultLeaseTTL:         "1h",
+		MaxLeaseTTL:             "8760h",
+		AuditNonHMACRequestKeys: []string{"role", "jwt"},
+		TokenType:               "default-service",
+	}
+
+	t.Run("when vault tune has the same values then there is no diff", func(t *testing.T) {
+
+		tune := map[string]interface{}{
+			"description":                 "test",
+			"default_lease_ttl":           float64(3600),
+			"max_lease_ttl":               float64(31536000),
+			"force_no_cache":              false,
+			"audit_non_hmac_request_keys": []interface{}{"jwt", "role"},
+			"token_type":                  "default-service",
+		}
+		assert.Nil(t, spec.tuneDiff(tune))
+	})
+
+	t.Run("when vault tune differs then only different managed fields are returned", func(t *testing.T) {
+
+		tune := map[string]interface{}{
+			"description":       "edited",
+			"default_lease_ttl": float64(3600),
+			"max_lease_ttl":     float64(2764800),
+			"token_type":        "default-service",
+		}
+		expected := map[string]interface{}{
+			"description":                 "test",
+			"max_lease_ttl":               "8760h",
+			"audit_non_hmac_request_keys": []string{"role", "jwt"},
+		}
+		assert.Equal(t, expected, spec.tuneDiff(tune))
+	})
+
+	t.Run("when mount spec has explicit empty audit keys then vault keys are cleared", func(t *testing.T) {
+
+		clearKeys := MountSpec{AuditNonHMACRequestKeys: []string{}}
+		expected := map[string]interface{}{"audit_non_hmac_request_keys": []string{}}
+		assert.Equal(t, expected, clearKeys.tuneDiff(map[string]interface{}{"audit_non_hmac_request_keys": []interface{}{"role"}}))
+		assert.Nil(t, clearKeys.tuneDiff(map[string]interface{}{}), "vault does not return keys when there are none")
+		assert.Nil(t, clearKeys.tuneDiff(map[string]interface{}{"audit_non_hmac_request_keys": []interface{}{}}))
+		assert.Nil(t, MountSpec{}.tuneDiff(map[string]interface{}{"audit_non_hmac_request_keys": []interface{}{"role"}}), "nil keys are not managed")
+	})
+
+	t.Run("when mount spec is empty then nothing is managed", func(t *testing.T) {
+
+		assert.Nil(t, MountSpec{}.tuneDiff(map[string]interface{}{"description": "edited"}))
+	})
+}
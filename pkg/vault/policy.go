@@ -0,0 +1,89 @@
+package vault
+
+import (
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"net/http"
+)
+
+// built-in policies, they cannot be written nor deleted
+var builtinPolicies = map[string]struct{}{"default": {}, "root": {}}
+
+// https://developer.hashicorp.com/vault/api-docs/system/policies#read-acl-policy
+type Policy struct {
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+}
+
+func IsBuiltinPolicy(name string) bool {
+
+	_, ok := builtinPolicies[name]
+	return ok
+}
+
+// list acl policy names, built-in policies (default and root) are included
+func (c *Client) ListPolicies() ([]string, error) {
+
+	response := struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest("LIST", "sys/policies/acl", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, &response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data.Keys, nil
+}
+
+// read acl policy, when 404 is returned from vault, nil policy and nil error is returned
+func (c *Client) ReadPolicy(name string) (*Policy, error) {
+
+	response := &struct {
+		Data *Policy `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, fmt.Sprintf("sys/policies/acl/%s", name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// create or update acl policy, policy is HCL (or json) policy document
+func (c *Client) WritePolicy(name, policy string) error {
+
+	path := fmt.Sprintf("sys/policies/acl/%s", name)
+	jsonRequest, err := c.newJsonRequest(http.MethodPut, path, map[string]string{"policy": policy})
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("writing policy: PUT %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+func (c *Client) DeletePolicy(name string) error {
+
+	path := fmt.Sprintf("sys/policies/acl/%s", name)
+	jsonRequest, err := c.newJsonRequest(http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("deleting policy: DELETE %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
@@ -1,12 +1,14 @@
 package vault
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/pete911/vault-auth-kubernetes/pkg/util"
 	"reflect"
 	"sort"
+	"strings"
 )
 
 // https://www.vaultproject.io/api-docs/auth/kubernetes#create-role
@@ -15,6 +17,7 @@ type Role struct {
 	BoundServiceAccountNamespaces []string `json:"bound_service_account_namespaces"`
 	TokenPolicies                 []string `json:"token_policies"`
 	TokenTTL                      int      `json:"token_ttl"`
+	Audience                      string   `json:"audience"`
 	// TODO add more fields, add omit empty tag
 }
 
@@ -22,7 +25,7 @@ func NewRole(rawRole []byte) (Role, error) {
 
 	var role Role
 	if err := json.Unmarshal(rawRole, &role); err != nil {
-		return Role{}, fmt.Errorf("unmarshal vault role: %v", err)
+		return Role{}, fmt.Errorf("unmarshal vault role: %w", err)
 	}
 
 	role = role.sanitize()
@@ -32,6 +35,75 @@ func NewRole(rawRole []byte) (Role, error) {
 	return role, nil
 }
 
+var (
+	// role fields vault returns with non-zero default value
+	roleDataDefaults = map[string]interface{}{
+		"alias_name_source": "serviceaccount_uid",
+		"token_type":        "default",
+	}
+	// deprecated role fields vault returns along with the new field
+	roleDataDeprecated = map[string]string{
+		"policies":    "token_policies",
+		"ttl":         "token_ttl",
+		"max_ttl":     "token_max_ttl",
+		"period":      "token_period",
+		"bound_cidrs": "token_bound_cidrs",
+	}
+)
+
+// role from role data read from vault, fields that are set in vault, but Role does not have them, are returned as
+// unsupported (e.g. token_max_ttl=3600), role is not sanitized nor validated, jwt role data is translated to kubernetes
+// role
+func NewRoleFromData(data map[string]interface{}) (Role, []string, error) {
+
+	if data["role_type"] != nil {
+		data = kubernetesRoleData(data, "")
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return Role{}, nil, fmt.Errorf("marshal vault role data: %w", err)
+	}
+	var role Role
+	if err := json.Unmarshal(b, &role); err != nil {
+		return Role{}, nil, fmt.Errorf("unmarshal vault role: %w", err)
+	}
+
+	fields := make(map[string]struct{})
+	roleType := reflect.TypeOf(role)
+	for i := 0; i < roleType.NumField(); i++ {
+		fields[strings.Split(roleType.Field(i).Tag.Get("json"), ",")[0]] = struct{}{}
+	}
+
+	var unsupported []string
+	for field, value := range data {
+		if _, ok := fields[field]; ok || isZeroValue(value) || reflect.DeepEqual(roleDataDefaults[field], value) {
+			continue
+		}
+		if newField, ok := roleDataDeprecated[field]; ok && reflect.DeepEqual(data[newField], value) {
+			continue
+		}
+		b, _ := json.Marshal(value)
+		unsupported = append(unsupported, fmt.Sprintf("%s=%s", field, b))
+	}
+	sort.Strings(unsupported)
+	return role, unsupported, nil
+}
+
+// nil, false, zero number, empty string, list or map
+func isZeroValue(v interface{}) bool {
+
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	}
+	return value.IsZero()
+}
+
 func (r Role) sanitize() Role {
 
 	// remove duplicates if any
@@ -58,14 +130,70 @@ func (r Role) validate() error {
 }
 
 func (r Role) Equal(r2 Role) bool {
+	return len(r.Diff(r2)) == 0
+}
+
+// difference of one role field, values are json encoded (lists are sorted)
+type FieldDiff struct {
+	Field   string
+	Desired string
+	Actual  string
+}
+
+type RoleDiff []FieldDiff
+
+func (d RoleDiff) String() string {
+
+	var fields []string
+	for _, f := range d {
+		fields = append(fields, fmt.Sprintf("%s: vault %s, desired %s", f.Field, f.Actual, f.Desired))
+	}
+	return strings.Join(fields, "; ")
+}
+
+// per field difference between desired role (r) and actual role e.g. role in vault, order of list values is ignored and
+// empty list is the same as no list
+func (r Role) Diff(actual Role) RoleDiff {
 
-	sort.Sort(sort.StringSlice(r.BoundServiceAccountNames))
-	sort.Sort(sort.StringSlice(r.BoundServiceAccountNamespaces))
-	sort.Sort(sort.StringSlice(r.TokenPolicies))
+	var diff RoleDiff
+	desiredValue, actualValue := reflect.ValueOf(r), reflect.ValueOf(actual)
+	for i := 0; i < desiredValue.NumField(); i++ {
+		field := strings.Split(desiredValue.Type().Field(i).Tag.Get("json"), ",")[0]
+		desired, actual := diffValue(desiredValue.Field(i).Interface()), diffValue(actualValue.Field(i).Interface())
+		if desired != actual {
+			diff = append(diff, FieldDiff{Field: field, Desired: desired, Actual: actual})
+		}
+	}
+	return diff
+}
+
+func diffValue(v interface{}) string {
+
+	if s, ok := v.([]string); ok {
+		if v = sortedCopy(s); len(s) == 0 {
+			v = []string{}
+		}
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// sha256 of the role, order of service account names, namespaces and policies does not change the hash
+func (r Role) Hash() string {
 
-	sort.Sort(sort.StringSlice(r2.BoundServiceAccountNames))
-	sort.Sort(sort.StringSlice(r2.BoundServiceAccountNamespaces))
-	sort.Sort(sort.StringSlice(r2.TokenPolicies))
+	r.BoundServiceAccountNames = sortedCopy(r.BoundServiceAccountNames)
+	r.BoundServiceAccountNamespaces = sortedCopy(r.BoundServiceAccountNamespaces)
+	r.TokenPolicies = sortedCopy(r.TokenPolicies)
+	b, _ := json.Marshal(r)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
 
-	return reflect.DeepEqual(r, r2)
+func sortedCopy(in []string) []string {
+
+	if in == nil {
+		return nil
+	}
+	out := append([]string{}, in...)
+	sort.Strings(out)
+	return out
 }
@@ -122,3 +122,132 @@ func TestRole_Equal(t *testing.T) {
 		assert.True(t, r1.Equal(r2))
 	})
 }
+
+func TestRole_Diff(t *testing.T) {
+
+	t.Run("when roles differ then changed fields are returned in field order", func(t *testing.T) {
+
+		desired := Role{BoundServiceAccountNames: []string{"app"}, TokenPolicies: []string{"app", "default"}, TokenTTL: 3600}
+		actual := Role{BoundServiceAccountNames: []string{"app"}, TokenPolicies: []string{"admin"}, TokenTTL: 60, Audience: "vault"}
+
+		diff := desired.Diff(actual)
+		expected := RoleDiff{
+			{Field: "token_policies", Desired: `["app","default"]`, Actual: `["admin"]`},
+			{Field: "token_ttl", Desired: "3600", Actual: "60"},
+			{Field: "audience", Desired: `""`, Actual: `"vault"`},
+		}
+		assert.Equal(t, expected, diff)
+		assert.Equal(t, `token_policies: vault ["admin"], desired ["app","default"]; token_ttl: vault 60, desired 3600; audience: vault "vault", desired ""`, diff.String())
+	})
+
+	t.Run("when roles differ only in order of values or in empty and missing lists then there is no diff", func(t *testing.T) {
+
+		desired := Role{BoundServiceAccountNames: []string{"app", "worker"}, TokenPolicies: []string{"app"}}
+		actual := Role{BoundServiceAccountNames: []string{"worker", "app"}, BoundServiceAccountNamespaces: []string{}, TokenPolicies: []string{"app"}}
+		assert.Empty(t, desired.Diff(actual))
+		assert.True(t, desired.Equal(actual))
+	})
+}
+
+func TestRole_Hash(t *testing.T) {
+
+	t.Run("when roles differ only in order of values then hash is the same", func(t *testing.T) {
+
+		r1 := Role{BoundServiceAccountNames: []string{"a", "b"}, BoundServiceAccountNamespaces: []string{"x", "y"}, TokenPolicies: []string{"p1", "p2"}}
+		r2 := Role{BoundServiceAccountNames: []string{"b", "a"}, BoundServiceAccountNamespaces: []string{"y", "x"}, TokenPolicies: []string{"p2", "p1"}}
+		assert.Equal(t, r1.Hash(), r2.Hash())
+		assert.Equal(t, []string{"b", "a"}, r2.BoundServiceAccountNames)
+	})
+
+	t.Run("when roles differ then hash is different", func(t *testing.T) {
+
+		r1 := Role{BoundServiceAccountNames: []string{"a"}, TokenPolicies: []string{"p1"}}
+		r2 := Role{BoundServiceAccountNames: []string{"a"}, TokenPolicies: []string{"p1"}, TokenTTL: 60}
+		assert.NotEqual(t, r1.Hash(), r2.Hash())
+	})
+}
+
+func TestNewRoleFromData(t *testing.T) {
+
+	t.Run("when role data has fields that role does not have then set fields are returned as unsupported", func(t *testing.T) {
+
+		data := map[string]interface{}{
+			"bound_service_account_names":      []interface{}{"app"},
+			"bound_service_account_namespaces": []interface{}{"payments"},
+			"token_policies":                   []interface{}{"app"},
+			"policies":                         []interface{}{"app"},
+			"token_ttl":                        float64(3600),
+			"ttl":                              float64(3600),
+			"token_max_ttl":                    float64(7200),
+			"token_bound_cidrs":                []interface{}{},
+			"token_no_default_policy":          false,
+			"alias_name_source":                "serviceaccount_uid",
+			"token_type":                       "service",
+		}
+		role, unsupported, err := NewRoleFromData(data)
+		require.NoError(t, err)
+
+		expected := Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"payments"},
+			TokenPolicies:                 []string{"app"},
+			TokenTTL:                      3600,
+		}
+		assert.Equal(t, expected, role)
+		assert.Equal(t, []string{`token_max_ttl=7200`, `token_type="service"`}, unsupported)
+	})
+
+	t.Run("when deprecated field differs from the new field then it is returned as unsupported", func(t *testing.T) {
+
+		data := map[string]interface{}{"token_policies": []interface{}{"app"}, "policies": []interface{}{"admin"}}
+		_, unsupported, err := NewRoleFromData(data)
+		require.NoError(t, err)
+		assert.Equal(t, []string{`policies=["admin"]`}, unsupported)
+	})
+	t.Run("when role data is jwt role then it is translated to kubernetes role", func(t *testing.T) {
+
+		data := map[string]interface{}{
+			"role_type":         "jwt",
+			"user_claim":        "sub",
+			"bound_subject":     "",
+			"bound_claims":      map[string]interface{}{"sub": []interface{}{"system:serviceaccount:*:app"}},
+			"bound_claims_type": "glob",
+			"bound_audiences":   []interface{}{"vault"},
+			"clock_skew_leeway": float64(60),
+			"token_policies":    []interface{}{"app"},
+		}
+		role, unsupported, err := NewRoleFromData(data)
+		require.NoError(t, err)
+
+		expected := Role{
+			BoundServiceAccountNames:      []string{"app"},
+			BoundServiceAccountNamespaces: []string{"*"},
+			TokenPolicies:                 []string{"app"},
+			Audience:                      "vault",
+		}
+		assert.Equal(t, expected, role)
+		assert.Empty(t, unsupported)
+	})
+}
+
+func TestNewJWTRole(t *testing.T) {
+
+	t.Run("when role has one service account then it is bound by subject to default audience", func(t *testing.T) {
+
+		role := Role{BoundServiceAccountNames: []string{"app"}, BoundServiceAccountNamespaces: []string{"payments"}, TokenPolicies: []string{"app"}}
+		jwt := newJWTRole(role, "vault")
+		assert.Equal(t, "system:serviceaccount:payments:app", jwt.BoundSubject)
+		assert.Empty(t, jwt.BoundClaims)
+		assert.Equal(t, []string{"vault"}, jwt.BoundAudiences)
+	})
+
+	t.Run("when role has wildcard then subjects are bound by glob sub claim and role audience is used", func(t *testing.T) {
+
+		role := Role{BoundServiceAccountNames: []string{"app", "worker"}, BoundServiceAccountNamespaces: []string{"*"}, Audience: "payments"}
+		jwt := newJWTRole(role, "vault")
+		assert.Empty(t, jwt.BoundSubject)
+		assert.Equal(t, []string{"system:serviceaccount:*:app", "system:serviceaccount:*:worker"}, jwt.BoundClaims["sub"])
+		assert.Equal(t, "glob", jwt.BoundClaimsType)
+		assert.Equal(t, []string{"payments"}, jwt.BoundAudiences)
+	})
+}
@@ -0,0 +1,222 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"net/http"
+	"strings"
+)
+
+// secrets engine mount as listed in sys/mounts
+type secretsMount struct {
+	Type    string            `json:"type"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// https://developer.hashicorp.com/vault/api-docs/secret/kubernetes#read-configuration
+type SecretsKubernetesConfig struct {
+	KubernetesHost   string `json:"kubernetes_host"`
+	KubernetesCACert string `json:"kubernetes_ca_cert"`
+}
+
+// initialise kubernetes secrets engine at the same path as auth mount 'kubernetes/<account>/<cluster>', secrets engine
+// is mounted if it is not mounted and re-configured when kubernetes host or CA in vault differs or service account JWT
+// has not been written by this client (e.g. token was rotated), mounted is true if secrets engine has been mounted by
+// this call (all secrets engine roles in vault are gone)
+func (c *Client) InitSecretsKubernetes(kubernetesHost string, kubernetesCACert, serviceAccountJWT []byte) (mounted bool, err error) {
+
+	mount, err := c.secretsMountAt(c.mount)
+	if err != nil {
+		return false, err
+	}
+	if mount != nil && mount.Type != kubernetesMountType {
+		return false, fmt.Errorf("found %s secrets engine but with incorrect type %s", c.mount, mount.Type)
+	}
+	if mounted = mount == nil; mounted {
+		logger.Logf("initialising %s kubernetes secrets engine", c.mount)
+		if err := c.mountSecrets(c.mount, secretsMount{Type: kubernetesMountType}); err != nil {
+			return false, err
+		}
+	}
+
+	config, err := c.ReadSecretsKubernetesConfig()
+	if err != nil {
+		return mounted, err
+	}
+	jwtHash := fmt.Sprintf("%x", sha256.Sum256(serviceAccountJWT))
+	if config != nil && config.KubernetesHost == kubernetesHost && config.KubernetesCACert == string(kubernetesCACert) && c.secretsJWTHash() == jwtHash {
+		return mounted, nil
+	}
+	if err := c.configureSecretsKubernetes(kubernetesHost, kubernetesCACert, serviceAccountJWT); err != nil {
+		return mounted, err
+	}
+	c.setSecretsJWTHash(jwtHash)
+	return mounted, nil
+}
+
+// read kubernetes secrets engine config, when 404 is returned from vault (secrets engine is not configured), nil config
+// and nil error is returned
+func (c *Client) ReadSecretsKubernetesConfig() (*SecretsKubernetesConfig, error) {
+
+	response := &struct {
+		Data *SecretsKubernetesConfig `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, fmt.Sprintf("%s/config", c.mount), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// list kubernetes secrets engine role names
+func (c *Client) ListSecretsRoles() ([]string, error) {
+
+	response := struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest("LIST", fmt.Sprintf("%s/roles", c.mount), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, &response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data.Keys, nil
+}
+
+// read kubernetes secrets engine role with all fields returned by vault, when 404 is returned from vault, nil role and
+// nil error is returned
+func (c *Client) ReadSecretsRole(name string) (map[string]interface{}, error) {
+
+	response := &struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, fmt.Sprintf("%s/roles/%s", c.mount, name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// create or update kubernetes secrets engine role
+func (c *Client) WriteSecretsRole(name string, role map[string]interface{}) error {
+
+	path := fmt.Sprintf("%s/roles/%s", c.mount, name)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, role)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("writing secrets engine role: POST %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+func (c *Client) DeleteSecretsRole(name string) error {
+
+	path := fmt.Sprintf("%s/roles/%s", c.mount, name)
+	jsonRequest, err := c.newJsonRequest(http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("deleting secrets engine role: DELETE %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler, expectedNotFoundErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+func (c *Client) configureSecretsKubernetes(kubernetesHost string, kubernetesCACert, serviceAccountJWT []byte) error {
+
+	logger.Logf("kubernetes host: %s", kubernetesHost)
+	path := fmt.Sprintf("%s/config", c.mount)
+	request := struct {
+		KubernetesHost    string `json:"kubernetes_host"`
+		KubernetesCACert  string `json:"kubernetes_ca_cert"`
+		ServiceAccountJWT string `json:"service_account_jwt"`
+		// vault must not fall back to its own service account (vault may run in different cluster)
+		DisableLocalCAJWT bool `json:"disable_local_ca_jwt"`
+	}{
+		KubernetesHost:    kubernetesHost,
+		KubernetesCACert:  string(kubernetesCACert),
+		ServiceAccountJWT: string(serviceAccountJWT),
+		DisableLocalCAJWT: true,
+	}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, path, request)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("configuring kubernetes secrets engine: POST %s", path)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
+
+func (c *Client) secretsJWTHash() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secretsJWT
+}
+
+func (c *Client) setSecretsJWTHash(hash string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secretsJWT = hash
+}
+
+// secrets engine mounted at the path, nil if nothing is mounted there
+func (c *Client) secretsMountAt(path string) (*secretsMount, error) {
+
+	response := struct {
+		Data map[string]secretsMount `json:"data"`
+	}{}
+
+	jsonRequest, err := c.newJsonRequest(http.MethodGet, "sys/mounts", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	if err := c.doJsonRequest(jsonRequest, &response, errorHandlers, httpNumberOfRetries); err != nil {
+		return nil, err
+	}
+	for key, val := range response.Data {
+		if strings.Trim(key, "/") == strings.Trim(path, "/") {
+			return &val, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *Client) mountSecrets(path string, mount secretsMount) error {
+
+	mountPath := fmt.Sprintf("sys/mounts/%s", path)
+	jsonRequest, err := c.newJsonRequest(http.MethodPost, mountPath, mount)
+	if err != nil {
+		return err
+	}
+
+	logger.Logf("mounting secrets engine: POST %s", mountPath)
+	errorHandlers := []errorHandler{permissionDeniedErrorHandler}
+	return c.doJsonMutation(jsonRequest, errorHandlers)
+}
@@ -0,0 +1,377 @@
+package vaulttest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type entity struct {
+	id       string
+	name     string
+	metadata map[string]interface{}
+	policies []interface{}
+}
+
+type entityAlias struct {
+	id            string
+	name          string
+	canonicalId   string
+	mountAccessor string
+}
+
+type group struct {
+	id              string
+	name            string
+	groupType       string
+	metadata        map[string]interface{}
+	policies        []interface{}
+	memberEntityIds []interface{}
+}
+
+// --- setup ---
+
+// add entity alias, entity is created if it does not exist (e.g. entity created by vault on the first login)
+func (s *Server) AddEntityAlias(entityName, aliasName, mountAccessor string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entities[entityName]
+	if !ok {
+		e = &entity{id: randomId(), name: entityName}
+		s.entities[entityName] = e
+	}
+	alias := &entityAlias{id: randomId(), name: aliasName, canonicalId: e.id, mountAccessor: mountAccessor}
+	s.aliases[alias.id] = alias
+}
+
+// set group policies, group is created if it does not exist
+func (s *Server) SetGroupPolicies(name string, policies ...string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[name]
+	if !ok {
+		g = &group{id: randomId(), name: name, groupType: "internal"}
+		s.groups[name] = g
+	}
+	g.policies = nil
+	for _, policy := range policies {
+		g.policies = append(g.policies, policy)
+	}
+}
+
+// --- state ---
+
+func (s *Server) EntityNames() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// entity as returned by vault read entity API, nil if the entity does not exist
+func (s *Server) Entity(name string) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entities[name]
+	if !ok {
+		return nil
+	}
+	return s.entityData(e)
+}
+
+func (s *Server) GroupNames() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// group as returned by vault read group API, nil if the group does not exist
+func (s *Server) Group(name string) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[name]
+	if !ok {
+		return nil
+	}
+	return groupData(g)
+}
+
+// --- handlers ---
+
+func (s *Server) identity(w http.ResponseWriter, method, path string, body map[string]interface{}) {
+
+	switch {
+	case path == "entity/name" && method == "LIST":
+		s.listIdentity(w, len(s.entities), func(keys []string) []string {
+			for name := range s.entities {
+				keys = append(keys, name)
+			}
+			return keys
+		})
+	case strings.HasPrefix(path, "entity/name/"):
+		s.entity(w, method, strings.TrimPrefix(path, "entity/name/"), body)
+	case path == "entity-alias" && method == http.MethodPost:
+		s.entityAlias(w, &entityAlias{id: randomId()}, body)
+	case strings.HasPrefix(path, "entity-alias/id/") && method == http.MethodDelete:
+		delete(s.aliases, strings.TrimPrefix(path, "entity-alias/id/"))
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "entity-alias/id/") && method == http.MethodPost:
+		alias, ok := s.aliases[strings.TrimPrefix(path, "entity-alias/id/")]
+		if !ok {
+			writeErrors(w, http.StatusBadRequest, "entity alias not found")
+			return
+		}
+		s.entityAlias(w, alias, body)
+	case path == "lookup/entity" && method == http.MethodPost:
+		s.lookupEntity(w, body)
+	case path == "group/name" && method == "LIST":
+		s.listIdentity(w, len(s.groups), func(keys []string) []string {
+			for name := range s.groups {
+				keys = append(keys, name)
+			}
+			return keys
+		})
+	case strings.HasPrefix(path, "group/name/"):
+		s.group(w, method, strings.TrimPrefix(path, "group/name/"), body)
+	default:
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("no handler for route \"identity/%s\"", path))
+	}
+}
+
+// vault returns 404 for empty list
+func (s *Server) listIdentity(w http.ResponseWriter, n int, keys func([]string) []string) {
+
+	if n == 0 {
+		writeErrors(w, http.StatusNotFound)
+		return
+	}
+	names := keys(nil)
+	sort.Strings(names)
+	writeJson(w, map[string]interface{}{"data": map[string]interface{}{"keys": names}})
+}
+
+func (s *Server) entity(w http.ResponseWriter, method, name string, body map[string]interface{}) {
+
+	switch method {
+	case http.MethodGet:
+		e, ok := s.entities[name]
+		if !ok {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": s.entityData(e)})
+	case http.MethodPost, http.MethodPut:
+		// vault updates only fields present in the request
+		e, ok := s.entities[name]
+		if !ok {
+			e = &entity{id: randomId(), name: name}
+			s.entities[name] = e
+		}
+		if metadata, ok := body["metadata"].(map[string]interface{}); ok {
+			e.metadata = metadata
+		}
+		if policies, ok := body["policies"].([]interface{}); ok {
+			e.policies = policies
+		}
+		if ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": map[string]interface{}{"id": e.id, "name": e.name}})
+	case http.MethodDelete:
+		if e, ok := s.entities[name]; ok {
+			s.deleteEntity(e)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// delete entity, its aliases and group memberships
+func (s *Server) deleteEntity(e *entity) {
+
+	delete(s.entities, e.name)
+	for id, alias := range s.aliases {
+		if alias.canonicalId == e.id {
+			delete(s.aliases, id)
+		}
+	}
+	for _, g := range s.groups {
+		var members []interface{}
+		for _, member := range g.memberEntityIds {
+			if member != e.id {
+				members = append(members, member)
+			}
+		}
+		g.memberEntityIds = members
+	}
+}
+
+// create or update entity alias, combination of alias name and mount accessor has to be unique
+func (s *Server) entityAlias(w http.ResponseWriter, alias *entityAlias, body map[string]interface{}) {
+
+	updated := *alias
+	if name, ok := body["name"].(string); ok {
+		updated.name = name
+	}
+	if canonicalId, ok := body["canonical_id"].(string); ok {
+		updated.canonicalId = canonicalId
+	}
+	if mountAccessor, ok := body["mount_accessor"].(string); ok {
+		updated.mountAccessor = mountAccessor
+	}
+	if s.entityById(updated.canonicalId) == nil {
+		writeErrors(w, http.StatusBadRequest, "entity not found from id")
+		return
+	}
+	if !s.hasAccessor(updated.mountAccessor) {
+		writeErrors(w, http.StatusBadRequest, "invalid mount accessor")
+		return
+	}
+	for id, existing := range s.aliases {
+		if id != updated.id && existing.name == updated.name && existing.mountAccessor == updated.mountAccessor {
+			writeErrors(w, http.StatusBadRequest, "combination of mount and alias name is already in use")
+			return
+		}
+		if id != updated.id && existing.canonicalId == updated.canonicalId && existing.mountAccessor == updated.mountAccessor {
+			writeErrors(w, http.StatusBadRequest, "entity already has an alias for the mount")
+			return
+		}
+	}
+	s.aliases[updated.id] = &updated
+	writeJson(w, map[string]interface{}{"data": map[string]interface{}{"id": updated.id, "canonical_id": updated.canonicalId}})
+}
+
+// entity by alias name and mount accessor, 204 with no body if the alias does not exist
+func (s *Server) lookupEntity(w http.ResponseWriter, body map[string]interface{}) {
+
+	name, _ := body["alias_name"].(string)
+	mountAccessor, _ := body["alias_mount_accessor"].(string)
+	for _, alias := range s.aliases {
+		if alias.name == name && alias.mountAccessor == mountAccessor {
+			if e := s.entityById(alias.canonicalId); e != nil {
+				writeJson(w, map[string]interface{}{"data": s.entityData(e)})
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) group(w http.ResponseWriter, method, name string, body map[string]interface{}) {
+
+	switch method {
+	case http.MethodGet:
+		g, ok := s.groups[name]
+		if !ok {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": groupData(g)})
+	case http.MethodPost, http.MethodPut:
+		// vault updates only fields present in the request
+		g, ok := s.groups[name]
+		if !ok {
+			g = &group{id: randomId(), name: name, groupType: "internal"}
+		}
+		if members, ok := body["member_entity_ids"].([]interface{}); ok {
+			for _, member := range members {
+				if id, _ := member.(string); s.entityById(id) == nil {
+					writeErrors(w, http.StatusBadRequest, fmt.Sprintf("entity %q does not exist", member))
+					return
+				}
+			}
+			g.memberEntityIds = members
+		}
+		if groupType, ok := body["type"].(string); ok {
+			g.groupType = groupType
+		}
+		if metadata, ok := body["metadata"].(map[string]interface{}); ok {
+			g.metadata = metadata
+		}
+		if policies, ok := body["policies"].([]interface{}); ok {
+			g.policies = policies
+		}
+		s.groups[name] = g
+		if ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": map[string]interface{}{"id": g.id, "name": g.name}})
+	case http.MethodDelete:
+		delete(s.groups, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// --- helpers ---
+
+func (s *Server) entityById(id string) *entity {
+
+	for _, e := range s.entities {
+		if e.id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *Server) hasAccessor(accessor string) bool {
+
+	for _, mount := range s.mounts {
+		if mount.Accessor == accessor {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) entityData(e *entity) map[string]interface{} {
+
+	aliases := []interface{}{}
+	for _, alias := range s.aliases {
+		if alias.canonicalId == e.id {
+			aliases = append(aliases, map[string]interface{}{
+				"id":             alias.id,
+				"name":           alias.name,
+				"canonical_id":   alias.canonicalId,
+				"mount_accessor": alias.mountAccessor,
+			})
+		}
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].(map[string]interface{})["id"].(string) < aliases[j].(map[string]interface{})["id"].(string)
+	})
+	return map[string]interface{}{"id": e.id, "name": e.name, "metadata": e.metadata, "policies": e.policies, "aliases": aliases}
+}
+
+func groupData(g *group) map[string]interface{} {
+
+	return map[string]interface{}{
+		"id":                g.id,
+		"name":              g.name,
+		"type":              g.groupType,
+		"metadata":          g.metadata,
+		"policies":          g.policies,
+		"member_entity_ids": g.memberEntityIds,
+	}
+}
@@ -0,0 +1,106 @@
+package vaulttest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// --- setup ---
+
+// write kv version 2 secret, so the path has versions (data itself is not stored)
+func (s *Server) SetKVVersions(mount, path string, versions int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata := s.kvMetadata(trimPath(mount), trimPath(path))
+	metadata["current_version"] = versions
+}
+
+// --- state ---
+
+// kv version 2 metadata as returned by vault read metadata API, nil if the path does not exist
+func (s *Server) KVMetadata(mount, path string) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata, ok := s.kv[trimPath(mount)][trimPath(path)]
+	if !ok {
+		return nil
+	}
+	return metadata
+}
+
+// --- handlers ---
+
+// kv version 2 metadata, LIST returns direct children of the path (folders end with '/')
+func (s *Server) kvMetadataHandler(w http.ResponseWriter, method, mount, path string, body map[string]interface{}) {
+
+	if s.secretsMounts[mount].Type != "kv" || s.secretsMounts[mount].Options["version"] != "2" {
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("no handler for route %q", mount+"/"+path))
+		return
+	}
+	switch method {
+	case "LIST":
+		set := make(map[string]struct{})
+		prefix := strings.TrimSuffix(path, "/") + "/"
+		for key := range s.kv[mount] {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			child := strings.TrimPrefix(key, prefix)
+			if i := strings.Index(child, "/"); i != -1 {
+				child = child[:i+1]
+			}
+			set[child] = struct{}{}
+		}
+		if len(set) == 0 {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		var keys []string
+		for key := range set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeJson(w, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case http.MethodGet:
+		metadata, ok := s.kv[mount][path]
+		if !ok {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": metadata})
+	case http.MethodPost, http.MethodPut:
+		// vault updates only fields present in the request
+		metadata := s.kvMetadata(mount, path)
+		for _, field := range []string{"max_versions", "delete_version_after", "custom_metadata"} {
+			if v, ok := body[field]; ok {
+				metadata[field] = v
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(s.kv[mount], path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// --- helpers ---
+
+// metadata of the path, metadata with defaults is created if it does not exist
+func (s *Server) kvMetadata(mount, path string) map[string]interface{} {
+
+	if s.kv[mount] == nil {
+		s.kv[mount] = make(map[string]map[string]interface{})
+	}
+	metadata, ok := s.kv[mount][path]
+	if !ok {
+		metadata = map[string]interface{}{"max_versions": 0, "delete_version_after": "0s", "custom_metadata": nil, "current_version": 0}
+		s.kv[mount][path] = metadata
+	}
+	return metadata
+}
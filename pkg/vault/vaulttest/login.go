@@ -0,0 +1,163 @@
+package vaulttest
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// service account of token registered by AddServiceAccountToken, tokens are not parsed or validated
+type serviceAccountToken struct {
+	namespace string
+	name      string
+	audiences []string
+}
+
+// --- setup ---
+
+// add service account token accepted by auth kubernetes and jwt login (vault would validate it by TokenReview or
+// signing keys), token without audiences is accepted only by roles without audience
+func (s *Server) AddServiceAccountToken(jwt, namespace, name string, audiences ...string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serviceAccountTokens[jwt] = serviceAccountToken{namespace: namespace, name: name, audiences: audiences}
+}
+
+// --- state ---
+
+// number of valid (not revoked and not expired) tokens
+func (s *Server) TokenCount() int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int
+	for clientToken := range s.tokens {
+		if _, ok := s.token(clientToken); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// --- handlers ---
+
+// auth login mount from path 'auth/<mount>/login', empty if path is not login of auth kubernetes or jwt mount
+func (s *Server) loginMount(method, path string) string {
+
+	if method != http.MethodPost || !strings.HasPrefix(path, "auth/") || !strings.HasSuffix(path, "/login") {
+		return ""
+	}
+	mount := strings.TrimSuffix(strings.TrimPrefix(path, "auth/"), "/login")
+	if t := s.mounts[mount].Type; t != "kubernetes" && t != "jwt" {
+		return ""
+	}
+	return mount
+}
+
+// login with service account token, token policies are role token_policies and default policy
+func (s *Server) serviceAccountLogin(w http.ResponseWriter, mount string, body map[string]interface{}) {
+
+	if s.configs[mount] == nil {
+		writeErrors(w, http.StatusBadRequest, "could not load backend configuration")
+		return
+	}
+	roleName, _ := body["role"].(string)
+	role, ok := s.roles[mount][roleName]
+	if !ok {
+		writeErrors(w, http.StatusBadRequest, fmt.Sprintf("invalid role name %q", roleName))
+		return
+	}
+	jwt, _ := body["jwt"].(string)
+	serviceAccount, ok := s.serviceAccountTokens[jwt]
+	if !ok {
+		writeErrors(w, http.StatusForbidden, errPermissionDenied)
+		return
+	}
+	if err := loginBound(s.mounts[mount].Type, role, serviceAccount); err != nil {
+		writeErrors(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	policies := []string{"default"}
+	tokenPolicies, _ := role["token_policies"].([]interface{})
+	for _, p := range tokenPolicies {
+		policies = append(policies, fmt.Sprint(p))
+	}
+	ttl := DefaultTokenTTL
+	if seconds, ok := role["token_ttl"].(float64); ok && seconds != 0 {
+		ttl = time.Duration(seconds) * time.Second
+	}
+	clientToken := s.newToken(policies, ttl)
+	writeJson(w, map[string]interface{}{"auth": s.authResponse(clientToken, s.tokens[clientToken])})
+}
+
+func (s *Server) revokeSelf(w http.ResponseWriter, t *token) {
+
+	for clientToken, v := range s.tokens {
+		if v == t {
+			delete(s.tokens, clientToken)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// service account is bound by kubernetes role (names, namespaces and audience) or jwt role (subject and audiences)
+func loginBound(mountType string, role map[string]interface{}, serviceAccount serviceAccountToken) error {
+
+	if mountType == "jwt" {
+		subject := fmt.Sprintf("system:serviceaccount:%s:%s", serviceAccount.namespace, serviceAccount.name)
+		subjects := []interface{}{role["bound_subject"]}
+		if claims, ok := role["bound_claims"].(map[string]interface{}); ok {
+			sub, _ := claims["sub"].([]interface{})
+			subjects = append(subjects, sub...)
+		}
+		if !matchAny(subjects, subject) {
+			return fmt.Errorf("sub claim %q does not match bound subjects", subject)
+		}
+		audiences, _ := role["bound_audiences"].([]interface{})
+		if len(audiences) != 0 && !hasAudience(serviceAccount.audiences, audiences) {
+			return fmt.Errorf("invalid audience (aud) claim: audience claim does not match any expected audience")
+		}
+		return nil
+	}
+
+	names, _ := role["bound_service_account_names"].([]interface{})
+	if !matchAny(names, serviceAccount.name) {
+		return fmt.Errorf("service account name not authorized")
+	}
+	namespaces, _ := role["bound_service_account_namespaces"].([]interface{})
+	if !matchAny(namespaces, serviceAccount.namespace) {
+		return fmt.Errorf("namespace not authorized")
+	}
+	if audience, _ := role["audience"].(string); audience != "" && !hasAudience(serviceAccount.audiences, []interface{}{audience}) {
+		return fmt.Errorf("invalid audience (aud) claim: audience claim does not match any expected audience")
+	}
+	return nil
+}
+
+// value matches any of the patterns, patterns support '*' glob
+func matchAny(patterns []interface{}, value string) bool {
+
+	for _, p := range patterns {
+		pattern, _ := p.(string)
+		if matched, _ := path.Match(pattern, value); matched && pattern != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAudience(audiences []string, expected []interface{}) bool {
+
+	for _, audience := range audiences {
+		for _, e := range expected {
+			if audience == e {
+				return true
+			}
+		}
+	}
+	return false
+}
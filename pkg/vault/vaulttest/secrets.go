@@ -0,0 +1,206 @@
+package vaulttest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// secrets engine mount, kv version 2 metadata and kubernetes secrets engine config and roles APIs are implemented
+type SecretsMount struct {
+	Type    string            `json:"type"`
+	Options map[string]string `json:"options"`
+}
+
+// kubernetes secrets engine role has to have exactly one of these fields
+var secretsRoleKinds = []string{"service_account_name", "kubernetes_role_name", "generated_role_rules"}
+
+// --- setup ---
+
+func (s *Server) MountSecrets(path string, mount SecretsMount) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secretsMounts[trimPath(path)] = mount
+}
+
+// --- state ---
+
+func (s *Server) SecretsMounts() map[string]SecretsMount {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]SecretsMount)
+	for k, v := range s.secretsMounts {
+		out[k] = v
+	}
+	return out
+}
+
+// kubernetes secrets engine config including service account JWT (vault does not return JWT), nil if not configured
+func (s *Server) SecretsConfig(mount string) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secretsConfigs[trimPath(mount)]
+}
+
+func (s *Server) SecretsRoleNames(mount string) []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.secretsRoles[trimPath(mount)])
+}
+
+func (s *Server) SecretsRole(mount, name string) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secretsRoles[trimPath(mount)][name]
+}
+
+// --- handlers ---
+
+func (s *Server) listSecretsMounts(w http.ResponseWriter) {
+
+	data := make(map[string]interface{})
+	for path, mount := range s.secretsMounts {
+		data[path+"/"] = mount
+	}
+	writeJson(w, map[string]interface{}{"data": data})
+}
+
+func (s *Server) secretsMount(w http.ResponseWriter, method, path string, body map[string]interface{}) {
+
+	switch method {
+	case http.MethodPost, http.MethodPut:
+		if _, ok := s.secretsMounts[path]; ok {
+			writeErrors(w, http.StatusBadRequest, fmt.Sprintf("path is already in use at %s/", path))
+			return
+		}
+		mount := SecretsMount{Options: make(map[string]string)}
+		mount.Type, _ = body["type"].(string)
+		if options, ok := body["options"].(map[string]interface{}); ok {
+			for k, v := range options {
+				mount.Options[k] = fmt.Sprint(v)
+			}
+		}
+		s.secretsMounts[path] = mount
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(s.secretsMounts, path)
+		delete(s.kv, path)
+		delete(s.secretsConfigs, path)
+		delete(s.secretsRoles, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func (s *Server) secrets(w http.ResponseWriter, method, path string, body map[string]interface{}) {
+
+	mount := s.findSecretsMount(path)
+	rest := strings.TrimPrefix(path, mount+"/")
+	switch {
+	case s.secretsMounts[mount].Type == "kv" && strings.HasPrefix(rest, "metadata/"):
+		s.kvMetadataHandler(w, method, mount, strings.TrimPrefix(rest, "metadata/"), body)
+	case s.secretsMounts[mount].Type == "kubernetes" && rest == "config":
+		s.secretsConfig(w, method, mount, body)
+	case s.secretsMounts[mount].Type == "kubernetes" && rest == "roles" && method == "LIST":
+		s.listIdentity(w, len(s.secretsRoles[mount]), func(keys []string) []string {
+			return append(keys, sortedKeys(s.secretsRoles[mount])...)
+		})
+	case s.secretsMounts[mount].Type == "kubernetes" && strings.HasPrefix(rest, "roles/"):
+		s.secretsRole(w, method, mount, strings.TrimPrefix(rest, "roles/"), body)
+	default:
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("no handler for route %q", path))
+	}
+}
+
+func (s *Server) secretsConfig(w http.ResponseWriter, method, mount string, body map[string]interface{}) {
+
+	switch method {
+	case http.MethodGet:
+		config, ok := s.secretsConfigs[mount]
+		if !ok {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		data := make(map[string]interface{})
+		for k, v := range config {
+			if k != "service_account_jwt" {
+				data[k] = v
+			}
+		}
+		writeJson(w, map[string]interface{}{"data": data})
+	case http.MethodPost, http.MethodPut:
+		s.secretsConfigs[mount] = body
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// role is returned with defaults, ttls are returned as number of seconds
+func (s *Server) secretsRole(w http.ResponseWriter, method, mount, name string, body map[string]interface{}) {
+
+	switch method {
+	case http.MethodGet:
+		role, ok := s.secretsRoles[mount][name]
+		if !ok {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": role})
+	case http.MethodPost, http.MethodPut:
+		if _, ok := body["allowed_kubernetes_namespaces"]; !ok {
+			writeErrors(w, http.StatusBadRequest, "one (at least) of allowed_kubernetes_namespaces or allowed_kubernetes_namespace_selector must be set")
+			return
+		}
+		var kinds int
+		for _, kind := range secretsRoleKinds {
+			if v, ok := body[kind]; ok && v != "" {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			writeErrors(w, http.StatusBadRequest, "one (and only one) of service_account_name, kubernetes_role_name or generated_role_rules must be set")
+			return
+		}
+		role := map[string]interface{}{"name": name, "token_default_ttl": 0, "token_max_ttl": 0, "kubernetes_role_type": "Role"}
+		for _, kind := range secretsRoleKinds {
+			role[kind] = ""
+		}
+		for k, v := range body {
+			if k == "token_default_ttl" || k == "token_max_ttl" {
+				v = ttlSeconds(v)
+			}
+			role[k] = v
+		}
+		if s.secretsRoles[mount] == nil {
+			s.secretsRoles[mount] = make(map[string]map[string]interface{})
+		}
+		s.secretsRoles[mount][name] = role
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(s.secretsRoles[mount], name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// --- helpers ---
+
+// longest secrets mount that is prefix of the path
+func (s *Server) findSecretsMount(path string) string {
+
+	var found string
+	for mount := range s.secretsMounts {
+		if strings.HasPrefix(path, mount+"/") && len(mount) > len(found) {
+			found = mount
+		}
+	}
+	return found
+}
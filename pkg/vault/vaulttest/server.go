@@ -0,0 +1,923 @@
+// Package vaulttest is in-memory fake vault server, it implements subset of vault API used by this project: approle
+// and service account login, token renew, lookup and revoke, capabilities, health, auth mounts and tune, auth kubernetes
+// and jwt config and roles, acl policies, identity entities, entity aliases and groups, secrets engine mounts, kv
+// version 2 metadata and kubernetes secrets engine config and roles
+package vaulttest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RootPolicy      = "root"
+	DefaultTokenTTL = time.Hour
+
+	errPermissionDenied = "permission denied"
+	errSealed           = "Vault is sealed"
+)
+
+// policy path rule, path supports vault glob patterns ('+' single segment and '*' suffix)
+// capabilities are create, read, update, delete, list and sudo
+type PathRule struct {
+	Path         string
+	Capabilities []string
+}
+
+// fault injected into matching requests, path supports the same patterns as policy path
+type Fault struct {
+	Method  string // empty for any method
+	Path    string
+	Status  int // 0 for no error response (latency only)
+	Errors  []string
+	Latency time.Duration
+	Count   int // number of requests to fail, 0 for all requests
+}
+
+// request received by the server
+type Request struct {
+	Method string
+	Path   string
+}
+
+// auth mount, lease ttls in config are number of seconds
+type Mount struct {
+	Type        string                 `json:"type"`
+	Accessor    string                 `json:"accessor"`
+	Description string                 `json:"description"`
+	Config      map[string]interface{} `json:"config"`
+	Local       bool                   `json:"local"`
+	SealWrap    bool                   `json:"seal_wrap"`
+}
+
+type appRole struct {
+	secretId string
+	tokenTTL time.Duration
+	policies []string
+}
+
+type token struct {
+	accessor string
+	policies []string
+	ttl      time.Duration
+	expires  time.Time
+}
+
+type Server struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	now    time.Time
+	sealed bool
+	// address of active node when this node is standby, requests (except sys/health) are redirected there
+	activeAddr string
+	appRoles   map[string]appRole
+	tokens     map[string]*token
+	policies   map[string][]PathRule
+	mounts     map[string]Mount
+	configs    map[string]map[string]interface{}
+	roles      map[string]map[string]map[string]interface{}
+	// acl policy documents by name, documents are not parsed (token capabilities are set by AddPolicy)
+	aclPolicies map[string]string
+	// identity entities and groups by name, entity aliases by id
+	entities map[string]*entity
+	aliases  map[string]*entityAlias
+	groups   map[string]*group
+	// secrets engine mounts by path, kv version 2 metadata by mount and path, kubernetes secrets engine config and
+	// roles by mount
+	secretsMounts  map[string]SecretsMount
+	kv             map[string]map[string]map[string]interface{}
+	secretsConfigs map[string]map[string]interface{}
+	secretsRoles   map[string]map[string]map[string]interface{}
+	// service account tokens accepted by auth kubernetes and jwt login
+	serviceAccountTokens map[string]serviceAccountToken
+	faults               []*Fault
+	requests             []Request
+}
+
+// start new fake vault server, server has to be closed
+func NewServer() *Server {
+
+	s := &Server{
+		now:      time.Now(),
+		appRoles: make(map[string]appRole),
+		tokens:   make(map[string]*token),
+		policies: make(map[string][]PathRule),
+		mounts:   make(map[string]Mount),
+		configs:  make(map[string]map[string]interface{}),
+		roles:    make(map[string]map[string]map[string]interface{}),
+
+		aclPolicies: make(map[string]string),
+		entities:    make(map[string]*entity),
+		aliases:     make(map[string]*entityAlias),
+		groups:      make(map[string]*group),
+
+		secretsMounts: make(map[string]SecretsMount),
+		kv:            make(map[string]map[string]map[string]interface{}),
+
+		secretsConfigs: make(map[string]map[string]interface{}),
+		secretsRoles:   make(map[string]map[string]map[string]interface{}),
+
+		serviceAccountTokens: make(map[string]serviceAccountToken),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// --- setup ---
+
+func (s *Server) AddPolicy(name string, rules ...PathRule) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[name] = rules
+}
+
+// add approle, token ttl 0 is DefaultTokenTTL
+func (s *Server) AddAppRole(roleId, secretId string, tokenTTL time.Duration, policies ...string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tokenTTL == 0 {
+		tokenTTL = DefaultTokenTTL
+	}
+	s.appRoles[roleId] = appRole{secretId: secretId, tokenTTL: tokenTTL, policies: policies}
+}
+
+// create token with root policy, token does not expire
+func (s *Server) RootToken() string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newToken([]string{RootPolicy}, 0)
+}
+
+// mount auth method directly, without api request, accessor is generated if not set
+func (s *Server) Mount(path string, mount Mount) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mount.Accessor == "" {
+		mount.Accessor = newAccessor(mount.Type)
+	}
+	s.mounts[trimPath(path)] = mount
+}
+
+// create role in auth mount directly, without api request
+func (s *Server) SetRole(mount, name string, role map[string]interface{}) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mount = trimPath(mount)
+	if s.roles[mount] == nil {
+		s.roles[mount] = make(map[string]map[string]interface{})
+	}
+	s.roles[mount][name] = role
+}
+
+// create acl policy directly, without api request
+func (s *Server) SetACLPolicy(name, policy string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aclPolicies[name] = policy
+}
+
+func (s *Server) InjectFault(fault Fault) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+func (s *Server) ClearFaults() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// move server clock, tokens with expired ttl are rejected
+func (s *Server) Advance(d time.Duration) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *Server) Seal() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealed = true
+}
+
+func (s *Server) Unseal() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealed = false
+}
+
+// make server standby node that redirects (307) requests to active node address, empty address makes it active again
+func (s *Server) SetStandby(activeAddr string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activeAddr = activeAddr
+}
+
+// restart invalidates all tokens, storage (mounts, config, roles, policies) is kept
+func (s *Server) Restart() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]*token)
+}
+
+// --- state ---
+
+func (s *Server) Mounts() map[string]Mount {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]Mount)
+	for k, v := range s.mounts {
+		out[k] = v
+	}
+	return out
+}
+
+// auth mount config, nil if the mount is not configured
+func (s *Server) Config(mount string) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.configs[trimPath(mount)]
+}
+
+// role names in auth mount, sorted
+func (s *Server) RoleNames(mount string) []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.roles[trimPath(mount)])
+}
+
+// role in auth mount, nil if the role does not exist
+func (s *Server) Role(mount, name string) map[string]interface{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roles[trimPath(mount)][name]
+}
+
+// acl policy names (without built-in default and root policies), sorted
+func (s *Server) ACLPolicyNames() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.aclPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// acl policy document, empty if the policy does not exist
+func (s *Server) ACLPolicy(name string) string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aclPolicies[name]
+}
+
+func (s *Server) Requests() []Request {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// --- handlers ---
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+
+	method := r.Method
+	if method == http.MethodGet && r.URL.Query().Get("list") == "true" {
+		method = "LIST"
+	}
+	path := strings.TrimPrefix(trimPath(r.URL.Path), "v1/")
+
+	fault := s.fault(method, path)
+	if fault != nil && fault.Latency != 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{Method: method, Path: path})
+
+	if fault != nil && fault.Status != 0 {
+		writeErrors(w, fault.Status, fault.Errors...)
+		return
+	}
+	if path == "sys/health" && method == http.MethodGet {
+		s.healthCheck(w)
+		return
+	}
+	if s.activeAddr != "" && !s.sealed {
+		http.Redirect(w, r, s.activeAddr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	if s.sealed {
+		writeErrors(w, http.StatusServiceUnavailable, errSealed)
+		return
+	}
+
+	var body map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	// login does not require token
+	if path == "auth/approle/login" && method == http.MethodPost {
+		s.login(w, body)
+		return
+	}
+	if mount := s.loginMount(method, path); mount != "" {
+		s.serviceAccountLogin(w, mount, body)
+		return
+	}
+
+	t, ok := s.token(r.Header.Get("X-Vault-Token"))
+	if !ok {
+		writeErrors(w, http.StatusForbidden, errPermissionDenied)
+		return
+	}
+
+	switch {
+	case path == "auth/token/renew-self" && method == http.MethodPost:
+		s.renewSelf(w, t)
+	case path == "auth/token/lookup-self" && method == http.MethodGet:
+		s.lookupSelf(w, t)
+	case path == "auth/token/revoke-self" && method == http.MethodPost:
+		s.revokeSelf(w, t)
+	case path == "sys/capabilities-self" && method == http.MethodPost:
+		s.capabilitiesSelf(w, t, body)
+	case !s.allowed(t, method, path):
+		writeErrors(w, http.StatusForbidden, errPermissionDenied)
+	case path == "sys/auth" && method == http.MethodGet:
+		s.listMounts(w)
+	case path == "sys/policies/acl" && method == "LIST":
+		s.listACLPolicies(w)
+	case strings.HasPrefix(path, "sys/policies/acl/"):
+		s.aclPolicy(w, method, strings.TrimPrefix(path, "sys/policies/acl/"), body)
+	case path == "sys/mounts" && method == http.MethodGet:
+		s.listSecretsMounts(w)
+	case strings.HasPrefix(path, "sys/mounts/"):
+		s.secretsMount(w, method, strings.TrimPrefix(path, "sys/mounts/"), body)
+	case s.findSecretsMount(path) != "":
+		s.secrets(w, method, path, body)
+	case strings.HasPrefix(path, "identity/"):
+		s.identity(w, method, strings.TrimPrefix(path, "identity/"), body)
+	case strings.HasPrefix(path, "sys/auth/"):
+		s.mount(w, method, strings.TrimPrefix(path, "sys/auth/"), body)
+	case strings.HasPrefix(path, "auth/"):
+		s.authMount(w, method, strings.TrimPrefix(path, "auth/"), body)
+	default:
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("no handler for route %q", path))
+	}
+}
+
+// sys/health status codes are 200 for active, 429 for standby and 503 for sealed node
+func (s *Server) healthCheck(w http.ResponseWriter) {
+
+	status := http.StatusOK
+	switch {
+	case s.sealed:
+		status = http.StatusServiceUnavailable
+	case s.activeAddr != "":
+		status = http.StatusTooManyRequests
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"initialized": true,
+		"sealed":      s.sealed,
+		"standby":     s.sealed || s.activeAddr != "",
+	})
+}
+
+func (s *Server) login(w http.ResponseWriter, body map[string]interface{}) {
+
+	roleId, _ := body["role_id"].(string)
+	secretId, _ := body["secret_id"].(string)
+	role, ok := s.appRoles[roleId]
+	if !ok || role.secretId != secretId {
+		writeErrors(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+
+	clientToken := s.newToken(role.policies, role.tokenTTL)
+	writeJson(w, map[string]interface{}{"auth": s.authResponse(clientToken, s.tokens[clientToken])})
+}
+
+func (s *Server) renewSelf(w http.ResponseWriter, t *token) {
+
+	if t.ttl != 0 {
+		t.expires = s.now.Add(t.ttl)
+	}
+	for clientToken, v := range s.tokens {
+		if v == t {
+			writeJson(w, map[string]interface{}{"auth": s.authResponse(clientToken, t)})
+			return
+		}
+	}
+}
+
+func (s *Server) lookupSelf(w http.ResponseWriter, t *token) {
+
+	writeJson(w, map[string]interface{}{"data": map[string]interface{}{
+		"accessor": t.accessor,
+		"policies": t.policies,
+		"ttl":      int(t.remaining(s.now).Seconds()),
+	}})
+}
+
+func (s *Server) capabilitiesSelf(w http.ResponseWriter, t *token, body map[string]interface{}) {
+
+	response := make(map[string]interface{})
+	paths, _ := body["paths"].([]interface{})
+	for _, p := range paths {
+		path, _ := p.(string)
+		response[path] = s.capabilities(t, trimPath(path))
+	}
+	if len(paths) == 1 {
+		response["capabilities"] = response[paths[0].(string)]
+	}
+	writeJson(w, response)
+}
+
+func (s *Server) listMounts(w http.ResponseWriter) {
+
+	data := make(map[string]interface{})
+	for path, mount := range s.mounts {
+		data[path+"/"] = mount
+	}
+	writeJson(w, map[string]interface{}{"data": data})
+}
+
+func (s *Server) mount(w http.ResponseWriter, method, path string, body map[string]interface{}) {
+
+	if strings.HasSuffix(path, "/tune") {
+		s.tune(w, method, strings.TrimSuffix(path, "/tune"), body)
+		return
+	}
+	switch method {
+	case http.MethodPost, http.MethodPut:
+		if _, ok := s.mounts[path]; ok {
+			writeErrors(w, http.StatusBadRequest, fmt.Sprintf("path is already in use at %s/", path))
+			return
+		}
+		mount := Mount{Config: make(map[string]interface{})}
+		mount.Type, _ = body["type"].(string)
+		mount.Accessor = newAccessor(mount.Type)
+		mount.Description, _ = body["description"].(string)
+		mount.Local, _ = body["local"].(bool)
+		mount.SealWrap, _ = body["seal_wrap"].(bool)
+		if config, ok := body["config"].(map[string]interface{}); ok {
+			setMountConfig(mount.Config, config)
+		}
+		if pluginVersion, ok := body["plugin_version"]; ok {
+			mount.Config["plugin_version"] = pluginVersion
+		}
+		s.mounts[path] = mount
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		// vault deletes entity aliases of the mount when it is disabled
+		for id, alias := range s.aliases {
+			if alias.mountAccessor == s.mounts[path].Accessor {
+				delete(s.aliases, id)
+			}
+		}
+		delete(s.mounts, path)
+		delete(s.configs, path)
+		delete(s.roles, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// mount tune, description and mount config values
+func (s *Server) tune(w http.ResponseWriter, method, path string, body map[string]interface{}) {
+
+	mount, ok := s.mounts[path]
+	if !ok {
+		writeErrors(w, http.StatusBadRequest, fmt.Sprintf("cannot fetch sysview for path %q", path+"/"))
+		return
+	}
+	switch method {
+	case http.MethodGet:
+		data := map[string]interface{}{"description": mount.Description}
+		for k, v := range mount.Config {
+			data[k] = v
+		}
+		writeJson(w, map[string]interface{}{"data": data})
+	case http.MethodPost, http.MethodPut:
+		config := make(map[string]interface{})
+		for k, v := range mount.Config {
+			config[k] = v
+		}
+		if description, ok := body["description"]; ok {
+			mount.Description, _ = description.(string)
+			delete(body, "description")
+		}
+		setMountConfig(config, body)
+		mount.Config = config
+		s.mounts[path] = mount
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func (s *Server) authMount(w http.ResponseWriter, method, path string, body map[string]interface{}) {
+
+	mount := s.findMount(path)
+	if mount == "" {
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("no handler for route \"auth/%s\"", path))
+		return
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, mount), "/")
+
+	switch {
+	case rest == "config":
+		s.authConfig(w, method, mount, body)
+	case rest == "role" && method == "LIST":
+		keys := sortedKeys(s.roles[mount])
+		if len(keys) == 0 {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case strings.HasPrefix(rest, "role/"):
+		s.role(w, method, mount, strings.TrimPrefix(rest, "role/"), body)
+	default:
+		writeErrors(w, http.StatusNotFound, fmt.Sprintf("no handler for route \"auth/%s\"", path))
+	}
+}
+
+func (s *Server) authConfig(w http.ResponseWriter, method, mount string, body map[string]interface{}) {
+
+	switch method {
+	case http.MethodGet:
+		if s.configs[mount] == nil {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": s.configs[mount]})
+	case http.MethodPost, http.MethodPut:
+		if s.mounts[mount].Type == "jwt" && body["jwt_validation_pubkeys"] == nil && body["jwks_url"] == nil && body["oidc_discovery_url"] == nil {
+			writeErrors(w, http.StatusBadRequest, "exactly one of 'jwt_validation_pubkeys', 'jwks_url', 'jwks_pairs' or 'oidc_discovery_url' must be set")
+			return
+		}
+		s.configs[mount] = body
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+func (s *Server) role(w http.ResponseWriter, method, mount, name string, body map[string]interface{}) {
+
+	switch method {
+	case http.MethodGet:
+		role, ok := s.roles[mount][name]
+		if !ok {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": role})
+	case http.MethodPost, http.MethodPut:
+		if s.roles[mount] == nil {
+			s.roles[mount] = make(map[string]map[string]interface{})
+		}
+		if s.mounts[mount].Type == "jwt" && body["user_claim"] == nil && s.roles[mount][name] == nil {
+			writeErrors(w, http.StatusBadRequest, "a user claim must be defined on the role")
+			return
+		}
+		// vault updates only fields present in the request
+		role := s.roles[mount][name]
+		if role == nil {
+			role = make(map[string]interface{})
+		}
+		for k, v := range body {
+			role[k] = v
+		}
+		s.roles[mount][name] = role
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(s.roles[mount], name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// acl policies list, built-in default and root policies are always present
+func (s *Server) listACLPolicies(w http.ResponseWriter) {
+
+	keys := []string{"default", RootPolicy}
+	for name := range s.aclPolicies {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	writeJson(w, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+}
+
+func (s *Server) aclPolicy(w http.ResponseWriter, method, name string, body map[string]interface{}) {
+
+	builtin := name == "default" || name == RootPolicy
+	switch method {
+	case http.MethodGet:
+		policy, ok := s.aclPolicies[name]
+		if !ok && !builtin {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		writeJson(w, map[string]interface{}{"data": map[string]interface{}{"name": name, "policy": policy}})
+	case http.MethodPost, http.MethodPut:
+		policy, _ := body["policy"].(string)
+		if name == RootPolicy || policy == "" {
+			writeErrors(w, http.StatusBadRequest, fmt.Sprintf("cannot write %q policy", name))
+			return
+		}
+		s.aclPolicies[name] = policy
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if builtin {
+			writeErrors(w, http.StatusBadRequest, fmt.Sprintf("cannot delete %q policy", name))
+			return
+		}
+		delete(s.aclPolicies, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "unsupported operation")
+	}
+}
+
+// --- helpers ---
+
+func (s *Server) fault(method, path string) *Fault {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fault := range s.faults {
+		if fault.Method != "" && fault.Method != method {
+			continue
+		}
+		if !matchPath(fault.Path, path) {
+			continue
+		}
+		if fault.Count != 0 {
+			if fault.Count == 1 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+			fault.Count--
+		}
+		f := *fault
+		return &f
+	}
+	return nil
+}
+
+func (s *Server) newToken(policies []string, ttl time.Duration) string {
+
+	t := &token{accessor: randomId(), policies: policies, ttl: ttl}
+	if ttl != 0 {
+		t.expires = s.now.Add(ttl)
+	}
+	clientToken := "s." + randomId()
+	s.tokens[clientToken] = t
+	return clientToken
+}
+
+func (s *Server) token(clientToken string) (*token, bool) {
+
+	t, ok := s.tokens[clientToken]
+	if !ok {
+		return nil, false
+	}
+	if t.ttl != 0 && !s.now.Before(t.expires) {
+		delete(s.tokens, clientToken)
+		return nil, false
+	}
+	return t, true
+}
+
+func (s *Server) authResponse(clientToken string, t *token) map[string]interface{} {
+
+	return map[string]interface{}{
+		"client_token":   clientToken,
+		"accessor":       t.accessor,
+		"policies":       t.policies,
+		"token_policies": t.policies,
+		"lease_duration": int(t.ttl.Seconds()),
+		"renewable":      t.ttl != 0,
+	}
+}
+
+func (s *Server) allowed(t *token, method, path string) bool {
+
+	var required string
+	switch method {
+	case http.MethodGet:
+		required = "read"
+	case "LIST":
+		required = "list"
+	case http.MethodDelete:
+		required = "delete"
+	default:
+		// create and update are not distinguished
+		for _, capability := range s.capabilities(t, path) {
+			if capability == "create" || capability == "update" || capability == RootPolicy {
+				return true
+			}
+		}
+		return false
+	}
+	for _, capability := range s.capabilities(t, path) {
+		if capability == required || capability == RootPolicy {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) capabilities(t *token, path string) []string {
+
+	set := make(map[string]struct{})
+	for _, policy := range t.policies {
+		if policy == RootPolicy {
+			return []string{RootPolicy}
+		}
+		for _, rule := range s.policies[policy] {
+			if !matchPath(rule.Path, path) {
+				continue
+			}
+			for _, capability := range rule.Capabilities {
+				set[capability] = struct{}{}
+			}
+		}
+	}
+	if len(set) == 0 {
+		return []string{"deny"}
+	}
+	var out []string
+	for capability := range set {
+		out = append(out, capability)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// longest mount that is prefix of the path, e.g. 'kubernetes/env/cluster' for 'kubernetes/env/cluster/role/test'
+func (s *Server) findMount(path string) string {
+
+	var found string
+	for mount := range s.mounts {
+		if (path == mount || strings.HasPrefix(path, mount+"/")) && len(mount) > len(found) {
+			found = mount
+		}
+	}
+	return found
+}
+
+func (t *token) remaining(now time.Time) time.Duration {
+
+	if t.ttl == 0 {
+		return 0
+	}
+	return t.expires.Sub(now)
+}
+
+// vault glob, '+' matches single path segment and '*' at the end matches any suffix
+func matchPath(pattern, path string) bool {
+
+	pattern = trimPath(pattern)
+	prefix := strings.HasSuffix(pattern, "*")
+	pattern = strings.TrimSuffix(pattern, "*")
+
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(pathSegments) < len(patternSegments) || (!prefix && len(pathSegments) != len(patternSegments)) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		last := i == len(patternSegments)-1
+		switch {
+		case segment == "+":
+		case last && prefix:
+			if !strings.HasPrefix(pathSegments[i], segment) {
+				return false
+			}
+		case segment != pathSegments[i]:
+			return false
+		}
+	}
+	return true
+}
+
+// set mount config values, lease ttls are stored as number of seconds (as returned by vault)
+func setMountConfig(config, values map[string]interface{}) {
+
+	for k, v := range values {
+		if k == "default_lease_ttl" || k == "max_lease_ttl" {
+			v = ttlSeconds(v)
+		}
+		config[k] = v
+	}
+}
+
+// ttl (duration string, number of seconds or string with number of seconds) as number of seconds, value is returned
+// unchanged if it is not ttl
+func ttlSeconds(v interface{}) interface{} {
+
+	switch ttl := v.(type) {
+	case float64:
+		return int(ttl)
+	case string:
+		if d, err := time.ParseDuration(ttl); err == nil {
+			return int(d.Seconds())
+		} else if seconds, err := strconv.Atoi(ttl); err == nil {
+			return seconds
+		}
+	}
+	return v
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeErrors(w http.ResponseWriter, status int, errs ...string) {
+
+	if errs == nil {
+		errs = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+}
+
+func trimPath(path string) string {
+	return strings.Trim(path, "/")
+}
+
+func sortedKeys(m map[string]map[string]interface{}) []string {
+
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// auth mount accessor, e.g. auth_kubernetes_1a2b3c4d
+func newAccessor(mountType string) string {
+	return fmt.Sprintf("auth_%s_%s", mountType, randomId()[:8])
+}
+
+func randomId() string {
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
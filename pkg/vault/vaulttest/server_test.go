@@ -0,0 +1,361 @@
+package vaulttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+
+	t.Run("when approle logs in then token has approle policies", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		s.AddPolicy("reader", PathRule{Path: "sys/auth", Capabilities: []string{"read"}})
+		s.AddAppRole("role", "secret", 0, "reader")
+
+		token := login(t, s, "role", "secret")
+		assert.Equal(t, http.StatusOK, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+		assert.Equal(t, http.StatusForbidden, do(t, s, token, http.MethodPost, "sys/auth/kubernetes", map[string]string{"type": "kubernetes"}).StatusCode)
+	})
+
+	t.Run("when secret id is invalid then login fails", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		s.AddAppRole("role", "secret", 0)
+
+		response := do(t, s, "", http.MethodPost, "auth/approle/login", map[string]string{"role_id": "role", "secret_id": "invalid"})
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	})
+
+	t.Run("when token expires then request is denied and renew extends the token", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		s.AddAppRole("role", "secret", time.Minute, RootPolicy)
+		token := login(t, s, "role", "secret")
+
+		s.Advance(50 * time.Second)
+		assert.Equal(t, http.StatusOK, do(t, s, token, http.MethodPost, "auth/token/renew-self", nil).StatusCode)
+		s.Advance(50 * time.Second)
+		assert.Equal(t, http.StatusOK, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+		s.Advance(time.Minute)
+		assert.Equal(t, http.StatusForbidden, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+	})
+
+	t.Run("when auth is mounted then roles can be created, listed and deleted", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "sys/auth/kubernetes/test", map[string]string{"type": "kubernetes"}).StatusCode)
+		require.Equal(t, http.StatusNotFound, do(t, s, token, "LIST", "auth/kubernetes/test/role", nil).StatusCode)
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "auth/kubernetes/test/role/app", map[string]interface{}{"token_ttl": 60}).StatusCode)
+		assert.Equal(t, []string{"app"}, s.RoleNames("kubernetes/test"))
+		assert.Equal(t, map[string]interface{}{"token_ttl": float64(60)}, s.Role("kubernetes/test", "app"))
+
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodDelete, "auth/kubernetes/test/role/app", nil).StatusCode)
+		assert.Empty(t, s.RoleNames("kubernetes/test"))
+	})
+
+	t.Run("when auth mount is tuned then tune returns description and config", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+
+		require.Equal(t, http.StatusBadRequest, do(t, s, token, http.MethodGet, "sys/auth/kubernetes/test/tune", nil).StatusCode)
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "sys/auth/kubernetes/test",
+			map[string]interface{}{"type": "kubernetes", "config": map[string]string{"max_lease_ttl": "8760h"}}).StatusCode)
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "sys/auth/kubernetes/test/tune",
+			map[string]interface{}{"description": "test", "default_lease_ttl": "1h"}).StatusCode)
+
+		response := do(t, s, token, http.MethodGet, "sys/auth/kubernetes/test/tune", nil)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"description": "test", "default_lease_ttl": float64(3600), "max_lease_ttl": float64(31536000)}, body.Data)
+		assert.Equal(t, "kubernetes", s.Mounts()["kubernetes/test"].Type)
+	})
+
+	t.Run("when acl policy is written then it is listed with built-in policies", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPut, "sys/policies/acl/app", map[string]string{"policy": "path \"secret/*\" {}"}).StatusCode)
+		require.Equal(t, http.StatusBadRequest, do(t, s, token, http.MethodPut, "sys/policies/acl/root", map[string]string{"policy": "path \"*\" {}"}).StatusCode)
+		require.Equal(t, http.StatusBadRequest, do(t, s, token, http.MethodDelete, "sys/policies/acl/default", nil).StatusCode)
+
+		response := do(t, s, token, "LIST", "sys/policies/acl", nil)
+		var body struct {
+			Data struct {
+				Keys []string `json:"keys"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+		assert.Equal(t, []string{"app", "default", "root"}, body.Data.Keys)
+		assert.Equal(t, "path \"secret/*\" {}", s.ACLPolicy("app"))
+
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodDelete, "sys/policies/acl/app", nil).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do(t, s, token, http.MethodGet, "sys/policies/acl/app", nil).StatusCode)
+	})
+
+	t.Run("when entity alias is added then entity can be looked up by alias and alias is deleted with the mount", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+		s.Mount("kubernetes/test", Mount{Type: "kubernetes"})
+		accessor := s.Mounts()["kubernetes/test"].Accessor
+
+		require.Equal(t, http.StatusOK, do(t, s, token, http.MethodPost, "identity/entity/name/app", map[string]interface{}{"metadata": map[string]string{"team": "a"}}).StatusCode)
+		entityId := s.Entity("app")["id"].(string)
+		alias := map[string]string{"name": "uid", "canonical_id": entityId, "mount_accessor": accessor}
+		require.Equal(t, http.StatusOK, do(t, s, token, http.MethodPost, "identity/entity-alias", alias).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, do(t, s, token, http.MethodPost, "identity/entity-alias", alias).StatusCode)
+
+		lookup := map[string]string{"alias_name": "uid", "alias_mount_accessor": accessor}
+		assert.Equal(t, http.StatusOK, do(t, s, token, http.MethodPost, "identity/lookup/entity", lookup).StatusCode)
+		assert.Len(t, s.Entity("app")["aliases"], 1)
+
+		require.Equal(t, http.StatusOK, do(t, s, token, http.MethodPost, "identity/group/name/team", map[string]interface{}{"member_entity_ids": []string{entityId}}).StatusCode)
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodDelete, "sys/auth/kubernetes/test", nil).StatusCode)
+		assert.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "identity/lookup/entity", lookup).StatusCode)
+
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodDelete, "identity/entity/name/app", nil).StatusCode)
+		assert.Empty(t, s.EntityNames())
+		assert.Empty(t, s.Group("team")["member_entity_ids"])
+	})
+
+	t.Run("when kv is mounted then metadata can be written, read and listed", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+
+		assert.Equal(t, http.StatusNotFound, do(t, s, token, http.MethodGet, "secret/metadata/k8s/app", nil).StatusCode)
+		kv := map[string]interface{}{"type": "kv", "options": map[string]string{"version": "2"}}
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "sys/mounts/secret", kv).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, do(t, s, token, http.MethodPost, "sys/mounts/secret", kv).StatusCode)
+		assert.Equal(t, "2", s.SecretsMounts()["secret"].Options["version"])
+
+		metadata := map[string]interface{}{"max_versions": 5, "custom_metadata": map[string]string{"team": "a"}}
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "secret/metadata/k8s/app", metadata).StatusCode)
+		s.SetKVVersions("secret", "k8s/app/db", 2)
+		assert.Equal(t, float64(5), s.KVMetadata("secret", "k8s/app")["max_versions"])
+		assert.Equal(t, 2, s.KVMetadata("secret", "k8s/app/db")["current_version"])
+
+		response := do(t, s, token, "LIST", "secret/metadata/k8s", nil)
+		var body struct {
+			Data struct {
+				Keys []string `json:"keys"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+		assert.Equal(t, []string{"app", "app/"}, body.Data.Keys)
+	})
+
+	t.Run("when kubernetes secrets engine is mounted then config and roles can be written and jwt is not returned", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "sys/mounts/kubernetes/test", map[string]string{"type": "kubernetes"}).StatusCode)
+		config := map[string]string{"kubernetes_host": "https://kube.host", "service_account_jwt": "jwt"}
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "kubernetes/test/config", config).StatusCode)
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(do(t, s, token, http.MethodGet, "kubernetes/test/config", nil).Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"kubernetes_host": "https://kube.host"}, body.Data)
+		assert.Equal(t, "jwt", s.SecretsConfig("kubernetes/test")["service_account_jwt"])
+
+		role := map[string]interface{}{"allowed_kubernetes_namespaces": []string{"payments"}, "service_account_name": "app", "token_default_ttl": "1h"}
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "kubernetes/test/roles/app", role).StatusCode)
+		assert.Equal(t, 3600, s.SecretsRole("kubernetes/test", "app")["token_default_ttl"])
+		role["kubernetes_role_name"] = "edit"
+		assert.Equal(t, http.StatusBadRequest, do(t, s, token, http.MethodPost, "kubernetes/test/roles/other", role).StatusCode)
+		assert.Equal(t, []string{"app"}, s.SecretsRoleNames("kubernetes/test"))
+	})
+
+	t.Run("when service account logs in then token has role policies and it can be revoked", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+		s.AddServiceAccountToken("app-jwt", "payments", "app", "vault")
+
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "sys/auth/kubernetes/test", map[string]string{"type": "kubernetes"}).StatusCode)
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "auth/kubernetes/test/config", map[string]string{"kubernetes_host": "https://kube.host"}).StatusCode)
+		role := map[string]interface{}{"bound_service_account_names": []string{"app"}, "bound_service_account_namespaces": []string{"pay*"}, "token_policies": []string{"app"}}
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "auth/kubernetes/test/role/app", role).StatusCode)
+
+		response := do(t, s, "", http.MethodPost, "auth/kubernetes/test/login", map[string]string{"role": "app", "jwt": "app-jwt"})
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		var body struct {
+			Auth struct {
+				ClientToken   string   `json:"client_token"`
+				TokenPolicies []string `json:"token_policies"`
+			} `json:"auth"`
+		}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+		assert.Equal(t, []string{"default", "app"}, body.Auth.TokenPolicies)
+
+		assert.Equal(t, http.StatusNoContent, do(t, s, body.Auth.ClientToken, http.MethodPost, "auth/token/revoke-self", nil).StatusCode)
+		assert.Equal(t, http.StatusForbidden, do(t, s, body.Auth.ClientToken, http.MethodGet, "auth/token/lookup-self", nil).StatusCode)
+
+		role["audience"] = "other"
+		require.Equal(t, http.StatusNoContent, do(t, s, token, http.MethodPost, "auth/kubernetes/test/role/app", role).StatusCode)
+		assert.Equal(t, http.StatusForbidden, do(t, s, "", http.MethodPost, "auth/kubernetes/test/login", map[string]string{"role": "app", "jwt": "app-jwt"}).StatusCode)
+		assert.Equal(t, http.StatusForbidden, do(t, s, "", http.MethodPost, "auth/kubernetes/test/login", map[string]string{"role": "app", "jwt": "unknown"}).StatusCode)
+	})
+
+	t.Run("when role is written to auth that is not mounted then not found is returned", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+
+		response := do(t, s, s.RootToken(), http.MethodPost, "auth/kubernetes/test/role/app", map[string]interface{}{})
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	})
+
+	t.Run("when policy uses glob patterns then capabilities are returned for matching paths", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		s.AddPolicy("roles", PathRule{Path: "auth/kubernetes/+/+/role/*", Capabilities: []string{"read", "update"}})
+		s.AddAppRole("role", "secret", 0, "roles")
+		token := login(t, s, "role", "secret")
+
+		response := do(t, s, token, http.MethodPost, "sys/capabilities-self", map[string]interface{}{
+			"paths": []string{"auth/kubernetes/env/cluster/role/app", "auth/kubernetes/cluster/role/app"},
+		})
+		var capabilities map[string][]string
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&capabilities))
+		assert.Equal(t, []string{"read", "update"}, capabilities["auth/kubernetes/env/cluster/role/app"])
+		assert.Equal(t, []string{"deny"}, capabilities["auth/kubernetes/cluster/role/app"])
+	})
+
+	t.Run("when fault is injected then matching requests fail count times", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+		s.InjectFault(Fault{Path: "sys/*", Status: http.StatusInternalServerError, Count: 2})
+
+		assert.Equal(t, http.StatusInternalServerError, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+		assert.Equal(t, http.StatusInternalServerError, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+		assert.Equal(t, http.StatusOK, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+		assert.Equal(t, 3, len(s.Requests()))
+	})
+
+	t.Run("when server is sealed then requests fail with service unavailable", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+
+		s.Seal()
+		assert.Equal(t, http.StatusServiceUnavailable, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+		s.Unseal()
+		assert.Equal(t, http.StatusOK, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+	})
+
+	t.Run("when health is checked then status reflects active, standby and sealed node", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+
+		assert.Equal(t, http.StatusOK, do(t, s, "", http.MethodGet, "sys/health", nil).StatusCode)
+		s.SetStandby("http://active")
+		assert.Equal(t, http.StatusTooManyRequests, do(t, s, "", http.MethodGet, "sys/health", nil).StatusCode)
+		s.Seal()
+		response := do(t, s, "", http.MethodGet, "sys/health", nil)
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+
+		var health map[string]interface{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&health))
+		assert.Equal(t, true, health["sealed"])
+	})
+
+	t.Run("when server is standby then requests are redirected to active node", func(t *testing.T) {
+
+		active := NewServer()
+		defer active.Close()
+		standby := NewServer()
+		defer standby.Close()
+		standby.SetStandby(active.URL())
+
+		response := do(t, standby, active.RootToken(), http.MethodGet, "sys/auth", nil)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, active.URL()+"/v1/sys/auth", response.Request.URL.String())
+	})
+
+	t.Run("when server restarts then tokens are invalid and storage is kept", func(t *testing.T) {
+
+		s := NewServer()
+		defer s.Close()
+		token := s.RootToken()
+		s.Mount("kubernetes/test", Mount{Type: "kubernetes"})
+
+		s.Restart()
+		assert.Equal(t, http.StatusForbidden, do(t, s, token, http.MethodGet, "sys/auth", nil).StatusCode)
+		assert.Contains(t, s.Mounts(), "kubernetes/test")
+	})
+}
+
+func TestMatchPath(t *testing.T) {
+
+	assert.True(t, matchPath("sys/auth", "sys/auth"))
+	assert.False(t, matchPath("sys/auth", "sys/auth/kubernetes"))
+	assert.True(t, matchPath("sys/auth/*", "sys/auth/kubernetes/test"))
+	assert.True(t, matchPath("auth/kubernetes/+/config", "auth/kubernetes/test/config"))
+	assert.False(t, matchPath("auth/kubernetes/+/config", "auth/kubernetes/env/test/config"))
+	assert.True(t, matchPath("auth/kube*", "auth/kubernetes/test"))
+}
+
+// --- helper functions ---
+
+func login(t *testing.T, s *Server, roleId, secretId string) string {
+
+	response := do(t, s, "", http.MethodPost, "auth/approle/login", map[string]string{"role_id": roleId, "secret_id": secretId})
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	var body struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+	return body.Auth.ClientToken
+}
+
+func do(t *testing.T, s *Server, token, method, path string, body interface{}) *http.Response {
+
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+	request, err := http.NewRequest(method, s.URL()+"/v1/"+path, bytes.NewReader(b))
+	require.NoError(t, err)
+	request.Header.Set("X-Vault-Token", token)
+
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
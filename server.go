@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pete911/vault-auth-kubernetes/logger"
+	"github.com/pete911/vault-auth-kubernetes/pkg/auth"
+	"github.com/pete911/vault-auth-kubernetes/pkg/metrics"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"net/http"
+)
+
+type healthResponse struct {
+	Status string       `json:"status"`
+	Vault  vault.Health `json:"vault"`
+}
+
+// health and metrics server, it does not return unless the server fails
+func serve(addr string, vaultClient *vault.Client) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/health", healthHandler(vaultClient.Health))
+
+	logger.Logf("starting health and metrics server on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("health and metrics server: %v", err)
+	}
+}
+
+// status server, it is not authenticated and it is served on separate address, so it is not exposed together with
+// health and metrics, it does not return unless the server fails
+func serveStatus(addr string, status func() auth.Status) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler(status))
+
+	logger.Logf("starting status server on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("status server: %v", err)
+	}
+}
+
+// health of the process and last known vault health, status is 'degraded' when vault is sealed or standby, 200 is
+// always returned, so the pod is not restarted because of vault
+func healthHandler(vaultHealth func() vault.Health) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, _ *http.Request) {
+
+		response := healthResponse{Status: "ok", Vault: vaultHealth()}
+		if response.Vault.Sealed || response.Vault.Standby {
+			response.Status = "degraded"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// read-only status of vault auth mount, roles and service accounts, format query parameter is table, json (default) or
+// yaml
+func statusHandler(status func() auth.Status) http.HandlerFunc {
+
+	contentTypes := map[string]string{
+		auth.StatusFormatTable: "text/plain",
+		auth.StatusFormatJSON:  "application/json",
+		auth.StatusFormatYAML:  "application/yaml",
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = auth.StatusFormatJSON
+		}
+		contentType, ok := contentTypes[format]
+		if !ok {
+			http.Error(w, fmt.Sprintf("format %q is not one of %s, %s or %s", format, auth.StatusFormatTable, auth.StatusFormatJSON, auth.StatusFormatYAML), http.StatusBadRequest)
+			return
+		}
+		b, err := status().Format(format)
+		if err != nil {
+			logger.Errorf("status: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(b)
+	}
+}
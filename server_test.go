@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pete911/vault-auth-kubernetes/pkg/auth"
+	"github.com/pete911/vault-auth-kubernetes/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+
+	t.Run("when vault is active then status is ok", func(t *testing.T) {
+
+		response := getHealth(t, vault.Health{Host: "https://vault-0", Initialized: true})
+		assert.Equal(t, "ok", response.Status)
+		assert.Equal(t, "https://vault-0", response.Vault.Host)
+	})
+
+	t.Run("when vault is sealed then status is degraded", func(t *testing.T) {
+
+		response := getHealth(t, vault.Health{Host: "https://vault-0", Initialized: true, Sealed: true})
+		assert.Equal(t, "degraded", response.Status)
+		assert.True(t, response.Vault.Sealed)
+	})
+}
+
+func TestStatusHandler(t *testing.T) {
+
+	status := func() auth.Status {
+		return auth.Status{
+			Mount: auth.MountStatus{Path: "kubernetes/test-cluster", Type: "kubernetes"},
+			Roles: []auth.RoleStatus{{Name: "app", State: auth.RoleSynced}},
+		}
+	}
+
+	t.Run("when format is not set then status is returned as json", func(t *testing.T) {
+
+		res := httptest.NewRecorder()
+		statusHandler(status)(res, httptest.NewRequest(http.MethodGet, "/status", nil))
+		require.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+		var response auth.Status
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+		assert.Equal(t, "kubernetes/test-cluster", response.Mount.Path)
+		assert.Equal(t, auth.RoleSynced, response.Roles[0].State)
+	})
+
+	t.Run("when format is table then status is returned as table", func(t *testing.T) {
+
+		res := httptest.NewRecorder()
+		statusHandler(status)(res, httptest.NewRequest(http.MethodGet, "/status?format=table", nil))
+		require.Equal(t, http.StatusOK, res.Code)
+		assert.True(t, strings.HasPrefix(res.Body.String(), "MOUNT"))
+	})
+
+	t.Run("when format is not valid then bad request is returned", func(t *testing.T) {
+
+		res := httptest.NewRecorder()
+		statusHandler(status)(res, httptest.NewRequest(http.MethodGet, "/status?format=xml", nil))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+}
+
+func getHealth(t *testing.T, health vault.Health) healthResponse {
+
+	res := httptest.NewRecorder()
+	healthHandler(func() vault.Health { return health })(res, httptest.NewRequest(http.MethodGet, "/health", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+
+	var response healthResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	return response
+}